@@ -1,165 +1,71 @@
+// Command api serves the users API; see internal/api for what it does and
+// -h for how to configure it.
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"strconv"
-	"strings"
+	"os"
 	"time"
-)
-
-type errorResponse struct {
-	Error string `json:"error"`
-}
-
-type userResponse struct {
-	UserID int `json:"user_id"`
-}
-
-type createUserRequest struct {
-	Name string `json:"name"`
-}
 
-type createUserResponse struct {
-	Created string `json:"created"`
-}
-
-func writeJSON(w http.ResponseWriter, status int, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	enc := json.NewEncoder(w)
-	enc.SetEscapeHTML(true)
-	if err := enc.Encode(v); err != nil {
-		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
-	}
-}
-
-func errorJSON(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, errorResponse{Error: msg})
-}
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/api"
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
 
-func handleGetUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", http.MethodGet)
-		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
+// version is the build version, set with -ldflags "-X main.version=...".
+var version string
 
-	idStr := r.URL.Query().Get("id")
-	if idStr == "" {
-		errorJSON(w, http.StatusBadRequest, "invalid id")
+func main() {
+	cfg := api.DefaultConfig()
+	cfg.Version = version
+	var cmd api.CommandLine
+	cfg.RegisterFlags(flag.CommandLine)
+	cmd.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if cmd.GenKey {
+		key, hashed, err := api.GenerateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("key:    %s\nhashed: %s\n", key, hashed)
 		return
 	}
 
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		errorJSON(w, http.StatusBadRequest, "invalid id")
-		return
+	err := cfg.Load(flag.CommandLine, cmd.ConfigFile, os.Args[1:])
+	if err == nil && cmd.PrintConfig {
+		err = api.PrintConfig(os.Stdout, flag.CommandLine, cfg)
+		if err == nil {
+			return
+		}
 	}
-
-	writeJSON(w, http.StatusOK, userResponse{UserID: id})
-}
-
-func handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.Header().Set("Allow", http.MethodPost)
-		errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
+	if err == nil {
+		err = cfg.Validate()
 	}
-	raw, _ := io.ReadAll(r.Body)
-	_ = r.Body.Close()
-	raw = bytes.TrimSpace(raw)
-	raw = bytes.TrimPrefix(raw, []byte{0xEF, 0xBB, 0xBF})
-
-	var name string
-
-	if len(raw) > 0 && raw[0] == '{' {
-		var req struct {
-			Name string `json:"name"`
-		}
-		if err := json.Unmarshal(raw, &req); err == nil {
-			name = strings.TrimSpace(req.Name)
-		} else {
-			log.Printf("POST /user: json unmarshal error: %v; raw=%q; ctype=%q",
-				err, string(raw), r.Header.Get("Content-Type"))
-		}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	if name == "" {
-		_ = r.ParseForm()
-		if v := r.Form.Get("name"); v != "" {
-			name = strings.TrimSpace(v)
-		}
-		if name == "" {
-			if v := r.URL.Query().Get("name"); v != "" {
-				name = strings.TrimSpace(v)
-			}
-		}
+	logger, err := cfg.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-
-	if name == "" {
-		errorJSON(w, http.StatusBadRequest, "invalid name")
-		return
+	var st store.Store
+	if st, err = cfg.OpenStore(time.Now); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	writeJSON(w, http.StatusCreated, createUserResponse{Created: name})
-}
-
-func authAndLog(next http.Handler) http.Handler {
-	const requiredKey = "secret123"
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("%s %s", r.Method, r.URL.Path)
-
-		if key := r.Header.Get("X-API-Key"); key != requiredKey {
-			errorJSON(w, http.StatusUnauthorized, "unauthorized")
-			log.Printf("-> %d (%s)", http.StatusUnauthorized, time.Since(start))
-			return
-		}
-
-		rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
-		next.ServeHTTP(rr, r)
-		log.Printf("-> %d (%s)", rr.status, time.Since(start))
-	})
-}
-
-type statusRecorder struct {
-	http.ResponseWriter
-	status int
-}
-
-func (sr *statusRecorder) WriteHeader(code int) {
-	sr.status = code
-	sr.ResponseWriter.WriteHeader(code)
-}
-
-func routes() http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			handleGetUser(w, r)
-		case http.MethodPost:
-			handleCreateUser(w, r)
-		default:
-			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
-			errorJSON(w, http.StatusMethodNotAllowed, "method not allowed")
-		}
-	})
-	return authAndLog(mux)
-}
-
-func main() {
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: routes(),
+	s := api.NewServer(cfg, st, logger, time.Now)
+	// ListenAndServe has logged why it failed.
+	err = s.ListenAndServe()
+	if c, ok := st.(io.Closer); ok {
+		_ = c.Close()
 	}
-
-	log.Println("listening on http://localhost:8080")
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	if err != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// producedTypes are the media types the API responds with.
+var producedTypes = []string{"application/json", ndjsonContentType}
+
+// acceptable reports whether an Accept header allows any of producedTypes.
+// A missing header, or one without a single well-formed media range,
+// accepts everything.
+func acceptable(header string) bool {
+	if header == "" {
+		return true
+	}
+	valid := false
+	for _, mr := range strings.Split(header, ",") {
+		typ, q, ok := parseMediaRange(mr)
+		if !ok {
+			continue
+		}
+		valid = true
+		if q > 0 && matchesProduced(typ) {
+			return true
+		}
+	}
+	return !valid
+}
+
+// parseMediaRange splits "type/subtype;param=v;q=0.5" into the lowercased
+// type and its quality, which defaults to 1.
+func parseMediaRange(mr string) (typ string, q float64, ok bool) {
+	typ, params, _ := strings.Cut(mr, ";")
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	major, minor, found := strings.Cut(typ, "/")
+	if !found || major == "" || minor == "" {
+		return "", 0, false
+	}
+
+	q = 1
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(p, "=")
+		if strings.TrimSpace(strings.ToLower(k)) != "q" {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || f < 0 || f > 1 {
+			return "", 0, false
+		}
+		q = f
+	}
+	return typ, q, true
+}
+
+func matchesProduced(typ string) bool {
+	if typ == "*/*" {
+		return true
+	}
+	for _, p := range producedTypes {
+		major, _, _ := strings.Cut(p, "/")
+		if typ == p || typ == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate answers 406 to requests whose Accept header rules out every
+// media type the API produces. It wraps the routes that answer JSON only:
+// /metrics, the debug routes and the health probes serve other formats,
+// or other clients, and are left alone.
+func (s *Server) negotiate() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acceptable(r.Header.Get("Accept")) {
+				s.errorJSON(w, r, http.StatusNotAcceptable, "not acceptable")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
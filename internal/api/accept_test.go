@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptable(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{"", true},
+		{"*/*", true},
+		{"application/json", true},
+		{"Application/JSON; charset=utf-8", true},
+		{"application/*", true},
+		{"application/x-ndjson", true},
+		{"text/html, application/json;q=0.1", true},
+		{"text/html, */*;q=0.8", true},
+		{"application/xml", false},
+		{"application/xml;q=1", false},
+		{"text/html, application/xhtml+xml", false},
+		{"application/json;q=0", false},
+		{"text/*", false},
+		// Nothing in these can be understood, so nothing is ruled out.
+		{"garbage", true},
+		{"application/json;q=2", true},
+		{"application/xml, garbage", false},
+	} {
+		if got := acceptable(tt.header); got != tt.want {
+			t.Errorf("acceptable(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range []struct {
+		accept     string
+		wantStatus int
+	}{
+		{"", http.StatusOK},
+		{"*/*", http.StatusOK},
+		{"application/json", http.StatusOK},
+		{"application/xml", http.StatusNotAcceptable},
+	} {
+		t.Run(tt.accept, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Set("Accept", tt.accept)
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != jsonContentType {
+				t.Errorf("Content-Type = %q, want %q", got, jsonContentType)
+			}
+		})
+	}
+}
+
+func TestNegotiateRoutes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin"}
+	cfg.enablePprof = true
+	h := newTestServer(t, cfg, nil).Handler()
+	for _, tt := range []struct {
+		target     string
+		accept     string
+		wantStatus int
+	}{
+		{"/users", "text/html", http.StatusNotAcceptable},
+		{"/users?format=ndjson", "application/xml", http.StatusNotAcceptable},
+		{"/export", "application/xml", http.StatusNotAcceptable},
+		{"/openapi.json", "application/xml", http.StatusNotAcceptable},
+		// What Prometheus and OpenMetrics scrapers send.
+		{"/metrics", "text/plain;version=0.0.4", http.StatusOK},
+		{"/metrics", "application/openmetrics-text;version=1.0.0", http.StatusOK},
+		{"/debug/vars", "text/html", http.StatusOK},
+		{"/debug/pprof/", "text/html", http.StatusOK},
+		{"/healthz", "text/html", http.StatusOK},
+	} {
+		t.Run(tt.target+" "+tt.accept, func(t *testing.T) {
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Header.Set("Accept", tt.accept)
+			if rec := serve(h, r); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessRecord is an access log record waiting to be written by
+// accessLogWriter.
+type accessRecord struct {
+	ctx     context.Context
+	handler slog.Handler
+	record  slog.Record
+}
+
+// sampled reports whether the access record for a response with status
+// should be written. Every non-2xx response is; of the rest, one in
+// cfg.accessLogSample.
+func (s *Server) sampled(status int) bool {
+	if s.cfg.accessLogSample <= 1 || status < 200 || status >= 300 {
+		return true
+	}
+	return s.accessSeq.Add(1)%uint64(s.cfg.accessLogSample) == 0
+}
+
+// writeAccessLog emits the access record for a request, directly or, when
+// buffering is enabled, through the background writer. A full buffer makes
+// the request wait rather than lose the record.
+func (s *Server) writeAccessLog(r *http.Request, start time.Time, attrs []slog.Attr) {
+	ctx := r.Context()
+	l := s.logger
+	if s.accessLogger != nil {
+		l = s.accessLogger
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if s.accessLog == nil {
+		l.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+		return
+	}
+	h := l.Handler()
+	if !h.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	rec := slog.NewRecord(start, slog.LevelInfo, "request", 0)
+	rec.AddAttrs(attrs...)
+	s.accessLogMu.RLock()
+	defer s.accessLogMu.RUnlock()
+	if s.accessLogClosed {
+		_ = h.Handle(ctx, rec)
+		return
+	}
+	s.accessLog <- accessRecord{ctx: context.WithoutCancel(ctx), handler: h, record: rec}
+}
+
+// accessLogWriter writes buffered access records until the buffer is
+// closed.
+func (s *Server) accessLogWriter(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for ar := range s.accessLog {
+		_ = ar.handler.Handle(ar.ctx, ar.record)
+	}
+}
+
+// flushAccessLog stops buffering access records and waits until those
+// already queued are written. Requests still running, after a shutdown
+// that ran out of time, write theirs directly.
+func (s *Server) flushAccessLog() {
+	if s.accessLog == nil {
+		return
+	}
+	s.accessLogMu.Lock()
+	s.accessLogClosed = true
+	close(s.accessLog)
+	s.accessLogMu.Unlock()
+	s.accessLogDone.Wait()
+}
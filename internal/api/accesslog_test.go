@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for a logger to write to from several
+// goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		buffer, sample int
+		// ok and notFound are the requests sent that succeed and fail.
+		ok, notFound int
+		want         int
+	}{
+		{name: "inline", ok: 10, notFound: 2, want: 12},
+		{name: "buffered", buffer: 4, ok: 10, notFound: 2, want: 12},
+		{name: "sampled", sample: 5, ok: 10, notFound: 2, want: 4},
+		{name: "buffered and sampled", buffer: 4, sample: 5, ok: 10, notFound: 2, want: 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.accessLogBuffer = tt.buffer
+			cfg.accessLogSample = tt.sample
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			h := s.Handler()
+			for range tt.ok {
+				serve(h, newRequest(http.MethodGet, "/healthz", ""))
+			}
+			for range tt.notFound {
+				serve(h, newRequest(http.MethodGet, "/user/404", ""))
+			}
+			s.flushAccessLog()
+			if got := len(logRecords(t, logs.String(), "request")); got != tt.want {
+				t.Errorf("%d access records, want %d; logs:\n%s", got, tt.want, logs.String())
+			}
+		})
+	}
+}
+
+func BenchmarkAccessLog(b *testing.B) {
+	for _, bb := range []struct {
+		name           string
+		buffer, sample int
+	}{
+		{"inline", 0, 0},
+		{"buffered", 1024, 0},
+		{"sampled", 0, 100},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.accessLogBuffer = bb.buffer
+			cfg.accessLogSample = bb.sample
+			s := newTestServer(b, cfg, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+			h := s.Handler()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					serve(h, newRequest(http.MethodGet, "/healthz", ""))
+				}
+			})
+			b.StopTimer()
+			s.flushAccessLog()
+		})
+	}
+}
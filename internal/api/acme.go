@@ -0,0 +1,35 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns an autocert manager that obtains and renews
+// certificates for domains, keeping them in cacheDir. The directory is
+// created if need be and must be writable, or certificates would be
+// requested anew on every start and run into the CA's rate limits.
+func newACMEManager(domains []string, cacheDir, email string) (*autocert.Manager, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("-acme-domain must list at least one domain")
+	}
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("ACME cache: %w", err)
+	}
+	f, err := os.CreateTemp(cacheDir, ".write-test-*")
+	if err != nil {
+		return nil, fmt.Errorf("ACME cache %s is not writable: %w", cacheDir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}, nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		domains  []string
+		cacheDir string
+		wantErr  bool
+	}{
+		{name: "existing cache", domains: []string{"example.com"}, cacheDir: t.TempDir()},
+		{name: "new cache", domains: []string{"example.com", "www.example.com"}, cacheDir: filepath.Join(t.TempDir(), "a", "b")},
+		{name: "no domains", cacheDir: t.TempDir(), wantErr: true},
+		{name: "cache is a file", domains: []string{"example.com"}, cacheDir: file, wantErr: true},
+		{name: "cache under a file", domains: []string{"example.com"}, cacheDir: filepath.Join(file, "certs"), wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newACMEManager(tt.domains, tt.cacheDir, "ops@example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// The write test leaves nothing behind.
+			if entries, err := os.ReadDir(tt.cacheDir); err != nil || len(entries) != 0 {
+				t.Errorf("cache holds %v (%v), want it empty", entries, err)
+			}
+			for _, d := range tt.domains {
+				if err := m.HostPolicy(context.Background(), d); err != nil {
+					t.Errorf("HostPolicy(%s) = %v", d, err)
+				}
+			}
+			if err := m.HostPolicy(context.Background(), "evil.example"); err == nil {
+				t.Error("HostPolicy accepts other hosts")
+			}
+		})
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-acme-domain=example.com"}, false},
+		{[]string{"-acme-domain=example.com,www.example.com", "-acme-cache=/var/lib/api/acme"}, false},
+		{[]string{"-acme-domain=example.com", "-tls-cert=c.pem", "-tls-key=k.pem"}, true},
+		{[]string{"-acme-domain=example.com", "-h2c"}, true},
+		{[]string{"-acme-domain="}, true},
+	} {
+		cfg := DefaultConfig()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.RegisterFlags(fs)
+		cfg.apiKeys = []string{testKey}
+		err := fs.Parse(tt.args)
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestACMEChallengeServer(t *testing.T) {
+	m, err := newACMEManager([]string{"example.com"}, t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m.HTTPHandler(nil)
+	for _, tt := range []struct {
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"/users?limit=2", http.StatusFound, "https://example.com/users?limit=2"},
+		{"/", http.StatusFound, "https://example.com/"},
+		// An unknown token is no redirect: the CA has to see it fail.
+		{"/.well-known/acme-challenge/unknown", http.StatusNotFound, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.target, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.wantStatus || rec.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s: status = %d, Location %q; want %d, %q", tt.target, rec.Code, rec.Header().Get("Location"), tt.wantStatus, tt.wantLocation)
+		}
+	}
+}
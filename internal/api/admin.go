@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type CreateKeyRequest struct {
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+	KeyLimitRequest
+}
+
+// KeyLimitRequest sets a key's own rate limit; both fields are required
+// together, and omitting both keeps the global default.
+type KeyLimitRequest struct {
+	Rate  *float64 `json:"rate,omitempty"`
+	Burst *int     `json:"burst,omitempty"`
+}
+
+func (req KeyLimitRequest) limit() (bucketLimit, error) {
+	switch {
+	case req.Rate == nil && req.Burst == nil:
+		return bucketLimit{}, nil
+	case req.Rate == nil || req.Burst == nil:
+		return bucketLimit{}, errors.New("rate and burst must be set together")
+	case *req.Rate <= 0 || *req.Burst < 1:
+		return bucketLimit{}, errors.New("invalid rate limit")
+	}
+	return bucketLimit{rate: *req.Rate, burst: float64(*req.Burst)}, nil
+}
+
+type KeyResponse struct {
+	ID      string     `json:"id"`
+	Label   string     `json:"label,omitempty"`
+	Prefix  string     `json:"prefix,omitempty"`
+	Scopes  []string   `json:"scopes"`
+	Managed bool       `json:"managed"`
+	Created *time.Time `json:"created_at,omitempty"`
+	// Rate and Burst are only set for keys with their own rate limit.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+type CreateKeyResponse struct {
+	KeyResponse
+	// Key is only ever returned here, when the key is created.
+	Key string `json:"key"`
+}
+
+func newKeyResponse(e keyEntry) KeyResponse {
+	resp := KeyResponse{
+		ID:      e.id(),
+		Label:   e.label,
+		Prefix:  e.prefix,
+		Scopes:  e.scopes,
+		Managed: e.managed,
+		Rate:    e.limit.rate,
+		Burst:   int(e.limit.burst),
+	}
+	if !e.created.IsZero() {
+		resp.Created = &e.created
+	}
+	return resp
+}
+
+// handleCreateKey mints a managed key. It is not persisted anywhere and is
+// gone once the server restarts; see keySet.
+func (s *Server) handleCreateKey(w http.ResponseWriter, r *http.Request) error {
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	var req CreateKeyRequest
+	if raw = trimBody(raw); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &req); err != nil {
+			s.log(r.Context()).Warn("json unmarshal error", "err", err)
+			return errBadRequest(errMalformedJSON.Error())
+		}
+	}
+	scopes, err := parseScopes(strings.Join(req.Scopes, " "))
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	limit, err := req.limit()
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+
+	key, e, err := s.keys.add(strings.TrimSpace(req.Label), scopes, limit, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	s.log(r.Context()).Info("API key created",
+		"key_id", e.id(), "label", e.label, "scopes", e.scopes,
+		"by", principalFromContext(r.Context()).name)
+	w.Header().Set("Location", "/admin/keys/"+e.id())
+	s.writeJSON(w, r, http.StatusCreated, CreateKeyResponse{KeyResponse: newKeyResponse(e), Key: key})
+	return nil
+}
+
+func (s *Server) handleListKeys(w http.ResponseWriter, r *http.Request) error {
+	keys := s.keys.list()
+	resp := make([]KeyResponse, len(keys))
+	for i, e := range keys {
+		resp[i] = newKeyResponse(e)
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+	return nil
+}
+
+// handleUpdateKey changes the rate limit of a managed key; a body without
+// rate and burst restores the default. The key's bucket starts afresh at
+// the new limit.
+func (s *Server) handleUpdateKey(w http.ResponseWriter, r *http.Request) error {
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	var req KeyLimitRequest
+	if raw = trimBody(raw); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &req); err != nil {
+			s.log(r.Context()).Warn("json unmarshal error", "err", err)
+			return errBadRequest(errMalformedJSON.Error())
+		}
+	}
+	limit, err := req.limit()
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+
+	e, err := s.keys.setLimit(r.PathValue("id"), limit)
+	if err != nil {
+		return err
+	}
+	s.log(r.Context()).Info("API key updated",
+		"key_id", e.id(), "rate", e.limit.rate, "burst", e.limit.burst,
+		"by", principalFromContext(r.Context()).name)
+	s.writeJSON(w, r, http.StatusOK, newKeyResponse(e))
+	return nil
+}
+
+// handleRevokeKey revokes a managed key. Callers may revoke the key they
+// are using; that request still completes, but it is logged as a warning
+// since the caller has just locked itself out.
+func (s *Server) handleRevokeKey(w http.ResponseWriter, r *http.Request) error {
+	id := r.PathValue("id")
+	if err := s.keys.revoke(id); err != nil {
+		return err
+	}
+
+	by := principalFromContext(r.Context()).name
+	l := s.log(r.Context()).With("key_id", id, "by", by)
+	if by == "key:"+id {
+		l.Warn("API key revoked by a request made with it")
+	} else {
+		l.Info("API key revoked")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newKeysServer returns a test server on which testKey is an admin key,
+// logging as JSON to logs.
+func newKeysServer(t *testing.T, logs *bytes.Buffer) http.Handler {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin"}
+	cfg.rateLimit, cfg.authMaxFailures = 0, 0
+	return newTestServer(t, cfg, slog.New(slog.NewJSONHandler(logs, nil))).Handler()
+}
+
+// createKey mints a key through POST /admin/keys with body.
+func createKey(t *testing.T, h http.Handler, body string) CreateKeyResponse {
+	t.Helper()
+	var created CreateKeyResponse
+	if err := json.Unmarshal(mustServe(t, h, http.StatusCreated, http.MethodPost, "/admin/keys", body), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+// statusWithKey is the status of a request made with key.
+func statusWithKey(h http.Handler, key, method, target, body string) int {
+	r := newRequest(method, target, body)
+	r.Header.Set("X-API-Key", key)
+	return serve(h, r).Code
+}
+
+func TestAdminKeys(t *testing.T) {
+	var logs bytes.Buffer
+	h := newKeysServer(t, &logs)
+	created := createKey(t, h, `{"label":" ci ","scopes":["read"]}`)
+	if created.Key == "" || created.Label != "ci" || !created.Managed || created.Prefix != created.Key[:managedKeyPrefixLen] {
+		t.Errorf("created %+v", created)
+	}
+	if created.ID != keyFingerprint(created.Key) {
+		t.Errorf("id = %q, want the key's fingerprint %q", created.ID, keyFingerprint(created.Key))
+	}
+
+	if code := statusWithKey(h, created.Key, http.MethodGet, "/users", ""); code != http.StatusOK {
+		t.Errorf("GET with the new key: status = %d", code)
+	}
+	if code := statusWithKey(h, created.Key, http.MethodPost, "/user", `{"name":"Ann"}`); code != http.StatusForbidden {
+		t.Errorf("POST with a read-only key: status = %d", code)
+	}
+
+	listed := mustServe(t, h, http.StatusOK, http.MethodGet, "/admin/keys", "")
+	if bytes.Contains(listed, []byte(created.Key)) {
+		t.Errorf("listing reveals the key: %s", listed)
+	}
+	var keys []KeyResponse
+	if err := json.Unmarshal(listed, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Managed || keys[1].ID != created.ID || keys[1].Label != "ci" {
+		t.Errorf("listed %+v", keys)
+	}
+
+	mustServe(t, h, http.StatusNoContent, http.MethodDelete, "/admin/keys/"+created.ID, "")
+	if code := statusWithKey(h, created.Key, http.MethodGet, "/users", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET with the revoked key: status = %d", code)
+	}
+	mustServe(t, h, http.StatusNotFound, http.MethodDelete, "/admin/keys/"+created.ID, "")
+	// Configured keys are not managed through the API.
+	mustServe(t, h, http.StatusConflict, http.MethodDelete, "/admin/keys/"+keyFingerprint(testKey), "")
+	if strings.Contains(logs.String(), created.Key) {
+		t.Errorf("key in the logs:\n%s", logs.String())
+	}
+}
+
+func TestCreateKeyRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantScopes []string
+	}{
+		{"empty", "", http.StatusCreated, defaultScopes},
+		{"scopes", `{"scopes":["read","admin"]}`, http.StatusCreated, []string{"read", "admin"}},
+		{"rate limit", `{"rate":2,"burst":4}`, http.StatusCreated, defaultScopes},
+		{"unknown scope", `{"scopes":["root"]}`, http.StatusBadRequest, nil},
+		{"rate without burst", `{"rate":2}`, http.StatusBadRequest, nil},
+		{"invalid rate", `{"rate":0,"burst":4}`, http.StatusBadRequest, nil},
+		{"malformed", `{"label":`, http.StatusBadRequest, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			body := mustServe(t, newKeysServer(t, &logs), tt.wantStatus, http.MethodPost, "/admin/keys", tt.body)
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			var created CreateKeyResponse
+			if err := json.Unmarshal(body, &created); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(created.Scopes, " ") != strings.Join(tt.wantScopes, " ") {
+				t.Errorf("scopes = %q, want %q", created.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestRevokeOwnKey(t *testing.T) {
+	var logs bytes.Buffer
+	h := newKeysServer(t, &logs)
+	created := createKey(t, h, `{"label":"self","scopes":["admin"]}`)
+	if code := statusWithKey(h, created.Key, http.MethodDelete, "/admin/keys/"+created.ID, ""); code != http.StatusNoContent {
+		t.Fatalf("revoking its own key: status = %d", code)
+	}
+	if recs := logRecords(t, logs.String(), "API key revoked by a request made with it"); len(recs) != 1 || recs[0]["level"] != "WARN" {
+		t.Errorf("want one warning, got %v", recs)
+	}
+	if code := statusWithKey(h, created.Key, http.MethodGet, "/admin/keys", ""); code != http.StatusUnauthorized {
+		t.Errorf("request after revoking: status = %d", code)
+	}
+}
+
+// TestAdminKeysConcurrent mints and revokes keys while other requests
+// authenticate with them.
+func TestAdminKeysConcurrent(t *testing.T) {
+	var logs bytes.Buffer
+	h := newKeysServer(t, &logs)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest(http.MethodPost, "/admin/keys", `{"scopes":["read"]}`)
+			rec := serve(h, r)
+			var created CreateKeyResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Error(err)
+				return
+			}
+			if code := statusWithKey(h, created.Key, http.MethodGet, "/users", ""); code != http.StatusOK {
+				t.Errorf("GET before revoking: status = %d", code)
+			}
+			if code := statusWithKey(h, testKey, http.MethodDelete, "/admin/keys/"+created.ID, ""); code != http.StatusNoContent {
+				t.Errorf("revoke: status = %d", code)
+			}
+			if code := statusWithKey(h, created.Key, http.MethodGet, "/users", ""); code != http.StatusUnauthorized {
+				t.Errorf("GET after revoking: status = %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestManagedKeysInMemory(t *testing.T) {
+	var logs bytes.Buffer
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin"}
+	cfg.rateLimit, cfg.authMaxFailures = 0, 0
+	s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+	created := createKey(t, s.Handler(), `{"label":"ci"}`)
+
+	// A reload replaces the configured keys only.
+	s.keys.replace([]string{"rotated,read write admin"})
+	if code := statusWithKey(s.Handler(), created.Key, http.MethodGet, "/users", ""); code != http.StatusOK {
+		t.Errorf("after a reload: status = %d, want 200", code)
+	}
+	// A restart starts from the configured keys alone.
+	if code := statusWithKey(newKeysServer(t, &logs), created.Key, http.MethodGet, "/users", ""); code != http.StatusUnauthorized {
+		t.Errorf("after a restart: status = %d, want 401", code)
+	}
+}
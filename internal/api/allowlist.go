@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// sourceAddr is the address the allowlist is checked against: the client
+// address everything else uses, except that with only TRUST_PROXY set,
+// which trusts any peer, it is the peer address instead.
+func (s *Server) sourceAddr(r *http.Request) (netip.Addr, bool) {
+	if len(s.cfg.trustedProxies) == 0 && s.cfg.trustProxy {
+		return parseHop(remoteIP(r.RemoteAddr))
+	}
+	return parseHop(s.clientIP(r))
+}
+
+// allowCIDRs rejects requests from addresses outside cfg.allowCIDRs with a
+// 403. An empty allowlist lets everything through.
+func (s *Server) allowCIDRs() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(s.cfg.allowCIDRs) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, ok := s.sourceAddr(r)
+			if ok {
+				for _, p := range s.cfg.allowCIDRs {
+					if p.Contains(ip) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			s.errorJSON(w, r, http.StatusForbidden, "forbidden")
+		})
+	}
+}
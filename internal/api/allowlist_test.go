@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAllowCIDRs(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		allow      string
+		proxies    string
+		remoteAddr string
+		forwarded  string
+		key        string
+		wantCode   int
+	}{
+		{name: "no allowlist", remoteAddr: "203.0.113.5:1234", key: testKey, wantCode: http.StatusOK},
+		{name: "allowed", allow: "10.0.0.0/8,192.168.1.0/24",
+			remoteAddr: "10.1.2.3:1234", key: testKey, wantCode: http.StatusOK},
+		{name: "second range", allow: "10.0.0.0/8,192.168.1.0/24",
+			remoteAddr: "192.168.1.7:1234", key: testKey, wantCode: http.StatusOK},
+		{name: "outside", allow: "10.0.0.0/8,192.168.1.0/24",
+			remoteAddr: "192.168.2.7:1234", key: testKey, wantCode: http.StatusForbidden},
+		{name: "ipv4-mapped", allow: "192.168.1.0/24",
+			remoteAddr: "[::ffff:192.168.1.7]:1234", key: testKey, wantCode: http.StatusOK},
+		{name: "before the key check", allow: "10.0.0.0/8",
+			remoteAddr: "203.0.113.5:1234", wantCode: http.StatusForbidden},
+		{name: "key checked when allowed", allow: "10.0.0.0/8",
+			remoteAddr: "10.1.2.3:1234", wantCode: http.StatusUnauthorized},
+		{name: "forwarded from untrusted peer", allow: "10.0.0.0/8",
+			remoteAddr: "203.0.113.5:1234", forwarded: "10.1.2.3", key: testKey, wantCode: http.StatusForbidden},
+		{name: "forwarded by trusted proxy", allow: "10.0.0.0/8", proxies: "203.0.113.0/24",
+			remoteAddr: "203.0.113.5:1234", forwarded: "10.1.2.3", key: testKey, wantCode: http.StatusOK},
+		{name: "trusted proxy forwarding outsider", allow: "10.0.0.0/8", proxies: "203.0.113.0/24",
+			remoteAddr: "203.0.113.5:1234", forwarded: "198.51.100.1", key: testKey, wantCode: http.StatusForbidden},
+		{name: "trusted proxy itself", allow: "10.0.0.0/8", proxies: "10.0.0.0/24",
+			remoteAddr: "10.0.0.2:1234", key: testKey, wantCode: http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			var err error
+			if cfg.allowCIDRs, err = parseCIDRs(tt.allow); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.trustedProxies, err = parseCIDRs(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t, cfg, nil)
+			s.users.Create(context.Background(), "Ann", "")
+			r := newRequest(http.MethodGet, "/user/1", "")
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-API-Key", tt.key)
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec := serve(s.Handler(), r)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if rec.Code == http.StatusForbidden {
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "forbidden" {
+					t.Errorf("body = %s (%v), want a JSON error", rec.Body, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	auditOff  = "off"
+	auditLog  = "log"
+	auditFile = "file"
+)
+
+// auditEvent records one authentication decision. It identifies the key by
+// its label or fingerprint, never by the key itself.
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	KeyLabel   string    `json:"key_label,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// eventSink writes events from a bounded queue in the background. When
+// the queue is full events are dropped, and counted, rather than holding
+// up requests.
+type eventSink[T any] struct {
+	events  chan T
+	dropped atomic.Int64
+	write   func(T)
+	done    sync.WaitGroup
+	// mu guards against recording into events once it is closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newEventSink[T any](queue int, write func(T)) *eventSink[T] {
+	a := &eventSink[T]{events: make(chan T, queue), write: write}
+	a.done.Add(1)
+	go func() {
+		defer a.done.Done()
+		for e := range a.events {
+			a.write(e)
+		}
+	}()
+	return a
+}
+
+func (a *eventSink[T]) record(e T) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(1)
+		return
+	}
+	select {
+	case a.events <- e:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// close stops the sink once the queued events are written. Events
+// recorded afterwards, by requests that outlived a shutdown, are dropped.
+func (a *eventSink[T]) close() {
+	a.mu.Lock()
+	a.closed = true
+	close(a.events)
+	a.mu.Unlock()
+	a.done.Wait()
+}
+
+type auditSink = eventSink[auditEvent]
+
+// newAuditSink starts a sink that writes to logger, with audit=true on
+// each record, or, if out is set, to out as JSON lines.
+func newAuditSink(logger *slog.Logger, out io.Writer, queue int) *auditSink {
+	if out != nil {
+		enc := json.NewEncoder(out)
+		return newEventSink(queue, func(e auditEvent) { _ = enc.Encode(e) })
+	}
+	return newEventSink(queue, func(e auditEvent) {
+		attrs := []slog.Attr{
+			slog.Bool("audit", true),
+			slog.Time("event_time", e.Time),
+			slog.String("event", e.Event),
+			slog.String("request_id", e.RequestID),
+			slog.String("method", e.Method),
+			slog.String("path", e.Path),
+			slog.Int("status", e.Status),
+			slog.String("remote_addr", e.RemoteAddr),
+		}
+		for _, a := range []slog.Attr{
+			slog.String("principal", e.Principal),
+			slog.String("key_label", e.KeyLabel),
+			slog.String("reason", e.Reason),
+		} {
+			if a.Value.String() != "" {
+				attrs = append(attrs, a)
+			}
+		}
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "audit", attrs...)
+	})
+}
+
+// audit records an authentication event for r, if auditing is enabled.
+// err is nil for a successful authentication.
+func (s *Server) audit(r *http.Request, p principal, status int, err error) {
+	if s.auditor == nil {
+		return
+	}
+	e := auditEvent{
+		Time:       s.now().UTC(),
+		Event:      "auth_success",
+		RequestID:  requestIDFromContext(r.Context()),
+		Principal:  p.name,
+		KeyLabel:   p.label,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		RemoteAddr: s.clientIP(r),
+	}
+	if err != nil {
+		e.Event = "auth_failure"
+		e.Reason = err.Error()
+	}
+	s.auditor.record(e)
+}
+
+// closeAudit flushes the audit sink and the call log.
+func (s *Server) closeAudit() {
+	if s.auditor != nil {
+		s.auditor.close()
+	}
+	if s.calls != nil {
+		s.calls.close()
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	requests := []struct {
+		method, target, key string
+		wantEvent           string
+		wantStatus          int
+	}{
+		{http.MethodGet, "/users", testKey, "auth_success", http.StatusOK},
+		{http.MethodPost, "/user", "reader", "auth_success", http.StatusForbidden},
+		{http.MethodGet, "/user/9", testKey, "auth_success", http.StatusNotFound},
+		{http.MethodGet, "/users", "", "auth_failure", http.StatusUnauthorized},
+		{http.MethodGet, "/users", "not-a-key", "auth_failure", http.StatusUnauthorized},
+		// Health checks are not authenticated, so they are not audited.
+		{http.MethodGet, "/healthz", "", "", http.StatusOK},
+	}
+	for _, mode := range []string{auditFile, auditLog} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.apiKeys = []string{testKey, "reader,read"}
+			cfg.auditLog = mode
+			var out, logs syncBuffer
+			if mode == auditFile {
+				cfg.auditOut = &out
+			}
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			h := s.Handler()
+			for _, req := range requests {
+				r := newRequest(req.method, req.target, `{"name":"Ann"}`)
+				r.Header.Set("X-API-Key", req.key)
+				r.RemoteAddr = "198.51.100.7:4321"
+				if rec := serve(h, r); rec.Code != req.wantStatus {
+					t.Errorf("%s %s: status = %d, want %d", req.method, req.target, rec.Code, req.wantStatus)
+				}
+			}
+			s.closeAudit()
+
+			var events []map[string]any
+			if mode == auditFile {
+				events = jsonLines(t, out.String())
+				if strings.Contains(logs.String(), "auth_success") {
+					t.Error("file audit events also went to the main log")
+				}
+			} else {
+				events = logRecords(t, logs.String(), "audit")
+			}
+			if strings.Contains(out.String()+logs.String(), "not-a-key") {
+				t.Error("presented key in the audit events")
+			}
+			var want []map[string]any
+			for _, req := range requests {
+				if req.wantEvent != "" {
+					want = append(want, map[string]any{
+						"event": req.wantEvent, "method": req.method, "path": strings.Split(req.target, "?")[0],
+						"status": float64(req.wantStatus), "remote_addr": "198.51.100.7",
+					})
+				}
+			}
+			if len(events) != len(want) {
+				t.Fatalf("%d events, want %d:\n%s%s", len(events), len(want), out.String(), logs.String())
+			}
+			for i, e := range events {
+				for k, v := range want[i] {
+					if e[k] != v {
+						t.Errorf("event %d: %s = %v, want %v", i, k, e[k], v)
+					}
+				}
+				if mode == auditLog && e["audit"] != true {
+					t.Errorf("event %d: audit = %v, want true", i, e["audit"])
+				}
+				if success := want[i]["event"] == "auth_success"; success != (e["principal"] != nil) || success == (e["reason"] != nil) {
+					t.Errorf("event %d: principal %v, reason %v", i, e["principal"], e["reason"])
+				}
+			}
+		})
+	}
+}
+
+// stuckWriter blocks its first write until unblock is closed, signalling
+// writing once it has started.
+type stuckWriter struct {
+	once             sync.Once
+	writing, unblock chan struct{}
+	buf              syncBuffer
+}
+
+func (w *stuckWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.unblock
+	})
+	return w.buf.Write(p)
+}
+
+// TestAuditDropped fills the queue of a sink whose writer is stuck and
+// checks that further events are dropped and counted instead of waiting.
+func TestAuditDropped(t *testing.T) {
+	out := &stuckWriter{writing: make(chan struct{}), unblock: make(chan struct{})}
+	sink := newAuditSink(nil, out, 1)
+	sink.record(auditEvent{Status: 0})
+	<-out.writing
+	for i := 1; i <= 3; i++ {
+		sink.record(auditEvent{Status: i})
+	}
+	if got := sink.dropped.Load(); got != 2 {
+		t.Errorf("%d dropped with a full queue, want 2", got)
+	}
+	close(out.unblock)
+	sink.close()
+	events := jsonLines(t, out.buf.String())
+	if len(events) != 2 || events[0]["status"] != float64(0) || events[1]["status"] != float64(1) {
+		t.Errorf("written %v, want statuses 0 and 1", events)
+	}
+}
+
+func TestAuditQueueConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-audit-queue=0"}, false},
+		{[]string{"-audit-queue=-1"}, true},
+		{[]string{"-audit-log=syslog"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	authModeKey  = "key"
+	authModeJWT  = "jwt"
+	authModeMTLS = "mtls"
+)
+
+var (
+	errNoCredentials        = errors.New("no credentials")
+	errMalformedCredentials = errors.New("malformed Authorization header")
+	errInvalidKey           = errors.New("invalid API key")
+	errInvalidBasic         = errors.New("invalid Basic auth credentials")
+)
+
+// principal is an authenticated caller. name is "key:" and the key's
+// fingerprint for static keys, "user:" and the username for Basic auth,
+// "cert:" and the matched subject for client certificates, and the token
+// subject for JWTs.
+type principal struct {
+	name string
+	// label is the label of a managed key, if that is what authenticated.
+	label string
+	// client names the caller in metrics. It only takes values the
+	// configuration or the admin API bound: every JWT subject counts as
+	// "jwt".
+	client string
+	scopes []string
+	// limit is the key's own rate limit, or zero for the default.
+	limit bucketLimit
+}
+
+// authenticate identifies the caller from its credentials: a static API key
+// or, in JWT mode, a signed token whose scope claim lists its scopes. With
+// Basic auth enabled, a configured username and its API key as the
+// password are accepted too. In mTLS mode only the client certificate
+// counts.
+func (s *Server) authenticate(r *http.Request) (principal, error) {
+	if s.cfg.authMode == authModeMTLS {
+		return s.certPrincipal(r)
+	}
+	if user, pass, ok := r.BasicAuth(); ok && s.cfg.basicAuth {
+		if !basicMatch(s.cfg.basicUsers, user, pass) {
+			return principal{}, errInvalidBasic
+		}
+		e, ok := s.keys.lookup(pass)
+		if !ok {
+			return principal{}, errInvalidKey
+		}
+		name := "user:" + user
+		return principal{name: name, label: e.label, client: name, scopes: e.scopes, limit: e.limit}, nil
+	}
+
+	k, ok := s.presentedKey(r)
+	switch {
+	case !ok:
+		return principal{}, errMalformedCredentials
+	case k == "":
+		return principal{}, errNoCredentials
+	}
+
+	if s.cfg.authMode == authModeJWT {
+		claims, err := s.verifyJWT(k, s.now())
+		if err != nil {
+			return principal{}, err
+		}
+		scopes, err := parseScopes(claims.Scope)
+		if err != nil {
+			return principal{}, fmt.Errorf("%w: %v", errTokenInvalid, err)
+		}
+		return principal{name: claims.Subject, client: "jwt", scopes: scopes}, nil
+	}
+	e, ok := s.keys.lookup(k)
+	if !ok {
+		return principal{}, errInvalidKey
+	}
+	p := principal{name: "key:" + keyFingerprint(k), label: e.label, scopes: e.scopes, limit: e.limit}
+	p.client = cmp.Or(p.label, p.name)
+	return p, nil
+}
+
+// requireAuth rejects requests that authenticate fails for, except for
+// paths matched by exempt (see pathExempt). The principal is recorded for
+// handlers and the access log, and the outcome in the audit log.
+func (s *Server) requireAuth(exempt []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.cfg.insecureNoAuth {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pathExempt(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, err := s.authenticated(r)
+			if err != nil {
+				s.authFailed(w, r, err)
+				return
+			}
+			setPrincipal(r.Context(), p)
+			if s.auditor == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rr, r)
+			s.audit(r, p, rr.status, nil)
+		})
+	}
+}
+
+// authFailed writes the audit record and the 401 for a failed
+// authentication. The presented credential itself is never logged, only a
+// fingerprint of it.
+func (s *Server) authFailed(w http.ResponseWriter, r *http.Request, err error) {
+	s.authFailureCount.Add(1)
+	k, _ := s.presentedKey(r)
+	attrs := []any{
+		slog.String("remote_addr", s.clientIP(r)),
+		slog.String("path", r.URL.Path),
+	}
+	if s.cfg.authMode == authModeMTLS {
+		// There is neither a key to fingerprint nor anything a client
+		// certificate could be challenged for.
+		s.log(r.Context()).Warn("authentication failed", append(attrs, slog.String("reason", err.Error()))...)
+		s.errorJSON(w, r, http.StatusUnauthorized, "unauthorized")
+		s.audit(r, principal{}, http.StatusUnauthorized, err)
+		return
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		k = pass
+		attrs = append(attrs, slog.String("user", user))
+	}
+	attrs = append(attrs,
+		slog.Bool("key_present", k != ""),
+		slog.String("key_sha256", keyFingerprint(k)),
+		slog.String("reason", err.Error()),
+	)
+	s.log(r.Context()).Warn("authentication failed", attrs...)
+
+	// Browsers get a Basic challenge too so that they prompt for
+	// credentials; other clients, embedded webviews included, would only
+	// be disturbed by the popup.
+	if s.cfg.basicAuth && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+basicRealm+`"`)
+	}
+
+	challenge := "Bearer"
+	resp := &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "unauthorized"}
+	switch {
+	case errors.Is(err, errNoCredentials):
+	case errors.Is(err, errMalformedCredentials):
+		challenge += ` error="invalid_request"`
+	case errors.Is(err, errTokenExpired):
+		challenge += ` error="invalid_token", error_description="token expired"`
+		resp.Code, resp.Message = "token_expired", errTokenExpired.Error()
+	case errors.Is(err, errTokenInvalid):
+		challenge += ` error="invalid_token"`
+		resp.Code, resp.Message = "token_invalid", errTokenInvalid.Error()
+	default:
+		challenge += ` error="invalid_token"`
+	}
+	w.Header().Add("WWW-Authenticate", challenge)
+	s.writeError(w, r, resp)
+	s.audit(r, principal{}, http.StatusUnauthorized, err)
+}
+
+// pathExempt reports whether path is one of exempt or lies below one of
+// them. Matching is by whole segments: "/health" covers "/health" and
+// "/health/live" but not "/healthz", and a trailing slash makes no
+// difference.
+func pathExempt(path string, exempt []string) bool {
+	for _, p := range exempt {
+		p = strings.TrimSuffix(p, "/")
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// principalSlot is placed in the context by requestLogger so that the
+// principal found further in, by requireAuth, is visible to the access log.
+// It also keeps the outcome of authenticate, so that the rate limiter and
+// requireAuth share one check of the credentials.
+type principalSlot struct {
+	p principal
+
+	authDone bool
+	authP    principal
+	authErr  error
+}
+
+// authenticated is authenticate, run once for each request: later calls
+// return the outcome of the first.
+func (s *Server) authenticated(r *http.Request) (principal, error) {
+	slot, ok := r.Context().Value(principalKey).(*principalSlot)
+	if !ok {
+		return s.authenticate(r)
+	}
+	if !slot.authDone {
+		slot.authP, slot.authErr = s.authenticate(r)
+		slot.authDone = true
+	}
+	return slot.authP, slot.authErr
+}
+
+func withPrincipalSlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, principalKey, &principalSlot{})
+}
+
+func setPrincipal(ctx context.Context, p principal) {
+	if slot, ok := ctx.Value(principalKey).(*principalSlot); ok {
+		slot.p = p
+	}
+}
+
+// principalFromContext returns the authenticated caller, or the zero
+// principal if there is none.
+func principalFromContext(ctx context.Context) principal {
+	if slot, ok := ctx.Value(principalKey).(*principalSlot); ok {
+		return slot.p
+	}
+	return principal{}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthFailureLog(t *testing.T) {
+	const secret = "s3cr3t-guess-that-must-not-leak"
+	for _, tt := range []struct {
+		name        string
+		key         string
+		wantPresent bool
+	}{
+		{"no key", "", false},
+		{"wrong key", secret, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/user/1?x=1", "")
+			r.RemoteAddr = "198.51.100.7:4321"
+			r.Header.Set("X-API-Key", tt.key)
+			if rec := serve(h, r); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want 401", rec.Code)
+			}
+			if strings.Contains(logs.String(), secret) {
+				t.Errorf("raw key in the logs:\n%s", logs.String())
+			}
+
+			recs := logRecords(t, logs.String(), "authentication failed")
+			if len(recs) != 1 {
+				t.Fatalf("%d failed authentication records, want 1:\n%s", len(recs), logs.String())
+			}
+			rec := recs[0]
+			if rec["level"] != "WARN" {
+				t.Errorf("level = %v, want WARN", rec["level"])
+			}
+			if rec["time"] == nil {
+				t.Error("no time")
+			}
+			wantHash := ""
+			if tt.wantPresent {
+				wantHash = keyFingerprint(secret)
+			}
+			for field, want := range map[string]any{
+				"remote_addr": "198.51.100.7",
+				"path":        "/user/1",
+				"key_present": tt.wantPresent,
+				"key_sha256":  wantHash,
+			} {
+				if rec[field] != want {
+					t.Errorf("%s = %v, want %v", field, rec[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPathExempt(t *testing.T) {
+	exempt := []string{"/health", "/debug/", "/stats"}
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/health", true},
+		{"/health/live", true},
+		{"/healthz", false},
+		{"/health-admin", false},
+		{"/debug", true},
+		{"/debug/vars", true},
+		{"/debugger", false},
+		{"/stats", true},
+		{"/stats/", true},
+		{"/statistics", false},
+		{"/users", false},
+		{"/", false},
+	} {
+		if got := pathExempt(tt.path, exempt); got != tt.want {
+			t.Errorf("pathExempt(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAuthExempt(t *testing.T) {
+	for _, tt := range []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/stats", http.StatusOK},
+		{"/user/1", http.StatusNotFound},
+		{"/users", http.StatusUnauthorized},
+		{"/statsz", http.StatusUnauthorized},
+	} {
+		t.Run(tt.target, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.authExempt = splitList("/stats,/user/")
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Header.Del("X-API-Key")
+			if rec := serve(h, r); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestBearer(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		apiKey        string
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{"neither", "", "", 401, "Bearer"},
+		{"api key", testKey, "", 200, ""},
+		{"wrong api key", "wrong", "", 401, `Bearer error="invalid_token"`},
+		{"bearer", "", "Bearer " + testKey, 200, ""},
+		{"scheme case", "", "bEaReR " + testKey, 200, ""},
+		{"wrong bearer", "", "Bearer wrong", 401, `Bearer error="invalid_token"`},
+		{"bearer over wrong api key", "wrong", "Bearer " + testKey, 200, ""},
+		{"wrong bearer over api key", testKey, "Bearer wrong", 401, `Bearer error="invalid_token"`},
+		{"two spaces", "", "Bearer  " + testKey, 401, `Bearer error="invalid_request"`},
+		{"no token", "", "Bearer", 401, `Bearer error="invalid_request"`},
+		{"empty token", "", "Bearer ", 401, `Bearer error="invalid_request"`},
+		{"other scheme", "", "Token " + testKey, 401, `Bearer error="invalid_request"`},
+		{"malformed over api key", testKey, "Token " + testKey, 401, `Bearer error="invalid_request"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.authMaxFailures = 0
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Set("X-API-Key", tt.apiKey)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+		})
+	}
+}
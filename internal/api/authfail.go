@@ -0,0 +1,107 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type authFailures struct {
+	count        int
+	windowStart  time.Time
+	blockedUntil time.Time
+}
+
+// authFailureLimiter blocks a client for cooldown once it has failed
+// authentication maxFailures times within window.
+type authFailureLimiter struct {
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*authFailures
+	lastSweep time.Time
+}
+
+func newAuthFailureLimiter(maxFailures int, window, cooldown time.Duration, now func() time.Time) *authFailureLimiter {
+	return &authFailureLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+		now:         now,
+		clients:     make(map[string]*authFailures),
+	}
+}
+
+// blocked reports whether key is in its cooldown and, if so, for how long.
+func (l *authFailureLimiter) blocked(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+
+	f, ok := l.clients[key]
+	if !ok || !now.Before(f.blockedUntil) {
+		return false, 0
+	}
+	return true, f.blockedUntil.Sub(now)
+}
+
+func (l *authFailureLimiter) fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	f, ok := l.clients[key]
+	if !ok || now.Sub(f.windowStart) >= l.window {
+		f = &authFailures{windowStart: now}
+		l.clients[key] = f
+	}
+	f.count++
+	if f.count >= l.maxFailures {
+		f.blockedUntil = now.Add(l.cooldown)
+	}
+}
+
+// sweep forgets clients whose window and cooldown have both run out.
+func (l *authFailureLimiter) sweep(now time.Time) {
+	for key, f := range l.clients {
+		if now.Sub(f.windowStart) >= l.window && !now.Before(f.blockedUntil) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// authFailureLimit must run in front of the API key check: it rejects
+// clients in cooldown outright and counts the 401s the rest of the chain
+// produces. Clients are told apart by their client address, so behind a
+// trusted proxy each forwarded client has a limit of its own.
+func (s *Server) authFailureLimit() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.authFailures == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ipBucket(s.clientIP(r))
+			if ok, wait := s.authFailures.blocked(key); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				s.errorJSON(w, r, http.StatusTooManyRequests, "too many failed authentication attempts")
+				return
+			}
+
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rr, r)
+			if rr.status == http.StatusUnauthorized {
+				s.authFailures.fail(key)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureLimit(t *testing.T) {
+	type step struct {
+		wait time.Duration
+		// peer is the connection's address and forwardedFor, if set, the
+		// X-Forwarded-For header.
+		peer, forwardedFor string
+		key                string
+		wantStatus         int
+	}
+	const a, b = "192.0.2.1:1234", "198.51.100.7:4321"
+	for _, tt := range []struct {
+		name       string
+		trustProxy bool
+		steps      []step
+	}{
+		{"blocked after max failures", false, []step{
+			{0, a, "", "bad", 401}, {0, a, "", "bad", 401}, {0, a, "", "bad", 401},
+			{0, a, "", "bad", 429}, {0, a, "", testKey, 429},
+		}},
+		{"successes do not count", false, []step{
+			{0, a, "", "bad", 401}, {0, a, "", testKey, 200}, {0, a, "", "bad", 401},
+			{0, a, "", testKey, 200}, {0, a, "", testKey, 200},
+		}},
+		{"cooldown runs out", false, []step{
+			{0, a, "", "bad", 401}, {0, a, "", "bad", 401}, {0, a, "", "bad", 401},
+			{time.Minute, a, "", testKey, 429}, {4 * time.Minute, a, "", testKey, 200},
+		}},
+		{"window runs out", false, []step{
+			{0, a, "", "bad", 401}, {0, a, "", "bad", 401},
+			{time.Minute, a, "", "bad", 401}, {0, a, "", testKey, 200},
+		}},
+		{"clients apart", false, []step{
+			{0, a, "", "bad", 401}, {0, a, "", "bad", 401}, {0, a, "", "bad", 401},
+			{0, b, "", testKey, 200}, {0, a, "", testKey, 429},
+		}},
+		{"forwarded clients apart behind a trusted proxy", true, []step{
+			{0, b, "203.0.113.1", "bad", 401}, {0, b, "203.0.113.1", "bad", 401}, {0, b, "203.0.113.1", "bad", 401},
+			{0, b, "203.0.113.2", testKey, 200}, {0, b, "203.0.113.1", testKey, 429},
+		}},
+		{"forwarded for ignored without trusting the proxy", false, []step{
+			{0, b, "203.0.113.1", "bad", 401}, {0, b, "203.0.113.2", "bad", 401}, {0, b, "203.0.113.3", "bad", 401},
+			{0, b, "203.0.113.4", testKey, 429},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.trustProxy = tt.trustProxy
+			cfg.rateLimit = 0
+			cfg.authMaxFailures = 3
+			cfg.authFailureWindow = time.Minute
+			cfg.authCooldown = 5 * time.Minute
+			clock := newFakeClock()
+			s := newTestServerAt(t, cfg, nil, clock.now)
+			s.users.Create(context.Background(), "Ann", "")
+			h := s.Handler()
+			for i, st := range tt.steps {
+				clock.advance(st.wait)
+				r := newRequest(http.MethodGet, "/user/1", "")
+				r.RemoteAddr = st.peer
+				r.Header.Set("X-API-Key", st.key)
+				if st.forwardedFor != "" {
+					r.Header.Set("X-Forwarded-For", st.forwardedFor)
+				}
+				rec := serve(h, r)
+				if rec.Code != st.wantStatus {
+					t.Errorf("request %d: status = %d, want %d: %s", i, rec.Code, st.wantStatus, rec.Body)
+				}
+				if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: 429 without Retry-After", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// basicRealm is the realm of the Basic challenge sent to browsers.
+const basicRealm = "api"
+
+// basicUser lets a browser authenticate with HTTP Basic: the username is
+// mapped to the API key that has to be given as the password.
+type basicUser struct {
+	name      string
+	nameHash  [32]byte
+	keyDigest [32]byte
+}
+
+// parseBasicUsers reads "user:key-or-hash" pairs separated by commas.
+func parseBasicUsers(v string) ([]basicUser, error) {
+	var users []basicUser
+	for _, pair := range splitList(v) {
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid Basic auth user %q: want user:key", name)
+		}
+		d, err := keyDigest(key)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, basicUser{name: name, nameHash: sha256.Sum256([]byte(name)), keyDigest: d})
+	}
+	return users, nil
+}
+
+// basicMatch reports whether user and pass are one of the configured
+// pairs, checking every pair in constant time.
+func basicMatch(users []basicUser, user, pass string) bool {
+	nh := sha256.Sum256([]byte(user))
+	pd := sha256.Sum256([]byte(pass))
+	match := 0
+	for i := range users {
+		match |= subtle.ConstantTimeCompare(nh[:], users[i].nameHash[:]) &
+			subtle.ConstantTimeCompare(pd[:], users[i].keyDigest[:])
+	}
+	return match == 1
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	const browser = "text/html,application/xhtml+xml,*/*;q=0.8"
+	for _, tt := range []struct {
+		name       string
+		enabled    bool
+		user, pass string
+		accept     string
+		wantStatus int
+		// wantBasic is whether a Basic challenge is sent.
+		wantBasic bool
+	}{
+		{"valid", true, "ann", testKey, "", http.StatusOK, false},
+		{"wrong password", true, "ann", "wrong", "", http.StatusUnauthorized, false},
+		{"key of another user", true, "bob", testKey, "", http.StatusUnauthorized, false},
+		{"unknown user", true, "eve", testKey, "", http.StatusUnauthorized, false},
+		{"browser", true, "ann", "wrong", browser, http.StatusUnauthorized, true},
+		{"browser without credentials", true, "", "", browser, http.StatusUnauthorized, true},
+		{"disabled", false, "ann", testKey, "", http.StatusUnauthorized, false},
+		{"disabled, browser", false, "ann", testKey, browser, http.StatusUnauthorized, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.apiKeys = []string{testKey, "bob-key"}
+			cfg.authMaxFailures = 0
+			if tt.enabled {
+				users, err := parseBasicUsers("ann:" + testKey + ",bob:bob-key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.basicAuth, cfg.basicUsers = true, users
+			}
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Del("X-API-Key")
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			r.Header.Set("Accept", tt.accept)
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			challenges := rec.Header().Values("WWW-Authenticate")
+			if got := slices.Contains(challenges, `Basic realm="api"`); got != tt.wantBasic {
+				t.Errorf("challenges %q, want Basic: %v", challenges, tt.wantBasic)
+			}
+		})
+	}
+}
+
+func TestParseBasicUsers(t *testing.T) {
+	for _, tt := range []struct {
+		in        string
+		wantUsers int
+		wantErr   bool
+	}{
+		{"", 0, false},
+		{"ann:k1", 1, false},
+		{"ann:k1, bob:sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", 2, false},
+		{"ann", 0, true},
+		{":k1", 0, true},
+		{"ann:", 0, true},
+		{"ann:sha256:zz", 0, true},
+	} {
+		users, err := parseBasicUsers(tt.in)
+		if (err != nil) != tt.wantErr || len(users) != tt.wantUsers {
+			t.Errorf("parseBasicUsers(%q) = %d users, %v; want %d, error %v", tt.in, len(users), err, tt.wantUsers, tt.wantErr)
+		}
+	}
+	users, _ := parseBasicUsers("ann:k1,bob:k2")
+	for _, tt := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"ann", "k1", true},
+		{"bob", "k2", true},
+		{"ann", "k2", false},
+		{"", "", false},
+	} {
+		if got := basicMatch(users, tt.user, tt.pass); got != tt.want {
+			t.Errorf("basicMatch(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
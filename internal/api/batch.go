@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BatchResult is the outcome of one item of POST /users: the created user,
+// or why it was not created.
+type BatchResult struct {
+	Status int               `json:"status"`
+	User   *UserResponse     `json:"user,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// handleCreateUsers creates each user of a JSON array, validated as in
+// POST /user. Items fail independently; the response lists a result per
+// item, in order.
+func (s *Server) handleCreateUsers(w http.ResponseWriter, r *http.Request) error {
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	raw = trimBody(raw)
+	if len(raw) == 0 {
+		return errBadRequest(errEmptyBody.Error())
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return errBadRequest("want a JSON array of users")
+	}
+	switch {
+	case len(items) == 0:
+		return errBadRequest("empty batch")
+	case len(items) > s.cfg.maxBatch:
+		return errBadRequest(fmt.Sprintf("batch too large: at most %d users", s.cfg.maxBatch))
+	}
+
+	results := make([]BatchResult, len(items))
+	for i, item := range items {
+		results[i] = s.createBatchItem(r, item)
+	}
+	s.writeJSON(w, r, http.StatusOK, results)
+	return nil
+}
+
+func (s *Server) createBatchItem(r *http.Request, item json.RawMessage) BatchResult {
+	var req CreateUserRequest
+	if err := json.Unmarshal(item, &req); err != nil {
+		return BatchResult{Status: http.StatusBadRequest, Error: errMalformedJSON.Error()}
+	}
+	if req.Name = normalizeName(req.Name); req.Name == "" {
+		return BatchResult{Status: http.StatusBadRequest, Error: errInvalidName.Error()}
+	}
+	if req.Email = strings.TrimSpace(req.Email); req.Email != "" {
+		email, err := parseEmail(req.Email)
+		if err != nil {
+			e := errValidation(map[string]string{"email": err.Error()})
+			return BatchResult{Status: e.Status, Error: e.Message, Fields: e.Fields}
+		}
+		req.Email = email
+	}
+	u, err := s.users.Create(r.Context(), req.Name, req.Email)
+	if err != nil {
+		e := apiError(err)
+		if e.Status == http.StatusInternalServerError {
+			s.log(r.Context()).Error("internal error", "err", err)
+		}
+		return BatchResult{Status: e.Status, Error: e.Message}
+	}
+	resp := newUserResponse(u)
+	return BatchResult{Status: http.StatusCreated, User: &resp}
+}
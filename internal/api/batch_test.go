@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestCreateUsers(t *testing.T) {
+	for _, tt := range []struct {
+		name, body string
+		wantStatus int
+		// wantResults are the statuses of the items, and wantUsers the names
+		// stored after the request.
+		wantResults []int
+		wantUsers   []string
+	}{
+		{name: "all created", body: `[{"name":"Ann"},{"name":"Bo","email":" Bo@Example.com "}]`,
+			wantStatus: http.StatusOK, wantResults: []int{201, 201}, wantUsers: []string{"Ann", "Bo"}},
+		{name: "items fail alone", body: `[{"name":"Ann"},{"name":" "},{"name":"Bo","email":"nope"},"ann",{"name":"Cy"}]`,
+			wantStatus: http.StatusOK, wantResults: []int{201, 400, 422, 400, 201}, wantUsers: []string{"Ann", "Cy"}},
+		{name: "at the limit", body: `[{"name":"Ann"},{"name":"Bo"},{"name":"Cy"},{"name":"Di"},{"name":"Ed"}]`,
+			wantStatus: http.StatusOK, wantResults: []int{201, 201, 201, 201, 201}, wantUsers: []string{"Ann", "Bo", "Cy", "Di", "Ed"}},
+		{name: "over the limit", body: `[{"name":"Ann"},{"name":"Bo"},{"name":"Cy"},{"name":"Di"},{"name":"Ed"},{"name":"Fay"}]`, wantStatus: http.StatusBadRequest},
+		{name: "empty batch", body: `[]`, wantStatus: http.StatusBadRequest},
+		{name: "empty body", body: ``, wantStatus: http.StatusBadRequest},
+		{name: "not an array", body: `{"name":"Ann"}`, wantStatus: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.maxBatch = 5
+			h := newTestServer(t, cfg, nil).Handler()
+			rec := serve(h, newRequest(http.MethodPost, "/users", tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var results []BatchResult
+				if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+					t.Fatal(err)
+				}
+				statuses := make([]int, len(results))
+				for i, res := range results {
+					statuses[i] = res.Status
+					if (res.Status == http.StatusCreated) != (res.User != nil) || (res.User == nil) != (res.Error != "") {
+						t.Errorf("result %d = %+v, want a user or an error", i, res)
+					}
+				}
+				if !slices.Equal(statuses, tt.wantResults) {
+					t.Errorf("results %v, want %v: %s", statuses, tt.wantResults, rec.Body)
+				}
+			}
+
+			var users []UserResponse
+			if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/users", "")).Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			if !slices.Equal(names, tt.wantUsers) {
+				t.Errorf("stored %v, want %v", names, tt.wantUsers)
+			}
+		})
+	}
+}
+
+func TestCreateUsersResult(t *testing.T) {
+	h := newTestServer(t, DefaultConfig(), nil).Handler()
+	rec := serve(h, newRequest(http.MethodPost, "/users", `[{"name":"Ann","email":"ann@example.com"},{"name":"Bo","email":"nope"}]`))
+	var results []BatchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("body %s (%v), want two results", rec.Body, err)
+	}
+	if u := results[0].User; u == nil || u.UserID != 1 || u.Name != "Ann" || u.Email != "ann@example.com" {
+		t.Errorf("created %+v", u)
+	}
+	if res := results[1]; res.Fields["email"] == "" {
+		t.Errorf("failed item %+v, want the invalid email named", res)
+	}
+}
+
+func TestMaxBatchConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		want    int
+		wantErr bool
+	}{
+		{nil, 100, false},
+		{[]string{"-max-batch=5"}, 5, false},
+		{[]string{"-max-batch=0"}, 0, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+		if err == nil && cfg.maxBatch != tt.want {
+			t.Errorf("%q: maxBatch = %d, want %d", tt.args, cfg.maxBatch, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errMalformedGzip is what reading a gzip request body that does not
+// decompress fails with.
+var errMalformedGzip = errors.New("malformed gzip body")
+
+// limitBody caps request bodies at cfg.maxBody bytes. A declared
+// Content-Length over the cap is refused before anything is read; bodies of
+// unknown length are cut off by http.MaxBytesReader instead, which readBody
+// turns into the same 413.
+func (s *Server) limitBody() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.cfg.maxBody <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > s.cfg.maxBody {
+				w.Header().Set("Connection", "close")
+				s.errorJSON(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, s.cfg.maxBody)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// readBody reads and closes the request body, failing with the APIError
+// the problem is reported as.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			return nil, &APIError{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large", Message: "request body too large", err: err}
+		case errors.Is(err, errMalformedGzip):
+			return nil, &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: "malformed gzip request body", err: err}
+		default:
+			return nil, &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: "unreadable request body", err: err}
+		}
+	}
+	return body, nil
+}
+
+// decompressBody decodes request bodies sent with Content-Encoding gzip,
+// so handlers only ever see the JSON. limitBody has capped the compressed
+// size already; the decompressed body is capped at cfg.maxBody as well, so
+// a small body cannot expand past it. Other codings are refused with 415.
+func (s *Server) decompressBody() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+			default:
+				w.Header().Set("Accept-Encoding", "gzip")
+				s.errorJSON(w, r, http.StatusUnsupportedMediaType, "unsupported content encoding")
+				return
+			}
+			r2 := r.WithContext(r.Context())
+			r2.Header = r.Header.Clone()
+			r2.Header.Del("Content-Encoding")
+			r2.ContentLength = -1
+			var body io.ReadCloser = &gzipBody{src: r.Body}
+			if s.cfg.maxBody > 0 {
+				body = http.MaxBytesReader(w, body, s.cfg.maxBody)
+			}
+			r2.Body = body
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// gzipBody decompresses src. The gzip header is only read on the first
+// Read, so that a malformed one is reported by readBody like any other
+// problem with the body.
+type gzipBody struct {
+	src io.ReadCloser
+	zr  *gzip.Reader
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		zr, err := gzip.NewReader(b.src)
+		if err != nil {
+			return 0, gzipError(err)
+		}
+		b.zr = zr
+	}
+	n, err := b.zr.Read(p)
+	return n, gzipError(err)
+}
+
+func (b *gzipBody) Close() error {
+	return b.src.Close()
+}
+
+// gzipError marks err as errMalformedGzip, unless it is the end of the
+// body or comes from the size limit on the compressed body.
+func gzipError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if err == nil || err == io.EOF || errors.As(err, &tooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errMalformedGzip, err)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// unreadBody fails the test if the request body is read at all.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("body read although its declared length is over the limit")
+	return 0, io.EOF
+}
+
+func TestLimitBody(t *testing.T) {
+	const limit = 64
+	// exact is a POST /user body of exactly limit bytes.
+	exact := `{"name":"` + strings.Repeat("a", limit-len(`{"name":""}`)) + `"}`
+	for _, tt := range []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		{"under the limit", `{"name":"Ann"}`, -1, http.StatusCreated},
+		{"at the limit", exact, int64(len(exact)), http.StatusCreated},
+		{"at the limit, chunked", exact, -1, http.StatusCreated},
+		{"over the limit, chunked", exact + " ", -1, http.StatusRequestEntityTooLarge},
+		{"declared over the limit", exact + " ", limit + 1, http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.maxBody = limit
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodPost, "/user", tt.body)
+			r.ContentLength = tt.contentLength
+			if tt.contentLength > limit {
+				r.Body = io.NopCloser(unreadBody{t})
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != "request body too large" {
+				t.Errorf("body = %+v", body)
+			}
+			if tt.contentLength > limit && rec.Header().Get("Connection") != "close" {
+				t.Error("connection kept open after refusing a body unread")
+			}
+		})
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := io.WriteString(zw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestDecompressBody(t *testing.T) {
+	const limit = 256
+	// bomb is small compressed, and over the limit once decompressed.
+	bomb := gzipped(t, `{"name":"`+strings.Repeat("a", 10*limit)+`"}`)
+	valid := gzipped(t, `{"name":"Ann"}`)
+	for _, tt := range []struct {
+		name, encoding, body string
+		wantStatus           int
+		wantError            string
+	}{
+		{name: "gzip", encoding: "gzip", body: valid, wantStatus: http.StatusCreated},
+		{name: "x-gzip", encoding: " X-Gzip ", body: valid, wantStatus: http.StatusCreated},
+		{name: "identity", encoding: "identity", body: `{"name":"Ann"}`, wantStatus: http.StatusCreated},
+		{name: "none", body: `{"name":"Ann"}`, wantStatus: http.StatusCreated},
+		{name: "unsupported", encoding: "br", body: valid, wantStatus: http.StatusUnsupportedMediaType, wantError: "unsupported content encoding"},
+		{name: "not gzip", encoding: "gzip", body: `{"name":"Ann"}`, wantStatus: http.StatusBadRequest, wantError: "malformed gzip request body"},
+		{name: "truncated", encoding: "gzip", body: valid[:len(valid)-6], wantStatus: http.StatusBadRequest, wantError: "malformed gzip request body"},
+		{name: "over the limit decompressed", encoding: "gzip", body: bomb, wantStatus: http.StatusRequestEntityTooLarge, wantError: "request body too large"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.body) > limit {
+				t.Fatalf("compressed body of %d bytes is over the limit itself", len(tt.body))
+			}
+			cfg := DefaultConfig()
+			cfg.maxBody = limit
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodPost, "/user", tt.body)
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusUnsupportedMediaType && rec.Header().Get("Accept-Encoding") != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", rec.Header().Get("Accept-Encoding"))
+			}
+			if tt.wantError == "" {
+				var u UserResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &u); err != nil || u.Name != "Ann" {
+					t.Errorf("created %s (%v), want Ann", rec.Body, err)
+				}
+				return
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != tt.wantError {
+				t.Errorf("body = %s (%v), want error %q", rec.Body, err, tt.wantError)
+			}
+		})
+	}
+}
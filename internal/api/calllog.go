@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// callLogBodyLimit is the most of each body a call record keeps. Request
+// bodies are normally held to cfg.maxBody well before that.
+const callLogBodyLimit = 1 << 20
+
+// callRecord is one API call in the call log: enough to replay the
+// request and check the response. Bodies are JSON where they were JSON,
+// and text otherwise.
+type callRecord struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Principal    string    `json:"principal,omitempty"`
+	KeyLabel     string    `json:"key_label,omitempty"`
+	Method       string    `json:"method"`
+	Route        string    `json:"route,omitempty"`
+	Path         string    `json:"path"`
+	Query        string    `json:"query,omitempty"`
+	RequestBody  any       `json:"request_body,omitempty"`
+	Status       int       `json:"status"`
+	ResponseBody any       `json:"response_body,omitempty"`
+}
+
+type callSink = eventSink[callRecord]
+
+// newCallLog starts a sink writing call records to out as JSON lines.
+func newCallLog(out io.Writer, queue int) *callSink {
+	enc := json.NewEncoder(out)
+	return newEventSink(queue, func(c callRecord) { _ = enc.Encode(c) })
+}
+
+// logCalls records the calls that change something, and with
+// cfg.callLogReads all others too, in the call log. It sits inside
+// authentication so that it knows the caller, and outside recoverer so
+// that it sees the 500 a panic turns into.
+func (s *Server) logCalls(route func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.calls == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			default:
+				if !s.cfg.callLogReads {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			start := s.now().UTC()
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			reqBody := &cappedBuffer{max: callLogBodyLimit}
+			respBody := &cappedBuffer{max: callLogBodyLimit}
+			rr.capture = respBody
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, reqBody), r.Body}
+			}
+			next.ServeHTTP(rr, r)
+
+			p := principalFromContext(r.Context())
+			s.calls.record(callRecord{
+				Time:         start,
+				RequestID:    requestIDFromContext(r.Context()),
+				Principal:    p.name,
+				KeyLabel:     p.label,
+				Method:       r.Method,
+				Route:        route(r),
+				Path:         r.URL.Path,
+				Query:        r.URL.RawQuery,
+				RequestBody:  s.callBody(reqBody, r.Header.Get("Content-Type")),
+				Status:       rr.status,
+				ResponseBody: s.callBody(respBody, rr.Header().Get("Content-Type")),
+			})
+		})
+	}
+}
+
+// callBody renders a captured body for a call record, with the
+// cfg.callLogRedact fields blanked out: as JSON if it is a whole JSON
+// document, as capturedBody's text otherwise, and nil if empty.
+func (s *Server) callBody(c *cappedBuffer, contentType string) any {
+	body := capturedBody(c, contentType, s.callRedactRE)
+	if body == "" {
+		return nil
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if (mt == "application/json" || mt == "application/problem+json") && json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	return body
+}
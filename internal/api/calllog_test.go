@@ -0,0 +1,154 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCallLog(t *testing.T) {
+	requests := []struct {
+		method, target, body string
+	}{
+		{http.MethodPost, "/user", `{"name":"Ann"}`},
+		{http.MethodGet, "/user/1", ""},
+		{http.MethodPatch, "/user?id=1&dry_run=true", `{"name":"Anne"}`},
+		{http.MethodGet, "/users?limit=1", ""},
+		{http.MethodDelete, "/user?id=1", ""},
+		{http.MethodDelete, "/user?id=1", ""},
+	}
+	for _, tt := range []struct {
+		name  string
+		reads bool
+		// want are the indexes of the requests recorded.
+		want []int
+	}{
+		{"writes", false, []int{0, 2, 4, 5}},
+		{"reads too", true, []int{0, 1, 2, 3, 4, 5}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out syncBuffer
+			cfg := DefaultConfig()
+			cfg.callLogOut = &out
+			cfg.callLogReads = tt.reads
+			s := newTestServer(t, cfg, nil)
+			h := s.Handler()
+			var statuses []int
+			for _, req := range requests {
+				statuses = append(statuses, serve(h, newRequest(req.method, req.target, req.body)).Code)
+			}
+			s.closeAudit()
+
+			records := jsonLines(t, out.String())
+			if len(records) != len(tt.want) {
+				t.Fatalf("%d records, want %d:\n%s", len(records), len(tt.want), out.String())
+			}
+			for i, rec := range records {
+				req := requests[tt.want[i]]
+				path, query, _ := strings.Cut(req.target, "?")
+				if rec["method"] != req.method || rec["path"] != path || rec["query"] != orNil(query) ||
+					rec["status"] != float64(statuses[tt.want[i]]) || rec["request_id"] == nil || rec["time"] == nil ||
+					rec["principal"] != "key:"+keyFingerprint(testKey) {
+					t.Errorf("record %d = %v, for %s %s", i, rec, req.method, req.target)
+				}
+			}
+			created := records[0]
+			if created["route"] != "/user" || !reflect.DeepEqual(created["request_body"], map[string]any{"name": "Ann"}) {
+				t.Errorf("create recorded as %v", created)
+			}
+			if body, _ := created["response_body"].(map[string]any); body["user_id"] != float64(1) || body["name"] != "Ann" {
+				t.Errorf("response body %v, want the created user", created["response_body"])
+			}
+			if gone := records[len(records)-1]; gone["status"] != float64(http.StatusNotFound) || gone["response_body"] == nil {
+				t.Errorf("failed delete recorded as %v, want its 404 and error", gone)
+			}
+		})
+	}
+}
+
+// orNil returns s, or nil if it is empty, as a JSON field left out decodes.
+func orNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func TestCallLogBodies(t *testing.T) {
+	for _, tt := range []struct {
+		name, contentType, body string
+		want                    any
+	}{
+		{"json", "application/json", `{"name":"Ann","password":"hunter2","token":"t0k"}`,
+			map[string]any{"name": "Ann", "password": redacted, "token": redacted}},
+		{"form", "application/x-www-form-urlencoded", "name=Bo&password=swordfish",
+			"name=Bo&password=" + redacted},
+		{"malformed json", "application/json", `{"name":`, `{"name":`},
+		{"empty", "application/json", "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out syncBuffer
+			cfg := configFromFlags(t, "-call-log-redact=password,token")
+			cfg.callLogOut = &out
+			s := newTestServer(t, cfg, nil)
+			r := newRequest(http.MethodPost, "/user", tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			serve(s.Handler(), r)
+			s.closeAudit()
+
+			records := jsonLines(t, out.String())
+			if len(records) != 1 {
+				t.Fatalf("%d records, want 1:\n%s", len(records), out.String())
+			}
+			if got := records[0]["request_body"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("request_body = %#v, want %#v", got, tt.want)
+			}
+			for _, secret := range []string{"hunter2", "t0k", "swordfish"} {
+				if strings.Contains(out.String(), secret) {
+					t.Errorf("%s in the call log:\n%s", secret, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestCallLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.jsonl")
+	if err := os.WriteFile(path, []byte(`{"earlier":true}`+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.addr = "127.0.0.1:0"
+	cfg.logFormat = "json"
+	cfg.callLogPath = path
+	var logs syncBuffer
+	s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+	base, errc := startServer(t, s, &logs)
+	req, err := http.NewRequest(http.MethodPost, base+"/user", strings.NewReader(`{"name":"Ann"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(apiKeyHeader, testKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := noKeepAlive.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := stopServer(t, errc); err != nil {
+		t.Fatalf("ListenAndServe = %v", err)
+	}
+
+	// The file is appended to, and flushed on shutdown.
+	records := jsonLines(t, readFile(t, path))
+	if len(records) != 2 || records[0]["earlier"] != true || records[1]["path"] != "/user" || records[1]["status"] != float64(http.StatusCreated) {
+		t.Errorf("call log holds %v, want the earlier record and the create", records)
+	}
+	if strings.Contains(logs.String(), "response_body") {
+		t.Errorf("calls in the main log:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientAddress works out the client address of each request once, before
+// anything needs it, and stores it in the request context so that logging,
+// rate limiting and the allowlist all agree on it.
+func (s *Server) clientAddress() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey, s.resolveClientIP(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// stripForwarded deletes the X-Forwarded-* and X-Real-IP headers of
+// requests whose peer is not a trusted proxy, so that nothing further on
+// can be fooled by values the client made up. Those of a trusted proxy are
+// left as they are.
+func (s *Server) stripForwarded() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.fromTrustedProxy(r) {
+				for name := range r.Header {
+					if strings.HasPrefix(name, "X-Forwarded-") || name == "X-Real-Ip" {
+						r.Header.Del(name)
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIPFromContext returns the client address stored by clientAddress.
+func clientIPFromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(clientIPKey).(string)
+	return ip, ok
+}
+
+// clientIP returns the address of the client that sent r, as stored by
+// clientAddress, or worked out now for a request that did not pass through
+// it.
+func (s *Server) clientIP(r *http.Request) string {
+	if ip, ok := clientIPFromContext(r.Context()); ok {
+		return ip
+	}
+	return s.resolveClientIP(r)
+}
+
+// resolveClientIP derives the client address of r. With a trusted-proxy
+// list configured, X-Forwarded-For and X-Real-IP are only honoured when the
+// peer is one of those proxies and ignored entirely otherwise, so a client
+// cannot pick its own address; failing that, when the server is configured
+// to trust its proxy, those headers take precedence over the connection's
+// peer address.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	if len(s.cfg.trustedProxies) > 0 {
+		if ip, ok := s.trustedForwardedIP(r); ok {
+			return ip.String()
+		}
+		return remoteIP(r.RemoteAddr)
+	}
+	if s.cfg.trustProxy {
+		if ip, ok := forwardedIP(r.Header); ok {
+			return ip.String()
+		}
+	}
+	return remoteIP(r.RemoteAddr)
+}
+
+// fromTrustedProxy reports whether the peer of r may speak for the client
+// in X-Forwarded-* headers: it is a configured trusted proxy, or with no
+// such list, TRUST_PROXY is set. A peer on a Unix socket is a local process
+// let in by the socket's permissions, such as a proxy on the same host, and
+// is trusted as well.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	if len(s.cfg.trustedProxies) == 0 {
+		return s.cfg.trustProxy
+	}
+	if r.RemoteAddr == unixPeer {
+		return true
+	}
+	peer, ok := parseHop(remoteIP(r.RemoteAddr))
+	return ok && s.isTrustedProxy(peer)
+}
+
+// trustedForwardedIP walks X-Forwarded-For from the right, skipping hops
+// that belong to trusted proxies; the first other hop is the client. A
+// proxy that only sends X-Real-IP is taken at its word. Nothing is taken
+// from a peer that is not a trusted proxy.
+func (s *Server) trustedForwardedIP(r *http.Request) (netip.Addr, bool) {
+	if !s.fromTrustedProxy(r) {
+		return netip.Addr{}, false
+	}
+
+	var hops []netip.Addr
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			ip, ok := parseHop(hop)
+			if !ok {
+				return netip.Addr{}, false
+			}
+			hops = append(hops, ip)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !s.isTrustedProxy(hops[i]) {
+			return hops[i], true
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0], true
+	}
+	return parseHop(r.Header.Get("X-Real-IP"))
+}
+
+// forwardedHTTPS reports whether the client reached us over TLS: directly,
+// or through a trusted proxy saying so in X-Forwarded-Proto. Of a list, the
+// last entry is the one added by the proxy next to us.
+func (s *Server) forwardedHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !s.fromTrustedProxy(r) {
+		return false
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 {
+		return false
+	}
+	protos := strings.Split(values[len(values)-1], ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
+
+func (s *Server) isTrustedProxy(ip netip.Addr) bool {
+	for _, p := range s.cfg.trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma-separated list of prefixes. A bare address is
+// accepted as a single-host prefix.
+func parseCIDRs(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", v)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// ipBucket groups addresses that belong to one client: IPv4 addresses stand
+// alone, IPv6 addresses are grouped by their /64, which is the smallest
+// allocation an end site usually gets.
+func ipBucket(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return addr
+	}
+	ip = ip.Unmap()
+	if ip.Is6() {
+		p, _ := ip.Prefix(64)
+		return p.String()
+	}
+	return ip.String()
+}
+
+// unixPeer is the RemoteAddr net/http gives requests on a Unix socket,
+// whose peers have no address. It is not an IP, so such requests fail
+// allowlist checks unless forwarded by a trusted proxy, and share a single
+// failed-authentication bucket.
+const unixPeer = "@"
+
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// forwardedIP picks the originating client out of X-Forwarded-For (the
+// leftmost well-formed entry, across repeated headers), falling back to
+// X-Real-IP.
+func forwardedIP(h http.Header) (netip.Addr, bool) {
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if ip, ok := parseHop(hop); ok {
+				return ip, true
+			}
+		}
+	}
+	return parseHop(h.Get("X-Real-IP"))
+}
+
+// parseHop parses a single proxy hop, tolerating an optional port and the
+// bracketed IPv6 form.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if hop == "" {
+		return netip.Addr{}, false
+	}
+	if ip, err := netip.ParseAddr(hop); err == nil {
+		return ip.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(hop, "[]")); err == nil {
+		return ip.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
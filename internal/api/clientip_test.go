@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestClientIPTrustProxy(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		trustProxy bool
+		header     http.Header
+		want       string
+	}{
+		{"peer", false, nil, "192.0.2.1"},
+		{"forwarded for, untrusted", false, http.Header{"X-Forwarded-For": {"203.0.113.9"}}, "192.0.2.1"},
+		{"forwarded for", true, http.Header{"X-Forwarded-For": {"203.0.113.9, 10.0.0.1"}}, "203.0.113.9"},
+		{"forwarded for, repeated", true, http.Header{"X-Forwarded-For": {"bogus", "203.0.113.9"}}, "203.0.113.9"},
+		{"forwarded for with port", true, http.Header{"X-Forwarded-For": {"[2001:db8::1]:443"}}, "2001:db8::1"},
+		{"real ip", true, http.Header{"X-Real-Ip": {"203.0.113.10"}}, "203.0.113.10"},
+		{"forwarded for before real ip", true, http.Header{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-Ip": {"203.0.113.10"}}, "203.0.113.9"},
+		{"malformed", true, http.Header{"X-Forwarded-For": {"nope"}}, "192.0.2.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.trustProxy = tt.trustProxy
+			var logs bytes.Buffer
+			h := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/user/1", "")
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			serve(h, r)
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 || recs[0]["remote_addr"] != tt.want {
+				t.Errorf("logged client address, want %s:\n%s", tt.want, logs.String())
+			}
+		})
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		peer      string
+		header    http.Header
+		want      string
+		wantHTTPS bool
+	}{
+		{name: "peer", peer: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "untrusted peer", peer: "198.51.100.7:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-Ip": {"203.0.113.10"}, "X-Forwarded-Proto": {"https"}},
+			want:   "198.51.100.7"},
+		{name: "forwarded for", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9"}}, want: "203.0.113.9"},
+		{name: "spoofed hops on the left", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"1.2.3.4, 203.0.113.9, 10.0.0.5"}}, want: "203.0.113.9"},
+		{name: "repeated headers", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"1.2.3.4", "203.0.113.9, 10.0.0.5"}}, want: "203.0.113.9"},
+		{name: "only proxies", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.0.0.6, 10.0.0.5"}}, want: "10.0.0.6"},
+		{name: "malformed hop", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9, nope"}}, want: "192.0.2.1"},
+		{name: "real ip", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Real-Ip": {"203.0.113.10"}}, want: "203.0.113.10"},
+		{name: "unix socket", peer: unixPeer,
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9"}}, want: "203.0.113.9"},
+		{name: "forwarded https", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-Proto": {"HTTPS"}}, want: "192.0.2.1", wantHTTPS: true},
+		{name: "last proto wins", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-Proto": {"http", "http, https"}}, want: "192.0.2.1", wantHTTPS: true},
+		{name: "forwarded http", peer: "192.0.2.1:1234",
+			header: http.Header{"X-Forwarded-Proto": {"https, http"}}, want: "192.0.2.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := configFromFlags(t, "-trusted-proxies=192.0.2.0/24,10.0.0.0/8")
+			// Set as well, but the list takes precedence.
+			cfg.trustProxy = true
+			var logs bytes.Buffer
+			h := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.RemoteAddr = tt.peer
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			rec := serve(h, r)
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 || recs[0]["remote_addr"] != tt.want {
+				t.Errorf("logged client address, want %s:\n%s", tt.want, logs.String())
+			}
+			if got := rec.Header().Get("Strict-Transport-Security") != ""; got != tt.wantHTTPS {
+				t.Errorf("HSTS set %v, want %v", got, tt.wantHTTPS)
+			}
+		})
+	}
+}
+
+func TestClientIPAllowlist(t *testing.T) {
+	// The allowlist sees the address the log does.
+	for _, tt := range []struct {
+		peer, forwardedFor string
+		wantStatus         int
+	}{
+		{"192.0.2.1:1234", "203.0.113.9", http.StatusOK},
+		{"192.0.2.1:1234", "198.51.100.7", http.StatusForbidden},
+		{"203.0.113.9:1234", "", http.StatusOK},
+		{"198.51.100.7:1234", "203.0.113.9", http.StatusForbidden},
+	} {
+		cfg := configFromFlags(t, "-trusted-proxies=192.0.2.0/24", "-allow-cidr=203.0.113.0/24")
+		h := newTestServer(t, cfg, nil).Handler()
+		r := newRequest(http.MethodGet, "/users", "")
+		r.RemoteAddr = tt.peer
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if rec := serve(h, r); rec.Code != tt.wantStatus {
+			t.Errorf("peer %s forwarding for %q: status = %d, want %d", tt.peer, tt.forwardedFor, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestStripForwarded(t *testing.T) {
+	forwarded := http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.example"},
+		"X-Real-Ip":         {"203.0.113.10"},
+		"X-Request-Id":      {"abc"},
+		"Forwarded":         {"for=203.0.113.9"},
+	}
+	kept := []string{"Forwarded", "X-Request-Id"}
+	all := slices.Sorted(maps.Keys(forwarded))
+	for _, tt := range []struct {
+		name       string
+		trustProxy bool
+		trusted    string
+		peer       string
+		want       []string
+	}{
+		{name: "no proxy trusted", peer: "192.0.2.1:1234", want: kept},
+		{name: "trust proxy", trustProxy: true, peer: "192.0.2.1:1234", want: all},
+		{name: "trusted proxy", trusted: "192.0.2.0/24", peer: "192.0.2.1:1234", want: all},
+		{name: "other peer", trusted: "192.0.2.0/24", peer: "198.51.100.7:1234", want: kept},
+		{name: "list over trust proxy", trustProxy: true, trusted: "192.0.2.0/24", peer: "198.51.100.7:1234", want: kept},
+		{name: "unix socket", trusted: "192.0.2.0/24", peer: unixPeer, want: all},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := configFromFlags(t, "-trusted-proxies="+tt.trusted)
+			cfg.trustProxy = tt.trustProxy
+			s := newTestServer(t, cfg, nil)
+			var got []string
+			h := s.stripForwarded()(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = slices.Sorted(maps.Keys(r.Header))
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/users", nil)
+			r.RemoteAddr = tt.peer
+			r.Header = forwarded.Clone()
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("handler saw %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// limitConcurrency caps the number of requests being handled at once at
+// maxConcurrent, using s.slots as a counting semaphore. A request that finds
+// no free slot waits up to concurrencyWait (or until it is canceled) and is
+// then turned away with a 503.
+func (s *Server) limitConcurrency() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.slots == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.acquireSlot(r) {
+				w.Header().Set("Retry-After", retryAfterUnavailable)
+				s.errorJSON(w, r, http.StatusServiceUnavailable, "server is busy")
+				return
+			}
+			defer func() { <-s.slots }()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) acquireSlot(r *http.Request) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.cfg.concurrencyWait <= 0 {
+		return false
+	}
+
+	t := time.NewTimer(s.cfg.concurrencyWait)
+	defer t.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimitConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wait time.Duration
+		// releaseAfter is when the request holding the only slot finishes.
+		releaseAfter time.Duration
+		wantStatus   int
+	}{
+		{"no wait", 0, 50 * time.Millisecond, http.StatusServiceUnavailable},
+		{"slot frees in time", time.Second, 20 * time.Millisecond, http.StatusOK},
+		{"slot frees too late", 20 * time.Millisecond, 200 * time.Millisecond, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.maxConcurrent = 1
+			cfg.concurrencyWait = tt.wait
+			s := newTestServer(t, cfg, nil)
+			entered, release := make(chan struct{}, 1), make(chan struct{})
+			h := s.limitConcurrency()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/block" {
+					entered <- struct{}{}
+					<-release
+				}
+			}))
+
+			first := make(chan int)
+			go func() { first <- serve(h, httptest.NewRequest(http.MethodGet, "/block", nil)).Code }()
+			<-entered
+			time.AfterFunc(tt.releaseAfter, func() { close(release) })
+
+			rec := serve(h, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+			if code := <-first; code != http.StatusOK {
+				t.Errorf("first request: status = %d", code)
+			}
+		})
+	}
+
+	t.Run("health checks are not limited", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.maxConcurrent = 1
+		s := newTestServer(t, cfg, nil)
+		s.slots <- struct{}{}
+		if code := serve(s.Handler(), newRequest(http.MethodGet, "/healthz", "")).Code; code != http.StatusOK {
+			t.Errorf("/healthz: status = %d", code)
+		}
+		if code := serve(s.Handler(), newRequest(http.MethodGet, "/stats", "")).Code; code != http.StatusServiceUnavailable {
+			t.Errorf("/stats: status = %d, want 503", code)
+		}
+	})
+}
+
+// TestLimitConcurrencyLoad fires more requests than there are slots at a
+// handler that holds on to them, and checks that every request is answered
+// exactly once: by the handler if it got a slot, by a 503 if not.
+func TestLimitConcurrencyLoad(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		slots    int
+		requests int
+	}{
+		{"one slot", 1, 20},
+		{"several slots", 8, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.maxConcurrent = tt.slots
+			s := newTestServer(t, cfg, nil)
+			entered, release := make(chan struct{}, tt.requests), make(chan struct{})
+			// requestLogger counts the requests in flight.
+			h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				entered <- struct{}{}
+				<-release
+			}), s.requestLogger(func(*http.Request) string { return "" }), s.limitConcurrency())
+
+			codes := make(chan int, tt.requests)
+			var wg sync.WaitGroup
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					codes <- serve(h, httptest.NewRequest(http.MethodGet, "/", nil)).Code
+				}()
+			}
+
+			// Nothing is released until everyone without a slot has been
+			// turned away.
+			counts := make(map[int]int)
+			for range tt.requests - tt.slots {
+				counts[<-codes]++
+			}
+			if counts[http.StatusServiceUnavailable] != tt.requests-tt.slots {
+				t.Fatalf("before release: %v, want %d 503s", counts, tt.requests-tt.slots)
+			}
+			for range tt.slots {
+				<-entered
+			}
+			if stats, metrics := inFlight(t, s); stats != int64(tt.slots) || metrics != int64(tt.slots) {
+				t.Errorf("in flight: %d on /stats, %d on /metrics, want %d", stats, metrics, tt.slots)
+			}
+
+			close(release)
+			wg.Wait()
+			close(codes)
+			for code := range codes {
+				counts[code]++
+			}
+			if counts[http.StatusOK] != tt.slots || len(counts) != 2 {
+				t.Errorf("responses: %v, want %d 200s and the rest 503s", counts, tt.slots)
+			}
+			if n := len(entered); n != 0 {
+				t.Errorf("handler ran %d more times than requests were served", n)
+			}
+			if stats, metrics := inFlight(t, s); stats != 0 || metrics != 0 {
+				t.Errorf("in flight afterwards: %d on /stats, %d on /metrics", stats, metrics)
+			}
+		})
+	}
+}
+
+// inFlight returns the in-flight count as /stats and /metrics report it,
+// asking their handlers directly so as not to need a slot.
+func inFlight(t *testing.T, s *Server) (stats, metrics int64) {
+	t.Helper()
+	var resp StatsResponse
+	rec := serve(s.handler(s.handleStats), newRequest(http.MethodGet, "/stats", ""))
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("/stats: %v: %s", err, rec.Body)
+	}
+	rec = serve(s.handler(s.handleMetrics), newRequest(http.MethodGet, "/metrics", ""))
+	for line := range strings.Lines(rec.Body.String()) {
+		if v, ok := strings.CutPrefix(line, "http_requests_in_flight "); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				t.Fatalf("/metrics: %v", err)
+			}
+			return resp.InFlight, n
+		}
+	}
+	t.Fatalf("/metrics has no http_requests_in_flight:\n%s", rec.Body)
+	return 0, 0
+}
+
+func TestMaxConcurrentConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-max-concurrent=0"}, false},
+		{[]string{"-max-concurrent=8"}, false},
+		{[]string{"-max-concurrent=-1"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
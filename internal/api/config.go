@@ -0,0 +1,662 @@
+package api
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+const (
+	storeMemory = "memory"
+	storeSQLite = "sqlite"
+)
+
+// CommandLine holds the flags that select what the program does rather
+// than configure the server, named in commandFlags. They cannot be set
+// from a config file and are not printed by -print-config.
+type CommandLine struct {
+	ConfigFile  string
+	PrintConfig bool
+	GenKey      bool
+}
+
+var commandFlags = []string{"config", "print-config", "gen-key"}
+
+// RegisterFlags defines the flags of cl on fs.
+func (cl *CommandLine) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cl.ConfigFile, "config", "", "YAML or JSON file of settings keyed by flag name; environment variables and flags override it; re-read on SIGHUP")
+	fs.BoolVar(&cl.PrintConfig, "print-config", false, "print the effective configuration, secrets redacted, and exit")
+	fs.BoolVar(&cl.GenKey, "gen-key", false, "print a new random API key and its hashed form, then exit")
+}
+
+// envSettings are the environment variables that override a flag's value
+// from the config file. PORT, as set by PaaS platforms, comes before ADDR
+// so that ADDR wins when both are set.
+var envSettings = []struct{ env, flag string }{
+	{"TRUST_PROXY", "trust-proxy"},
+	{"ALLOWED_HOSTS", "allowed-hosts"},
+	{"SHUTDOWN_TIMEOUT", "shutdown-grace"},
+	{"PRETTY_JSON", "pretty-json"},
+	{"JSON_ESCAPE_HTML", "escape-html"},
+	{"JSON_CASE", "json-case"},
+	{"MAX_CONCURRENT", "max-concurrent"},
+	{"ACCESS_LOG_SAMPLE", "access-log-sample"},
+	{"USER_TTL", "user-ttl"},
+	{"API_KEY_HEADER", "api-key-header"},
+	{"STORE", "store"},
+	{"DB_PATH", "db-path"},
+	{"PORT", "addr"},
+	{"ADDR", "addr"},
+}
+
+// RegisterFlags defines a flag on fs for every setting of c that is not a
+// secret, with c's values as the defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.addr, "addr", c.addr, "listen address, :0 picking a free port, or unix:/path for a Unix socket (env ADDR, or :$PORT if PORT is set)")
+	fs.Var(modeValue{&c.socketMode}, "socket-mode", "permissions of Unix sockets listened on, in octal")
+	fs.StringVar(&c.keysFile, "keys-file", c.keysFile, "file of API keys, one per line, added to those in API_KEYS; re-read on SIGHUP")
+	fs.StringVar(&c.apiKeyHeader, "api-key-header", c.apiKeyHeader, "further header, besides X-API-Key, that API keys are accepted in (env API_KEY_HEADER)")
+	fs.StringVar(&c.storeBackend, "store", c.storeBackend, "where users are kept: memory or sqlite (env STORE)")
+	fs.StringVar(&c.dbPath, "db-path", c.dbPath, "SQLite database file for -store sqlite (env DB_PATH)")
+	fs.DurationVar(&c.userTTL, "user-ttl", c.userTTL, "expire users not updated for this long (0 keeps them; env USER_TTL)")
+	fs.StringVar(&c.authMode, "auth-mode", c.authMode,
+		"how callers authenticate: key (static API keys), jwt (HS256 tokens signed with JWT_SECRET) or mtls (client certificates of the subjects in MTLS_SUBJECTS)")
+	fs.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "serve HTTPS with this certificate file (with -tls-key); re-read on SIGHUP")
+	fs.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "private key file for -tls-cert")
+	fs.Var(listValue{p: &c.acmeDomains, nonEmpty: true}, "acme-domain",
+		"comma-separated domains to obtain certificates for from Let's Encrypt, serving HTTPS (excludes -tls-cert)")
+	fs.StringVar(&c.acmeCache, "acme-cache", c.acmeCache, "directory ACME certificates and keys are kept in")
+	fs.StringVar(&c.acmeEmail, "acme-email", c.acmeEmail, "contact address given to the ACME CA (optional)")
+	fs.StringVar(&c.acmeHTTPAddr, "acme-http-addr", c.acmeHTTPAddr, "plaintext address answering ACME HTTP-01 challenges and redirecting everything else to https")
+	fs.StringVar(&c.clientCA, "client-ca", c.clientCA, "CA bundle client certificates must chain to with -auth-mode mtls")
+	fs.DurationVar(&c.shutdownGrace, "shutdown-grace", c.shutdownGrace,
+		"how long in-flight requests may run after SIGINT/SIGTERM before their connections are closed; a second signal exits at once (env SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&c.drainDelay, "drain-delay", c.drainDelay,
+		"how long /ready reports 503 before the listener closes on shutdown, for load balancers to notice")
+	fs.BoolVar(&c.h2c, "h2c", c.h2c, "also serve HTTP/2 without TLS, by prior knowledge or Upgrade, on the plaintext listener")
+	fs.StringVar(&c.healthAddr, "health-addr", c.healthAddr, "extra plaintext listen address serving only /healthz and /ready (default: none)")
+	fs.StringVar(&c.jwtIssuer, "jwt-issuer", c.jwtIssuer, "required JWT iss claim (default: any)")
+	fs.StringVar(&c.jwtAudience, "jwt-audience", c.jwtAudience, "audience that must be in the JWT aud claim (default: any)")
+	fs.DurationVar(&c.jwtLeeway, "jwt-leeway", c.jwtLeeway, "clock skew allowed when checking JWT exp and nbf")
+	fs.BoolVar(&c.basicAuth, "basic-auth", c.basicAuth,
+		"also accept HTTP Basic auth for the user:key pairs in BASIC_AUTH_USERS")
+	fs.StringVar(&c.auditLog, "audit-log", c.auditLog,
+		"where authentication events are recorded: off, log (main logger) or file (-audit-file)")
+	fs.StringVar(&c.auditPath, "audit-file", c.auditPath, "file audit events are appended to with -audit-log file")
+	fs.IntVar(&c.auditQueue, "audit-queue", c.auditQueue,
+		"audit events, or call log records, buffered before new ones are dropped")
+	fs.StringVar(&c.callLogPath, "call-log", c.callLogPath,
+		"file a JSON line is appended to for every POST, PUT, PATCH and DELETE, with the caller and both bodies (default: none)")
+	fs.BoolVar(&c.callLogReads, "call-log-reads", c.callLogReads, "also record requests other than POST, PUT, PATCH and DELETE, such as GET, in the -call-log")
+	fs.Var(listValue{p: &c.callLogRedact}, "call-log-redact", "comma-separated JSON/form fields blanked out of -call-log bodies")
+	fs.BoolVar(&c.insecureNoAuth, "insecure-no-auth", c.insecureNoAuth,
+		"serve the API without authentication")
+	fs.StringVar(&c.logFormat, "log-format", c.logFormat, "log output format: json or text")
+	fs.StringVar(&c.logLevel, "log-level", c.logLevel, "minimum log level: debug, info, warn or error")
+	fs.BoolVar(&c.compatCreated, "compat-created", c.compatCreated,
+		`include the deprecated "created" field in POST /user responses`)
+	fs.BoolVar(&c.envelope, "envelope", c.envelope,
+		`wrap responses as {"data": ..., "error": ...}`)
+	fs.BoolVar(&c.escapeHTML, "escape-html", c.escapeHTML,
+		"escape <, > and & in JSON responses; API-only deployments can turn it off for cleaner output (env JSON_ESCAPE_HTML)")
+	fs.BoolVar(&c.prettyJSON, "pretty-json", c.prettyJSON,
+		"indent JSON responses unless the request asks otherwise with ?pretty= (env PRETTY_JSON)")
+	fs.StringVar(&c.jsonCase, "json-case", c.jsonCase,
+		"naming of JSON response fields: snake (user_id) or camel (userId) (env JSON_CASE)")
+	fs.BoolVar(&c.maintenance, "maintenance", c.maintenance,
+		"answer API requests with 503, for instance while the store is worked on; can be switched on SIGHUP")
+	fs.Float64Var(&c.rateLimit, "rate", c.rateLimit,
+		"requests per second allowed per API key (0 disables rate limiting)")
+	fs.IntVar(&c.rateBurst, "burst", c.rateBurst,
+		"maximum burst of requests per API key")
+	fs.IntVar(&c.authMaxFailures, "auth-max-failures", c.authMaxFailures,
+		"failed authentications per client before it is blocked (0 disables)")
+	fs.DurationVar(&c.authFailureWindow, "auth-failure-window", c.authFailureWindow,
+		"window in which failed authentications are counted")
+	fs.DurationVar(&c.authCooldown, "auth-cooldown", c.authCooldown,
+		"how long a client stays blocked after too many failed authentications")
+	sh := &c.securityHeaders
+	fs.StringVar(&sh.contentTypeOptions, "header-content-type-options", sh.contentTypeOptions,
+		"X-Content-Type-Options value (empty disables)")
+	fs.StringVar(&sh.frameOptions, "header-frame-options", sh.frameOptions,
+		"X-Frame-Options value (empty disables)")
+	fs.StringVar(&sh.referrerPolicy, "header-referrer-policy", sh.referrerPolicy,
+		"Referrer-Policy value (empty disables)")
+	fs.StringVar(&sh.hsts, "hsts", sh.hsts,
+		"Strict-Transport-Security value for TLS responses (empty disables)")
+	fs.StringVar(&sh.cacheControl, "header-cache-control", sh.cacheControl,
+		"default Cache-Control for authenticated responses (empty disables)")
+	fs.Var(listValue{p: &c.corsOrigins}, "cors-origins",
+		"comma-separated origins allowed to make CORS requests (https://*.example.com matches subdomains)")
+	fs.Var(listValue{p: &c.corsMethods}, "cors-methods", "comma-separated methods allowed in CORS requests")
+	fs.Var(listValue{p: &c.corsHeaders}, "cors-headers", "comma-separated request headers allowed in CORS requests")
+	fs.DurationVar(&c.corsMaxAge, "cors-max-age", c.corsMaxAge,
+		"how long browsers may cache a CORS preflight response")
+	fs.DurationVar(&c.requestTimeout, "request-timeout", c.requestTimeout,
+		"maximum time a request may take before it is answered with 503 (0 disables)")
+	fs.StringVar(&c.timeoutMode, "timeout-mode", c.timeoutMode,
+		"how -request-timeout is enforced: context (handler context deadline) or handler (http.TimeoutHandler)")
+	fs.StringVar(&c.trailingSlash, "trailing-slash", c.trailingSlash,
+		"what happens to paths ending in a slash: redirect (308 to the path without it) or strip (served as if sent without)")
+	fs.DurationVar(&c.readHeaderTimeout, "read-header-timeout", c.readHeaderTimeout,
+		"maximum time to read a request's headers")
+	fs.DurationVar(&c.readTimeout, "read-timeout", c.readTimeout,
+		"maximum time to read a whole request, body included (0 disables)")
+	fs.DurationVar(&c.writeTimeout, "write-timeout", c.writeTimeout,
+		"maximum time to write a response; keep it above -request-timeout (0 disables)")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", c.idleTimeout,
+		"how long an idle keep-alive connection is kept open")
+	fs.IntVar(&c.maxHeaderBytes, "max-header-bytes", c.maxHeaderBytes,
+		"largest request head accepted, in bytes")
+	fs.BoolVar(&c.debugHTTP, "debug-http", c.debugHTTP,
+		"log request and response bodies (redacted) with each request")
+	fs.IntVar(&c.debugBodyLimit, "debug-body-limit", c.debugBodyLimit,
+		"maximum number of body bytes logged per request and response by -debug-http")
+	fs.Var(listValue{p: &c.debugRedact}, "debug-redact", "comma-separated JSON/form fields blanked out by -debug-http")
+	fs.Var(listValue{p: &c.authExempt}, "auth-exempt", "comma-separated paths or path prefixes that need no API key")
+	fs.BoolVar(&c.enablePprof, "enable-pprof", c.enablePprof, "serve runtime profiles under /debug/pprof/ to keys with the admin scope")
+	fs.Var(bucketsValue{&c.metricsBuckets}, "metrics-buckets",
+		"comma-separated upper bounds, in seconds, of the request latency histogram on /metrics")
+	fs.Var(cidrValue{&c.allowCIDRs}, "allow-cidr", "comma-separated CIDRs allowed to use the API (default: any)")
+	fs.Var(listValue{p: &c.allowedHosts}, "allowed-hosts",
+		"comma-separated Host header values accepted, *.example.com matching subdomains (default: any; env ALLOWED_HOSTS)")
+	fs.Int64Var(&c.maxBody, "max-body", c.maxBody, "largest request body accepted, in bytes (0 is unlimited)")
+	fs.IntVar(&c.maxConcurrent, "max-concurrent", c.maxConcurrent,
+		"maximum number of API requests handled at once (0 is unlimited; env MAX_CONCURRENT)")
+	fs.DurationVar(&c.concurrencyWait, "concurrency-wait", c.concurrencyWait,
+		"how long a request waits for a free slot before getting 503 (0 rejects immediately)")
+	fs.IntVar(&c.accessLogSample, "access-log-sample", c.accessLogSample,
+		"log one in this many successful requests; errors are always logged (env ACCESS_LOG_SAMPLE)")
+	fs.DurationVar(&c.slowThreshold, "slow-threshold", c.slowThreshold,
+		"log requests taking longer than this at WARN level as slow, with their store calls (0 disables)")
+	fs.Float64Var(&c.slowStackFactor, "slow-stack-factor", c.slowStackFactor,
+		"also log the goroutine stacks of a request still running at this multiple of -slow-threshold, at most once a minute (0 disables)")
+	fs.StringVar(&c.accessLogPath, "access-log", c.accessLogPath,
+		"file the access log is written to instead of stderr; reopened on SIGUSR1")
+	fs.Int64Var(&c.accessLogMaxSize, "access-log-max-size", c.accessLogMaxSize,
+		"size in bytes at which -access-log is rotated (0 never rotates)")
+	fs.IntVar(&c.accessLogKeep, "access-log-keep", c.accessLogKeep,
+		"number of rotated -access-log files kept")
+	fs.IntVar(&c.accessLogBuffer, "access-log-buffer", c.accessLogBuffer,
+		"queue up to this many access log records for a background writer (0 writes them inline)")
+	fs.IntVar(&c.pageLimit, "page-limit", c.pageLimit, "default page size of GET /users")
+	fs.IntVar(&c.maxPageLimit, "max-page-limit", c.maxPageLimit, "largest page size GET /users returns; bigger limits are clamped")
+	fs.IntVar(&c.maxBatch, "max-batch", c.maxBatch, "most users POST /users accepts in one request")
+	fs.DurationVar(&c.idempotencyTTL, "idempotency-ttl", c.idempotencyTTL,
+		"how long responses are kept for replay by Idempotency-Key")
+	fs.IntVar(&c.idempotencyMaxKeys, "idempotency-max-keys", c.idempotencyMaxKeys,
+		"maximum number of Idempotency-Key responses kept")
+	fs.BoolVar(&c.trustProxy, "trust-proxy", c.trustProxy,
+		"take the client address from X-Forwarded-For/X-Real-IP (env TRUST_PROXY)")
+	fs.Var(cidrValue{&c.trustedProxies}, "trusted-proxies", "comma-separated CIDRs of proxies whose X-Forwarded-For, X-Real-IP and X-Forwarded-Proto are honoured")
+}
+
+// Load fills in c, whose flags are registered on fs and already parsed
+// from args once: the settings in file, if any, are overridden by
+// envSettings, which are overridden by the flags in args, and the secrets
+// come from the environment. c remembers args for SIGHUP to read it all
+// again.
+func (c *Config) Load(fs *flag.FlagSet, file string, args []string) error {
+	if err := loadConfig(fs, file, args); err != nil {
+		return err
+	}
+	if err := c.loadSecrets(); err != nil {
+		return err
+	}
+	c.args, c.settings = args, settingValues(fs)
+	return nil
+}
+
+// OpenStore opens the store c.storeBackend names, telling the time by
+// now. The SQLite store is an io.Closer, to be closed when done.
+func (c *Config) OpenStore(now func() time.Time) (store.Store, error) {
+	if c.storeBackend == storeSQLite {
+		return store.OpenSQLite(c.dbPath, c.userTTL, now)
+	}
+	return store.NewMemory(c.userTTL, now), nil
+}
+
+// loadConfig merges the settings registered on fs, already parsed from
+// args once: the values in file, if any, are overridden by envSettings,
+// which are overridden by the flags in args.
+func loadConfig(fs *flag.FlagSet, file string, args []string) error {
+	if file != "" {
+		if err := loadConfigFile(fs, file); err != nil {
+			return err
+		}
+	}
+	for _, e := range envSettings {
+		v := os.Getenv(e.env)
+		if v == "" {
+			continue
+		}
+		if e.env == "PORT" {
+			v = ":" + v
+		}
+		if err := fs.Set(e.flag, v); err != nil {
+			return fmt.Errorf("%s: %w", e.env, err)
+		}
+	}
+	return fs.Parse(args)
+}
+
+// readConfig loads the configuration afresh, as main does at startup,
+// from args, the config file they name and the environment. It returns the
+// flag set holding the merged settings, for settingValues.
+func readConfig(args []string) (Config, *flag.FlagSet, error) {
+	c := DefaultConfig()
+	var cl CommandLine
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c.RegisterFlags(fs)
+	cl.RegisterFlags(fs)
+	err := fs.Parse(args)
+	if err == nil {
+		err = loadConfig(fs, cl.ConfigFile, args)
+	}
+	if err == nil {
+		err = c.loadSecrets()
+	}
+	if err == nil {
+		err = c.Validate()
+	}
+	return c, fs, err
+}
+
+// settingValues maps the name of every setting on fs to its value, as the
+// flag formats it.
+func settingValues(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !slices.Contains(commandFlags, f.Name) {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// loadConfigFile sets flags on fs from a YAML or JSON file mapping flag
+// names to values. Lists may be given as sequences or comma-separated
+// strings.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Values are taken as written rather than as YAML resolves them, so
+	// that 0660 stays octal and 1.10 does not become 1.1.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	settings := doc.Content[0]
+	if settings.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: want a mapping of setting names to values", path)
+	}
+	for i := 0; i+1 < len(settings.Content); i += 2 {
+		name := settings.Content[i].Value
+		if fs.Lookup(name) == nil || slices.Contains(commandFlags, name) {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, settings.Content[i].Line, name)
+		}
+		s, err := settingString(settings.Content[i+1])
+		if err == nil {
+			err = fs.Set(name, s)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, settings.Content[i].Line, name, err)
+		}
+	}
+	return nil
+}
+
+// settingString turns a value from a config file into the string its flag
+// parses: a scalar as written, or a list joined with commas.
+func settingString(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return "", nil
+		}
+		return n.Value, nil
+	case yaml.SequenceNode:
+		items := make([]string, len(n.Content))
+		for i, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("lists must not be nested")
+			}
+			items[i] = item.Value
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("want a value or a list")
+	}
+}
+
+// loadSecrets fills in the settings that only come from the environment,
+// and the keys from keysFile, none of which are printed by -print-config.
+func (c *Config) loadSecrets() error {
+	var err error
+	if c.apiKeys, err = loadKeys(os.Getenv("API_KEYS"), c.keysFile); err != nil {
+		return err
+	}
+	c.jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	c.metricsToken = []byte(os.Getenv("METRICS_TOKEN"))
+	if c.basicAuth {
+		if c.basicUsers, err = parseBasicUsers(os.Getenv("BASIC_AUTH_USERS")); err != nil {
+			return err
+		}
+	}
+	if c.authMode == authModeMTLS {
+		if c.certSubjects, err = parseCertSubjects(os.Getenv("MTLS_SUBJECTS")); err != nil {
+			return err
+		}
+	}
+	c.apiKeyHeader = http.CanonicalHeaderKey(strings.TrimSpace(c.apiKeyHeader))
+	if c.apiKeyHeader != "" && !slices.Contains(c.corsHeaders, c.apiKeyHeader) {
+		c.corsHeaders = append(c.corsHeaders, c.apiKeyHeader)
+	}
+	return nil
+}
+
+// Validate reports the first setting that is invalid or contradicts
+// another, so that it is caught before anything is opened or listened on.
+func (c Config) Validate() error {
+	switch {
+	case !validHeaderName(c.apiKeyHeader):
+		return fmt.Errorf("invalid API key header %q", c.apiKeyHeader)
+	case c.auditLog != auditOff && c.auditLog != auditLog && c.auditLog != auditFile:
+		return fmt.Errorf("invalid audit log %q", c.auditLog)
+	case c.basicAuth && len(c.basicUsers) == 0:
+		return errors.New("BASIC_AUTH_USERS must be set with -basic-auth")
+	case c.logFormat != "json" && c.logFormat != "text":
+		return fmt.Errorf("invalid log format %q", c.logFormat)
+	case c.jsonCase != jsonCaseSnake && c.jsonCase != jsonCaseCamel:
+		return fmt.Errorf("invalid JSON case %q: want snake or camel", c.jsonCase)
+	case c.timeoutMode != timeoutModeContext && c.timeoutMode != timeoutModeHandler:
+		return fmt.Errorf("invalid timeout mode %q", c.timeoutMode)
+	case c.trailingSlash != trailingSlashRedirect && c.trailingSlash != trailingSlashStrip:
+		return fmt.Errorf("invalid trailing slash policy %q: want redirect or strip", c.trailingSlash)
+	case c.authMode != authModeKey && c.authMode != authModeJWT && c.authMode != authModeMTLS:
+		return fmt.Errorf("invalid auth mode %q", c.authMode)
+	case c.storeBackend != storeMemory && c.storeBackend != storeSQLite:
+		return fmt.Errorf("invalid store %q: want memory or sqlite", c.storeBackend)
+	case c.storeBackend == storeSQLite && c.dbPath == "":
+		return errors.New("-db-path (DB_PATH) must be set with -store sqlite")
+	case c.rateLimit < 0:
+		return errors.New("-rate must not be negative")
+	case c.rateBurst < 1:
+		return errors.New("-burst must be at least 1")
+	case c.auditQueue < 0:
+		return errors.New("-audit-queue must not be negative")
+	case c.maxConcurrent < 0:
+		return errors.New("-max-concurrent must not be negative")
+	case c.idempotencyTTL <= 0:
+		return errors.New("-idempotency-ttl must be positive")
+	case c.idempotencyMaxKeys < 1:
+		return errors.New("-idempotency-max-keys must be at least 1")
+	case c.shutdownGrace < 0 || c.drainDelay < 0:
+		return errors.New("-shutdown-grace and -drain-delay must not be negative")
+	case c.pageLimit < 1 || c.maxPageLimit < 1:
+		return errors.New("-page-limit and -max-page-limit must be at least 1")
+	case c.pageLimit > c.maxPageLimit:
+		return errors.New("-page-limit must not be above -max-page-limit")
+	case c.maxBatch < 1:
+		return errors.New("-max-batch must be at least 1")
+	case c.accessLogMaxSize < 0 || c.accessLogKeep < 0:
+		return errors.New("-access-log-max-size and -access-log-keep must not be negative")
+	case c.slowThreshold < 0 || c.slowStackFactor < 0:
+		return errors.New("-slow-threshold and -slow-stack-factor must not be negative")
+	case c.userTTL < 0:
+		return errors.New("-user-ttl must not be negative")
+	case (c.tlsCert == "") != (c.tlsKey == ""):
+		return errors.New("-tls-cert and -tls-key must be set together")
+	case c.h2c && (c.tlsCert != "" || len(c.acmeDomains) > 0):
+		return errors.New("-h2c is for plaintext listeners; HTTPS negotiates HTTP/2 already")
+	case len(c.acmeDomains) > 0 && c.tlsCert != "":
+		return errors.New("-acme-domain and -tls-cert are mutually exclusive: certificates come either from ACME or from files")
+	case c.authMode == authModeMTLS && (c.tlsCert == "" && len(c.acmeDomains) == 0 || c.clientCA == ""):
+		return errors.New("-tls-cert, -tls-key and -client-ca must be set with -auth-mode mtls")
+	}
+	if _, err := parseLogLevel(c.logLevel); err != nil {
+		return err
+	}
+	if err := checkAddr(c.addr); err != nil {
+		return err
+	}
+	if c.healthAddr != "" {
+		if err := checkAddr(c.healthAddr); err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.insecureNoAuth:
+	case c.authMode == authModeKey && len(c.apiKeys) == 0:
+		return errNoKeys
+	case c.authMode == authModeJWT && len(c.jwtSecret) == 0:
+		return errors.New("JWT_SECRET must be set with -auth-mode jwt")
+	case c.authMode == authModeMTLS && len(c.certSubjects) == 0:
+		return errors.New("MTLS_SUBJECTS must be set with -auth-mode mtls")
+	}
+	return nil
+}
+
+// checkAddr rejects listen addresses that are not host:port with a numeric
+// port or unixPrefix and a path, before anything is started.
+func checkAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("invalid listen address %q: no socket path", addr)
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid listen address %q: bad port", addr)
+	}
+	return nil
+}
+
+// PrintConfig writes the settings of fs, as merged into c, in the format
+// -config reads. Secrets are only summarised, in comments. Empty lists are
+// left out, since the file format cannot tell them from unset ones.
+func PrintConfig(w io.Writer, fs *flag.FlagSet, c Config) error {
+	settings := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(commandFlags, f.Name) {
+			return
+		}
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case time.Duration:
+			settings[f.Name] = v.String()
+		case []string:
+			if len(v) > 0 {
+				settings[f.Name] = v
+			}
+		default:
+			settings[f.Name] = v
+		}
+	})
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# API keys (API_KEYS, -keys-file): %d, redacted\n", len(c.apiKeys))
+	if len(c.jwtSecret) > 0 {
+		fmt.Fprintln(w, "# JWT_SECRET: set, redacted")
+	}
+	if len(c.metricsToken) > 0 {
+		fmt.Fprintln(w, "# METRICS_TOKEN: set, redacted")
+	}
+	if len(c.basicUsers) > 0 {
+		names := make([]string, len(c.basicUsers))
+		for i, u := range c.basicUsers {
+			names[i] = u.name
+		}
+		fmt.Fprintf(w, "# BASIC_AUTH_USERS: %s, keys redacted\n", strings.Join(names, ", "))
+	}
+	if len(c.certSubjects) > 0 {
+		names := make([]string, len(c.certSubjects))
+		for i, sub := range c.certSubjects {
+			names[i] = sub.name
+		}
+		fmt.Fprintf(w, "# MTLS_SUBJECTS: %s\n", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// listValue is a flag holding a comma-separated list. With nonEmpty, the
+// list has to have at least one item.
+type listValue struct {
+	p        *[]string
+	nonEmpty bool
+}
+
+func (v listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v listValue) Set(s string) error {
+	list := splitList(s)
+	if v.nonEmpty && len(list) == 0 {
+		return errors.New("empty list")
+	}
+	*v.p = list
+	return nil
+}
+
+func (v listValue) Get() any { return *v.p }
+
+// cidrValue is a flag holding a comma-separated list of CIDRs, as parsed
+// by parseCIDRs.
+type cidrValue struct {
+	p *[]netip.Prefix
+}
+
+func (v cidrValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(v.strings(), ",")
+}
+
+func (v cidrValue) strings() []string {
+	out := make([]string, len(*v.p))
+	for i, p := range *v.p {
+		out[i] = p.String()
+	}
+	return out
+}
+
+func (v cidrValue) Set(s string) error {
+	p, err := parseCIDRs(s)
+	if err != nil {
+		return err
+	}
+	*v.p = p
+	return nil
+}
+
+func (v cidrValue) Get() any { return v.strings() }
+
+// bucketsValue is a flag holding histogram bucket bounds: a
+// comma-separated list of positive numbers in increasing order.
+type bucketsValue struct {
+	p *[]float64
+}
+
+func (v bucketsValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(v.strings(), ",")
+}
+
+func (v bucketsValue) strings() []string {
+	out := make([]string, len(*v.p))
+	for i, b := range *v.p {
+		out[i] = formatFloat(b)
+	}
+	return out
+}
+
+func (v bucketsValue) Set(s string) error {
+	var buckets []float64
+	for _, item := range splitList(s) {
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil || b <= 0 || math.IsInf(b, 0) {
+			return fmt.Errorf("invalid bucket %q: want a positive number of seconds", item)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return errors.New("buckets must be in increasing order")
+		}
+		buckets = append(buckets, b)
+	}
+	if len(buckets) == 0 {
+		return errors.New("empty list")
+	}
+	*v.p = buckets
+	return nil
+}
+
+func (v bucketsValue) Get() any { return v.strings() }
+
+// modeValue is a flag holding file permissions, written in octal.
+type modeValue struct {
+	p *os.FileMode
+}
+
+func (v modeValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(*v.p))
+}
+
+func (v modeValue) Set(s string) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil || n&^0o777 != 0 {
+		return errors.New("want octal permissions such as 0660")
+	}
+	*v.p = os.FileMode(n)
+	return nil
+}
+
+func (v modeValue) Get() any { return v.String() }
+
+// splitList splits a comma-separated setting into its non-empty, trimmed items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestAddrPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		port, addr string
+		args       []string
+		want       string
+	}{
+		{"default", "", "", nil, DefaultConfig().addr},
+		{"PORT", "9000", "", nil, ":9000"},
+		{"ADDR over PORT", "9000", "127.0.0.1:7000", nil, "127.0.0.1:7000"},
+		{"flag over PORT", "9000", "", []string{"-addr=:6000"}, ":6000"},
+		{"flag over both", "9000", ":7000", []string{"-addr=:6000"}, ":6000"},
+		{"flag set to the default", "9000", ":7000", []string{"-addr=:8080"}, ":8080"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			t.Setenv("PORT", tt.port)
+			t.Setenv("ADDR", tt.addr)
+			cfg, _, err := readConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.addr != tt.want {
+				t.Errorf("addr = %q, want %q", cfg.addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr    string
+		wantErr bool
+	}{
+		{":8080", false},
+		{":0", false},
+		{"127.0.0.1:7000", false},
+		{"[::1]:7000", false},
+		{"localhost:65535", false},
+		{unixPrefix + "/run/api.sock", false},
+		{"8080", true},
+		{"localhost", true},
+		{":http", true},
+		{":65536", true},
+		{":-1", true},
+		{unixPrefix, true},
+	} {
+		if err := checkAddr(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("checkAddr(%q) = %v, want error %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name          string
+		store, dbPath string
+		args          []string
+		wantErr       bool
+		wantSQLite    bool
+	}{
+		{name: "default"},
+		{name: "memory", store: "memory"},
+		{name: "sqlite", store: "sqlite", dbPath: filepath.Join(dir, "users.db"), wantSQLite: true},
+		{name: "flags", args: []string{"-store=sqlite", "-db-path=" + filepath.Join(dir, "flags.db")}, wantSQLite: true},
+		{name: "sqlite without a path", store: "sqlite", wantErr: true},
+		{name: "unknown", store: "redis", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			t.Setenv("STORE", tt.store)
+			t.Setenv("DB_PATH", tt.dbPath)
+			cfg, _, err := readConfig(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			st, err := cfg.OpenStore(time.Now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c, ok := st.(io.Closer); ok {
+				defer c.Close()
+			}
+			if _, isSQLite := st.(*store.SQLite); isSQLite != tt.wantSQLite {
+				t.Errorf("opened a %T", st)
+			}
+		})
+	}
+}
+
+// writeConfigFile writes content to a config file called name and
+// returns its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigSources(t *testing.T) {
+	type want struct {
+		addr    string
+		rate    float64
+		origins []string
+		mode    os.FileMode
+	}
+	defaults := DefaultConfig()
+	for _, tt := range []struct {
+		name          string
+		file, content string
+		env           map[string]string
+		args          []string
+		want          want
+	}{
+		{name: "defaults",
+			want: want{defaults.addr, defaults.rateLimit, nil, defaults.socketMode}},
+		{name: "YAML file", file: "config.yaml",
+			content: "addr: 127.0.0.1:7000\nrate: 2.5\ncors-origins:\n  - https://a.example\n  - https://b.example\nsocket-mode: 0640\n",
+			want:    want{"127.0.0.1:7000", 2.5, []string{"https://a.example", "https://b.example"}, 0o640}},
+		{name: "JSON file", file: "config.json",
+			content: `{"addr": ":7000", "rate": 3, "cors-origins": "https://a.example,https://b.example"}`,
+			want:    want{":7000", 3, []string{"https://a.example", "https://b.example"}, defaults.socketMode}},
+		{name: "env over file", file: "config.yaml", content: "addr: :7000\nrate: 3\n",
+			env:  map[string]string{"PORT": "9000"},
+			want: want{":9000", 3, nil, defaults.socketMode}},
+		{name: "flags over env and file", file: "config.yaml", content: "addr: :7000\nrate: 3\n",
+			env: map[string]string{"ADDR": ":9000"}, args: []string{"-addr=:6000", "-rate=4"},
+			want: want{":6000", 4, nil, defaults.socketMode}},
+		{name: "empty file", file: "config.yaml",
+			want: want{defaults.addr, defaults.rateLimit, nil, defaults.socketMode}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			t.Setenv("PORT", "")
+			t.Setenv("ADDR", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file, tt.content)}, args...)
+			}
+			cfg, _, err := readConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := want{cfg.addr, cfg.rateLimit, cfg.corsOrigins, cfg.socketMode}
+			if got.addr != tt.want.addr || got.rate != tt.want.rate || !slices.Equal(got.origins, tt.want.origins) || got.mode != tt.want.mode {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, content string
+		// wantErr is part of the error expected.
+		wantErr string
+	}{
+		{"unknown setting", "addr: :7000\nport: 7000\n", `:2: unknown setting "port"`},
+		{"command flag", "print-config: true\n", `unknown setting "print-config"`},
+		{"bad value", "rate: fast\n", ":1: rate:"},
+		{"nested list", "cors-origins:\n  - [a, b]\n", "lists must not be nested"},
+		{"mapping value", "cors-origins:\n  a: b\n", "want a value or a list"},
+		{"not a mapping", "- addr\n", "want a mapping"},
+		{"malformed", "addr: [\n", "config.yaml"},
+		{"contradictory", "tls-cert: cert.pem\n", "-tls-cert and -tls-key must be set together"},
+		{"sqlite without a path", "store: sqlite\n", "-db-path (DB_PATH) must be set"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			_, _, err := readConfig([]string{"-config", writeConfigFile(t, "config.yaml", tt.content)})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one saying %q", err, tt.wantErr)
+			}
+		})
+	}
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("API_KEYS", testKey)
+		if _, _, err := readConfig([]string{"-config", filepath.Join(t.TempDir(), "nope.yaml")}); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("err = %v, want it not to exist", err)
+		}
+	})
+}
+
+func TestPrintConfig(t *testing.T) {
+	const secret = "jwt-secret-that-is-long-enough-to-sign"
+	t.Setenv("API_KEYS", testKey+",other-key")
+	t.Setenv("JWT_SECRET", secret)
+	t.Setenv("PORT", "9000")
+	cfg, flags, err := readConfig([]string{"-rate=2", "-cors-origins=https://a.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := PrintConfig(&out, flags, cfg); err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+	for _, s := range []string{testKey, "other-key", secret} {
+		if strings.Contains(printed, s) {
+			t.Errorf("printed a secret:\n%s", printed)
+		}
+	}
+	for _, s := range []string{"addr: :9000\n", "rate: 2\n", "# API keys (API_KEYS, -keys-file): 2, redacted\n", "# JWT_SECRET: set, redacted\n"} {
+		if !strings.Contains(printed, s) {
+			t.Errorf("printed config lacks %q:\n%s", s, printed)
+		}
+	}
+
+	// What is printed reads back as the same configuration.
+	t.Setenv("PORT", "")
+	_, again, err := readConfig([]string{"-config", writeConfigFile(t, "config.yaml", printed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := settingValues(flags), settingValues(again); !maps.Equal(got, want) {
+		for name, v := range want {
+			if got[name] != v {
+				t.Errorf("%s = %q read back, want %q", name, got[name], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser scripts may read.
+var corsExposedHeaders = strings.Join([]string{"ETag", "Location", "Retry-After", requestIDHeader}, ", ")
+
+// originAllowed matches origin against the origins allowed. An entry like
+// https://*.example.com allows any subdomain of example.com over https, but
+// not example.com itself.
+func originAllowed(origins []string, origin string) bool {
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		prefix := scheme + "://"
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+host) &&
+			len(origin) > len(prefix)+len(host)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// cors answers preflight requests itself, so they never reach the API key
+// check or the method dispatch, and adds Access-Control-Allow-Origin to
+// responses for allowed origins. Other origins just get no CORS headers,
+// and with no origins configured CORS is not handled at all.
+func (s *Server) cors() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origins := s.live.Load().corsOrigins
+			origin := r.Header.Get("Origin")
+			if origin == "" || len(origins) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			allowed := originAllowed(origins, origin)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				if allowed {
+					h.Set("Access-Control-Allow-Origin", origin)
+					h.Set("Access-Control-Allow-Methods", strings.Join(s.cfg.corsMethods, ", "))
+					if r.Header.Get("Access-Control-Request-Headers") != "" {
+						h.Set("Access-Control-Allow-Headers", strings.Join(s.cfg.corsHeaders, ", "))
+					}
+					if s.cfg.corsMaxAge > 0 {
+						h.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cfg.corsMaxAge.Seconds())))
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if allowed {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
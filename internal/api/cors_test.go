@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	origins := []string{"https://app.example.com", "https://*.example.org"}
+	for _, tt := range []struct {
+		name       string
+		origins    []string
+		method     string
+		header     map[string]string
+		wantStatus int
+		want       map[string]string
+	}{
+		{"no origin", origins, "GET", nil, 200, map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""}},
+		{"allowed", origins, "GET", map[string]string{"Origin": "https://app.example.com"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Expose-Headers": corsExposedHeaders, "Vary": "Origin",
+		}},
+		{"subdomain", origins, "GET", map[string]string{"Origin": "https://a.b.example.org"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "https://a.b.example.org",
+		}},
+		{"not the bare domain", origins, "GET", map[string]string{"Origin": "https://example.org"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "Origin",
+		}},
+		{"other scheme", origins, "GET", map[string]string{"Origin": "http://app.example.com"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+		{"disabled", nil, "GET", map[string]string{"Origin": "https://app.example.com"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "", "Vary": "",
+		}},
+		{"wildcard", []string{"*"}, "GET", map[string]string{"Origin": "https://anywhere.test"}, 200, map[string]string{
+			"Access-Control-Allow-Origin": "https://anywhere.test",
+		}},
+		{"preflight", origins, "OPTIONS", map[string]string{
+			"Origin": "https://app.example.com", "Access-Control-Request-Method": "PATCH", "Access-Control-Request-Headers": "x-api-key",
+		}, 204, map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "GET, POST, PATCH, DELETE",
+			"Access-Control-Max-Age":       "600",
+		}},
+		{"preflight from another origin", origins, "OPTIONS", map[string]string{
+			"Origin": "https://evil.test", "Access-Control-Request-Method": "PATCH",
+		}, 204, map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""}},
+		{"not a preflight", origins, "OPTIONS", map[string]string{"Origin": "https://app.example.com"}, 401, map[string]string{
+			"Access-Control-Allow-Origin": "https://app.example.com",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.corsOrigins = tt.origins
+			s := newTestServer(t, cfg, nil)
+			s.users.Create(context.Background(), "Ann", "")
+			h := s.Handler()
+			// Preflights carry no credentials.
+			r := newRequest(tt.method, "/user/1", "")
+			if tt.method == http.MethodOptions {
+				r.Header.Del("X-API-Key")
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if allow := rec.Header().Get("Access-Control-Allow-Headers"); tt.name == "preflight" && allow == "" {
+				t.Error("preflight asking for headers got no Access-Control-Allow-Headers")
+			}
+		})
+	}
+}
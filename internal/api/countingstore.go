@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// storeCounters count the calls made to a Store, and how many of them
+// failed. Outcomes a client causes, such as ErrNotFound or an update
+// rejected by its own function, are not failures.
+type storeCounters struct {
+	ops    atomic.Int64
+	errors atomic.Int64
+}
+
+// countingStore is a Store that keeps storeCounters for the one it wraps,
+// and records the time each call takes in the caller's storeTimings.
+type countingStore struct {
+	store.Store
+	c *storeCounters
+}
+
+// storeFailure reports whether err is a failure of the store rather than
+// an outcome the client caused.
+func storeFailure(err error) bool {
+	return err != nil && !errors.Is(err, store.ErrNotFound) && !errors.Is(err, store.ErrConflict) && !errors.Is(err, store.ErrPrecondition)
+}
+
+// done counts a call to op that started at start, and records how long it
+// took for the slow request log.
+func (cs countingStore) done(ctx context.Context, op string, start time.Time, err error) {
+	recordStoreTiming(ctx, op, time.Since(start))
+	cs.c.ops.Add(1)
+	if storeFailure(err) {
+		cs.c.errors.Add(1)
+	}
+}
+
+func (cs countingStore) Create(ctx context.Context, name, email string) (store.User, error) {
+	start := time.Now()
+	u, err := cs.Store.Create(ctx, name, email)
+	cs.done(ctx, "Create", start, err)
+	return u, err
+}
+
+func (cs countingStore) Get(ctx context.Context, id int64) (store.User, error) {
+	start := time.Now()
+	u, err := cs.Store.Get(ctx, id)
+	cs.done(ctx, "Get", start, err)
+	return u, err
+}
+
+func (cs countingStore) Update(ctx context.Context, id int64, fn func(*store.User) error) (store.User, error) {
+	start := time.Now()
+	var fnErr error
+	u, err := cs.Store.Update(ctx, id, func(u *store.User) error {
+		fnErr = fn(u)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		// Rejected by fn: the call does not count as failed.
+		cs.done(ctx, "Update", start, nil)
+	} else {
+		cs.done(ctx, "Update", start, err)
+	}
+	return u, err
+}
+
+func (cs countingStore) Delete(ctx context.Context, id int64) error {
+	start := time.Now()
+	err := cs.Store.Delete(ctx, id)
+	cs.done(ctx, "Delete", start, err)
+	return err
+}
+
+func (cs countingStore) List(ctx context.Context) ([]store.User, error) {
+	start := time.Now()
+	users, err := cs.Store.List(ctx)
+	cs.done(ctx, "List", start, err)
+	return users, err
+}
+
+func (cs countingStore) ListAfter(ctx context.Context, afterID int64, limit int) ([]store.User, error) {
+	start := time.Now()
+	users, err := cs.Store.ListAfter(ctx, afterID, limit)
+	cs.done(ctx, "ListAfter", start, err)
+	return users, err
+}
+
+func (cs countingStore) Count(ctx context.Context) (int, error) {
+	start := time.Now()
+	n, err := cs.Store.Count(ctx)
+	cs.done(ctx, "Count", start, err)
+	return n, err
+}
+
+func (cs countingStore) Load(ctx context.Context, users []store.User, replace bool) error {
+	start := time.Now()
+	err := cs.Store.Load(ctx, users, replace)
+	cs.done(ctx, "Load", start, err)
+	return err
+}
+
+func (cs countingStore) Expire(ctx context.Context) (int, error) {
+	start := time.Now()
+	n, err := cs.Store.Expire(ctx)
+	cs.done(ctx, "Expire", start, err)
+	return n, err
+}
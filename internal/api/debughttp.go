@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactedHeaders are never logged verbatim, whatever -debug-redact says.
+// The configured API key alias header is redacted as well.
+var redactedHeaders = []string{apiKeyHeader, "Authorization", "Cookie"}
+
+// cappedBuffer keeps the first max bytes written to it and remembers whether
+// anything was cut off.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// httpDebug captures request and response bodies for -debug-http. The
+// request body is teed as the handler reads it, so the handler still sees
+// the whole body.
+type httpDebug struct {
+	req, resp cappedBuffer
+}
+
+func (s *Server) startHTTPDebug(r *http.Request, rr *statusRecorder) *httpDebug {
+	d := &httpDebug{
+		req:  cappedBuffer{max: s.cfg.debugBodyLimit},
+		resp: cappedBuffer{max: s.cfg.debugBodyLimit},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &d.req), r.Body}
+	}
+	rr.capture = &d.resp
+	return d
+}
+
+func (s *Server) httpDebugAttr(d *httpDebug, r *http.Request, w http.ResponseWriter) slog.Attr {
+	headers := make([]any, 0, len(r.Header))
+	for name, values := range r.Header {
+		v := strings.Join(values, ", ")
+		for _, h := range redactedHeaders {
+			if strings.EqualFold(name, h) {
+				v = redacted
+			}
+		}
+		if s.cfg.apiKeyHeader != "" && strings.EqualFold(name, s.cfg.apiKeyHeader) {
+			v = redacted
+		}
+		headers = append(headers, slog.String(name, v))
+	}
+
+	return slog.Group("debug",
+		slog.Group("request_headers", headers...),
+		slog.String("request_body", capturedBody(&d.req, r.Header.Get("Content-Type"), s.redactRE)),
+		slog.String("response_body", capturedBody(&d.resp, w.Header().Get("Content-Type"), s.redactRE)),
+	)
+}
+
+// capturedBody renders a captured body for the log: text with the fields
+// re matches redacted for textual content types, only the length for
+// anything else.
+func capturedBody(c *cappedBuffer, contentType string, re *regexp.Regexp) string {
+	if c.buf.Len() == 0 && !c.truncated {
+		return ""
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if !isTextual(mt) {
+		n := strconv.Itoa(c.buf.Len())
+		if c.truncated {
+			return "(" + n + "+ bytes, binary)"
+		}
+		return "(" + n + " bytes, binary)"
+	}
+
+	body := c.buf.String()
+	if re != nil {
+		body = redactFields(re, body)
+	}
+	if c.truncated {
+		body += "...(truncated)"
+	}
+	return body
+}
+
+func isTextual(mediaType string) bool {
+	return mediaType == "" ||
+		strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/x-www-form-urlencoded" ||
+		mediaType == "application/x-ndjson"
+}
+
+// redactFields blanks the values of the field names re was compiled for,
+// by compileRedactRE, in JSON ("email": "...") and form-encoded (email=...)
+// bodies. It works on the raw text so that truncated bodies are redacted
+// too; only scalar values are recognised.
+func redactFields(re *regexp.Regexp, body string) string {
+	return re.ReplaceAllStringFunc(body, func(m string) string {
+		if i := strings.IndexByte(m, '='); i >= 0 && !strings.HasPrefix(m, `"`) {
+			return m[:i+1] + redacted
+		}
+		i := strings.IndexByte(m[1:], '"') + 1
+		return m[:i+1] + `: "` + redacted + `"`
+	})
+}
+
+func compileRedactRE(fields []string) *regexp.Regexp {
+	if len(fields) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(fields))
+	for i, f := range fields {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	names := "(?:" + strings.Join(quoted, "|") + ")"
+	return regexp.MustCompile(`"` + names + `"\s*:\s*(?:"(?:[^"\\]|\\.)*"?|[^,}\]\s]*)` +
+		`|(?:^|&)` + names + `=[^&]*`)
+}
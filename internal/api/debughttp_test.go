@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactFields(t *testing.T) {
+	re := compileRedactRE([]string{"email", "password"})
+	for _, tt := range []struct {
+		name, body, want string
+	}{
+		{"json", `{"name":"Ann","email":"ann@example.com"}`, `{"name":"Ann","email": "[REDACTED]"}`},
+		{"json with spaces", `{"password" :  "se\"cret", "n": 1}`, `{"password": "[REDACTED]", "n": 1}`},
+		{"json number", `{"password":1234}`, `{"password": "[REDACTED]"}`},
+		{"truncated json", `{"email":"ann@exa`, `{"email": "[REDACTED]"`},
+		{"form", "name=Ann&email=ann%40example.com&x=1", "name=Ann&email=[REDACTED]&x=1"},
+		{"form first", "password=hunter2", "password=[REDACTED]"},
+		{"other fields", `{"emails":"x","name":"email"}`, `{"emails":"x","name":"email"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactFields(re, tt.body); got != tt.want {
+				t.Errorf("redactFields(%s) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebugHTTP(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		limit       int
+		want        []string
+		notWant     []string
+	}{
+		{
+			name: "json", contentType: "application/json", body: `{"name":"Ann","email":"ann@example.com"}`, limit: 1024,
+			want:    []string{`"request_body":"{\"name\":\"Ann\",\"email\": \"[REDACTED]\"}"`, `"response_body":"{\"user_id\":1`, `"X-Api-Key":"[REDACTED]"`},
+			notWant: []string{"ann@example.com", testKey},
+		},
+		{
+			name: "truncated", contentType: "application/json", body: `{"name":"` + strings.Repeat("A", 100) + `"}`, limit: 16,
+			want: []string{`"request_body":"{\"name\":\"AAAAAAA...(truncated)"`},
+		},
+		{
+			name: "binary", contentType: "application/octet-stream", body: "\x00\x01\x02", limit: 1024,
+			want: []string{`"request_body":"(3 bytes, binary)"`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.debugHTTP = true
+			cfg.debugBodyLimit = tt.limit
+			cfg.debugRedact = []string{"email"}
+			var logs bytes.Buffer
+			h := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodPost, "/user", tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			serve(h, r)
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 {
+				t.Fatalf("%d access records:\n%s", len(recs), logs.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("access record lacks %s:\n%s", want, logs.String())
+				}
+			}
+			for _, leak := range tt.notWant {
+				if strings.Contains(logs.String(), leak) {
+					t.Errorf("access record shows %s:\n%s", leak, logs.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// retryAfterUnavailable is the Retry-After hint, in seconds, sent with
+// ErrUnavailable responses.
+const retryAfterUnavailable = "5"
+
+// statusClientClosedRequest is nginx's status for a request the client
+// gave up on. The client never sees it; it is for the logs and metrics.
+const statusClientClosedRequest = 499
+
+// APIError is an error together with the response it is reported to
+// clients with. Handlers return it, or any other error, and leave writing
+// the response to writeError.
+type APIError struct {
+	Status int
+	// Code names the kind of error, such as not_found, so that it can be
+	// told apart without looking at Message.
+	Code    string
+	Message string
+	// Fields says what is wrong with each field or parameter, if that is
+	// the problem.
+	Fields map[string]string
+
+	// err is the error the APIError reports, if any.
+	err error
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func (e *APIError) Unwrap() error { return e.err }
+
+// Is matches APIErrors of the same code, so errors.Is(err, ErrNotFound)
+// holds whatever the message.
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Code == e.Code
+}
+
+// The errors the store reports, as they reach clients. Unclassified errors
+// become errInternal, without their details, and context errors
+// errCanceled or errTimedOut.
+var (
+	ErrNotFound     = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: store.ErrNotFound.Error()}
+	ErrConflict     = &APIError{Status: http.StatusConflict, Code: "conflict", Message: store.ErrConflict.Error()}
+	ErrPrecondition = &APIError{Status: http.StatusPreconditionFailed, Code: "precondition_failed", Message: store.ErrPrecondition.Error()}
+	ErrUnavailable  = &APIError{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: store.ErrUnavailable.Error()}
+
+	errInternal         = &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: "internal error"}
+	errCanceled         = &APIError{Status: statusClientClosedRequest, Code: "canceled", Message: "request canceled"}
+	errTimedOut         = &APIError{Status: http.StatusServiceUnavailable, Code: "timeout", Message: timeoutMessage}
+	errMethodNotAllowed = &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "method not allowed"}
+)
+
+// ErrInvalidParam reports the query parameter name as malformed, for the
+// reason given.
+func ErrInvalidParam(name, reason string) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    "invalid_param",
+		Message: "invalid " + name,
+		Fields:  map[string]string{name: reason},
+	}
+}
+
+// errBadRequest rejects a request that cannot be handled as sent.
+func errBadRequest(msg string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "bad_request", Message: msg}
+}
+
+// errValidation rejects a well-formed request whose fields do not pass
+// validation, saying what is wrong with each.
+func errValidation(fields map[string]string) *APIError {
+	return &APIError{Status: http.StatusUnprocessableEntity, Code: "validation_failed", Message: "validation failed", Fields: fields}
+}
+
+// apiError returns the APIError err is or wraps, or the one it is reported
+// as otherwise, wrapping err.
+func apiError(err error) *APIError {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e
+	}
+	for _, known := range []struct {
+		err error
+		api *APIError
+	}{
+		{store.ErrNotFound, ErrNotFound},
+		{store.ErrConflict, ErrConflict},
+		{store.ErrUnavailable, ErrUnavailable},
+		{store.ErrPrecondition, ErrPrecondition},
+		// A client that went away, or a request that ran out of time, is
+		// not a fault of the server's.
+		{context.Canceled, errCanceled},
+		{context.DeadlineExceeded, errTimedOut},
+	} {
+		if errors.Is(err, known.err) {
+			e = known.api
+			break
+		}
+	}
+	if e == nil {
+		e = errInternal
+	}
+	wrapped := *e
+	wrapped.err = err
+	return &wrapped
+}
+
+// writeError translates an error returned by the store or a handler into
+// its HTTP status and ErrorResponse body. Unclassified errors are logged and
+// reported as a generic 500 so internal details never reach the client.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := apiError(err)
+	switch {
+	case errors.Is(e, ErrUnavailable):
+		w.Header().Set("Retry-After", retryAfterUnavailable)
+	case e.Status == http.StatusInternalServerError:
+		s.log(r.Context()).Error("internal error", "err", err)
+	}
+	msg := e.Message
+	var body any = ErrorResponse{Error: msg, Code: e.Code, Fields: e.Fields}
+	if s.cfg.envelope {
+		body = EnvelopeResponse{Error: &msg, Code: e.Code, Fields: e.Fields}
+	}
+	s.send(w, r, e.Status, body)
+}
+
+// handlerFunc is a handler that returns its errors for handler to report.
+type handlerFunc func(http.ResponseWriter, *http.Request) error
+
+// handler adapts h to net/http, answering an error it returns with
+// writeError. An error returned once h has started its response, such as a
+// stream failing midway, can no longer be reported to the client and is
+// only logged.
+func (s *Server) handler(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		err := h(sr, r)
+		switch {
+		case err == nil:
+		case sr.wroteHeader:
+			s.log(r.Context()).Error("error after response was started", "err", err)
+		default:
+			s.writeError(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestHandlerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		h          handlerFunc
+		wantStatus int
+		wantBody   string
+		wantLog    string
+	}{
+		{
+			name:       "no error",
+			h:          func(w http.ResponseWriter, r *http.Request) error { return nil },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "api error",
+			h:          func(w http.ResponseWriter, r *http.Request) error { return ErrNotFound },
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"not found","code":"not_found"}` + "\n",
+		},
+		{
+			name:       "unclassified error",
+			h:          func(w http.ResponseWriter, r *http.Request) error { return errors.New("disk on fire") },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal error","code":"internal"}` + "\n",
+			wantLog:    "disk on fire",
+		},
+		{
+			name:       "client gone",
+			h:          func(w http.ResponseWriter, r *http.Request) error { return context.Canceled },
+			wantStatus: statusClientClosedRequest,
+			wantBody:   `{"error":"request canceled","code":"canceled"}` + "\n",
+		},
+		{
+			name: "out of time",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				return fmt.Errorf("get: %w", context.DeadlineExceeded)
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"error":"request timed out","code":"timeout"}` + "\n",
+		},
+		{
+			name: "error after header",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusAccepted)
+				return errors.New("stream broke")
+			},
+			wantStatus: http.StatusAccepted,
+			wantLog:    "error after response was started",
+		},
+		{
+			name: "error after body",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				_, _ = w.Write([]byte(`{"id":1}` + "\n"))
+				return ErrUnavailable
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":1}` + "\n",
+			wantLog:    "error after response was started",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := newTestServer(t, DefaultConfig(), slog.New(slog.NewTextHandler(&logs, nil)))
+			rec := httptest.NewRecorder()
+			s.handler(tt.h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if tt.wantLog == "" && logs.Len() > 0 {
+				t.Errorf("logged %q, want nothing", logs.String())
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logs = %q, want %q in them", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestWriteErrorFromStore(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter string
+	}{
+		{"not found", store.ErrNotFound, http.StatusNotFound, "not_found", ""},
+		{"wrapped not found", fmt.Errorf("user 7: %w", store.ErrNotFound), http.StatusNotFound, "not_found", ""},
+		{"conflict", store.ErrConflict, http.StatusConflict, "conflict", ""},
+		{"precondition", store.ErrPrecondition, http.StatusPreconditionFailed, "precondition_failed", ""},
+		{"unavailable", store.ErrUnavailable, http.StatusServiceUnavailable, "unavailable", retryAfterUnavailable},
+		{"wrapped unavailable", fmt.Errorf("database is locked: %w", store.ErrUnavailable), http.StatusServiceUnavailable, "unavailable", retryAfterUnavailable},
+		{"unclassified", errors.New("boom"), http.StatusInternalServerError, "internal", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			rec := httptest.NewRecorder()
+			s.writeError(rec, httptest.NewRequest(http.MethodGet, "/", nil), tt.err)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if strings.Contains(rec.Body.String(), "boom") || strings.Contains(rec.Body.String(), "locked") {
+				t.Errorf("body %s leaks the error", rec.Body)
+			}
+		})
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	cause := fmt.Errorf("user 7: %w", store.ErrNotFound)
+	for _, tt := range []struct {
+		name string
+		err  error
+		// want is what apiError makes of err, and wantIs the errors it
+		// still matches.
+		want   *APIError
+		wantIs []error
+	}{
+		{"api error", ErrConflict, ErrConflict, []error{ErrConflict}},
+		{"wrapped api error", fmt.Errorf("creating: %w", errBadRequest("no")), errBadRequest("no"), nil},
+		{"store error", cause, ErrNotFound, []error{ErrNotFound, store.ErrNotFound}},
+		{"unavailable", store.ErrUnavailable, ErrUnavailable, []error{ErrUnavailable, store.ErrUnavailable}},
+		{"unclassified", errors.New("boom"), errInternal, []error{errInternal}},
+		{"invalid param", ErrInvalidParam("limit", "must be a number"), ErrInvalidParam("limit", "must be a number"), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := apiError(tt.err)
+			if got.Status != tt.want.Status || got.Code != tt.want.Code || got.Message != tt.want.Message ||
+				fmt.Sprint(got.Fields) != fmt.Sprint(tt.want.Fields) {
+				t.Errorf("apiError = %+v, want %+v", got, tt.want)
+			}
+			if !errors.Is(got, tt.err) && !errors.Is(tt.err, got) {
+				t.Errorf("%v does not match the error %v it reports", got, tt.err)
+			}
+			for _, target := range tt.wantIs {
+				if !errors.Is(got, target) {
+					t.Errorf("errors.Is(%v, %v) = false", got, target)
+				}
+			}
+			// The shared errors are never changed by wrapping.
+			if ErrNotFound.err != nil || errInternal.err != nil || ErrUnavailable.err != nil {
+				t.Fatal("apiError modified a shared error")
+			}
+		})
+	}
+	// Matching is by code, whatever the message.
+	if !errors.Is(&APIError{Code: "not_found", Message: "no such key"}, ErrNotFound) {
+		t.Error("an APIError with the not_found code is not ErrNotFound")
+	}
+	if errors.Is(ErrConflict, ErrNotFound) {
+		t.Error("ErrConflict is ErrNotFound")
+	}
+}
+
+func TestHandlerErrorResponses(t *testing.T) {
+	for _, tt := range []struct {
+		name, method, target, body string
+		envelope                   bool
+		wantStatus                 int
+		wantCode                   string
+		wantFields                 map[string]string
+	}{
+		{name: "not found", method: http.MethodGet, target: "/user/9",
+			wantStatus: http.StatusNotFound, wantCode: "not_found"},
+		{name: "invalid param", method: http.MethodGet, target: "/user?id=x",
+			wantStatus: http.StatusBadRequest, wantCode: "invalid_param", wantFields: map[string]string{"id": ""}},
+		{name: "validation", method: http.MethodPost, target: "/user", body: `{"name":"Bo","email":"nope"}`,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: "validation_failed", wantFields: map[string]string{"email": ""}},
+		{name: "bad request", method: http.MethodPost, target: "/user", body: `{"name":`,
+			wantStatus: http.StatusBadRequest, wantCode: "bad_request"},
+		{name: "method not allowed", method: http.MethodPut, target: "/user",
+			wantStatus: http.StatusMethodNotAllowed, wantCode: "method_not_allowed"},
+		{name: "enveloped", method: http.MethodPost, target: "/user", body: `{"name":"Bo","email":"nope"}`, envelope: true,
+			wantStatus: http.StatusUnprocessableEntity, wantCode: "validation_failed", wantFields: map[string]string{"email": ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.envelope = tt.envelope
+			rec := serve(newTestServer(t, cfg, nil).Handler(), newRequest(tt.method, tt.target, tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var body struct {
+				Data   json.RawMessage
+				Error  *string
+				Code   string
+				Fields map[string]string
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error == nil || *body.Error == "" || body.Code != tt.wantCode {
+				t.Errorf("body = %s, want an error with code %s", rec.Body, tt.wantCode)
+			}
+			if tt.envelope != (string(body.Data) == "null") {
+				t.Errorf("body = %s, enveloped %v", rec.Body, tt.envelope)
+			}
+			if len(body.Fields) != len(tt.wantFields) {
+				t.Errorf("fields %v, want reasons for %v", body.Fields, tt.wantFields)
+			}
+			for f := range tt.wantFields {
+				if body.Fields[f] == "" {
+					t.Errorf("no reason for %s in %v", f, body.Fields)
+				}
+			}
+		})
+	}
+}
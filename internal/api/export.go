@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+const (
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+type ImportResponse struct {
+	Imported int    `json:"imported"`
+	Mode     string `json:"mode"`
+}
+
+// handleExport dumps the whole store in the format handleImport reads. The
+// dump is snake_case and unenveloped whatever the response settings, so
+// that it can be imported as it is.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) error {
+	users, err := s.users.List(r.Context())
+	if err != nil {
+		return err
+	}
+	resp := make([]UserResponse, len(users))
+	for i, u := range users {
+		resp[i] = newUserResponse(u)
+	}
+	s.sendInCase(w, r, http.StatusOK, resp, jsonCaseSnake)
+	return nil
+}
+
+// handleImport loads an exported array of users, keeping their ids. With
+// ?mode=replace the store is emptied first; the default, merge, overwrites
+// users with the same id and keeps the rest. Nothing is loaded unless every
+// record is valid.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) error {
+	mode, err := queryValue(r, "mode")
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case "":
+		mode = importMerge
+	case importMerge, importReplace:
+	default:
+		return ErrInvalidParam("mode", "must be "+importMerge+" or "+importReplace)
+	}
+
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	var records []UserResponse
+	if err := json.Unmarshal(trimBody(raw), &records); err != nil {
+		s.log(r.Context()).Warn("json unmarshal error", "err", err)
+		return errBadRequest(errMalformedJSON.Error())
+	}
+
+	users, err := importedUsers(records, s.now().UTC())
+	if err != nil {
+		return errBadRequest(err.Error())
+	}
+	if err := s.users.Load(r.Context(), users, mode == importReplace); err != nil {
+		return err
+	}
+	s.writeJSON(w, r, http.StatusOK, ImportResponse{Imported: len(users), Mode: mode})
+	return nil
+}
+
+// importedUsers validates exported records and converts them back to
+// users. Missing timestamps default to now, and missing versions to 1.
+func importedUsers(records []UserResponse, now time.Time) ([]store.User, error) {
+	users := make([]store.User, len(records))
+	seen := make(map[int64]bool, len(records))
+	for i, rec := range records {
+		name := normalizeName(rec.Name)
+		switch {
+		case rec.UserID <= 0:
+			return nil, fmt.Errorf("record %d: invalid user_id", i)
+		case seen[rec.UserID]:
+			return nil, fmt.Errorf("record %d: duplicate user_id %d", i, rec.UserID)
+		case name == "":
+			return nil, fmt.Errorf("record %d: %v", i, errInvalidName)
+		}
+		seen[rec.UserID] = true
+
+		email := rec.Email
+		if email != "" {
+			var err error
+			if email, err = parseEmail(email); err != nil {
+				return nil, fmt.Errorf("record %d: %v", i, err)
+			}
+		}
+		u := store.User{ID: rec.UserID, Name: name, Email: email, Version: max(1, rec.Version), CreatedAt: rec.CreatedAt, UpdatedAt: rec.UpdatedAt}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		if u.UpdatedAt.IsZero() {
+			u.UpdatedAt = u.CreatedAt
+		}
+		users[i] = u
+	}
+	return users, nil
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// mustServe serves r through h, failing the test unless the response has
+// status want.
+func mustServe(t *testing.T, h http.Handler, want int, method, target, body string) []byte {
+	t.Helper()
+	rec := serve(h, newRequest(method, target, body))
+	if rec.Code != want {
+		t.Fatalf("%s %s: status = %d, want %d: %s", method, target, rec.Code, want, rec.Body)
+	}
+	return rec.Body.Bytes()
+}
+
+// newAdminServer returns a test server for cfg, without rate limiting, for
+// which testKey holds the admin scope as well.
+func newAdminServer(t *testing.T, cfg Config) http.Handler {
+	t.Helper()
+	cfg.apiKeys = []string{testKey + ",read write admin"}
+	cfg.rateLimit = 0
+	return newTestServer(t, cfg, nil).Handler()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		envelope bool
+		jsonCase string
+	}{
+		{"plain", false, jsonCaseSnake},
+		{"envelope", true, jsonCaseSnake},
+		{"camel case", false, jsonCaseCamel},
+		{"envelope and camel case", true, jsonCaseCamel},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.envelope = tt.envelope
+			cfg.jsonCase = tt.jsonCase
+			src := newAdminServer(t, cfg)
+			for _, body := range []string{`{"name":"Ann"}`, `{"name":"Bob"}`, `{"name":"Cy"}`} {
+				mustServe(t, src, http.StatusCreated, http.MethodPost, "/user", body)
+			}
+			mustServe(t, src, http.StatusOK, http.MethodPatch, "/user?id=1", `{"name":"Anne"}`)
+			exported := mustServe(t, src, http.StatusOK, http.MethodGet, "/export", "")
+			var records []UserResponse
+			if err := json.Unmarshal(exported, &records); err != nil || len(records) != 3 || records[0].UserID != 1 || records[0].Name != "Anne" {
+				t.Fatalf("export is not a snake_case array of the 3 users: %s", exported)
+			}
+
+			dst := newAdminServer(t, cfg)
+			mustServe(t, dst, http.StatusOK, http.MethodPost, "/import", string(exported))
+			if got := mustServe(t, dst, http.StatusOK, http.MethodGet, "/export", ""); string(got) != string(exported) {
+				t.Errorf("exported again\n%s\nwant\n%s", got, exported)
+			}
+
+			// New users continue after the highest imported id.
+			rec := serve(dst, newRequest(http.MethodPost, "/user", `{"name":"Di"}`))
+			if loc := rec.Header().Get("Location"); loc != "/user/4" {
+				t.Errorf("new user after import at %q, want /user/4", loc)
+			}
+		})
+	}
+}
+
+func TestImportResponse(t *testing.T) {
+	h := newAdminServer(t, DefaultConfig())
+	var resp ImportResponse
+	if err := json.Unmarshal(mustServe(t, h, http.StatusOK, http.MethodPost, "/import", `[{"user_id":1,"name":"Ann"}]`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp != (ImportResponse{Imported: 1, Mode: importMerge}) {
+		t.Errorf("import response %+v", resp)
+	}
+}
+
+func TestImport(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+		// wantIDs are the users left afterwards, with their names.
+		wantIDs map[int64]string
+	}{
+		{"merge", "/import", `[{"user_id":2,"name":"Bobby"},{"user_id":9,"name":"Ida"}]`, 200,
+			map[int64]string{1: "Ann", 2: "Bobby", 9: "Ida"}},
+		{"replace", "/import?mode=replace", `[{"user_id":9,"name":"Ida"}]`, 200,
+			map[int64]string{9: "Ida"}},
+		{"replace with nothing", "/import?mode=replace", `[]`, 200, map[int64]string{}},
+		{"unknown mode", "/import?mode=append", `[]`, 400, map[int64]string{1: "Ann", 2: "Bob"}},
+		{"malformed", "/import", `[{"user_id":`, 400, map[int64]string{1: "Ann", 2: "Bob"}},
+		{"no id", "/import", `[{"name":"Ida"}]`, 400, map[int64]string{1: "Ann", 2: "Bob"}},
+		{"duplicate id", "/import", `[{"user_id":9,"name":"Ida"},{"user_id":9,"name":"Ivy"}]`, 400,
+			map[int64]string{1: "Ann", 2: "Bob"}},
+		{"one invalid record", "/import?mode=replace", `[{"user_id":9,"name":"Ida"},{"user_id":10,"name":" "}]`, 400,
+			map[int64]string{1: "Ann", 2: "Bob"}},
+		{"invalid email", "/import", `[{"user_id":9,"name":"Ida","email":"ida"}]`, 400,
+			map[int64]string{1: "Ann", 2: "Bob"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAdminServer(t, DefaultConfig())
+			mustServe(t, h, http.StatusCreated, http.MethodPost, "/user", `{"name":"Ann"}`)
+			mustServe(t, h, http.StatusCreated, http.MethodPost, "/user", `{"name":"Bob"}`)
+			mustServe(t, h, tt.wantStatus, http.MethodPost, tt.target, tt.body)
+
+			var users []UserResponse
+			if err := json.Unmarshal(mustServe(t, h, http.StatusOK, http.MethodGet, "/export", ""), &users); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[int64]string, len(users))
+			for _, u := range users {
+				got[u.UserID] = u.Name
+			}
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("users = %v, want %v", got, tt.wantIDs)
+			}
+			for id, name := range tt.wantIDs {
+				if got[id] != name {
+					t.Errorf("user %d = %q, want %q", id, got[id], name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+)
+
+// buildVersion is version, or without it the module version recorded by
+// the go command.
+func buildVersion(version string) string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// vars are the server's own variables under /debug/vars. They read the
+// same counters as /stats.
+func (s *Server) vars() map[string]expvar.Var {
+	return map[string]expvar.Var{
+		"version": expvar.Func(func() any { return buildVersion(s.cfg.Version) }),
+		"requests": expvar.Func(func() any {
+			var n int64
+			for i := range s.requests {
+				n += s.requests[i].Load()
+			}
+			return n
+		}),
+		"responses": expvar.Func(func() any {
+			classes := make(map[string]int64, len(s.requests))
+			for i := range s.requests {
+				classes[strconv.Itoa(i+1)+"xx"] = s.requests[i].Load()
+			}
+			return classes
+		}),
+		"auth_failures":    expvar.Func(func() any { return s.authFailureCount.Load() }),
+		"store_operations": expvar.Func(func() any { return s.storeCounters.ops.Load() }),
+		"store_errors":     expvar.Func(func() any { return s.storeCounters.errors.Load() }),
+	}
+}
+
+// handleVars serves the variables published with expvar, such as cmdline
+// and memstats, together with the server's own, in the format of
+// expvar.Handler. The server's are not published, so that each Server
+// reports its own.
+func (s *Server) handleVars(w http.ResponseWriter, r *http.Request) error {
+	vars := s.vars()
+	expvar.Do(func(kv expvar.KeyValue) {
+		if _, ok := vars[kv.Key]; !ok {
+			vars[kv.Key] = kv.Value
+		}
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{\n")
+	for i, name := range slices.Sorted(maps.Keys(vars)) {
+		if i > 0 {
+			fmt.Fprintf(bw, ",\n")
+		}
+		fmt.Fprintf(bw, "%q: %s", name, vars[name])
+	}
+	fmt.Fprintf(bw, "\n}\n")
+	_ = bw.Flush()
+	return nil
+}
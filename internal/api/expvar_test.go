@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// getVars fetches /debug/vars from h as the key "admin".
+func getVars(t *testing.T, h http.Handler) map[string]json.RawMessage {
+	t.Helper()
+	r := newRequest(http.MethodGet, "/debug/vars", "")
+	r.Header.Set(apiKeyHeader, "admin")
+	rec := serve(h, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/debug/vars: status = %d: %s", rec.Code, rec.Body)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("/debug/vars is not JSON: %v:\n%s", err, rec.Body)
+	}
+	return vars
+}
+
+func TestVars(t *testing.T) {
+	newServer := func() http.Handler {
+		cfg := DefaultConfig()
+		cfg.apiKeys = []string{"admin,read write admin", testKey}
+		cfg.Version = "v1.2.3"
+		return newTestServer(t, cfg, nil).Handler()
+	}
+	h, other := newServer(), newServer()
+	serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+	serve(h, newRequest(http.MethodGet, "/user/1", ""))
+	serve(h, newRequest(http.MethodGet, "/user/9", ""))
+	bad := newRequest(http.MethodGet, "/users", "")
+	bad.Header.Set(apiKeyHeader, "nope")
+	serve(h, bad)
+
+	vars := getVars(t, h)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"version", `"v1.2.3"`},
+		// The scrape itself is not counted until it is done.
+		{"requests", "4"},
+		{"responses", `{"1xx":0,"2xx":2,"3xx":0,"4xx":2,"5xx":0}`},
+		{"auth_failures", "1"},
+		{"store_operations", "3"},
+		{"store_errors", "0"},
+	} {
+		if got := compactJSON(t, vars[tt.name]); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	// Those published with expvar are there too.
+	for _, name := range []string{"cmdline", "memstats"} {
+		if vars[name] == nil {
+			t.Errorf("no %s", name)
+		}
+	}
+	// Each server reports its own.
+	if got := string(getVars(t, other)["requests"]); got != "0" {
+		t.Errorf("requests on another server = %s, want 0", got)
+	}
+}
+
+// compactJSON returns raw with insignificant space removed.
+func compactJSON(t *testing.T, raw json.RawMessage) string {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		t.Fatalf("%s: %v", raw, err)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestVarsRequireAdmin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{"reader,read", "admin,read write admin"}
+	h := newTestServer(t, cfg, nil).Handler()
+	for _, tt := range []struct {
+		key        string
+		wantStatus int
+	}{
+		{"", http.StatusUnauthorized},
+		{"reader", http.StatusForbidden},
+		{"admin", http.StatusOK},
+	} {
+		r := newRequest(http.MethodGet, "/debug/vars", "")
+		r.Header.Set(apiKeyHeader, tt.key)
+		if rec := serve(h, r); rec.Code != tt.wantStatus {
+			t.Errorf("key %q: status = %d, want %d", tt.key, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	if got := buildVersion("v2.0.0"); got != "v2.0.0" {
+		t.Errorf("buildVersion(v2.0.0) = %q", got)
+	}
+	// Test binaries carry no module version.
+	if got := buildVersion(""); got != "(devel)" {
+		t.Errorf(`buildVersion("") = %q, want (devel)`, got)
+	}
+}
@@ -0,0 +1,378 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+type UserResponse struct {
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email,omitempty"`
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CreateUserRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// PatchUserRequest uses pointers so that a field left out of the body can be
+// told apart from one explicitly set to its zero value.
+type PatchUserRequest struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+}
+
+type CreateUserResponse struct {
+	UserResponse
+	// Created is deprecated; it is only set when compatCreated is enabled.
+	Created string `json:"created,omitempty"`
+}
+
+func newUserResponse(u store.User) UserResponse {
+	return UserResponse{
+		UserID:    u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Version:   u.Version,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) error {
+	idStr, err := queryValue(r, "id")
+	if err != nil {
+		return err
+	}
+	return s.writeUser(w, r, idStr)
+}
+
+func (s *Server) handleGetUserByID(w http.ResponseWriter, r *http.Request) error {
+	return s.writeUser(w, r, r.PathValue("id"))
+}
+
+// queryValue returns the query parameter name, which may be absent but
+// must not be repeated: ?id=1&id=2 is a 400.
+func queryValue(r *http.Request, name string) (string, error) {
+	vs := r.URL.Query()[name]
+	switch len(vs) {
+	case 0:
+		return "", nil
+	case 1:
+		return vs[0], nil
+	default:
+		return "", errBadRequest("duplicate parameter: " + name)
+	}
+}
+
+// dryRunParam, set to true, asks for a payload to be validated without
+// being applied.
+const dryRunParam = "dry_run"
+
+// DryRunResponse answers a dry run that passed validation.
+type DryRunResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// dryRun reports whether r is a dry run, failing with a 400 for a
+// malformed dry_run parameter.
+func dryRun(r *http.Request) (bool, error) {
+	v, err := queryValue(r, dryRunParam)
+	if err != nil || v == "" {
+		return false, err
+	}
+	dry, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, ErrInvalidParam(dryRunParam, "must be true or false")
+	}
+	return dry, nil
+}
+
+// parseID parses the user id idStr, failing with a 400 for anything but
+// an integer.
+func parseID(idStr string) (int64, error) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidParam("id", "must be an integer")
+	}
+	return id, nil
+}
+
+func (s *Server) writeUser(w http.ResponseWriter, r *http.Request, idStr string) error {
+	id, err := parseID(idStr)
+	if err != nil {
+		return err
+	}
+
+	// The lookup is shared with concurrent requests for the same id, and
+	// only canceled once none of them is waiting for it any more.
+	u, err := s.lookups.get(r.Context(), id, s.users.Get)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", userETag(u))
+	s.writeJSON(w, r, http.StatusOK, newUserResponse(u))
+	return nil
+}
+
+// userETag is the entity tag of u, its version as a quoted string.
+func userETag(u store.User) string {
+	return `"` + strconv.FormatInt(u.Version, 10) + `"`
+}
+
+// ifMatch reports whether u satisfies an If-Match header: "*", or a list of
+// entity tags of which one is u's. Bare versions are accepted as well as
+// quoted ones; weak tags never match, as RFC 9110 requires.
+func ifMatch(header string, u store.User) bool {
+	want := userETag(u)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == want || tag == want[1:len(want)-1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) error {
+	dry, err := dryRun(r)
+	if err != nil {
+		return err
+	}
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	raw = trimBody(raw)
+
+	// The body has already been drained above; hand ParseForm a fresh copy.
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	_ = r.ParseForm()
+	for _, field := range []string{"name", "email"} {
+		if len(r.Form[field]) > 1 {
+			return errBadRequest("duplicate parameter: " + field)
+		}
+	}
+
+	req, err := parseCreateUser(raw, r.Form)
+	if err != nil {
+		msg := err.Error()
+		if errors.Is(err, errMalformedJSON) {
+			s.log(r.Context()).Warn("json unmarshal error",
+				"err", err,
+				"body", string(raw),
+				"content_type", r.Header.Get("Content-Type"))
+			msg = errMalformedJSON.Error()
+		}
+		return errBadRequest(msg)
+	}
+
+	if req.Email != "" {
+		if req.Email, err = parseEmail(req.Email); err != nil {
+			return errValidation(map[string]string{"email": err.Error()})
+		}
+	}
+	if dry {
+		s.writeJSON(w, r, http.StatusOK, DryRunResponse{Valid: true})
+		return nil
+	}
+
+	u, err := s.users.Create(r.Context(), req.Name, req.Email)
+	if err != nil {
+		return err
+	}
+	resp := CreateUserResponse{UserResponse: newUserResponse(u)}
+	if s.cfg.compatCreated {
+		resp.Created = u.Name
+	}
+
+	w.Header().Set("Location", userLocation(u.ID))
+	w.Header().Set("ETag", userETag(u))
+	s.writeJSON(w, r, http.StatusCreated, resp)
+	return nil
+}
+
+var (
+	errEmptyBody     = errors.New("request body is empty")
+	errMalformedJSON = errors.New("malformed JSON")
+	errInvalidName   = errors.New("invalid name")
+)
+
+// normalizeName trims a name and puts it in Unicode NFC, so that names
+// differing only in how accented characters are encoded are stored alike.
+func normalizeName(name string) string {
+	return norm.NFC.String(strings.TrimSpace(name))
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// trimBody strips surrounding whitespace and a leading UTF-8 byte order
+// mark, in whichever order they appear.
+func trimBody(raw []byte) []byte {
+	raw = bytes.TrimSpace(raw)
+	raw = bytes.TrimPrefix(raw, utf8BOM)
+	return bytes.TrimSpace(raw)
+}
+
+// parseCreateUser extracts the fields for POST /user from a trimmed body,
+// which may be a JSON object, or from form and query values. The name is
+// normalized and required; the email is trimmed but not validated. It must
+// cope with arbitrary client input: every failure is one of errEmptyBody,
+// errMalformedJSON (wrapping the decoder error) or errInvalidName.
+func parseCreateUser(raw []byte, form url.Values) (CreateUserRequest, error) {
+	var jsonErr error
+	if len(raw) > 0 && raw[0] == '{' {
+		var req CreateUserRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			jsonErr = err
+		} else if req.Name = normalizeName(req.Name); req.Name != "" {
+			req.Email = strings.TrimSpace(req.Email)
+			return req, nil
+		}
+	}
+	if name := normalizeName(form.Get("name")); name != "" {
+		return CreateUserRequest{Name: name, Email: strings.TrimSpace(form.Get("email"))}, nil
+	}
+
+	switch {
+	case jsonErr != nil:
+		return CreateUserRequest{}, fmt.Errorf("%w: %v", errMalformedJSON, jsonErr)
+	case len(raw) == 0 && !form.Has("name"):
+		return CreateUserRequest{}, errEmptyBody
+	default:
+		return CreateUserRequest{}, errInvalidName
+	}
+}
+
+var errInvalidEmail = errors.New("invalid email address")
+
+// parseEmail validates a bare email address, such as user@example.com, and
+// returns it in canonical form. Display names ("Ann <ann@example.com>") are
+// not accepted.
+func parseEmail(v string) (string, error) {
+	addr, err := mail.ParseAddress(v)
+	if err != nil || addr.Name != "" || addr.Address != v {
+		return "", errInvalidEmail
+	}
+	return addr.Address, nil
+}
+
+func (s *Server) handlePatchUser(w http.ResponseWriter, r *http.Request) error {
+	idStr, err := queryValue(r, "id")
+	if err != nil {
+		return err
+	}
+	id, err := parseID(idStr)
+	if err != nil {
+		return err
+	}
+	dry, err := dryRun(r)
+	if err != nil {
+		return err
+	}
+
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	raw = trimBody(raw)
+	if len(raw) == 0 {
+		return errBadRequest(errEmptyBody.Error())
+	}
+
+	var req PatchUserRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return errBadRequest(errMalformedJSON.Error())
+	}
+	if req.Name != nil {
+		*req.Name = normalizeName(*req.Name)
+		if *req.Name == "" {
+			return errBadRequest(errInvalidName.Error())
+		}
+	}
+	// An empty email removes it.
+	if req.Email != nil {
+		*req.Email = strings.TrimSpace(*req.Email)
+		if *req.Email != "" {
+			email, err := parseEmail(*req.Email)
+			if err != nil {
+				return errValidation(map[string]string{"email": err.Error()})
+			}
+			*req.Email = email
+		}
+	}
+
+	// With If-Match the update only applies to the version the client
+	// last saw, so concurrent writers cannot silently overwrite each other.
+	match, conditional := r.Header["If-Match"]
+	precondition := func(u store.User) error {
+		if conditional && !ifMatch(strings.Join(match, ","), u) {
+			return fmt.Errorf("user %d is at version %d: %w", u.ID, u.Version, store.ErrPrecondition)
+		}
+		return nil
+	}
+	if dry {
+		u, err := s.users.Get(r.Context(), id)
+		if err == nil {
+			err = precondition(u)
+		}
+		if err != nil {
+			return err
+		}
+		s.writeJSON(w, r, http.StatusOK, DryRunResponse{Valid: true})
+		return nil
+	}
+	u, err := s.users.Update(r.Context(), id, func(u *store.User) error {
+		if err := precondition(*u); err != nil {
+			return err
+		}
+		if req.Name != nil {
+			u.Name = *req.Name
+		}
+		if req.Email != nil {
+			u.Email = *req.Email
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", userETag(u))
+	s.writeJSON(w, r, http.StatusOK, newUserResponse(u))
+	return nil
+}
+
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	idStr, err := queryValue(r, "id")
+	if err != nil {
+		return err
+	}
+	id, err := parseID(idStr)
+	if err != nil {
+		return err
+	}
+	if err := s.users.Delete(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
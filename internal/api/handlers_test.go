@@ -0,0 +1,583 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestCreateUserResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		compatCreated bool
+		wantCreated   string
+	}{
+		{"compat", true, "Ann"},
+		{"canonical only", false, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.compatCreated = tt.compatCreated
+			h := newTestServer(t, cfg, nil).Handler()
+			rec := serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Location"); got != "/user/1" {
+				t.Errorf("Location = %q, want /user/1", got)
+			}
+			var created CreateUserResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Fatal(err)
+			}
+			if created.Created != tt.wantCreated {
+				t.Errorf("created = %q, want %q", created.Created, tt.wantCreated)
+			}
+
+			// The body is the resource as GET on Location returns it.
+			get := serve(h, newRequest(http.MethodGet, rec.Header().Get("Location"), ""))
+			var fetched UserResponse
+			if err := json.Unmarshal(get.Body.Bytes(), &fetched); err != nil {
+				t.Fatal(err)
+			}
+			if created.UserResponse != fetched {
+				t.Errorf("created %+v, fetched %+v", created.UserResponse, fetched)
+			}
+		})
+	}
+}
+
+func TestLargeUserIDs(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin"}
+	h := newTestServer(t, cfg, nil).Handler()
+	// Above 2^53, where a float64 would lose the last digit.
+	const big = "9007199254740993"
+	if rec := serve(h, newRequest(http.MethodPost, "/import", `[{"user_id":`+big+`,"name":"Ann"}]`)); rec.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", rec.Code, rec.Body)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"beyond float precision", "/user/" + big, http.StatusOK, `"user_id":` + big + `,`},
+		{"as query", "/user?id=" + big, http.StatusOK, `"user_id":` + big + `,`},
+		{"largest int64", "/user/9223372036854775807", http.StatusNotFound, "not found"},
+		{"past int64", "/user/9223372036854775808", http.StatusBadRequest, "invalid id"},
+		{"negative", "/user/-1", http.StatusNotFound, "not found"},
+		{"fraction", "/user/1.5", http.StatusBadRequest, "invalid id"},
+		{"exponent", "/user/1e3", http.StatusBadRequest, "invalid id"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(h, newRequest(http.MethodGet, tt.target, ""))
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d with %s", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestCreateUserBody(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantError   string
+	}{
+		{"empty", "application/json", "", http.StatusBadRequest, "request body is empty"},
+		{"whitespace", "application/json", " \r\n\t", http.StatusBadRequest, "request body is empty"},
+		{"byte order mark", "application/json", "\xEF\xBB\xBF", http.StatusBadRequest, "request body is empty"},
+		{"empty object", "application/json", "{}", http.StatusBadRequest, "invalid name"},
+		{"blank name", "application/json", `{"name":"  "}`, http.StatusBadRequest, "invalid name"},
+		{"malformed", "application/json", `{"name":"Ann"`, http.StatusBadRequest, "malformed JSON"},
+		{"wrong type", "application/json", `{"name":7}`, http.StatusBadRequest, "malformed JSON"},
+		{"form without name", form, "email=a%40b.c", http.StatusBadRequest, "invalid name"},
+		{"form with blank name", form, "name=+", http.StatusBadRequest, "invalid name"},
+		{"form", form, "name=Ann", http.StatusCreated, ""},
+		{"json with byte order mark", "application/json", "\xEF\xBB\xBF" + `{"name":"Ann"}`, http.StatusCreated, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			r := newRequest(http.MethodPost, "/user", tt.body)
+			r.Header.Set("Content-Type", tt.contentType)
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantError == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error != tt.wantError {
+				t.Errorf("body = %s, want error %q", rec.Body, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+		wantName   string
+	}{
+		{"name", "/user?id=1", `{"name":" Anne "}`, http.StatusOK, "Anne"},
+		{"nothing", "/user?id=1", `{}`, http.StatusOK, "Ann"},
+		{"blank name", "/user?id=1", `{"name":" "}`, http.StatusBadRequest, "Ann"},
+		{"null name", "/user?id=1", `{"name":null}`, http.StatusOK, "Ann"},
+		{"empty body", "/user?id=1", "", http.StatusBadRequest, "Ann"},
+		{"malformed", "/user?id=1", `{"name":`, http.StatusBadRequest, "Ann"},
+		{"missing user", "/user?id=2", `{"name":"Bo"}`, http.StatusNotFound, "Ann"},
+		{"no id", "/user", `{"name":"Bo"}`, http.StatusBadRequest, "Ann"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			rec := serve(h, newRequest(http.MethodPatch, tt.target, tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var u UserResponse
+			if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/user/1", "")).Body.Bytes(), &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Name != tt.wantName {
+				t.Errorf("name = %q, want %q", u.Name, tt.wantName)
+			}
+			if u.UpdatedAt.Before(u.CreatedAt) {
+				t.Errorf("updated_at %v before created_at %v", u.UpdatedAt, u.CreatedAt)
+			}
+		})
+	}
+}
+
+func FuzzCreateUser(f *testing.F) {
+	for _, seed := range []string{
+		`{"name":"Ann"}`,
+		"\xEF\xBB\xBF",
+		"\xEF\xBB\xBF" + `{"name":"Ann"}`,
+		"\xEF\xBB\xBF \n" + `{"name":"Ann"}`,
+		`{"name":`,
+		`{"name":"Ann"`,
+		`{"name":1e999}`,
+		`{"name":"` + "\xff\xfe" + `"}`,
+		"\xc3\x28",
+		"name=Ann",
+		strings.Repeat(`{"name":"Ann"}`, 200),
+		"",
+	} {
+		f.Add(seed)
+	}
+	cfg := DefaultConfig()
+	cfg.rateLimit = 0
+	h := newTestServer(f, cfg, nil).Handler()
+
+	f.Fuzz(func(t *testing.T, body string) {
+		r := newRequest(http.MethodPost, "/user", body)
+		if body == "" || body[0] != '{' {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := serve(h, r)
+		switch rec.Code {
+		case http.StatusCreated:
+			return
+		case http.StatusBadRequest:
+		default:
+			t.Fatalf("status %d for %q: %s", rec.Code, body, rec.Body)
+		}
+		var resp ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("error body %q for %q is not an ErrorResponse: %v", rec.Body, body, err)
+		}
+		switch resp.Error {
+		case errEmptyBody.Error(), errMalformedJSON.Error(), errInvalidName.Error():
+		default:
+			t.Fatalf("error %q for %q", resp.Error, body)
+		}
+	})
+}
+
+func TestDuplicateParams(t *testing.T) {
+	for _, tt := range []struct {
+		method, target, body string
+		wantError            string
+	}{
+		{http.MethodGet, "/user?id=1&id=2", "", "duplicate parameter: id"},
+		{http.MethodGet, "/user?id=1&id=1", "", "duplicate parameter: id"},
+		{http.MethodPatch, "/user?id=1&id=2", `{"name":"Bo"}`, "duplicate parameter: id"},
+		{http.MethodPost, "/user", "name=Bo&name=Cy", "duplicate parameter: name"},
+		{http.MethodPost, "/user?name=Cy", "name=Bo", "duplicate parameter: name"},
+		{http.MethodGet, "/users?format=json&format=ndjson", "", "duplicate parameter: format"},
+	} {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			r := newRequest(tt.method, tt.target, tt.body)
+			if strings.HasPrefix(tt.body, "name=") {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := serve(h, r)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != tt.wantError {
+				t.Errorf("body = %s (%v), want error %q", rec.Body, err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestEmail(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		email     string
+		wantEmail string
+		// wantErr is the message for the email field of a 422, if any.
+		wantErr string
+	}{
+		{"none", "", "", ""},
+		{"plain", "ann@example.com", "ann@example.com", ""},
+		{"trimmed", "  ann@example.com ", "ann@example.com", ""},
+		{"subaddress", "ann+news@mail.example.com", "ann+news@mail.example.com", ""},
+		{"no at", "ann.example.com", "", errInvalidEmail.Error()},
+		{"no domain", "ann@", "", errInvalidEmail.Error()},
+		{"display name", "Ann <ann@example.com>", "", errInvalidEmail.Error()},
+		{"angle brackets", "<ann@example.com>", "", errInvalidEmail.Error()},
+		{"two addresses", "ann@example.com, bob@example.com", "", errInvalidEmail.Error()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			body, _ := json.Marshal(CreateUserRequest{Name: "Ann", Email: tt.email})
+			rec := serve(h, newRequest(http.MethodPost, "/user", string(body)))
+			if tt.wantErr != "" {
+				if rec.Code != http.StatusUnprocessableEntity {
+					t.Fatalf("status = %d, want 422: %s", rec.Code, rec.Body)
+				}
+				var resp ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Fields["email"] != tt.wantErr {
+					t.Errorf("body = %s (%v), want email: %q", rec.Body, err, tt.wantErr)
+				}
+				return
+			}
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+			}
+			var u UserResponse
+			if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/user/1", "")).Body.Bytes(), &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Email != tt.wantEmail {
+				t.Errorf("email = %q, want %q", u.Email, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		target     string
+		ifMatch    []string
+		wantStatus int
+	}{
+		{name: "unconditional", target: "/user?id=1", wantStatus: http.StatusOK},
+		{name: "current", target: "/user?id=1", ifMatch: []string{`"2"`}, wantStatus: http.StatusOK},
+		{name: "bare version", target: "/user?id=1", ifMatch: []string{"2"}, wantStatus: http.StatusOK},
+		{name: "any", target: "/user?id=1", ifMatch: []string{"*"}, wantStatus: http.StatusOK},
+		{name: "one of a list", target: "/user?id=1", ifMatch: []string{`"1", "2"`}, wantStatus: http.StatusOK},
+		{name: "one of several lines", target: "/user?id=1", ifMatch: []string{`"1"`, `"2"`}, wantStatus: http.StatusOK},
+		{name: "stale", target: "/user?id=1", ifMatch: []string{`"1"`}, wantStatus: http.StatusPreconditionFailed},
+		{name: "weak", target: "/user?id=1", ifMatch: []string{`W/"2"`}, wantStatus: http.StatusPreconditionFailed},
+		{name: "empty", target: "/user?id=1", ifMatch: []string{""}, wantStatus: http.StatusPreconditionFailed},
+		{name: "missing user", target: "/user?id=2", ifMatch: []string{"*"}, wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			serve(h, newRequest(http.MethodPatch, "/user?id=1", `{"name":"Anne"}`))
+
+			r := newRequest(http.MethodPatch, tt.target, `{"name":"Bo"}`)
+			if tt.ifMatch != nil {
+				r.Header["If-Match"] = tt.ifMatch
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusPreconditionFailed {
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != store.ErrPrecondition.Error() {
+					t.Errorf("body = %s (%v), want error %q", rec.Body, err, store.ErrPrecondition)
+				}
+			}
+
+			wantName, wantVersion := "Anne", `"2"`
+			if rec.Code == http.StatusOK {
+				wantName, wantVersion = "Bo", `"3"`
+				if got := rec.Header().Get("ETag"); got != wantVersion {
+					t.Errorf("update ETag = %s, want %s", got, wantVersion)
+				}
+			}
+			got := serve(h, newRequest(http.MethodGet, "/user/1", ""))
+			var u UserResponse
+			if err := json.Unmarshal(got.Body.Bytes(), &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Name != wantName || got.Header().Get("ETag") != wantVersion {
+				t.Errorf("user is %q with ETag %s, want %q with %s", u.Name, got.Header().Get("ETag"), wantName, wantVersion)
+			}
+		})
+	}
+}
+
+// TestStaleUpdates has writers that all read version 1 update the user at
+// once: only the first to get there may succeed.
+func TestStaleUpdates(t *testing.T) {
+	const writers = 20
+	cfg := DefaultConfig()
+	cfg.rateLimit = 0
+	h := newTestServer(t, cfg, nil).Handler()
+	serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+	etag := serve(h, newRequest(http.MethodGet, "/user/1", "")).Header().Get("ETag")
+
+	codes := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := newRequest(http.MethodPatch, "/user?id=1", `{"name":"writer `+strconv.Itoa(i)+`"}`)
+			r.Header.Set("If-Match", etag)
+			codes <- serve(h, r).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusPreconditionFailed] != writers-1 {
+		t.Errorf("statuses %v, want one 200 and the rest 412", counts)
+	}
+	if got := serve(h, newRequest(http.MethodGet, "/user/1", "")).Header().Get("ETag"); got != `"2"` {
+		t.Errorf("ETag = %s after the updates, want \"2\"", got)
+	}
+}
+
+// callRecorder is a Store recording the methods called on it, in order.
+type callRecorder struct {
+	store.Store
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *callRecorder) record(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, method)
+}
+
+func (c *callRecorder) Create(ctx context.Context, name, email string) (store.User, error) {
+	c.record("Create")
+	return c.Store.Create(ctx, name, email)
+}
+
+func (c *callRecorder) Get(ctx context.Context, id int64) (store.User, error) {
+	c.record("Get")
+	return c.Store.Get(ctx, id)
+}
+
+func (c *callRecorder) Update(ctx context.Context, id int64, fn func(*store.User) error) (store.User, error) {
+	c.record("Update")
+	return c.Store.Update(ctx, id, fn)
+}
+
+func (c *callRecorder) Delete(ctx context.Context, id int64) error {
+	c.record("Delete")
+	return c.Store.Delete(ctx, id)
+}
+
+func (c *callRecorder) List(ctx context.Context) ([]store.User, error) {
+	c.record("List")
+	return c.Store.List(ctx)
+}
+
+func (c *callRecorder) ListAfter(ctx context.Context, afterID int64, limit int) ([]store.User, error) {
+	c.record("ListAfter")
+	return c.Store.ListAfter(ctx, afterID, limit)
+}
+
+func (c *callRecorder) Count(ctx context.Context) (int, error) {
+	c.record("Count")
+	return c.Store.Count(ctx)
+}
+
+// TestHandlersUseStore checks the store calls behind each route, with one
+// user in the store.
+func TestHandlersUseStore(t *testing.T) {
+	for _, tt := range []struct {
+		method, target, body string
+		wantStatus           int
+		wantCalls            []string
+	}{
+		{http.MethodPost, "/user", `{"name":"Bob"}`, http.StatusCreated, []string{"Create"}},
+		{http.MethodPost, "/user", `{"name":""}`, http.StatusBadRequest, nil},
+		{http.MethodGet, "/user/1", "", http.StatusOK, []string{"Get"}},
+		{http.MethodGet, "/user?id=1", "", http.StatusOK, []string{"Get"}},
+		{http.MethodGet, "/user/2", "", http.StatusNotFound, []string{"Get"}},
+		{http.MethodPatch, "/user?id=1", `{"name":"Anne"}`, http.StatusOK, []string{"Update"}},
+		{http.MethodDelete, "/user?id=1", "", http.StatusNoContent, []string{"Delete"}},
+		{http.MethodDelete, "/user?id=2", "", http.StatusNotFound, []string{"Delete"}},
+		{http.MethodGet, "/users", "", http.StatusOK, []string{"List"}},
+		{http.MethodGet, "/users?format=ndjson", "", http.StatusOK, []string{"ListAfter"}},
+		{http.MethodGet, "/stats", "", http.StatusOK, []string{"Count"}},
+	} {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			st := &callRecorder{Store: s.users}
+			if _, err := st.Store.Create(context.Background(), "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			s.users = st
+			if rec := serve(s.Handler(), newRequest(tt.method, tt.target, tt.body)); rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !slices.Equal(st.calls, tt.wantCalls) {
+				t.Errorf("store calls %v, want %v", st.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"Jos\u00e9", "Jos\u00e9"},
+		{"Jose\u0301", "Jos\u00e9"},
+		{"  Jose\u0301  ", "Jos\u00e9"},
+		{"\t\u00c5ngstr\u00f6m\n", "\u00c5ngstr\u00f6m"},
+		{"A\u030angstro\u0308m", "\u00c5ngstr\u00f6m"},
+		{"Ann", "Ann"},
+		{"   ", ""},
+	} {
+		if got := normalizeName(tt.in); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestNamesStoredNormalized sends the decomposed and the precomposed form
+// of a name through every way a name is stored: both must end up alike.
+func TestNamesStoredNormalized(t *testing.T) {
+	const want = "Jos\u00e9"
+	for _, tt := range []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        func(name string) string
+	}{
+		{"create", http.MethodPost, "/user", "application/json",
+			func(name string) string { return `{"name":"` + name + `"}` }},
+		{"create from a form", http.MethodPost, "/user", "application/x-www-form-urlencoded",
+			func(name string) string { return "name=" + url.QueryEscape(name) }},
+		{"update", http.MethodPatch, "/user?id=1", "application/json",
+			func(name string) string { return `{"name":"` + name + `"}` }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"  Jose\u0301  ", "Jos\u00e9"} {
+				h := newTestServer(t, DefaultConfig(), nil).Handler()
+				serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+				r := newRequest(tt.method, tt.target, tt.body(name))
+				r.Header.Set("Content-Type", tt.contentType)
+				if rec := serve(h, r); rec.Code >= 300 {
+					t.Fatalf("%q: status = %d: %s", name, rec.Code, rec.Body)
+				}
+				var users []UserResponse
+				if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/users", "")).Body.Bytes(), &users); err != nil {
+					t.Fatal(err)
+				}
+				if got := users[len(users)-1].Name; got != want {
+					t.Errorf("%q stored as %q (% x), want %q", name, got, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	for _, tt := range []struct {
+		name, method, target, body string
+		wantStatus                 int
+		// wantFields are the fields a validation error names.
+		wantFields []string
+	}{
+		{name: "valid create", method: http.MethodPost, target: "/user?dry_run=1",
+			body: `{"name":"Bo","email":"bo@example.com"}`, wantStatus: http.StatusOK},
+		{name: "invalid create", method: http.MethodPost, target: "/user?dry_run=true",
+			body: `{"name":"Bo","email":"nope"}`, wantStatus: http.StatusUnprocessableEntity, wantFields: []string{"email"}},
+		{name: "blank name", method: http.MethodPost, target: "/user?dry_run=true",
+			body: `{"name":" "}`, wantStatus: http.StatusBadRequest},
+		{name: "valid update", method: http.MethodPatch, target: "/user?id=1&dry_run=true",
+			body: `{"name":"Anne"}`, wantStatus: http.StatusOK},
+		{name: "invalid update", method: http.MethodPatch, target: "/user?id=1&dry_run=true",
+			body: `{"email":"nope"}`, wantStatus: http.StatusUnprocessableEntity, wantFields: []string{"email"}},
+		{name: "update of a missing user", method: http.MethodPatch, target: "/user?id=9&dry_run=true",
+			body: `{"name":"Anne"}`, wantStatus: http.StatusNotFound},
+		{name: "explicitly off", method: http.MethodPost, target: "/user?dry_run=false",
+			body: `{"name":"Bo"}`, wantStatus: http.StatusCreated},
+		{name: "bad value", method: http.MethodPost, target: "/user?dry_run=maybe",
+			body: `{"name":"Bo"}`, wantStatus: http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.rateLimit = 0
+			s := newTestServer(t, cfg, nil)
+			h := s.Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			before := serve(h, newRequest(http.MethodGet, "/users", "")).Body.String()
+
+			rec := serve(h, newRequest(tt.method, tt.target, tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			switch {
+			case tt.wantStatus == http.StatusOK:
+				var resp DryRunResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !resp.Valid {
+					t.Errorf("body = %s (%v), want valid", rec.Body, err)
+				}
+			case tt.wantFields != nil:
+				var resp ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !slices.Equal(slices.Sorted(maps.Keys(resp.Fields)), tt.wantFields) {
+					t.Errorf("body = %s (%v), want errors for %v", rec.Body, err, tt.wantFields)
+				}
+			}
+			if rec.Code == http.StatusCreated {
+				return
+			}
+			if after := serve(h, newRequest(http.MethodGet, "/users", "")).Body.String(); after != before {
+				t.Errorf("the store changed: %s, was %s", after, before)
+			}
+		})
+	}
+}
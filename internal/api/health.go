@@ -0,0 +1,56 @@
+package api
+
+import "net/http"
+
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	s.writeJSON(w, r, http.StatusOK, StatusResponse{Status: "ok"})
+	return nil
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) error {
+	if !s.ready.Load() {
+		return &APIError{Status: http.StatusServiceUnavailable, Code: "not_ready", Message: "not ready"}
+	}
+	s.writeJSON(w, r, http.StatusOK, StatusResponse{Status: "ready"})
+	return nil
+}
+
+// beginShutdown flips readiness off and makes rejectWhileDraining turn away
+// new requests, while requests already in flight run to completion.
+func (s *Server) beginShutdown() {
+	s.ready.Store(false)
+	s.draining.Store(true)
+}
+
+func (s *Server) rejectWhileDraining() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.draining.Load() {
+				w.Header().Set("Connection", "close")
+				w.Header().Set("Retry-After", retryAfterUnavailable)
+				s.errorJSON(w, r, http.StatusServiceUnavailable, "server is shutting down")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectInMaintenance answers API requests with 503 while maintenance mode
+// is on.
+func (s *Server) rejectInMaintenance() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.live.Load().maintenance {
+				w.Header().Set("Retry-After", retryAfterUnavailable)
+				s.errorJSON(w, r, http.StatusServiceUnavailable, "down for maintenance")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
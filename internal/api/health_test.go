@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		state       func(*Server)
+		wantHealthz int
+		wantReady   int
+	}{
+		{"starting", func(*Server) {}, http.StatusOK, http.StatusServiceUnavailable},
+		{"serving", func(s *Server) { s.ready.Store(true) }, http.StatusOK, http.StatusOK},
+		{"shutting down", func(s *Server) { s.ready.Store(true); s.beginShutdown() }, http.StatusOK, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			tt.state(s)
+			h := s.Handler()
+			for path, want := range map[string]int{"/healthz": tt.wantHealthz, "/ready": tt.wantReady} {
+				// Probes carry no credentials.
+				r := newRequest(http.MethodGet, path, "")
+				r.Header.Del("X-API-Key")
+				if rec := serve(h, r); rec.Code != want {
+					t.Errorf("%s: status = %d, want %d: %s", path, rec.Code, want, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestDraining(t *testing.T) {
+	s := newTestServer(t, DefaultConfig(), nil)
+	s.ready.Store(true)
+	entered, release := make(chan struct{}), make(chan struct{})
+	slow := s.rejectWhileDraining()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	inFlight := make(chan int)
+	go func() { inFlight <- serve(slow, newRequest(http.MethodGet, "/user/1", "")).Code }()
+	<-entered
+	s.beginShutdown()
+
+	h := s.Handler()
+	for _, tt := range []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/user/1", http.StatusServiceUnavailable},
+		{"/user?id=1", http.StatusServiceUnavailable},
+		{"/healthz", http.StatusOK},
+		{"/ready", http.StatusServiceUnavailable},
+	} {
+		rec := serve(h, newRequest(http.MethodGet, tt.target, ""))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.target, rec.Code, tt.wantStatus)
+		}
+		if tt.target == "/user/1" {
+			if rec.Header().Get("Connection") != "close" || rec.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: rejected without Connection: close and Retry-After: %v", tt.target, rec.Header())
+			}
+		}
+	}
+
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("request in flight: status = %d, want 200", code)
+	}
+}
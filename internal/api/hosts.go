@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostAllowed matches host, the Host header of a request, against the
+// hosts allowed. Names are compared without regard to case, and the port
+// only counts for entries that have one. An entry like *.example.com
+// allows any subdomain of example.com, but not example.com itself.
+func hostAllowed(hosts []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = strings.TrimSuffix(h, ".")
+	}
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		candidate := name
+		if _, _, err := net.SplitHostPort(allowed); err == nil {
+			candidate = host
+		}
+		if allowed == candidate {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok &&
+			strings.HasSuffix(candidate, "."+suffix) && len(candidate) > len(suffix)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost rejects requests whose Host header is missing or not in
+// cfg.allowedHosts with a 400, so that links and redirects built from it
+// cannot be pointed elsewhere. An empty allowlist lets everything through.
+// The health endpoints are exempt, as probes tend to address the server by
+// IP.
+func (s *Server) checkHost() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(s.cfg.allowedHosts) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "" && hostAllowed(s.cfg.allowedHosts, r.Host) ||
+				r.URL.Path == "/healthz" || r.URL.Path == "/ready" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s.log(r.Context()).Warn("host not allowed", "host", r.Host)
+			s.errorJSON(w, r, http.StatusBadRequest, "host not allowed")
+		})
+	}
+}
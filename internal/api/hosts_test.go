@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	hosts := []string{"api.example.com", "*.example.org", "Internal:8080", "[::1]:8443"}
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com", true},
+		{"API.Example.COM", true},
+		{"api.example.com.", true},
+		{"api.example.com:8080", true},
+		{"www.example.com", false},
+		{"example.com", false},
+		{"a.example.org", true},
+		{"a.b.example.org:443", true},
+		{"example.org", false},
+		{".example.org", false},
+		{"evilexample.org", false},
+		{"internal:8080", true},
+		{"internal", false},
+		{"internal:9090", false},
+		{"[::1]:8443", true},
+		{"[::1]", false},
+		{"", false},
+	} {
+		if got := hostAllowed(hosts, tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, tt := range []struct {
+		name, allowed, host, target string
+		wantStatus                  int
+	}{
+		{"allowed", "api.example.com", "api.example.com", "/users", http.StatusOK},
+		{"wildcard", "*.example.com", "eu.example.com", "/users", http.StatusOK},
+		{"not allowed", "api.example.com", "evil.example", "/users", http.StatusBadRequest},
+		{"no host", "api.example.com", "", "/users", http.StatusBadRequest},
+		{"not allowed, unauthenticated", "api.example.com", "evil.example", "/openapi.json", http.StatusBadRequest},
+		{"health exempt", "api.example.com", "10.0.0.7:8080", "/healthz", http.StatusOK},
+		// Not ready, as the server is not listening, but not refused.
+		{"readiness exempt", "api.example.com", "10.0.0.7:8080", "/ready", http.StatusServiceUnavailable},
+		{"no allowlist", "", "evil.example", "/users", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			cfg := configFromFlags(t, "-allowed-hosts="+tt.allowed)
+			h := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Host = tt.host
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			warned := logRecords(t, logs.String(), "host not allowed")
+			if tt.wantStatus != http.StatusBadRequest {
+				if len(warned) != 0 {
+					t.Errorf("warned about an allowed host: %v", warned)
+				}
+				return
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "host not allowed" {
+				t.Errorf("body = %s (%v)", rec.Body, err)
+			}
+			if len(warned) != 1 || warned[0]["host"] != tt.host {
+				t.Errorf("warnings %v, want one naming host %q", warned, tt.host)
+			}
+		})
+	}
+}
+
+func TestAllowedHostsConfig(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		args []string
+		want []string
+	}{
+		{"", nil, nil},
+		{"api.example.com, *.example.org", nil, []string{"api.example.com", "*.example.org"}},
+		{"api.example.com", []string{"-allowed-hosts=other.example"}, []string{"other.example"}},
+	} {
+		t.Setenv("API_KEYS", testKey)
+		t.Setenv("ALLOWED_HOSTS", tt.env)
+		cfg, _, err := readConfig(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(cfg.allowedHosts, tt.want) {
+			t.Errorf("ALLOWED_HOSTS=%q %q: allowedHosts = %q, want %q", tt.env, tt.args, cfg.allowedHosts, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// replayedHeaders are the response headers stored with an idempotent
+// response; everything else is produced afresh for the retry.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+type idempotentResponse struct {
+	// fingerprint identifies the request, as requestFingerprint computes
+	// it.
+	fingerprint [32]byte
+	// done is closed once the first request has finished; the fields
+	// below are only valid after that.
+	done    chan struct{}
+	ok      bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyCache remembers responses by idempotency key for ttl, holding
+// at most max of them.
+type idempotencyCache struct {
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, max int, now func() time.Time) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		max:     max,
+		now:     now,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+// claim returns the entry for key. If there is none, or it has expired, a
+// new pending entry is created and owner is true: the caller must execute
+// the request and then call finish. When the cache is full of requests
+// still running, ok is false and nothing is created.
+func (c *idempotencyCache) claim(key string, fingerprint [32]byte) (e *idempotentResponse, owner, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.lastSweep) >= sweepInterval || len(c.entries) >= c.max {
+		c.sweep(now)
+		c.lastSweep = now
+	}
+
+	if e, found := c.entries[key]; found {
+		if !e.completed() || now.Before(e.expires) {
+			return e, false, true
+		}
+		// Expired, but not swept yet.
+		delete(c.entries, key)
+	}
+	if len(c.entries) >= c.max && !c.evictOldest() {
+		return nil, false, false
+	}
+	e = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	c.entries[key] = e
+	return e, true, true
+}
+
+// finish publishes the outcome of a claimed request. Unsuccessful requests
+// are forgotten so that a retry executes again.
+func (c *idempotencyCache) finish(key string, e *idempotentResponse, ok bool) {
+	c.mu.Lock()
+	e.ok = ok
+	if ok {
+		e.expires = c.now().Add(c.ttl)
+	} else {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+func (c *idempotencyCache) sweep(now time.Time) {
+	for key, e := range c.entries {
+		if e.completed() && !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// evictOldest drops the completed entry closest to expiry, reporting
+// whether there was one. Pending entries are never dropped, as their
+// requests are still running.
+func (c *idempotencyCache) evictOldest() bool {
+	var oldestKey string
+	var oldest *idempotentResponse
+	for key, e := range c.entries {
+		if e.completed() && (oldest == nil || e.expires.Before(oldest.expires)) {
+			oldestKey, oldest = key, e
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(c.entries, oldestKey)
+	return true
+}
+
+func (e *idempotentResponse) completed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotent makes POST handlers safe to retry: the first request with a
+// given Idempotency-Key runs normally and its response is kept for the
+// cache TTL; later requests with that key and the same body get the stored
+// response, and with a different body a 422. A retry that arrives while the
+// first request is still running waits for it instead of executing again.
+// Keys are scoped to the principal that presented them and to the method
+// and path they were sent to, and the body, like the query, is part of the
+// request fingerprint that must match. When idempotencyMaxKeys requests
+// with a key are all still running, further ones get a 503 rather than
+// growing the cache past it. Dry runs change nothing, so they are neither
+// replayed nor remembered.
+func (s *Server) idempotent() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if dry, _ := strconv.ParseBool(r.URL.Query().Get(dryRunParam)); key == "" || dry {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				s.errorJSON(w, r, http.StatusBadRequest, "invalid Idempotency-Key")
+				return
+			}
+
+			body, err := readBody(r)
+			if err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			fingerprint := requestFingerprint(r, body)
+			cacheKey := principalFromContext(r.Context()).name + ":" + r.Method + " " + r.URL.Path + ":" + key
+
+			for {
+				e, owner, ok := s.idempotency.claim(cacheKey, fingerprint)
+				if !ok {
+					w.Header().Set("Retry-After", retryAfterUnavailable)
+					s.errorJSON(w, r, http.StatusServiceUnavailable, "too many requests with an Idempotency-Key in progress")
+					return
+				}
+				if owner {
+					s.executeIdempotent(w, r, next, cacheKey, e)
+					return
+				}
+				if e.fingerprint != fingerprint {
+					s.errorJSON(w, r, http.StatusUnprocessableEntity,
+						"Idempotency-Key was already used with a different request")
+					return
+				}
+
+				select {
+				case <-e.done:
+				case <-r.Context().Done():
+					return
+				}
+				if !e.ok {
+					// The first attempt failed and was forgotten; run this one.
+					continue
+				}
+
+				h := w.Header()
+				for name, v := range e.header {
+					h[name] = v
+				}
+				h.Set("Idempotent-Replayed", "true")
+				w.WriteHeader(e.status)
+				_, _ = w.Write(e.body)
+				return
+			}
+		})
+	}
+}
+
+// requestFingerprint hashes what makes r the request it is: its method,
+// path, query and body.
+func requestFingerprint(r *http.Request, body []byte) [32]byte {
+	h := sha256.New()
+	for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func (s *Server) executeIdempotent(w http.ResponseWriter, r *http.Request, next http.Handler, cacheKey string, e *idempotentResponse) {
+	ir := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+	ok := false
+	defer func() {
+		s.idempotency.finish(cacheKey, e, ok)
+	}()
+
+	next.ServeHTTP(ir, r)
+
+	e.status = ir.status
+	e.body = ir.body.Bytes()
+	e.header = make(http.Header)
+	for _, name := range replayedHeaders {
+		if v := w.Header().Values(name); len(v) > 0 {
+			e.header[name] = v
+		}
+	}
+	// Server errors are not remembered so that the client's retry can
+	// succeed.
+	ok = ir.status < http.StatusInternalServerError
+}
+
+// idempotencyRecorder passes the response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (ir *idempotencyRecorder) WriteHeader(code int) {
+	if !ir.wroteHeader {
+		ir.status = code
+		ir.wroteHeader = true
+	}
+	ir.ResponseWriter.WriteHeader(code)
+}
+
+func (ir *idempotencyRecorder) Write(b []byte) (int, error) {
+	ir.wroteHeader = true
+	ir.body.Write(b)
+	return ir.ResponseWriter.Write(b)
+}
+
+func (ir *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return ir.ResponseWriter
+}
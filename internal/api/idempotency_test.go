@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	type step struct {
+		// wait is how long the clock moves on before the request.
+		wait           time.Duration
+		target, body   string
+		idempotencyKey string
+		wantStatus     int
+		wantReplayed   bool
+	}
+	post := func(key, body string, wantStatus int, wantReplayed bool) step {
+		return step{target: "/user", body: body, idempotencyKey: key, wantStatus: wantStatus, wantReplayed: wantReplayed}
+	}
+	for _, tt := range []struct {
+		name      string
+		steps     []step
+		wantUsers int
+	}{
+		{"replay", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			post("k1", `{"name":"Ann"}`, 201, true),
+		}, 1},
+		{"different body", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			post("k1", `{"name":"Bob"}`, 422, false),
+		}, 1},
+		{"different query", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			{target: "/user?pretty=true", body: `{"name":"Ann"}`, idempotencyKey: "k1", wantStatus: 422},
+		}, 1},
+		{"different keys", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			post("k2", `{"name":"Ann"}`, 201, false),
+		}, 2},
+		{"no key", []step{
+			post("", `{"name":"Ann"}`, 201, false),
+			post("", `{"name":"Ann"}`, 201, false),
+		}, 2},
+		{"expired", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			{wait: 23 * time.Hour, target: "/user", body: `{"name":"Ann"}`, idempotencyKey: "k1", wantStatus: 201, wantReplayed: true},
+			{wait: time.Hour, target: "/user", body: `{"name":"Ann"}`, idempotencyKey: "k1", wantStatus: 201},
+		}, 2},
+		{"expired between sweeps", []step{
+			post("k1", `{"name":"Ann"}`, 201, false),
+			{wait: 24*time.Hour - sweepInterval/2, target: "/user", body: `{"name":"Ann"}`, idempotencyKey: "k1", wantStatus: 201, wantReplayed: true},
+			{wait: sweepInterval / 2, target: "/user", body: `{"name":"Ann"}`, idempotencyKey: "k1", wantStatus: 201},
+		}, 2},
+		{"client errors are kept", []step{
+			post("k1", `{"name":" "}`, 400, false),
+			post("k1", `{"name":" "}`, 400, true),
+		}, 0},
+		{"key too long", []step{
+			post(strings.Repeat("k", maxIdempotencyKeyLen+1), `{"name":"Ann"}`, 400, false),
+		}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.rateLimit = 0
+			clock := newFakeClock()
+			s := newTestServerAt(t, cfg, nil, clock.now)
+			h := s.Handler()
+			var first string
+			for i, st := range tt.steps {
+				clock.advance(st.wait)
+				r := newRequest(http.MethodPost, st.target, st.body)
+				if st.idempotencyKey != "" {
+					r.Header.Set(idempotencyKeyHeader, st.idempotencyKey)
+				}
+				rec := serve(h, r)
+				if rec.Code != st.wantStatus {
+					t.Errorf("request %d: status = %d, want %d: %s", i, rec.Code, st.wantStatus, rec.Body)
+				}
+				if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != st.wantReplayed {
+					t.Errorf("request %d: replayed = %v, want %v", i, replayed, st.wantReplayed)
+				}
+				if i == 0 {
+					first = rec.Body.String()
+				} else if st.wantReplayed && rec.Body.String() != first {
+					t.Errorf("request %d: replayed %s, first response was %s", i, rec.Body, first)
+				}
+			}
+			if n, _ := s.users.Count(context.Background()); n != tt.wantUsers {
+				t.Errorf("%d users created, want %d", n, tt.wantUsers)
+			}
+		})
+	}
+}
+
+// blockingCreates returns POST /user behind idempotent, with each create
+// reporting on entered and then waiting for release to be closed.
+func blockingCreates(s *Server, entered chan struct{}, release <-chan struct{}) http.Handler {
+	return s.idempotent()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		s.handleCreateUser(w, r)
+	}))
+}
+
+// TestIdempotencyConcurrent sends the same request many times at once:
+// only one of them may create the user, and the others must wait for it
+// and replay its response.
+func TestIdempotencyConcurrent(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		requests int
+	}{
+		{"two", 2},
+		{"many", 50},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			entered, release := make(chan struct{}, tt.requests), make(chan struct{})
+			h := blockingCreates(s, entered, release)
+
+			type response struct {
+				code     int
+				replayed bool
+				body     string
+			}
+			responses := make(chan response, tt.requests)
+			var wg sync.WaitGroup
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := newRequest(http.MethodPost, "/user", `{"name":"Ann"}`)
+					r.Header.Set(idempotencyKeyHeader, "k1")
+					rec := serve(h, r)
+					responses <- response{rec.Code, rec.Header().Get("Idempotent-Replayed") == "true", rec.Body.String()}
+				}()
+			}
+			<-entered
+			close(release)
+			wg.Wait()
+			close(responses)
+
+			var executed int
+			var body string
+			for resp := range responses {
+				if resp.code != http.StatusCreated {
+					t.Errorf("status = %d: %s", resp.code, resp.body)
+				}
+				if !resp.replayed {
+					executed++
+				}
+				if body == "" {
+					body = resp.body
+				} else if resp.body != body {
+					t.Errorf("responses differ: %s and %s", resp.body, body)
+				}
+			}
+			if executed != 1 || len(entered) != 0 {
+				t.Errorf("%d responses not replayed, %d more creates; want the request executed once", executed, len(entered))
+			}
+			var u UserResponse
+			if err := json.Unmarshal([]byte(body), &u); err != nil || u.UserID != 1 {
+				t.Errorf("created %s (%v), want user 1", body, err)
+			}
+		})
+	}
+}
+
+func TestIdempotencyFull(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.idempotencyMaxKeys = 1
+	s := newTestServer(t, cfg, nil)
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	h := blockingCreates(s, entered, release)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodPost, "/user", `{"name":"Ann"}`)
+		r.Header.Set(idempotencyKeyHeader, key)
+		return serve(h, r)
+	}
+	first := make(chan int)
+	go func() { first <- send("k1").Code }()
+	<-entered
+
+	// The only entry is still running, so it cannot make room.
+	rec := send("k2")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("while full: status = %d, Retry-After %q; want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	if code := <-first; code != http.StatusCreated {
+		t.Errorf("first request: status = %d", code)
+	}
+
+	// Once it has finished it can be evicted.
+	if rec := send("k2"); rec.Code != http.StatusCreated {
+		t.Errorf("after the first finished: status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestIdempotencyConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-idempotency-ttl=1m", "-idempotency-max-keys=1"}, false},
+		{[]string{"-idempotency-ttl=0"}, true},
+		{[]string{"-idempotency-ttl=-1h"}, true},
+		{[]string{"-idempotency-max-keys=0"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// janitorInterval is how often expireUsers sweeps for a given TTL: often
+// enough that expired users do not linger for long, but at most once a
+// second and at least once a minute.
+func janitorInterval(ttl time.Duration) time.Duration {
+	return min(max(ttl/2, time.Second), time.Minute)
+}
+
+// expireUsers removes expired users from the store until ctx is done. It
+// returns at once if users do not expire.
+func (s *Server) expireUsers(ctx context.Context) {
+	if s.cfg.userTTL <= 0 {
+		return
+	}
+	t := time.NewTicker(janitorInterval(s.cfg.userTTL))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.users.Expire(ctx)
+			switch {
+			case err != nil:
+				s.logger.Error("expiring users failed", "err", err)
+			case n > 0:
+				s.logger.Info("expired users removed", "count", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestUserTTL(t *testing.T) {
+	const ttl = time.Minute
+	type step struct {
+		wait                 time.Duration
+		method, target, body string
+		wantStatus           int
+	}
+	get := func(wait time.Duration, wantStatus int) step {
+		return step{wait: wait, method: http.MethodGet, target: "/user/1", wantStatus: wantStatus}
+	}
+	for _, tt := range []struct {
+		name      string
+		steps     []step
+		wantUsers int
+	}{
+		{"fresh", []step{get(ttl-time.Second, http.StatusOK)}, 1},
+		{"expired", []step{get(ttl, http.StatusNotFound)}, 0},
+		{"update extends", []step{
+			get(40*time.Second, http.StatusOK),
+			{method: http.MethodPatch, target: "/user?id=1", body: `{"name":"Anne"}`, wantStatus: http.StatusOK},
+			get(40*time.Second, http.StatusOK),
+			get(20*time.Second, http.StatusNotFound),
+		}, 0},
+		{"expired cannot be updated", []step{
+			{wait: ttl, method: http.MethodPatch, target: "/user?id=1", body: `{"name":"Anne"}`, wantStatus: http.StatusNotFound},
+		}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.userTTL = ttl
+			clock := newFakeClock()
+			s := newTestServerAt(t, cfg, nil, clock.now)
+			useStore(s, store.NewMemory(ttl, clock.now))
+			h := s.Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			for i, st := range tt.steps {
+				clock.advance(st.wait)
+				if rec := serve(h, newRequest(st.method, st.target, st.body)); rec.Code != st.wantStatus {
+					t.Errorf("step %d: %s %s: status = %d, want %d", i, st.method, st.target, rec.Code, st.wantStatus)
+				}
+			}
+			var users []UserResponse
+			if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/users", "")).Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != tt.wantUsers {
+				t.Errorf("listed %d users, want %d", len(users), tt.wantUsers)
+			}
+			// The stream reads the store a page at a time, but leaves out
+			// the same users.
+			stream := serve(h, newRequest(http.MethodGet, "/users?format=ndjson", "")).Body.Bytes()
+			if n := bytes.Count(stream, []byte("\n")); n != tt.wantUsers {
+				t.Errorf("streamed %d users, want %d", n, tt.wantUsers)
+			}
+		})
+	}
+}
+
+func TestJanitorInterval(t *testing.T) {
+	for _, tt := range []struct {
+		ttl, want time.Duration
+	}{
+		{100 * time.Millisecond, time.Second},
+		{time.Second, time.Second},
+		{30 * time.Second, 15 * time.Second},
+		{2 * time.Minute, time.Minute},
+		{24 * time.Hour, time.Minute},
+	} {
+		if got := janitorInterval(tt.ttl); got != tt.want {
+			t.Errorf("janitorInterval(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestExpireUsers(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ttl  time.Duration
+		// wantSweep tells whether expireUsers keeps running and sweeps.
+		wantSweep bool
+	}{
+		{"off", 0, false},
+		{"on", time.Second, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.userTTL = tt.ttl
+			clock := newFakeClock()
+			var logs syncBuffer
+			s := newTestServerAt(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)), clock.now)
+			useStore(s, store.NewMemory(tt.ttl, clock.now))
+			s.users.Create(context.Background(), "Ann", "")
+			s.users.Create(context.Background(), "Bob", "")
+			clock.advance(tt.ttl)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				s.expireUsers(ctx)
+				close(done)
+			}()
+			if !tt.wantSweep {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Fatal("expireUsers kept running without a TTL")
+				}
+				return
+			}
+
+			// The first sweep is due a janitorInterval after the start.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(logRecords(t, logs.String(), "expired users removed")) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("no sweep")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("expireUsers did not return once canceled")
+			}
+			if recs := logRecords(t, logs.String(), "expired users removed"); len(recs) != 1 || recs[0]["count"] != 2.0 {
+				t.Errorf("logged %v, want the 2 users removed", recs)
+			}
+			if n, _ := s.users.Expire(context.Background()); n != 0 {
+				t.Errorf("%d expired users left in the store, want them removed", n)
+			}
+		})
+	}
+}
+
+func TestUserTTLConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-user-ttl=24h"}, false},
+		{[]string{"-user-ttl=-1m"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"io"
+)
+
+// Field naming strategies for JSON responses. The struct tags are
+// snake_case; camelCase is produced by rewriting the encoded keys.
+const (
+	jsonCaseSnake = "snake"
+	jsonCaseCamel = "camel"
+)
+
+// camelKeys rewrites the object keys of the encoded JSON in b from
+// snake_case to camelCase, leaving values and layout untouched. Map keys
+// are object keys too, so the field names in a validation error follow
+// the same casing as the fields themselves.
+func camelKeys(b []byte) []byte {
+	if bytes.IndexByte(b, '_') < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		if b[i] != '"' {
+			out = append(out, b[i])
+			i++
+			continue
+		}
+		end := stringEnd(b, i)
+		str := b[i:end]
+		j := end
+		for j < len(b) && (b[j] == ' ' || b[j] == '\n' || b[j] == '\t' || b[j] == '\r') {
+			j++
+		}
+		if j < len(b) && b[j] == ':' {
+			str = camelKey(str)
+		}
+		out = append(out, str...)
+		i = end
+	}
+	return out
+}
+
+// stringEnd is the index just past the JSON string starting with the quote
+// at b[i].
+func stringEnd(b []byte, i int) int {
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// camelKey turns the quoted key "user_id" into "userId". Underscores that
+// do not separate two words are kept.
+func camelKey(key []byte) []byte {
+	if bytes.IndexByte(key, '_') < 0 {
+		return key
+	}
+	out := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		if key[i] == '_' && i > 1 && i+2 < len(key) && 'a' <= key[i+1] && key[i+1] <= 'z' {
+			out = append(out, key[i+1]-'a'+'A')
+			i++
+			continue
+		}
+		out = append(out, key[i])
+	}
+	return out
+}
+
+// camelWriter applies camelKeys to every Write. json.Encoder writes each
+// value whole, so keys are never split between writes.
+type camelWriter struct {
+	w io.Writer
+}
+
+func (cw camelWriter) Write(p []byte) (int, error) {
+	if _, err := cw.w.Write(camelKeys(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
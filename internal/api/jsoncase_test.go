@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCamelKeys(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{`{"user_id":1}`, `{"userId":1}`},
+		{`{"created_at":"2024","updated_at":"2024"}`, `{"createdAt":"2024","updatedAt":"2024"}`},
+		{`{"name":"snake_case_value"}`, `{"name":"snake_case_value"}`},
+		{`["user_id"]`, `["user_id"]`},
+		{`{"fields":{"first_name":"too_long"}}`, `{"fields":{"firstName":"too_long"}}`},
+		{`{"a\"_b":1}`, `{"a\"B":1}`},
+		{`{"say_\"hi\"":"x_y"}`, `{"say_\"hi\"":"x_y"}`},
+		{"{\n  \"user_id\" : 1\n}", "{\n  \"userId\" : 1\n}"},
+		{`{"_private":1,"trailing_":2,"a__b":3,"x_1":4}`, `{"_private":1,"trailing_":2,"a_B":3,"x_1":4}`},
+		{`{"no_underscore`, `{"no_underscore`},
+	} {
+		if got := string(camelKeys([]byte(tt.in))); got != tt.want {
+			t.Errorf("camelKeys(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJSONCase(t *testing.T) {
+	for _, tt := range []struct {
+		jsonCase string
+		// wantKeys are the keys of a user response, and wantField the key
+		// of the invalid email in a validation error.
+		wantKeys  []string
+		wantField string
+	}{
+		{jsonCaseSnake, []string{"created_at", "email", "name", "updated_at", "user_id", "version"}, "email"},
+		{jsonCaseCamel, []string{"createdAt", "email", "name", "updatedAt", "userId", "version"}, "email"},
+	} {
+		t.Run(tt.jsonCase, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.jsonCase = tt.jsonCase
+			h := newTestServer(t, cfg, nil).Handler()
+			for _, req := range []struct {
+				method, target, body string
+			}{
+				{http.MethodPost, "/user", `{"name":"Ann_Lee","email":"ann@example.com"}`},
+				{http.MethodGet, "/user/1", ""},
+				{http.MethodGet, "/users", ""},
+				{http.MethodGet, "/users?format=ndjson", ""},
+				{http.MethodPatch, "/user?id=1", `{"name":"Ann_Lee"}`},
+			} {
+				rec := serve(h, newRequest(req.method, req.target, req.body))
+				if rec.Code >= 300 {
+					t.Fatalf("%s %s: status = %d: %s", req.method, req.target, rec.Code, rec.Body)
+				}
+				body := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSpace(rec.Body.String()), "]"), "[")
+				var u map[string]any
+				if err := json.Unmarshal([]byte(body), &u); err != nil {
+					t.Fatalf("%s %s: %v: %s", req.method, req.target, err, rec.Body)
+				}
+				keys := slices.Sorted(maps.Keys(u))
+				for _, k := range tt.wantKeys {
+					if !slices.Contains(keys, k) {
+						t.Errorf("%s %s: keys %v, want %v among them", req.method, req.target, keys, tt.wantKeys)
+						break
+					}
+				}
+				if tt.jsonCase == jsonCaseCamel && strings.Contains(strings.Join(keys, ","), "_") {
+					t.Errorf("%s %s: snake_case among keys %v", req.method, req.target, keys)
+				}
+				// Values are left alone.
+				if u["name"] != "Ann_Lee" {
+					t.Errorf("%s %s: name = %v", req.method, req.target, u["name"])
+				}
+			}
+
+			rec := serve(h, newRequest(http.MethodPost, "/user", `{"name":"Bo","email":"nope"}`))
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Fields[tt.wantField] == "" {
+				t.Errorf("validation error %s (%v), want field %q", rec.Body, err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestJSONCaseConfig(t *testing.T) {
+	for _, tt := range []struct {
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"", jsonCaseSnake, false},
+		{"snake", jsonCaseSnake, false},
+		{"camel", jsonCaseCamel, false},
+		{"kebab", "", true},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			t.Setenv("JSON_CASE", tt.env)
+			cfg, _, err := readConfig(nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.jsonCase != tt.want {
+				t.Errorf("jsonCase = %q, want %q", cfg.jsonCase, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenInvalid = errors.New("invalid token")
+)
+
+// audience is the JWT "aud" claim, which may be a single string or an
+// array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Scope     string   `json:"scope"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// verifyJWT checks an HS256 token against cfg.jwtSecret and its exp, nbf,
+// iss and aud claims, allowing cfg.jwtLeeway of clock skew. Tokens without
+// exp or sub are refused. Errors wrap errTokenExpired or errTokenInvalid.
+func (s *Server) verifyJWT(token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: not a JWT", errTokenInvalid)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, fmt.Errorf("%w: header: %v", errTokenInvalid, err)
+	}
+	if header.Alg != "HS256" {
+		return claims, fmt.Errorf("%w: unsupported alg %q", errTokenInvalid, header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: signature: %v", errTokenInvalid, err)
+	}
+	mac := hmac.New(sha256.New, s.cfg.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, fmt.Errorf("%w: bad signature", errTokenInvalid)
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("%w: claims: %v", errTokenInvalid, err)
+	}
+	leeway := s.cfg.jwtLeeway
+	switch {
+	case claims.ExpiresAt == nil:
+		return claims, fmt.Errorf("%w: no exp claim", errTokenInvalid)
+	case now.Add(-leeway).After(numericDate(*claims.ExpiresAt)):
+		return claims, errTokenExpired
+	case claims.NotBefore != nil && now.Add(leeway).Before(numericDate(*claims.NotBefore)):
+		return claims, fmt.Errorf("%w: not valid yet", errTokenInvalid)
+	case s.cfg.jwtIssuer != "" && claims.Issuer != s.cfg.jwtIssuer:
+		return claims, fmt.Errorf("%w: wrong issuer", errTokenInvalid)
+	case s.cfg.jwtAudience != "" && !slices.Contains(claims.Audience, s.cfg.jwtAudience):
+		return claims, fmt.Errorf("%w: wrong audience", errTokenInvalid)
+	case claims.Subject == "":
+		return claims, fmt.Errorf("%w: no sub claim", errTokenInvalid)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericDate(sec float64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(sec * float64(time.Second)))
+}
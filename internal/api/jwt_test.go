@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "jwt-test-secret"
+
+// signJWT returns a token with header and claims signed with HS256 under
+// secret.
+func signJWT(t *testing.T, secret string, header, claims map[string]any) string {
+	t.Helper()
+	seg := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := seg(header) + "." + seg(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	// The server checks tokens against the real clock; the margins below
+	// are kept well clear of the 30s leeway.
+	now := float64(time.Now().Unix())
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	// claims returns valid claims with changes applied; a nil value
+	// removes the claim.
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "issuer", "aud": "api", "exp": now + 300, "nbf": now - 300}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	for _, tt := range []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantCode   string
+	}{
+		{"valid", signJWT(t, testJWTSecret, hs256, claims(nil)), 200, ""},
+		{"audience list", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"aud": []string{"other", "api"}})), 200, ""},
+		{"expired", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"exp": now - 60})), 401, "token_expired"},
+		{"expired within leeway", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"exp": now - 10})), 200, ""},
+		{"not yet valid", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"nbf": now + 60})), 401, "token_invalid"},
+		{"not yet valid within leeway", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"nbf": now + 10})), 200, ""},
+		{"no exp", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"exp": nil})), 401, "token_invalid"},
+		{"no nbf", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"nbf": nil})), 200, ""},
+		{"wrong issuer", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"iss": "mallory"})), 401, "token_invalid"},
+		{"wrong audience", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"aud": "other"})), 401, "token_invalid"},
+		{"no subject", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"sub": nil})), 401, "token_invalid"},
+		{"unknown scope", signJWT(t, testJWTSecret, hs256, claims(map[string]any{"scope": "root"})), 401, "token_invalid"},
+		{"wrong secret", signJWT(t, "other-secret", hs256, claims(nil)), 401, "token_invalid"},
+		{"alg none", signJWT(t, testJWTSecret, map[string]any{"alg": "none"}, claims(nil)), 401, "token_invalid"},
+		{"not a jwt", "not-a-jwt", 401, "token_invalid"},
+		{"static key", testKey, 401, "token_invalid"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.authMode = authModeJWT
+			cfg.jwtSecret = []byte(testJWTSecret)
+			cfg.jwtIssuer, cfg.jwtAudience = "issuer", "api"
+			var logs bytes.Buffer
+			h := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Del("X-API-Key")
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code == http.StatusOK {
+				if recs := logRecords(t, logs.String(), "request"); len(recs) != 1 || recs[0]["principal"] != "alice" {
+					t.Errorf("access log has principal %v, want alice", recs)
+				}
+				return
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestJWTScopes(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	for _, tt := range []struct {
+		scope      string
+		wantStatus int
+	}{
+		{"", http.StatusCreated},
+		{"read write", http.StatusCreated},
+		{"read", http.StatusForbidden},
+	} {
+		t.Run(tt.scope, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.authMode = authModeJWT
+			cfg.jwtSecret = []byte(testJWTSecret)
+			h := newTestServer(t, cfg, nil).Handler()
+			token := signJWT(t, testJWTSecret, map[string]any{"alg": "HS256"}, map[string]any{"sub": "bob", "exp": exp, "scope": tt.scope})
+			r := newRequest(http.MethodPost, "/user", `{"name":"Ann"}`)
+			r.Header.Set("Authorization", "Bearer "+token)
+			if rec := serve(h, r); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+// TestRateLimitByPrincipal checks that JWTs for the same subject share a
+// bucket however they differ, and that the rate limiter and requireAuth
+// agree on who the caller is.
+func TestRateLimitByPrincipal(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.authMode = authModeJWT
+	cfg.jwtSecret = []byte(testJWTSecret)
+	cfg.rateLimit, cfg.rateBurst = 1, 1
+	h := newTestServer(t, cfg, nil).Handler()
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	hs256 := map[string]any{"alg": "HS256"}
+	for i, tt := range []struct {
+		sub        string
+		exp        float64
+		wantStatus int
+	}{
+		{"alice", exp, http.StatusOK},
+		{"alice", exp + 1, http.StatusTooManyRequests},
+		{"bob", exp, http.StatusOK},
+	} {
+		r := newRequest(http.MethodGet, "/users", "")
+		r.Header.Set("Authorization", "Bearer "+signJWT(t, testJWTSecret, hs256, map[string]any{"sub": tt.sub, "exp": tt.exp}))
+		if rec := serve(h, r); rec.Code != tt.wantStatus {
+			t.Errorf("request %d as %s: status = %d, want %d", i, tt.sub, rec.Code, tt.wantStatus)
+		}
+	}
+}
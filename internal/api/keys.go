@@ -0,0 +1,314 @@
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+var errNoKeys = errors.New("no API keys configured: set API_KEYS or -keys-file, or pass -insecure-no-auth")
+
+// hashedKeyPrefix marks a configured key given as the hex SHA-256 of the
+// real key, so that the key itself need not appear in configuration.
+const hashedKeyPrefix = "sha256:"
+
+// managedKeyPrefixLen is how much of a managed key is kept, and shown by
+// the admin API, to help tell keys apart.
+const managedKeyPrefixLen = 8
+
+// keyEntry is one accepted key: the digest it stands for and the scopes it
+// grants. Keys minted through /admin/keys also carry a label, the first
+// characters of the key and their creation time.
+type keyEntry struct {
+	digest  [32]byte
+	scopes  []string
+	limit   bucketLimit
+	managed bool
+	label   string
+	prefix  string
+	created time.Time
+}
+
+// id identifies the key in the admin API and logs; it is the key's
+// fingerprint (see keyFingerprint).
+func (e keyEntry) id() string {
+	return hex.EncodeToString(e.digest[:6])
+}
+
+// parseKeyEntry reads a configured key, "key-or-hash[,scopes[,rate,burst]]",
+// where scopes is a space-separated list defaulting to defaultScopes and
+// rate and burst override the global rate limit for the key.
+func parseKeyEntry(entry string) (keyEntry, error) {
+	fields := strings.Split(entry, ",")
+	key := strings.TrimSpace(fields[0])
+	d, err := keyDigest(key)
+	if err != nil {
+		return keyEntry{}, err
+	}
+	e := keyEntry{digest: d}
+	scopes := ""
+	if len(fields) > 1 {
+		scopes = fields[1]
+	}
+	if e.scopes, err = parseScopes(scopes); err != nil {
+		return keyEntry{}, fmt.Errorf("API key %s: %w", keyFingerprint(key), err)
+	}
+
+	switch len(fields) {
+	case 1, 2:
+	case 4:
+		rate, err1 := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+		burst, err2 := strconv.Atoi(strings.TrimSpace(fields[3]))
+		if err1 != nil || err2 != nil || rate <= 0 || burst < 1 {
+			return keyEntry{}, fmt.Errorf("API key %s: invalid rate limit", keyFingerprint(key))
+		}
+		e.limit = bucketLimit{rate: rate, burst: float64(burst)}
+	default:
+		return keyEntry{}, fmt.Errorf("API key %s: want key,scopes,rate,burst", keyFingerprint(key))
+	}
+	return e, nil
+}
+
+// keyDigest is the SHA-256 a configured key stands for.
+func keyDigest(key string) ([32]byte, error) {
+	var d [32]byte
+	h, ok := strings.CutPrefix(key, hashedKeyPrefix)
+	if !ok {
+		return sha256.Sum256([]byte(key)), nil
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != len(d) {
+		return d, fmt.Errorf("invalid hashed API key %q", key)
+	}
+	copy(d[:], b)
+	return d, nil
+}
+
+// keySet is the set of API keys currently accepted. Several keys can be
+// valid at once so that rotation can overlap. Only digests are kept. The
+// configured keys are replaced wholesale on reload; managed ones are added
+// and revoked one by one through the admin API. Managed keys live in
+// memory only: a reload keeps them, but a restart loses every one of them,
+// so they suit short-lived credentials rather than ones clients depend on.
+type keySet struct {
+	mu         sync.RWMutex
+	configured []keyEntry
+	managed    []keyEntry
+}
+
+// newKeySet builds a key set from entries already checked by loadKeys.
+func newKeySet(entries []string) *keySet {
+	ks := &keySet{}
+	ks.replace(entries)
+	return ks
+}
+
+// lookup returns the entry for key. It compares the digest of key against
+// every configured digest in constant time, without stopping at a match,
+// so timing reveals neither whether nor which key matched.
+func (ks *keySet) lookup(key string) (keyEntry, bool) {
+	d := sha256.Sum256([]byte(key))
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	// Indexes into managed are offset by len(configured).
+	match := -1
+	for i := range ks.configured {
+		eq := subtle.ConstantTimeCompare(d[:], ks.configured[i].digest[:])
+		match = subtle.ConstantTimeSelect(eq, i, match)
+	}
+	for i := range ks.managed {
+		eq := subtle.ConstantTimeCompare(d[:], ks.managed[i].digest[:])
+		match = subtle.ConstantTimeSelect(eq, len(ks.configured)+i, match)
+	}
+	switch {
+	case key == "" || match < 0:
+		return keyEntry{}, false
+	case match < len(ks.configured):
+		return ks.configured[match], true
+	default:
+		return ks.managed[match-len(ks.configured)], true
+	}
+}
+
+func (ks *keySet) replace(entries []string) {
+	parsed := make([]keyEntry, 0, len(entries))
+	for _, e := range entries {
+		if ke, err := parseKeyEntry(e); err == nil {
+			parsed = append(parsed, ke)
+		}
+	}
+	ks.mu.Lock()
+	ks.configured = parsed
+	ks.mu.Unlock()
+}
+
+// add mints a new managed key and returns it, in the clear, together with
+// its entry. The key itself is not kept.
+func (ks *keySet) add(label string, scopes []string, limit bucketLimit, now time.Time) (string, keyEntry, error) {
+	key, _, err := GenerateKey()
+	if err != nil {
+		return "", keyEntry{}, err
+	}
+	e := keyEntry{
+		digest:  sha256.Sum256([]byte(key)),
+		scopes:  scopes,
+		limit:   limit,
+		managed: true,
+		label:   label,
+		prefix:  key[:managedKeyPrefixLen],
+		created: now,
+	}
+	ks.mu.Lock()
+	ks.managed = append(ks.managed, e)
+	ks.mu.Unlock()
+	return key, e, nil
+}
+
+// list returns the configured keys followed by the managed ones.
+func (ks *keySet) list() []keyEntry {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return slices.Concat(ks.configured, ks.managed)
+}
+
+// setLimit changes the rate limit of the managed key with the given id;
+// the zero limit restores the default. The key's bucket is replaced on its
+// next request.
+func (ks *keySet) setLimit(id string, limit bucketLimit) (keyEntry, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for i := range ks.managed {
+		if ks.managed[i].id() == id {
+			ks.managed[i].limit = limit
+			return ks.managed[i], nil
+		}
+	}
+	for _, e := range ks.configured {
+		if e.id() == id {
+			return keyEntry{}, fmt.Errorf("key %s is configured, not managed: %w", id, store.ErrConflict)
+		}
+	}
+	return keyEntry{}, fmt.Errorf("key %s: %w", id, store.ErrNotFound)
+}
+
+// revoke removes the managed key with the given id. Configured keys cannot
+// be revoked this way, since the next reload would bring them back.
+func (ks *keySet) revoke(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for i, e := range ks.managed {
+		if e.id() == id {
+			ks.managed = slices.Delete(ks.managed, i, i+1)
+			return nil
+		}
+	}
+	for _, e := range ks.configured {
+		if e.id() == id {
+			return fmt.Errorf("key %s is configured, not managed: %w", id, store.ErrConflict)
+		}
+	}
+	return fmt.Errorf("key %s: %w", id, store.ErrNotFound)
+}
+
+// GenerateKey returns a new random API key and the hashed form to put in
+// configuration instead of it.
+func GenerateKey() (key, hashed string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = base64.RawURLEncoding.EncodeToString(b)
+	d := sha256.Sum256([]byte(key))
+	return key, hashedKeyPrefix + hex.EncodeToString(d[:]), nil
+}
+
+// apiKeyHeader is the header an API key can be sent in instead of a
+// Bearer token.
+const apiKeyHeader = "X-API-Key"
+
+// presentedKey returns the API key a request carries: the Bearer token
+// from Authorization if that header is set, otherwise apiKeyHeader or,
+// failing that, the configured alias header. ok is
+// false for an Authorization header that is not a well-formed Bearer
+// credential (RFC 6750: the scheme, case-insensitively, one space and a
+// non-empty token).
+func (s *Server) presentedKey(r *http.Request) (key string, ok bool) {
+	v := r.Header.Get("Authorization")
+	if v == "" {
+		key = r.Header.Get(apiKeyHeader)
+		if key == "" && s.cfg.apiKeyHeader != "" {
+			key = r.Header.Get(s.cfg.apiKeyHeader)
+		}
+		return key, true
+	}
+	scheme, token, found := strings.Cut(v, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" || token[0] == ' ' {
+		return "", false
+	}
+	return token, true
+}
+
+// validHeaderName reports whether name is empty or a valid header field
+// name, an RFC 9110 token.
+func validHeaderName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadKeys combines the comma-separated keys from env with those in file,
+// one per line; blank lines and lines starting with # are ignored. An
+// empty file name means no file. Keys may be plain or hashed (see
+// hashedKeyPrefix); in the file they may be followed by their scopes and
+// rate limit (see parseKeyEntry).
+func loadKeys(env, file string) ([]string, error) {
+	keys := splitList(env)
+	if file == "" {
+		return keys, checkKeys(keys)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("keys file: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("keys file %s: %w", file, err)
+	}
+	return keys, checkKeys(keys)
+}
+
+func checkKeys(entries []string) error {
+	for _, e := range entries {
+		if _, err := parseKeyEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
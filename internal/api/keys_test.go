@@ -0,0 +1,246 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeKeysFile writes a keys file holding content and returns its path.
+func writeKeysFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		env     string
+		file    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "env", env: "a, b,,c", want: []string{"a", "b", "c"}},
+		{name: "file", file: "# old key, still valid\nold\n\n  new  \n", want: []string{"old", "new"}},
+		{name: "both", env: "a", file: "b\n", want: []string{"a", "b"}},
+		{name: "none", want: nil},
+		{name: "hashed", env: hashedKeyPrefix + strings.Repeat("ab", 32), want: []string{hashedKeyPrefix + strings.Repeat("ab", 32)}},
+		{name: "invalid hashed key", file: hashedKeyPrefix + "abc\n", wantErr: true},
+		{name: "scopes in file", file: "k,read\n", want: []string{"k,read"}},
+		{name: "invalid entry", file: "k,read,x\n", wantErr: true},
+		{name: "missing file", file: "-", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			file := ""
+			switch tt.file {
+			case "":
+			case "-":
+				file = filepath.Join(t.TempDir(), "missing")
+			default:
+				file = writeKeysFile(t, tt.file)
+			}
+			got, err := loadKeys(tt.env, file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("keys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestKeysRotation overlaps the old and new keys through a reload of the
+// keys file, then drops the old one with another. A reload that fails or
+// finds no keys leaves the current ones in place.
+func TestKeysRotation(t *testing.T) {
+	t.Setenv("API_KEYS", "")
+	keys := writeKeysFile(t, "old\n")
+	s, rl, _ := newTestReloader(t, `{"keys-file": "`+filepath.ToSlash(keys)+`"}`, nil)
+	h := s.Handler()
+
+	for i, step := range []struct {
+		file       string
+		wantStatus map[string]int
+	}{
+		{"", map[string]int{"old": 200, "new": 401}},
+		{"old\nnew\n", map[string]int{"old": 200, "new": 200}},
+		{"new\n", map[string]int{"old": 401, "new": 200}},
+		// A reload that would leave no keys is refused.
+		{"# emptied by mistake\n", map[string]int{"old": 401, "new": 200}},
+		{"-", map[string]int{"old": 401, "new": 200}},
+	} {
+		switch step.file {
+		case "":
+		case "-":
+			if err := os.Remove(keys); err != nil {
+				t.Fatal(err)
+			}
+			rl.reload()
+		default:
+			if err := os.WriteFile(keys, []byte(step.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			rl.reload()
+		}
+		for key, want := range step.wantStatus {
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Set("X-API-Key", key)
+			if rec := serve(h, r); rec.Code != want {
+				t.Errorf("step %d, key %s: status = %d, want %d", i, key, rec.Code, want)
+			}
+		}
+	}
+}
+
+func TestHashedKeys(t *testing.T) {
+	key, hashed, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == other {
+		t.Fatal("generateKey returned the same key twice")
+	}
+	for _, tt := range []struct {
+		name       string
+		configured []string
+		presented  string
+		wantStatus int
+	}{
+		{"hash configured", []string{hashed}, key, http.StatusOK},
+		{"hash presented", []string{hashed}, hashed, http.StatusUnauthorized},
+		{"other key", []string{hashed}, other, http.StatusUnauthorized},
+		{"among plain keys", []string{"plain", hashed}, key, http.StatusOK},
+		{"plain beside a hash", []string{"plain", hashed}, "plain", http.StatusOK},
+		{"prefix of a key", []string{"plain"}, "plai", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.apiKeys = tt.configured
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.Header.Set("X-API-Key", tt.presented)
+			if rec := serve(h, r); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestKeyDigest(t *testing.T) {
+	for _, tt := range []struct {
+		key     string
+		wantErr bool
+	}{
+		{"plain", false},
+		{hashedKeyPrefix + "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", false},
+		{hashedKeyPrefix + "2bb80d53", true},
+		{hashedKeyPrefix + "not hex", true},
+	} {
+		if _, err := keyDigest(tt.key); (err != nil) != tt.wantErr {
+			t.Errorf("keyDigest(%q): err = %v, want error %v", tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNoKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		wantErr error
+	}{
+		{"refused", nil, errNoKeys},
+		{"insecure", []string{"-insecure-no-auth"}, nil},
+		{"empty keys file", []string{"-keys-file", writeKeysFile(t, "# none yet\n")}, errNoKeys},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEYS", "")
+			if _, _, err := readConfig(tt.args); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIKeyHeaderAlias(t *testing.T) {
+	t.Setenv("API_KEYS", testKey)
+	t.Setenv("API_KEY_HEADER", " x-token ")
+	cfg, _, err := readConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.apiKeyHeader != "X-Token" {
+		t.Errorf("apiKeyHeader = %q, want X-Token", cfg.apiKeyHeader)
+	}
+	if !slices.Contains(cfg.corsHeaders, "X-Token") {
+		t.Errorf("CORS headers %q do not allow the alias", cfg.corsHeaders)
+	}
+	srv := httptest.NewServer(newTestServer(t, cfg, nil).Handler())
+	t.Cleanup(srv.Close)
+
+	for _, tt := range []struct {
+		// header is sent exactly as written, without canonicalization.
+		header, key string
+		wantStatus  int
+	}{
+		{"X-API-Key", testKey, http.StatusOK},
+		{"x-api-key", testKey, http.StatusOK},
+		{"X-Api-Key", testKey, http.StatusOK},
+		{"X-Token", testKey, http.StatusOK},
+		{"x-token", testKey, http.StatusOK},
+		{"X-Token", "wrong", http.StatusUnauthorized},
+		{"X-Other", testKey, http.StatusUnauthorized},
+	} {
+		t.Run(tt.header, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, srv.URL+"/users", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header[tt.header] = []string{tt.key}
+			resp, err := srv.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAPIKeyHeaderInvalid(t *testing.T) {
+	t.Setenv("API_KEYS", testKey)
+	t.Setenv("API_KEY_HEADER", "X Token")
+	if _, _, err := readConfig(nil); err == nil {
+		t.Error("a header name with a space was accepted")
+	}
+}
+
+func TestValidHeaderName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"":          true,
+		"X-Token":   true,
+		"x_token.1": true,
+		"X Token":   false,
+		"X-Token:":  false,
+		"X-Tökén":   false,
+	} {
+		if got := validHeaderName(name); got != want {
+			t.Errorf("validHeaderName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
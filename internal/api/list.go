@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonPageSize is how many users are read from the store at a time, and
+// written between flushes, when streaming NDJSON.
+const ndjsonPageSize = 100
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) error {
+	format, err := queryValue(r, "format")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "json":
+		limit, offset, err := s.pageParams(r)
+		if err != nil {
+			return err
+		}
+		users, err := s.users.List(r.Context())
+		if err != nil {
+			return err
+		}
+		total := len(users)
+		start := min(offset, total)
+		users = users[start : start+min(limit, total-start)]
+
+		resp := make([]UserResponse, len(users))
+		for i, u := range users {
+			resp[i] = newUserResponse(u)
+		}
+		if link := pageLinks(r.URL, limit, offset, total); link != "" {
+			w.Header().Set("Link", link)
+		}
+		s.writeJSON(w, r, http.StatusOK, resp)
+	case "ndjson":
+		// The stream is meant for complete dumps and is not paginated.
+		return s.streamUsers(w, r)
+	default:
+		return ErrInvalidParam("format", "must be json or ndjson")
+	}
+	return nil
+}
+
+// pageParams reads ?limit= and ?offset=. limit defaults to cfg.pageLimit
+// and is clamped to cfg.maxPageLimit.
+func (s *Server) pageParams(r *http.Request) (limit, offset int, err error) {
+	limitStr, err := queryValue(r, "limit")
+	if err != nil {
+		return 0, 0, err
+	}
+	offsetStr, err := queryValue(r, "offset")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	limit = s.cfg.pageLimit
+	if limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 {
+			return 0, 0, ErrInvalidParam("limit", "must be a positive integer")
+		}
+		limit = n
+	}
+	limit = min(limit, s.cfg.maxPageLimit)
+
+	if offsetStr != "" {
+		n, err := strconv.Atoi(offsetStr)
+		if err != nil || n < 0 {
+			return 0, 0, ErrInvalidParam("offset", "must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// pageLinks builds an RFC 8288 Link header pointing at the pages before
+// and after the current one, keeping the other query parameters of u.
+func pageLinks(u *url.URL, limit, offset, total int) string {
+	link := func(off int, rel string) string {
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(off))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, q.Encode(), rel)
+	}
+	var links []string
+	if offset < total-limit {
+		links = append(links, link(offset+limit, "next"))
+	}
+	if offset > 0 {
+		links = append(links, link(max(0, min(offset, total)-limit), "prev"))
+	}
+	return strings.Join(links, ", ")
+}
+
+// streamUsers writes one JSON object per line, reading the users from the
+// store a page at a time and flushing after each, so that neither the
+// server nor the client has to hold all of them. Each flush moves the
+// write deadline along, so a long stream is not cut off by the server's
+// write timeout as long as the client keeps reading. An error reading the
+// first page is reported as usual; later ones can only cut the stream
+// short.
+func (s *Server) streamUsers(w http.ResponseWriter, r *http.Request) error {
+	users, err := s.users.ListAfter(r.Context(), 0, ndjsonPageSize)
+	if err != nil {
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	extendDeadline := func() {
+		if s.cfg.writeTimeout > 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(s.cfg.writeTimeout))
+		}
+	}
+	extendDeadline()
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	var out io.Writer = w
+	if s.cfg.jsonCase == jsonCaseCamel {
+		out = camelWriter{w}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(s.cfg.escapeHTML)
+	written := 0
+	for {
+		for _, u := range users {
+			if err := enc.Encode(newUserResponse(u)); err != nil {
+				s.log(r.Context()).Warn("ndjson stream aborted", "err", err, "written", written)
+				return nil
+			}
+			written++
+		}
+		_ = rc.Flush()
+		if len(users) < ndjsonPageSize || r.Context().Err() != nil {
+			return nil
+		}
+		extendDeadline()
+		if users, err = s.users.ListAfter(r.Context(), users[len(users)-1].ID, ndjsonPageSize); err != nil {
+			return err
+		}
+	}
+}
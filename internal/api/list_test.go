@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestListUsersNDJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		users int
+	}{
+		{"empty", 0},
+		{"one", 1},
+		{"one full page", ndjsonPageSize},
+		{"several pages", 2*ndjsonPageSize + 50},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			for i := range tt.users {
+				s.users.Create(context.Background(), "user"+strconv.Itoa(i), "")
+			}
+			rec := serve(s.Handler(), newRequest(http.MethodGet, "/users?format=ndjson", ""))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != ndjsonContentType {
+				t.Errorf("Content-Type = %q, want %q", got, ndjsonContentType)
+			}
+			if !rec.Flushed {
+				t.Error("stream was never flushed")
+			}
+
+			n := 0
+			sc := bufio.NewScanner(rec.Body)
+			for sc.Scan() {
+				var u UserResponse
+				if err := json.Unmarshal(sc.Bytes(), &u); err != nil {
+					t.Fatalf("line %d: %v: %s", n+1, err, sc.Bytes())
+				}
+				if want := "user" + strconv.Itoa(n); u.Name != want {
+					t.Errorf("line %d: name = %q, want %q", n+1, u.Name, want)
+				}
+				n++
+			}
+			if n != tt.users {
+				t.Errorf("got %d records, want %d", n, tt.users)
+			}
+		})
+	}
+}
+
+func TestListUsersFormat(t *testing.T) {
+	for _, tt := range []struct {
+		target   string
+		wantCode int
+	}{
+		{"/users", http.StatusOK},
+		{"/users?format=json", http.StatusOK},
+		{"/users?format=ndjson", http.StatusOK},
+		{"/users?format=csv", http.StatusBadRequest},
+	} {
+		t.Run(tt.target, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			if rec := serve(h, newRequest(http.MethodGet, tt.target, "")); rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		target    string
+		wantIDs   []int64
+		wantLink  string
+		wantCode  int
+		pageLimit int
+	}{
+		{name: "first page", target: "/users?limit=2", wantIDs: []int64{1, 2},
+			wantLink: `</users?limit=2&offset=2>; rel="next"`},
+		{name: "middle page", target: "/users?limit=2&offset=2", wantIDs: []int64{3, 4},
+			wantLink: `</users?limit=2&offset=4>; rel="next", </users?limit=2&offset=0>; rel="prev"`},
+		{name: "last page", target: "/users?limit=2&offset=4", wantIDs: []int64{5},
+			wantLink: `</users?limit=2&offset=2>; rel="prev"`},
+		{name: "past the end", target: "/users?limit=2&offset=9", wantIDs: []int64{},
+			wantLink: `</users?limit=2&offset=3>; rel="prev"`},
+		{name: "everything", target: "/users", wantIDs: []int64{1, 2, 3, 4, 5}},
+		{name: "default limit", target: "/users", pageLimit: 3, wantIDs: []int64{1, 2, 3},
+			wantLink: `</users?limit=3&offset=3>; rel="next"`},
+		{name: "clamped", target: "/users?limit=1000", pageLimit: 2, wantIDs: []int64{1, 2, 3, 4},
+			wantLink: `</users?limit=4&offset=4>; rel="next"`},
+		{name: "other parameters kept", target: "/users?limit=2&pretty=false", wantIDs: []int64{1, 2},
+			wantLink: `</users?limit=2&offset=2&pretty=false>; rel="next"`},
+		{name: "zero limit", target: "/users?limit=0", wantCode: 400},
+		{name: "negative offset", target: "/users?offset=-1", wantCode: 400},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if tt.pageLimit > 0 {
+				cfg.pageLimit, cfg.maxPageLimit = tt.pageLimit, 4
+			}
+			s := newTestServer(t, cfg, nil)
+			for i := range 5 {
+				s.users.Create(context.Background(), "user"+strconv.Itoa(i), "")
+			}
+			rec := serve(s.Handler(), newRequest(http.MethodGet, tt.target, ""))
+			if want := cmp.Or(tt.wantCode, http.StatusOK); rec.Code != want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, want, rec.Body)
+			}
+			if tt.wantCode != 0 {
+				return
+			}
+			if got := rec.Header().Get("Link"); got != tt.wantLink {
+				t.Errorf("Link = %q, want %q", got, tt.wantLink)
+			}
+			var users []UserResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int64, len(users))
+			for i, u := range users {
+				ids[i] = u.UserID
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestPageLimitConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-page-limit=100", "-max-page-limit=100"}, false},
+		{[]string{"-page-limit=0"}, true},
+		{[]string{"-max-page-limit=0"}, true},
+		{[]string{"-page-limit=200"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
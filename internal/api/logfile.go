@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFlushInterval is how often a logFile writes out what it has buffered.
+const logFlushInterval = time.Second
+
+// logFile is a buffered, size-rotated log file. When a write would take it
+// past maxSize bytes, path is renamed to path.1, older files move on to
+// path.2 and so on with at most keep of them kept, and a new file is
+// started. If the file cannot be written, records go to fallback until the
+// next successful reopen.
+type logFile struct {
+	path     string
+	maxSize  int64
+	keep     int
+	fallback io.Writer
+	logger   *slog.Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openLogFile opens path for appending and starts flushing it every
+// logFlushInterval. Problems after that are reported to logger.
+func openLogFile(path string, maxSize int64, keep int, logger *slog.Logger) (*logFile, error) {
+	lf := &logFile{
+		path:     path,
+		maxSize:  maxSize,
+		keep:     keep,
+		fallback: os.Stderr,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	go lf.flushLoop()
+	return lf, nil
+}
+
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f, lf.w, lf.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+// closeFile writes out the buffer and closes the file, which is then
+// unset. lf.mu is held.
+func (lf *logFile) closeFile() error {
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.w.Flush()
+	if cerr := lf.f.Close(); err == nil {
+		err = cerr
+	}
+	lf.f, lf.w = nil, nil
+	return err
+}
+
+// fail switches to the fallback writer after err. lf.mu is held.
+func (lf *logFile) fail(err error) {
+	_ = lf.closeFile()
+	lf.logger.Warn("log file failed, writing to stderr until it is reopened", "path", lf.path, "err", err)
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f != nil && lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxSize {
+		if err := lf.rotate(); err != nil {
+			lf.fail(err)
+		}
+	}
+	if lf.f == nil {
+		return lf.fallback.Write(p)
+	}
+	n, err := lf.w.Write(p)
+	lf.size += int64(n)
+	if err != nil {
+		lf.fail(err)
+		m, err := lf.fallback.Write(p[n:])
+		return n + m, err
+	}
+	return n, nil
+}
+
+// rotate moves the current file aside and starts a new one. lf.mu is
+// held.
+func (lf *logFile) rotate() error {
+	if err := lf.closeFile(); err != nil {
+		return err
+	}
+	if lf.keep <= 0 {
+		if err := os.Remove(lf.path); err != nil {
+			return err
+		}
+		return lf.open()
+	}
+	for i := lf.keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", lf.path, i), fmt.Sprintf("%s.%d", lf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(lf.path, lf.path+".1"); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+// reopen closes the file and opens path again, for after it was moved
+// away by an external tool, or to recover from a failure.
+func (lf *logFile) reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	_ = lf.closeFile()
+	return lf.open()
+}
+
+func (lf *logFile) flush() {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return
+	}
+	if err := lf.w.Flush(); err != nil {
+		lf.fail(err)
+	}
+}
+
+func (lf *logFile) flushLoop() {
+	defer close(lf.done)
+	t := time.NewTicker(logFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			lf.flush()
+		case <-lf.stop:
+			return
+		}
+	}
+}
+
+// Close stops the periodic flushing and closes the file, writing out what
+// is still buffered.
+func (lf *logFile) Close() error {
+	close(lf.stop)
+	<-lf.done
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.closeFile()
+}
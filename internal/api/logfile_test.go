@@ -0,0 +1,193 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readFile returns the content of path, or "-" if there is no such file.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "-"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	// Every record is 5 bytes.
+	records := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&b, "rec%d\n", i)
+		}
+		return b.String()
+	}
+	for _, tt := range []struct {
+		name          string
+		maxSize       int64
+		keep, records int
+		// want are the contents of the file and its rotated copies .1, .2
+		// and .3, "-" for none.
+		want [4]string
+	}{
+		{"no rotation", 0, 2, 7, [4]string{records(0, 6), "-", "-", "-"}},
+		{"under the limit", 100, 2, 7, [4]string{records(0, 6), "-", "-", "-"}},
+		{"rotated", 12, 2, 7, [4]string{records(6, 6), records(4, 5), records(2, 3), "-"}},
+		{"nothing kept", 12, 0, 7, [4]string{records(6, 6), "-", "-", "-"}},
+		{"record over the limit", 3, 3, 2, [4]string{records(1, 1), records(0, 0), "-", "-"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			lf, err := openLogFile(path, tt.maxSize, tt.keep, slog.New(slog.DiscardHandler))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.records {
+				if _, err := io.WriteString(lf, records(i, i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := lf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				p := path
+				if i > 0 {
+					p = fmt.Sprintf("%s.%d", path, i)
+				}
+				if got := readFile(t, p); got != want {
+					t.Errorf("%s = %q, want %q", filepath.Base(p), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogFileBuffered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	lf, err := openLogFile(path, 0, 0, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "one\n")
+	if got := readFile(t, path); got != "" {
+		t.Errorf("before a flush: %q, want nothing written yet", got)
+	}
+	lf.flush()
+	if got := readFile(t, path); got != "one\n" {
+		t.Errorf("after a flush: %q", got)
+	}
+	io.WriteString(lf, "two\n")
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "one\ntwo\n" {
+		t.Errorf("after Close: %q", got)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	lf, err := openLogFile(path, 0, 0, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	io.WriteString(lf, "before\n")
+	// As logrotate does, move the file away first.
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "after\n")
+	lf.flush()
+	if old, cur := readFile(t, path+".old"), readFile(t, path); old != "before\n" || cur != "after\n" {
+		t.Errorf("moved file %q, new file %q; want the records split between them", old, cur)
+	}
+}
+
+func TestLogFileFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	var logs, fallback syncBuffer
+	lf, err := openLogFile(path, 5, 1, slog.New(slog.NewJSONHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	lf.fallback = &fallback
+
+	// A directory where the rotated file should go makes rotating fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []string{"rec0\n", "rec1\n", "rec2\n"} {
+		if n, err := io.WriteString(lf, rec); err != nil || n != len(rec) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if got := fallback.String(); got != "rec1\nrec2\n" {
+		t.Errorf("fallback got %q, want the records after the failure", got)
+	}
+	if recs := logRecords(t, logs.String(), "log file failed, writing to stderr until it is reopened"); len(recs) != 1 {
+		t.Errorf("warned %d times, want once:\n%s", len(recs), logs.String())
+	}
+
+	// Once the problem is gone, reopening recovers.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(lf, "rec3\n")
+	lf.flush()
+	if cur, old := readFile(t, path), readFile(t, path+".1"); cur != "rec3\n" || old != "rec0\n" {
+		t.Errorf("after reopening: file %q, rotated %q", cur, old)
+	}
+}
+
+func TestOpenLogFileFails(t *testing.T) {
+	if _, err := openLogFile(filepath.Join(t.TempDir(), "missing", "access.log"), 0, 0, slog.New(slog.DiscardHandler)); err == nil {
+		t.Error("opened a log file in a directory that does not exist")
+	}
+}
+
+func TestAccessLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	var logs syncBuffer
+	s := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil)))
+	lf, err := openLogFile(path, 0, 0, s.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.accessLogger = slog.New(slog.NewJSONHandler(lf, nil))
+	h := s.Handler()
+	serve(h, newRequest(http.MethodGet, "/healthz", ""))
+	serve(h, newRequest(http.MethodGet, "/users", ""))
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the access log goes to the file.
+	recs := jsonLines(t, readFile(t, path))
+	if len(recs) != 2 || recs[0]["path"] != "/healthz" || recs[1]["path"] != "/users" || recs[1]["request_id"] == nil {
+		t.Errorf("access log file holds %v, want both requests", recs)
+	}
+	if recs := logRecords(t, logs.String(), "request"); len(recs) != 0 {
+		t.Errorf("access records in the main log: %v", recs)
+	}
+}
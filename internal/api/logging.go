@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// newLogger returns a logger writing in format to w. level may be a
+// *slog.LevelVar, for the level to be changed later.
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// NewLogger returns the logger c.logFormat and c.logLevel ask for, writing
+// to w. A reload of c may change its level.
+func (c *Config) NewLogger(w io.Writer) (*slog.Logger, error) {
+	lvl, _ := parseLogLevel(c.logLevel)
+	c.level = new(slog.LevelVar)
+	c.level.Set(lvl)
+	return newLogger(w, c.logFormat, c.level)
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", level)
+	}
+	return lvl, nil
+}
+
+// log returns the server logger annotated with the request id carried by
+// ctx, if any.
+func (s *Server) log(ctx context.Context) *slog.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return s.logger.With("request_id", id)
+	}
+	return s.logger
+}
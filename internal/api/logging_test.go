@@ -0,0 +1,60 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	for _, tt := range []struct {
+		name, format, level string
+		wantErr             bool
+		// want is what the Info and Debug lines logged come out as.
+		want []string
+	}{
+		{name: "json", format: "json", level: "info", want: []string{`"level":"INFO","msg":"info line","request_id":"rid"`}},
+		{name: "text", format: "text", level: "info", want: []string{`level=INFO msg="info line" request_id=rid`}},
+		{name: "debug", format: "text", level: "debug", want: []string{`msg="info line"`, `msg="debug line"`}},
+		{name: "warn", format: "text", level: "warn"},
+		{name: "bad format", format: "xml", level: "info", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.logFormat, cfg.logLevel = tt.format, tt.level
+			var out bytes.Buffer
+			logger, err := cfg.NewLogger(&out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger: err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			s := newTestServer(t, cfg, logger)
+			ctx := context.WithValue(context.Background(), requestIDKey, "rid")
+			s.log(ctx).Info("info line")
+			s.log(ctx).Debug("debug line")
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if out.Len() == 0 {
+				lines = nil
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("logged %q, want %d lines", lines, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("line %d = %s, want %s in it", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []string{"loud", ""} {
+		if _, err := parseLogLevel(level); err == nil {
+			t.Errorf("parseLogLevel(%q) succeeded, want an error", level)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// lookupGroup collapses concurrent lookups of the same user into one store
+// call. The call runs for as long as any of the requests waiting for it
+// does: it is canceled once the last of them has gone away, timed out or
+// been disconnected. The zero value is ready to use.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[int64]*lookupCall
+}
+
+type lookupCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	user    store.User
+	err     error
+}
+
+// get returns the user id as fn finds it, sharing a call of fn already
+// under way for id. fn is given a context with the values of the ctx of
+// the request that started the call, canceled only when no request waits
+// any more. get itself returns as soon as ctx is done.
+func (g *lookupGroup) get(ctx context.Context, id int64, fn func(context.Context, int64) (store.User, error)) (store.User, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[int64]*lookupCall)
+	}
+	c, ok := g.calls[id]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &lookupCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[id] = c
+		go func() {
+			defer cancel()
+			c.user, c.err = fn(callCtx, id)
+			g.forget(id, c)
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.user, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Later requests start afresh rather than join a canceled call.
+			if g.calls[id] == c {
+				delete(g.calls, id)
+			}
+		}
+		g.mu.Unlock()
+		return store.User{}, ctx.Err()
+	}
+}
+
+func (g *lookupGroup) forget(id int64, c *lookupCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[id] == c {
+		delete(g.calls, id)
+	}
+}
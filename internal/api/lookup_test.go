@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestConcurrentLookups(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ids  []int64
+	}{
+		{"one request", []int64{1}},
+		{"same id", []int64{1, 1, 1, 1, 1, 1, 1, 1}},
+		{"different ids", []int64{1, 2, 3, 1, 2, 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			for i := 1; i <= 3; i++ {
+				s.users.Create(context.Background(), fmt.Sprintf("user%d", i), "")
+			}
+			h := s.Handler()
+			var wg sync.WaitGroup
+			for _, id := range tt.ids {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := serve(h, newRequest(http.MethodGet, userLocation(id), ""))
+					var got UserResponse
+					if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+						t.Errorf("GET %d: %v: %s", id, err, rec.Body)
+						return
+					}
+					// A shared lookup answers every request with the user it
+					// asked for.
+					if got.UserID != id || got.Name != fmt.Sprintf("user%d", id) {
+						t.Errorf("GET %d: got %+v", id, got)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// blockingLookup is a store lookup that waits for release, or for its
+// context, counting its calls.
+type blockingLookup struct {
+	calls    atomic.Int32
+	release  chan struct{}
+	canceled chan struct{}
+}
+
+func newBlockingLookup() *blockingLookup {
+	return &blockingLookup{release: make(chan struct{}), canceled: make(chan struct{}, 16)}
+}
+
+func (b *blockingLookup) get(ctx context.Context, id int64) (store.User, error) {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+		return store.User{ID: id, Name: "Ann"}, nil
+	case <-ctx.Done():
+		b.canceled <- struct{}{}
+		return store.User{}, ctx.Err()
+	}
+}
+
+func TestLookupGroupShares(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		ids       []int64
+		wantCalls int32
+	}{
+		{"one request", []int64{1}, 1},
+		{"same id", []int64{1, 1, 1, 1, 1, 1, 1, 1}, 1},
+		{"different ids", []int64{1, 2, 3, 1, 2, 3}, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var g lookupGroup
+			b := newBlockingLookup()
+			var wg sync.WaitGroup
+			errs := make(chan error, len(tt.ids))
+			for _, id := range tt.ids {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					u, err := g.get(context.Background(), id, b.get)
+					if err == nil && u.ID != id {
+						err = errors.New("got another user")
+					}
+					errs <- err
+				}()
+			}
+			// Every request has joined a call once there are as many calls
+			// as ids and the group counts every waiter.
+			waitFor(t, func() bool {
+				g.mu.Lock()
+				defer g.mu.Unlock()
+				n := 0
+				for _, c := range g.calls {
+					n += c.waiters
+				}
+				return n == len(tt.ids)
+			})
+			close(b.release)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			if got := b.calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d store calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestLookupGroupCancel(t *testing.T) {
+	var g lookupGroup
+	b := newBlockingLookup()
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		go func() {
+			_, err := g.get(ctx, 1, b.get)
+			done <- err
+		}()
+	}
+	waitFor(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.calls[1] != nil && g.calls[1].waiters == 2
+	})
+
+	// The call outlives the first request to go away...
+	cancel1()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled request: err = %v", err)
+	}
+	select {
+	case <-b.canceled:
+		t.Fatal("store call canceled while a request still waits for it")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// ...but not the last.
+	cancel2()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled request: err = %v", err)
+	}
+	select {
+	case <-b.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("store call not canceled once no request waits for it")
+	}
+
+	// A later request starts a call of its own.
+	close(b.release)
+	if u, err := g.get(context.Background(), 1, b.get); err != nil || u.ID != 1 {
+		t.Errorf("later request: %v, %v", u, err)
+	}
+	if got := b.calls.Load(); got != 2 {
+		t.Errorf("%d store calls, want 2", got)
+	}
+}
+
+// stallingStore is a Store whose Get calls last until their context is
+// done.
+type stallingStore struct {
+	store.Store
+}
+
+func (stallingStore) Get(ctx context.Context, id int64) (store.User, error) {
+	<-ctx.Done()
+	return store.User{}, ctx.Err()
+}
+
+func TestLookupContextErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		ctx        func() (context.Context, context.CancelFunc)
+		wantStatus int
+	}{
+		{"client gone", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}, statusClientClosedRequest},
+		{"out of time", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 10*time.Millisecond)
+		}, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.requestTimeout = 0
+			var logs bytes.Buffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			useStore(s, stallingStore{s.store})
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			rec := serve(s.Handler(), newRequest(http.MethodGet, "/user/1", "").WithContext(ctx))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for _, rec := range jsonLines(t, logs.String()) {
+				if rec["level"] == "ERROR" {
+					t.Errorf("logged an error: %v", rec)
+				}
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing t after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// methodHandler dispatches to handlers by request method. Any other method
+// gets a 405 with an Allow header listing the registered ones.
+func (s *Server) methodHandler(handlers map[string]http.HandlerFunc) http.Handler {
+	methods := make([]string, 0, len(handlers))
+	for m := range handlers {
+		methods = append(methods, m)
+	}
+	slices.Sort(methods)
+	allow := strings.Join(methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", allow)
+			s.writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	})
+}
+
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods are the methods a POST may ask to be treated as.
+var overridableMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// methodOverride routes a POST carrying X-HTTP-Method-Override as the
+// method it names, for clients that can only send GET and POST. The header
+// is refused on any other method, so it cannot turn a safe request into an
+// unsafe one.
+func (s *Server) methodOverride() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m := r.Header.Get(methodOverrideHeader)
+			if m == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Method != http.MethodPost {
+				s.errorJSON(w, r, http.StatusBadRequest, methodOverrideHeader+" is only allowed on POST")
+				return
+			}
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if !slices.Contains(overridableMethods, m) {
+				s.errorJSON(w, r, http.StatusBadRequest, "cannot override POST with "+strconv.Quote(m))
+				return
+			}
+			s.log(r.Context()).Info("method override", "method", r.Method, "override", m, "path", r.URL.Path)
+			r = r.WithContext(r.Context())
+			r.Method = m
+			next.ServeHTTP(w, r)
+		})
+	}
+}
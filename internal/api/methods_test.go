@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestMethodHandler(t *testing.T) {
+	for _, tt := range []struct {
+		method, target string
+		wantStatus     int
+		wantAllow      string
+	}{
+		{http.MethodGet, "/user?id=1", http.StatusOK, ""},
+		{http.MethodPut, "/user?id=1", http.StatusMethodNotAllowed, "DELETE, GET, PATCH, POST"},
+		{http.MethodHead, "/user?id=1", http.StatusMethodNotAllowed, "DELETE, GET, PATCH, POST"},
+		{http.MethodGet, "/openapi.json", http.StatusOK, ""},
+		{http.MethodPost, "/openapi.json", http.StatusMethodNotAllowed, "GET"},
+	} {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			s := newTestServer(t, DefaultConfig(), nil)
+			h := s.Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			rec := serve(h, newRequest(tt.method, tt.target, ""))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "method not allowed" {
+					t.Errorf("body = %s (%v), want a JSON 405", rec.Body, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	for _, tt := range []struct {
+		name, method, override, target, body string
+		wantStatus                           int
+		// wantName is the name of user 1 after the request, "" if it is gone.
+		wantName string
+	}{
+		{name: "patch", method: http.MethodPost, override: "PATCH", target: "/user?id=1", body: `{"name":"Anne"}`,
+			wantStatus: http.StatusOK, wantName: "Anne"},
+		{name: "lower case", method: http.MethodPost, override: " patch ", target: "/user?id=1", body: `{"name":"Anne"}`,
+			wantStatus: http.StatusOK, wantName: "Anne"},
+		{name: "delete", method: http.MethodPost, override: "DELETE", target: "/user?id=1",
+			wantStatus: http.StatusNoContent},
+		{name: "put is not routed", method: http.MethodPost, override: "PUT", target: "/user?id=1", body: `{"name":"Anne"}`,
+			wantStatus: http.StatusMethodNotAllowed, wantName: "Ann"},
+		{name: "not overridable", method: http.MethodPost, override: "GET", target: "/user?id=1",
+			wantStatus: http.StatusBadRequest, wantName: "Ann"},
+		{name: "not on a GET", method: http.MethodGet, override: "DELETE", target: "/user?id=1",
+			wantStatus: http.StatusBadRequest, wantName: "Ann"},
+		{name: "not on a DELETE", method: http.MethodDelete, override: "PATCH", target: "/user?id=1",
+			wantStatus: http.StatusBadRequest, wantName: "Ann"},
+		{name: "no header", method: http.MethodPost, target: "/user", body: `{"name":"Bo"}`,
+			wantStatus: http.StatusCreated, wantName: "Ann"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			r := newRequest(tt.method, tt.target, tt.body)
+			if tt.override != "" {
+				r.Header.Set(methodOverrideHeader, tt.override)
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			rec = serve(h, newRequest(http.MethodGet, "/user?id=1", ""))
+			var u UserResponse
+			json.Unmarshal(rec.Body.Bytes(), &u)
+			if u.Name != tt.wantName {
+				t.Errorf("user 1 is %q (status %d), want %q", u.Name, rec.Code, tt.wantName)
+			}
+			overridden := len(logRecords(t, logs.String(), "method override")) > 0
+			if want := tt.method == http.MethodPost && tt.wantStatus != http.StatusBadRequest && tt.override != ""; overridden != want {
+				t.Errorf("logged an override %v, want %v:\n%s", overridden, want, logs.String())
+			}
+		})
+	}
+}
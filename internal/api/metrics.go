@@ -0,0 +1,208 @@
+package api
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMetricsBuckets are the upper bounds, in seconds, of the request
+// latency histogram buckets: those of the Prometheus client libraries.
+var defaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// seriesKey labels one request series. route is the pattern the request
+// matched rather than its path, and client the principal's client name
+// rather than anything the request says, so the number of series stays
+// bounded. client is empty for requests that did not authenticate.
+type seriesKey struct {
+	method, route, client, code string
+}
+
+type requestSeries struct {
+	// counts[i] is the number of requests that took at most buckets[i];
+	// the last entry counts all of them.
+	counts []uint64
+	sum    float64
+}
+
+// metrics holds the server's Prometheus series. Each server has its own,
+// rather than registering them globally.
+type metrics struct {
+	buckets []float64
+	// inFlight is the number of requests being served, on any route.
+	inFlight atomic.Int64
+
+	mu     sync.Mutex
+	series map[seriesKey]*requestSeries
+	// slow counts the requests over the slow threshold by route pattern.
+	slow map[string]int64
+}
+
+func newMetrics(buckets []float64) *metrics {
+	return &metrics{
+		buckets: buckets,
+		series:  make(map[seriesKey]*requestSeries),
+		slow:    make(map[string]int64),
+	}
+}
+
+// observeSlow counts a request over the slow threshold.
+func (m *metrics) observeSlow(route string) {
+	m.mu.Lock()
+	m.slow[route]++
+	m.mu.Unlock()
+}
+
+// slowCounts returns a copy of the slow request counts by route pattern.
+func (m *metrics) slowCounts() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.slow)
+}
+
+// observe records a finished request.
+func (m *metrics) observe(method, route, client string, status int, d time.Duration) {
+	k := seriesKey{metricsMethod(method), route, client, strconv.Itoa(status)}
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rs := m.series[k]
+	if rs == nil {
+		rs = &requestSeries{counts: make([]uint64, len(m.buckets)+1)}
+		m.series[k] = rs
+	}
+	for i, le := range m.buckets {
+		if secs <= le {
+			rs.counts[i]++
+		}
+	}
+	rs.counts[len(m.buckets)]++
+	rs.sum += secs
+}
+
+// metricsMethod keeps the method label to the standard methods, so that
+// clients cannot add series by making methods up.
+func metricsMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return m
+	}
+	return "OTHER"
+}
+
+// write renders the series in the Prometheus text exposition format, in a
+// stable order.
+func (m *metrics) write(w *bufio.Writer, users int) {
+	m.mu.Lock()
+	keys := make([]seriesKey, 0, len(m.series))
+	series := make(map[seriesKey]requestSeries, len(m.series))
+	for k, rs := range m.series {
+		keys = append(keys, k)
+		series[k] = requestSeries{counts: slices.Clone(rs.counts), sum: rs.sum}
+	}
+	m.mu.Unlock()
+	slow := m.slowCounts()
+	slices.SortFunc(keys, func(a, b seriesKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.method, b.method),
+			strings.Compare(a.client, b.client), strings.Compare(a.code, b.code))
+	})
+
+	fmt.Fprintln(w, "# HELP http_requests_total Requests served, by method, route pattern, client and status code.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, k := range keys {
+		rs := series[k]
+		fmt.Fprintf(w, "http_requests_total{%s} %d\n", k.labels(), rs.counts[len(rs.counts)-1])
+	}
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Time taken to serve requests, by method, route pattern, client and status code.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, k := range keys {
+		rs, labels := series[k], k.labels()
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels, formatFloat(le), rs.counts[i])
+		}
+		n := rs.counts[len(rs.counts)-1]
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, n)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(rs.sum))
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, n)
+	}
+	fmt.Fprintln(w, "# HELP http_slow_requests_total Requests that took longer than the slow threshold, by route pattern.")
+	fmt.Fprintln(w, "# TYPE http_slow_requests_total counter")
+	for _, route := range slices.Sorted(maps.Keys(slow)) {
+		fmt.Fprintf(w, "http_slow_requests_total{route=\"%s\"} %d\n", labelEscaper.Replace(route), slow[route])
+	}
+	fmt.Fprintln(w, "# HELP http_requests_in_flight Requests currently being served.")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_in_flight %d\n", m.inFlight.Load())
+	fmt.Fprintln(w, "# HELP users Users in the store.")
+	fmt.Fprintln(w, "# TYPE users gauge")
+	fmt.Fprintf(w, "users %d\n", users)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (k seriesKey) labels() string {
+	return fmt.Sprintf(`method="%s",route="%s",client="%s",code="%s"`,
+		labelEscaper.Replace(k.method), labelEscaper.Replace(k.route), labelEscaper.Replace(k.client), k.code)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// matchPattern returns a func naming the route of a request: the pattern
+// it matches in mux or, for requests mux hands to its "/" catch-all, the
+// pattern it matches in next. Requests matching no route get "".
+func matchPattern(mux, next *http.ServeMux) func(*http.Request) string {
+	return func(r *http.Request) string {
+		_, p := mux.Handler(r)
+		if p == "/" && next != nil {
+			_, p = next.Handler(r)
+		}
+		return p
+	}
+}
+
+// routePattern is matchPattern, except that a path with a trailing slash
+// matching no route is named after the route trailingSlash takes it to.
+func routePattern(mux, next *http.ServeMux) func(*http.Request) string {
+	match := matchPattern(mux, next)
+	return func(r *http.Request) string {
+		p := match(r)
+		if trimmed, ok := trimSlash(r.URL.Path); p == "" && ok {
+			return match(withPath(r, trimmed))
+		}
+		return p
+	}
+}
+
+// handleMetrics serves the metrics for Prometheus to scrape. It sits
+// outside API-key authentication; when METRICS_TOKEN is set, scrapers
+// have to send it as a bearer token instead.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if len(s.cfg.metricsToken) > 0 {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.cfg.metricsToken) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			return &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "unauthorized"}
+		}
+	}
+	users, err := s.users.Count(r.Context())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.metrics.write(bw, users)
+	_ = bw.Flush()
+	return nil
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bufio"
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape fetches /metrics from h as Prometheus does, returning the value
+// of each series by its name and labels.
+func scrape(t *testing.T, h http.Handler, token string) map[string]string {
+	t.Helper()
+	r := newRequest(http.MethodGet, "/metrics", "")
+	r.Header.Set("Accept", "text/plain;version=0.0.4")
+	r.Header.Del(apiKeyHeader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := serve(h, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics: status = %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	series := make(map[string]string)
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		if line := sc.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			i := strings.LastIndexByte(line, ' ')
+			series[line[:i]] = line[i+1:]
+		}
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	client := `client="key:` + keyFingerprint(testKey) + `"`
+	h := newTestServer(t, DefaultConfig(), nil).Handler()
+	for _, req := range []struct{ method, target, body string }{
+		{http.MethodPost, "/user", `{"name":"Ann"}`},
+		{http.MethodPost, "/user", `{"name":"Bo"}`},
+		{http.MethodGet, "/user/1", ""},
+		{http.MethodGet, "/user/2", ""},
+		{http.MethodGet, "/user/9", ""},
+		{http.MethodGet, "/nope", ""},
+		{"BREW", "/user", ""},
+	} {
+		serve(h, newRequest(req.method, req.target, req.body))
+	}
+	unauthenticated := newRequest(http.MethodGet, "/users", "")
+	unauthenticated.Header.Del(apiKeyHeader)
+	serve(h, unauthenticated)
+
+	series := scrape(t, h, "")
+	for _, tt := range []struct {
+		series, want string
+	}{
+		// One series per route pattern, not per path.
+		{`http_requests_total{method="POST",route="/user",` + client + `,code="201"}`, "2"},
+		{`http_requests_total{method="GET",route="GET /user/{id}",` + client + `,code="200"}`, "2"},
+		{`http_requests_total{method="GET",route="GET /user/{id}",` + client + `,code="404"}`, "1"},
+		{`http_requests_total{method="GET",route="",` + client + `,code="404"}`, "1"},
+		// Made-up methods share a series.
+		{`http_requests_total{method="OTHER",route="/user",` + client + `,code="405"}`, "1"},
+		{`http_requests_total{method="GET",route="GET /users",client="",code="401"}`, "1"},
+		{`http_request_duration_seconds_count{method="GET",route="GET /user/{id}",` + client + `,code="200"}`, "2"},
+		{`http_request_duration_seconds_bucket{method="GET",route="GET /user/{id}",` + client + `,code="200",le="+Inf"}`, "2"},
+		{`http_request_duration_seconds_bucket{method="GET",route="GET /user/{id}",` + client + `,code="200",le="10"}`, "2"},
+		// The scrape itself is in flight.
+		{`http_requests_in_flight`, "1"},
+		{`users`, "2"},
+	} {
+		if got := series[tt.series]; got != tt.want {
+			t.Errorf("%s = %q, want %s", tt.series, got, tt.want)
+		}
+	}
+	for s := range series {
+		if strings.Contains(s, "/user/1") || strings.Contains(s, "BREW") {
+			t.Errorf("series %s is labelled by what the request said", s)
+		}
+	}
+}
+
+func TestMetricsBuckets(t *testing.T) {
+	for _, tt := range []struct {
+		flag    string
+		wantLe  []string
+		wantErr bool
+	}{
+		{flag: "-metrics-buckets=0.1,1", wantLe: []string{"0.1", "1", "+Inf"}},
+		{flag: "-metrics-buckets=0.25", wantLe: []string{"0.25", "+Inf"}},
+		{flag: "-metrics-buckets=1,0.1", wantErr: true},
+		{flag: "-metrics-buckets=0,1", wantErr: true},
+		{flag: "-metrics-buckets=fast", wantErr: true},
+	} {
+		t.Run(tt.flag, func(t *testing.T) {
+			cfg := DefaultConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.RegisterFlags(fs)
+			if err := fs.Parse([]string{tt.flag}); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			h := newTestServer(t, cfg, nil).Handler()
+			serve(h, newRequest(http.MethodGet, "/users", ""))
+			var le []string
+			for s := range scrape(t, h, "") {
+				if strings.HasPrefix(s, `http_request_duration_seconds_bucket{method="GET",route="GET /users"`) {
+					le = append(le, s[strings.Index(s, `le="`)+4:len(s)-2])
+				}
+			}
+			slices.SortFunc(le, func(a, b string) int {
+				return cmp.Compare(bucketOrder(a), bucketOrder(b))
+			})
+			if !slices.Equal(le, tt.wantLe) {
+				t.Errorf("buckets %v, want %v", le, tt.wantLe)
+			}
+		})
+	}
+}
+
+// bucketOrder sorts le label values, +Inf last.
+func bucketOrder(le string) float64 {
+	if le == "+Inf" {
+		return math.Inf(1)
+	}
+	f, _ := strconv.ParseFloat(le, 64)
+	return f
+}
+
+func TestMetricsToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.metricsToken = []byte("scrape-token")
+	h := newTestServer(t, cfg, nil).Handler()
+	for _, tt := range []struct {
+		name, authorization string
+		wantStatus          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"not a bearer token", "scrape-token", http.StatusUnauthorized},
+		{"token", "Bearer scrape-token", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(http.MethodGet, "/metrics", "")
+			r.Header.Del(apiKeyHeader)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); (got != "") != (tt.wantStatus == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q", got)
+			}
+		})
+	}
+	// Without a token, scrapers need nothing.
+	scrape(t, newTestServer(t, DefaultConfig(), nil).Handler(), "")
+}
+
+func TestMetricsClient(t *testing.T) {
+	now := float64(time.Now().Unix())
+	jwt := func(sub string) string {
+		return signJWT(t, testJWTSecret, map[string]any{"alg": "HS256", "typ": "JWT"},
+			map[string]any{"sub": sub, "iss": "issuer", "aud": "api", "exp": now + 60})
+	}
+	for _, tt := range []struct {
+		name string
+		jwt  bool
+		// auth sets the credentials of the ith request r, minting keys on
+		// h if need be.
+		auth       func(h http.Handler, r *http.Request, i int)
+		wantClient string
+	}{
+		{name: "static key", auth: func(http.Handler, *http.Request, int) {}, wantClient: "key:" + keyFingerprint(testKey)},
+		// Every key minted with a label counts under it.
+		{name: "labelled key", auth: func(h http.Handler, r *http.Request, _ int) {
+			r.Header.Set(apiKeyHeader, createKey(t, h, `{"label":"ci"}`).Key)
+		}, wantClient: "ci"},
+		{name: "basic auth", auth: func(_ http.Handler, r *http.Request, _ int) {
+			r.Header.Del(apiKeyHeader)
+			r.SetBasicAuth("ann", testKey)
+		}, wantClient: "user:ann"},
+		// Subjects are unbounded, so all of them share one client.
+		{name: "jwt", jwt: true, auth: func(_ http.Handler, r *http.Request, i int) {
+			r.Header.Set(apiKeyHeader, jwt([]string{"alice", "bob"}[i]))
+		}, wantClient: "jwt"},
+		{name: "invalid key", auth: func(_ http.Handler, r *http.Request, _ int) {
+			r.Header.Set(apiKeyHeader, "nope")
+		}, wantClient: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.apiKeys = []string{testKey + ",read write admin"}
+			cfg.authMaxFailures = 0
+			users, err := parseBasicUsers("ann:" + testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.basicAuth, cfg.basicUsers = true, users
+			if tt.jwt {
+				cfg.authMode, cfg.jwtSecret = authModeJWT, []byte(testJWTSecret)
+				cfg.jwtIssuer, cfg.jwtAudience = "issuer", "api"
+			}
+			h := newTestServer(t, cfg, nil).Handler()
+			var code int
+			for i := range 2 {
+				r := newRequest(http.MethodGet, "/users", "")
+				tt.auth(h, r, i)
+				code = serve(h, r).Code
+			}
+			want := fmt.Sprintf(`http_requests_total{method="GET",route="GET /users",client=%q,code="%d"}`, tt.wantClient, code)
+			series := scrape(t, h, "")
+			if got := series[want]; got != "2" {
+				t.Errorf("%s = %q, want 2", want, got)
+			}
+			for s := range series {
+				if strings.Contains(s, "alice") || strings.Contains(s, "bob") || strings.Contains(s, "nope") {
+					t.Errorf("series %s is labelled by what the request said", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// chain wraps h with mws so that the first middleware is the outermost one:
+// chain(h, a, b) is equivalent to a(b(h)).
+func chain(h http.Handler, mws ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// requestLogger logs each request and records it in the server's
+// counters and metrics, under the route pattern route finds for it.
+// Requests taking longer than cfg.slowThreshold are also reported at WARN
+// level, whether or not they are sampled for the access log, along with
+// the store calls they made.
+func (s *Server) requestLogger(route func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			s.metrics.inFlight.Add(1)
+			defer s.metrics.inFlight.Add(-1)
+			ctx := withPrincipalSlot(r.Context())
+			if s.cfg.slowThreshold > 0 {
+				ctx = withStoreTimings(ctx)
+			}
+			r = r.WithContext(ctx)
+			stopWatch := s.watchSlowRequest(r)
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			var debug *httpDebug
+			if s.cfg.debugHTTP {
+				debug = s.startHTTPDebug(r, rr)
+			}
+			next.ServeHTTP(rr, r)
+			stopWatch()
+
+			// net/http discards HEAD bodies but still reports them as written.
+			bytes := rr.bytes
+			if r.Method == http.MethodHead {
+				bytes = 0
+			}
+			s.bytesServed.Add(bytes)
+			if c := rr.status/100 - 1; c >= 0 && c < len(s.requests) {
+				s.requests[c].Add(1)
+			}
+			elapsed := time.Since(start)
+			pattern := route(r)
+			s.metrics.observe(r.Method, pattern, principalFromContext(r.Context()).client, rr.status, elapsed)
+			if s.cfg.slowThreshold > 0 && elapsed > s.cfg.slowThreshold {
+				s.logSlowRequest(r, pattern, rr.status, elapsed)
+			}
+			if !s.sampled(rr.status) {
+				return
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("proto", r.Proto),
+				slog.Int("status", rr.status),
+				slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+				slog.Int64("bytes", bytes),
+				slog.String("remote_addr", s.clientIP(r)),
+			}
+			if p := principalFromContext(r.Context()); p.name != "" {
+				attrs = append(attrs, slog.String("principal", p.name))
+			}
+			if debug != nil {
+				attrs = append(attrs, s.httpDebugAttr(debug, r, rr))
+			}
+			s.writeAccessLog(r, start, attrs)
+		})
+	}
+}
+
+// keyFingerprint identifies an API key in logs and caches without revealing
+// it: a prefix of its SHA-256, or "" for no key.
+func keyFingerprint(k string) string {
+	if k == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:6])
+}
+
+// recoverer turns a panicking handler into a JSON 500, provided the handler
+// had not started its response yet. http.ErrAbortHandler is left to
+// net/http, which uses it to abort the connection on purpose.
+func (s *Server) recoverer() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				stack := debug.Stack()
+				if hp, ok := v.(*handlerPanic); ok {
+					v, stack = hp.value, hp.stack
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				s.log(r.Context()).Error("panic",
+					"panic", fmt.Sprint(v),
+					"stack", string(stack))
+				if !rr.wroteHeader {
+					s.errorJSON(rr, r, http.StatusInternalServerError, "internal server error")
+				}
+			}()
+			next.ServeHTTP(rr, r)
+		})
+	}
+}
+
+// statusRecorder records the status and body size of a response. It passes
+// Flush, Hijack and ReadFrom through to the wrapped writer, and exposes it via
+// Unwrap for http.ResponseController, so wrapping a handler does not take
+// streaming, connection upgrades or sendfile away from it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+	// capture, when set, receives a copy of the body for -debug-http.
+	capture io.Writer
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	if sr.capture != nil {
+		_, _ = sr.capture.Write(b[:n])
+	}
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	sr.wroteHeader = true
+	_ = http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sr.ResponseWriter).Hijack()
+}
+
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	sr.wroteHeader = true
+	if sr.capture != nil {
+		src = io.TeeReader(src, sr.capture)
+	}
+	n, err := io.Copy(sr.ResponseWriter, src)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// logRecords decodes the JSON log lines in logs with message msg.
+func logRecords(t *testing.T, logs, msg string) []map[string]any {
+	t.Helper()
+	var recs []map[string]any
+	for _, rec := range jsonLines(t, logs) {
+		if rec["msg"] == msg {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// jsonLines decodes every line of s as a JSON object.
+func jsonLines(t *testing.T, s string) []map[string]any {
+	t.Helper()
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	tracer := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				trace = append(trace, name+" in")
+				next.ServeHTTP(w, r)
+				trace = append(trace, name+" out")
+			})
+		}
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = append(trace, "handler")
+	})
+
+	for _, tt := range []struct {
+		name string
+		mws  []string
+		want []string
+	}{
+		{"none", nil, []string{"handler"}},
+		{"one", []string{"a"}, []string{"a in", "handler", "a out"}},
+		{"three", []string{"a", "b", "c"}, []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			trace = nil
+			var mws []func(http.Handler) http.Handler
+			for _, name := range tt.mws {
+				mws = append(mws, tracer(name))
+			}
+			chain(h, mws...).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			if !slices.Equal(trace, tt.want) {
+				t.Errorf("trace = %q, want %q", trace, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerAroundAuth(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		key        string
+		wantStatus float64
+	}{
+		{"valid key", testKey, 404},
+		{"no key", "", 401},
+		{"wrong key", "wrong", 401},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/user/1", "")
+			r.Header.Set("X-API-Key", tt.key)
+			serve(h, r)
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 {
+				t.Fatalf("%d access records, want 1:\n%s", len(recs), logs.String())
+			}
+			if recs[0]["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %v", recs[0]["status"], tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		h          http.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantLog    string
+	}{
+		{
+			name:       "no panic",
+			h:          func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "panic before writing",
+			h:          func(w http.ResponseWriter, r *http.Request) { panic("kaboom") },
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal server error"}` + "\n",
+			wantLog:    "kaboom",
+		},
+		{
+			name: "panic after writing",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte("partial"))
+				panic("kaboom")
+			},
+			wantStatus: http.StatusAccepted,
+			wantBody:   "partial",
+			wantLog:    "kaboom",
+		},
+		{
+			name: "panic in another goroutine",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				panic(&handlerPanic{value: "kaboom", stack: []byte("goroutine 42 [running]")})
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal server error"}` + "\n",
+			wantLog:    "goroutine 42",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil)))
+			rec := httptest.NewRecorder()
+			s.recoverer()(tt.h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) || (tt.wantLog == "") != (logs.Len() == 0) {
+				t.Errorf("logs = %s, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+
+	t.Run("abort handler", func(t *testing.T) {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+			}
+		}()
+		newTestServer(t, DefaultConfig(), nil).recoverer()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestAccessLogBytes(t *testing.T) {
+	var logs bytes.Buffer
+	s := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil)))
+	h := s.Handler()
+	serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+	var served int64
+	for _, tt := range []struct {
+		name, method, target string
+		// headOnly responses send no body whatever was written.
+		headOnly bool
+	}{
+		{"body", "GET", "/user/1", false},
+		{"error", "GET", "/user/2", false},
+		{"head", "HEAD", "/healthz", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			rec := serve(h, newRequest(tt.method, tt.target, ""))
+			want := float64(rec.Body.Len())
+			if tt.headOnly {
+				want = 0
+			}
+			served += int64(want)
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 || recs[0]["bytes"] != want {
+				t.Errorf("logged %s, want bytes %v", logs.String(), want)
+			}
+		})
+	}
+
+	// The create above counts too, and the stats response itself does not
+	// yet.
+	before := s.bytesServed.Load()
+	if before < served {
+		t.Errorf("bytes_served = %d, want at least %d", before, served)
+	}
+	rec := serve(h, newRequest(http.MethodGet, "/stats", ""))
+	var stats StatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesServed != before {
+		t.Errorf("stats bytes_served = %d, want %d", stats.BytesServed, before)
+	}
+}
+
+func TestStatusRecorderPassesThrough(t *testing.T) {
+	t.Run("flush", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sr := &statusRecorder{ResponseWriter: rec, status: http.StatusOK}
+		if err := http.NewResponseController(sr).Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if !rec.Flushed || !sr.wroteHeader {
+			t.Errorf("flushed %v, header written %v", rec.Flushed, sr.wroteHeader)
+		}
+	})
+
+	t.Run("read from", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sr := &statusRecorder{ResponseWriter: rec, status: http.StatusOK}
+		n, err := sr.ReadFrom(strings.NewReader("hello"))
+		if err != nil || n != 5 || sr.bytes != 5 || rec.Body.String() != "hello" {
+			t.Errorf("ReadFrom = %d, %v; counted %d, wrote %q", n, err, sr.bytes, rec.Body)
+		}
+	})
+
+	t.Run("hijack", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			conn, buf, err := http.NewResponseController(sr).Hijack()
+			if err != nil {
+				t.Errorf("Hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			_ = buf.Flush()
+		}))
+		defer srv.Close()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hijacked" {
+			t.Errorf("body = %q, want hijacked", body)
+		}
+	})
+
+	t.Run("through the middleware", func(t *testing.T) {
+		// A streaming handler behind requestLogger and recoverer can still
+		// flush.
+		var flushErr error
+		s := newTestServer(t, DefaultConfig(), nil)
+		h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			flushErr = http.NewResponseController(w).Flush()
+		}), s.requestLogger(func(*http.Request) string { return "" }), s.recoverer())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if flushErr != nil || !rec.Flushed {
+			t.Errorf("Flush: %v, flushed %v", flushErr, rec.Flushed)
+		}
+	})
+}
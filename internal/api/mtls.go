@@ -0,0 +1,93 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errNoClientCert   = errors.New("no verified client certificate")
+	errUnknownSubject = errors.New("client certificate subject not allowed")
+)
+
+// certSubject is a client certificate subject allowed in mTLS mode, and
+// the scopes it is granted.
+type certSubject struct {
+	name   string
+	scopes []string
+}
+
+// parseCertSubjects reads comma-separated "subject[=scopes]" entries, where
+// scopes is a space-separated list defaulting to defaultScopes. A subject
+// is matched against the certificate's common name and its DNS, URI and
+// email SANs.
+func parseCertSubjects(v string) ([]certSubject, error) {
+	var subjects []certSubject
+	for _, entry := range splitList(v) {
+		name, scopes := entry, ""
+		if i := strings.LastIndexByte(entry, '='); i >= 0 {
+			name, scopes = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid client certificate subject %q", entry)
+		}
+		sc, err := parseScopes(scopes)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate subject %s: %w", name, err)
+		}
+		subjects = append(subjects, certSubject{name: name, scopes: sc})
+	}
+	return subjects, nil
+}
+
+// certNames lists the names a certificate identifies its holder by, the
+// common name first.
+func certNames(c *x509.Certificate) []string {
+	var names []string
+	if c.Subject.CommonName != "" {
+		names = append(names, c.Subject.CommonName)
+	}
+	names = append(names, c.DNSNames...)
+	for _, u := range c.URIs {
+		names = append(names, u.String())
+	}
+	return append(names, c.EmailAddresses...)
+}
+
+// certPrincipal identifies the caller by the verified client certificate
+// of the connection: the first of its names that is an allowed subject.
+func (s *Server) certPrincipal(r *http.Request) (principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return principal{}, errNoClientCert
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, name := range certNames(leaf) {
+		for _, sub := range s.cfg.certSubjects {
+			if sub.name == name {
+				return principal{name: "cert:" + name, client: "cert:" + name, scopes: sub.scopes}, nil
+			}
+		}
+	}
+	return principal{}, fmt.Errorf("%w: %s", errUnknownSubject, leaf.Subject)
+}
+
+// requireClientCerts makes cfg fail the handshake unless the client
+// presents a certificate signed by one of the CAs in caFile.
+func requireClientCerts(cfg *tls.Config, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no CA certificates found", caFile)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = pool
+	return nil
+}
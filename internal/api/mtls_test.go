@@ -0,0 +1,231 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for certificates made up on the fly.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// file writes the CA certificate out as PEM and returns its path.
+func (ca *testCA) file(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a certificate signed by ca for the common name cn and the
+// DNS names dns, good for clients and servers alike.
+func (ca *testCA) issue(t *testing.T, cn string, dns ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// pool returns a pool trusting ca alone.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func TestMTLS(t *testing.T) {
+	ca, other := newTestCA(t, "test CA"), newTestCA(t, "other CA")
+	svcA := ca.issue(t, "svc-a")
+	svcB := ca.issue(t, "ignored", "svc-b.internal")
+	unknown := ca.issue(t, "svc-c")
+	forged := other.issue(t, "svc-a")
+
+	cfg := DefaultConfig()
+	cfg.authMode = authModeMTLS
+	cfg.tlsCert, cfg.tlsKey, cfg.clientCA = "cert.pem", "key.pem", ca.file(t)
+	subjects, err := parseCertSubjects("svc-a=read write, svc-b.internal=read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.certSubjects = subjects
+	cfg.auditLog = auditFile
+	var logs, audit syncBuffer
+	cfg.auditOut = &audit
+	s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS = &tls.Config{}
+	if err := requireClientCerts(ts.TLS, cfg.clientCA); err != nil {
+		t.Fatal(err)
+	}
+	// Handshake failures are expected; they need not clutter the output.
+	ts.Config.ErrorLog = slog.NewLogLogger(slog.DiscardHandler, slog.LevelWarn)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	for _, tt := range []struct {
+		name          string
+		cert          *tls.Certificate
+		method        string
+		apiKey        string
+		wantHandshake bool
+		wantStatus    int
+		wantPrincipal string
+	}{
+		{name: "common name", cert: &svcA, method: http.MethodPost,
+			wantHandshake: true, wantStatus: http.StatusCreated, wantPrincipal: "cert:svc-a"},
+		{name: "DNS name", cert: &svcB, method: http.MethodGet,
+			wantHandshake: true, wantStatus: http.StatusOK, wantPrincipal: "cert:svc-b.internal"},
+		{name: "scopes of the subject", cert: &svcB, method: http.MethodPost,
+			wantHandshake: true, wantStatus: http.StatusForbidden, wantPrincipal: "cert:svc-b.internal"},
+		{name: "subject not allowed", cert: &unknown, method: http.MethodGet,
+			wantHandshake: true, wantStatus: http.StatusUnauthorized},
+		{name: "API key does not count", cert: &unknown, method: http.MethodGet, apiKey: testKey,
+			wantHandshake: true, wantStatus: http.StatusUnauthorized},
+		{name: "other CA", cert: &forged, method: http.MethodGet},
+		{name: "no certificate", method: http.MethodGet, apiKey: testKey},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := ts.Client().Transport.(*http.Transport).Clone()
+			if tt.cert != nil {
+				tr.TLSClientConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			client := &http.Client{Transport: tr}
+			t.Cleanup(tr.CloseIdleConnections)
+
+			target := ts.URL + "/users"
+			if tt.method == http.MethodPost {
+				target = ts.URL + "/user"
+			}
+			r, err := http.NewRequest(tt.method, target, strings.NewReader(`{"name":"Ann"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Type", "application/json")
+			if tt.apiKey != "" {
+				r.Header.Set(apiKeyHeader, tt.apiKey)
+			}
+			resp, err := client.Do(r)
+			if !tt.wantHandshake {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("status = %d, want the handshake to fail", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	// Closing waits for the handlers, so all records are written by now.
+	ts.Close()
+	s.closeAudit()
+	var principals []any
+	for _, rec := range logRecords(t, logs.String(), "request") {
+		principals = append(principals, rec["principal"])
+	}
+	want := []any{"cert:svc-a", "cert:svc-b.internal", "cert:svc-b.internal", nil, nil}
+	if !slices.Equal(principals, want) {
+		t.Errorf("access log principals = %v, want %v", principals, want)
+	}
+	principals = nil
+	for _, e := range jsonLines(t, audit.String()) {
+		principals = append(principals, e["principal"])
+	}
+	if !slices.Equal(principals, want) {
+		t.Errorf("audit principals = %v, want %v", principals, want)
+	}
+}
+
+func TestParseCertSubjects(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    []certSubject
+		wantErr bool
+	}{
+		{in: "svc-a", want: []certSubject{{"svc-a", defaultScopes}}},
+		{in: "svc-a=read, spiffe://mesh/svc-b = read write", want: []certSubject{
+			{"svc-a", []string{"read"}},
+			{"spiffe://mesh/svc-b", []string{"read", "write"}},
+		}},
+		{in: "=read", wantErr: true},
+		{in: "svc-a=fly", wantErr: true},
+	} {
+		got, err := parseCertSubjects(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b certSubject) bool {
+			return a.name == b.name && slices.Equal(a.scopes, b.scopes)
+		}) {
+			t.Errorf("%q = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
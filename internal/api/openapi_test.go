@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	if _, ok := spec.Paths["/user"]; !ok {
+		t.Error("openapi.json does not describe /user")
+	}
+
+	h := newTestServer(t, DefaultConfig(), nil).Handler()
+	for _, tt := range []struct {
+		name       string
+		method     string
+		withKey    bool
+		wantStatus int
+		wantSpec   bool
+	}{
+		{"get", http.MethodGet, false, http.StatusOK, true},
+		{"get with key", http.MethodGet, true, http.StatusOK, true},
+		{"head", http.MethodHead, false, http.StatusMethodNotAllowed, false},
+		{"post", http.MethodPost, false, http.StatusMethodNotAllowed, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(tt.method, "/openapi.json", "")
+			if !tt.withKey {
+				r.Header.Del("X-API-Key")
+			}
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := bytes.Equal(rec.Body.Bytes(), openAPISpec); got != tt.wantSpec {
+				t.Errorf("served the spec: %v, want %v", got, tt.wantSpec)
+			}
+			if tt.wantSpec && rec.Header().Get("Content-Type") != jsonContentType {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	for _, tt := range []struct {
+		enabled    bool
+		key        string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{false, "admin", "/debug/pprof", http.StatusNotFound, ""},
+		{false, "admin", "/debug/pprof/heap", http.StatusNotFound, ""},
+		{false, "admin", "/debug/pprof/cmdline", http.StatusNotFound, ""},
+		{true, "admin", "/debug/pprof/", http.StatusOK, "goroutine"},
+		{true, "admin", "/debug/pprof/heap?debug=1", http.StatusOK, "heap profile"},
+		{true, "admin", "/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile"},
+		{true, "admin", "/debug/pprof/cmdline", http.StatusOK, ".test"},
+		{true, "admin", "/debug/pprof/symbol", http.StatusOK, "num_symbols"},
+		{true, "reader", "/debug/pprof/", http.StatusForbidden, ""},
+		{true, "reader", "/debug/pprof/heap", http.StatusForbidden, ""},
+		{true, "", "/debug/pprof/", http.StatusUnauthorized, ""},
+	} {
+		t.Run(strings.Join([]string{map[bool]string{false: "disabled", true: "enabled"}[tt.enabled], tt.key, tt.target}, " "), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.enablePprof = tt.enabled
+			cfg.apiKeys = []string{"reader,read", "admin,read write admin"}
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Header.Set(apiKeyHeader, tt.key)
+			rec := serve(h, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body %.200q, want %q in it", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPprofFlag(t *testing.T) {
+	if DefaultConfig().enablePprof {
+		t.Error("profiles served by default")
+	}
+	if !configFromFlags(t, "-enable-pprof").enablePprof {
+		t.Error("-enable-pprof did not enable them")
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// anonymousBucket is shared by every request that does not present a valid
+// API key, so omitting or guessing the key cannot be used to dodge the limit.
+const anonymousBucket = "anonymous"
+
+// sweepInterval is how often allow looks for buckets to evict.
+const sweepInterval = time.Minute
+
+// bucketLimit is the refill rate, in tokens per second, and capacity of a
+// bucket. The zero value, for a key without a limit of its own, stands for
+// the server-wide one.
+type bucketLimit struct {
+	rate  float64
+	burst float64
+}
+
+type tokenBucket struct {
+	bucketLimit
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key, each with the limit
+// it was last asked for.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		now:     now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// rateLimitStatus is the state of a bucket as of one allow call. It is
+// taken under the limiter's lock so its fields are consistent with each
+// other.
+type rateLimitStatus struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is when the bucket will be full again.
+	reset time.Time
+	// retryAfter is how long a rejected caller has to wait for a token.
+	retryAfter time.Duration
+}
+
+// allow takes a token from key's bucket, if there is one, and reports the
+// bucket's state afterwards. A bucket whose limit differs from lim, because
+// the key's limit or the server-wide one was changed, is replaced by a
+// fresh one.
+func (l *rateLimiter) allow(key string, lim bucketLimit) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok || b.bucketLimit != lim {
+		b = &tokenBucket{bucketLimit: lim, tokens: lim.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	st := rateLimitStatus{limit: int(b.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		st.allowed = true
+	} else {
+		st.retryAfter = l.secondsToDuration((1 - b.tokens) / b.rate)
+	}
+	st.remaining = max(0, int(b.tokens))
+	st.reset = now.Add(l.secondsToDuration((b.burst - b.tokens) / b.rate))
+	return st
+}
+
+func (l *rateLimiter) secondsToDuration(sec float64) time.Duration {
+	return time.Duration(sec * float64(time.Second))
+}
+
+// sweep drops buckets that have been idle long enough to refill completely;
+// such a bucket is indistinguishable from a new one, so nothing is lost.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit limits requests per authenticated principal, at the limit of
+// its key if it has one. Requests that do not authenticate share
+// anonymousBucket. It is a no-op while rate limiting is disabled.
+func (s *Server) rateLimit() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			live := s.live.Load()
+			if live.rateLimit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			bucket := anonymousBucket
+			lim := bucketLimit{rate: live.rateLimit, burst: float64(live.rateBurst)}
+			if p, err := s.authenticated(r); err == nil {
+				bucket = "principal:" + p.name
+				if p.limit.rate > 0 && p.limit.burst > 0 {
+					lim = p.limit
+				}
+			}
+
+			st := s.limiter.allow(bucket, lim)
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(st.limit))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(st.remaining))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(unixCeil(st.reset), 10))
+			if !st.allowed {
+				h.Set("Retry-After", strconv.Itoa(int(math.Ceil(st.retryAfter.Seconds()))))
+				s.errorJSON(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// unixCeil is t in unix seconds, rounded up so a client waiting until then
+// never arrives early.
+func unixCeil(t time.Time) int64 {
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	return sec
+}
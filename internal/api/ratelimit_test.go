@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRateLimitedServer returns a server limited to rate requests per second
+// with bursts of burst, telling the time by clock, with user 1 in its store.
+func newRateLimitedServer(t *testing.T, rate float64, burst int, clock *fakeClock) http.Handler {
+	cfg := DefaultConfig()
+	cfg.rateLimit, cfg.rateBurst = rate, burst
+	s := newTestServerAt(t, cfg, nil, clock.now)
+	s.users.Create(context.Background(), "Ann", "")
+	return s.Handler()
+}
+
+func TestRateLimit(t *testing.T) {
+	type step struct {
+		// wait is how long the clock moves on before the request.
+		wait       time.Duration
+		key        string
+		wantStatus int
+	}
+	for _, tt := range []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"burst then limited", 1, 3, []step{
+			{0, testKey, 200}, {0, testKey, 200}, {0, testKey, 200}, {0, testKey, 429},
+		}},
+		{"refills at the rate", 2, 1, []step{
+			{0, testKey, 200}, {0, testKey, 429}, {250 * time.Millisecond, testKey, 429}, {250 * time.Millisecond, testKey, 200},
+		}},
+		{"refills up to the burst", 10, 2, []step{
+			{0, testKey, 200}, {0, testKey, 200}, {time.Hour, testKey, 200}, {0, testKey, 200}, {0, testKey, 429},
+		}},
+		{"anonymous requests share a bucket", 1, 1, []step{
+			{0, "", 401}, {0, "wrong", 429}, {0, testKey, 200},
+		}},
+		{"disabled", 0, 1, []step{
+			{0, testKey, 200}, {0, testKey, 200}, {0, testKey, 200},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			h := newRateLimitedServer(t, tt.rate, tt.burst, clock)
+			for i, st := range tt.steps {
+				clock.advance(st.wait)
+				r := newRequest(http.MethodGet, "/user/1", "")
+				r.Header.Set("X-API-Key", st.key)
+				if rec := serve(h, r); rec.Code != st.wantStatus {
+					t.Errorf("request %d: status = %d, want %d: %s", i, rec.Code, st.wantStatus, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		burst    int
+		requests int
+	}{
+		{"under the burst", 50, 40},
+		{"over the burst", 20, 200},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The clock stands still, so no tokens come back meanwhile.
+			h := newRateLimitedServer(t, 1, tt.burst, newFakeClock())
+			var ok, limited atomic.Int32
+			var wg sync.WaitGroup
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					switch rec := serve(h, newRequest(http.MethodGet, "/user/1", "")); rec.Code {
+					case http.StatusOK:
+						ok.Add(1)
+					case http.StatusTooManyRequests:
+						limited.Add(1)
+					default:
+						t.Errorf("status %d: %s", rec.Code, rec.Body)
+					}
+				}()
+			}
+			wg.Wait()
+			wantOK := min(tt.burst, tt.requests)
+			if int(ok.Load()) != wantOK || int(limited.Load()) != tt.requests-wantOK {
+				t.Errorf("%d allowed and %d limited, want %d and %d", ok.Load(), limited.Load(), wantOK, tt.requests-wantOK)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	type want struct {
+		status           int
+		remaining, retry string
+		// reset is how far from now the bucket is full again.
+		reset time.Duration
+	}
+	for _, tt := range []struct {
+		name  string
+		rate  float64
+		burst int
+		// targets are requested one after the other at the same instant.
+		targets []string
+		want    []want
+	}{
+		{"decrement", 1, 3, []string{"/user/1", "/user/1", "/user/1", "/user/1"}, []want{
+			{200, "2", "", time.Second}, {200, "1", "", 2 * time.Second}, {200, "0", "", 3 * time.Second}, {429, "0", "1", 3 * time.Second},
+		}},
+		{"on errors too", 2, 2, []string{"/user/99", "/user/x", "/user/1"}, []want{
+			{404, "1", "", 500 * time.Millisecond}, {400, "0", "", time.Second}, {429, "0", "1", time.Second},
+		}},
+		{"disabled", 0, 3, []string{"/user/1"}, []want{{status: 200}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			h := newRateLimitedServer(t, tt.rate, tt.burst, clock)
+			for i, target := range tt.targets {
+				w := tt.want[i]
+				rec := serve(h, newRequest(http.MethodGet, target, ""))
+				if rec.Code != w.status {
+					t.Errorf("request %d: status = %d, want %d", i, rec.Code, w.status)
+				}
+				headers := map[string]string{"X-RateLimit-Limit": "", "X-RateLimit-Remaining": "", "X-RateLimit-Reset": "", "Retry-After": ""}
+				if tt.rate > 0 {
+					headers = map[string]string{
+						"X-RateLimit-Limit":     strconv.Itoa(tt.burst),
+						"X-RateLimit-Remaining": w.remaining,
+						"X-RateLimit-Reset":     strconv.FormatInt(unixCeil(clock.now().Add(w.reset)), 10),
+						"Retry-After":           w.retry,
+					}
+				}
+				for name, want := range headers {
+					if got := rec.Header().Get(name); got != want {
+						t.Errorf("request %d: %s = %q, want %q", i, name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimitHeadersConcurrent checks that the headers each admitted
+// request gets describe the bucket as that request left it, even with
+// others taking tokens at the same time: with the clock standing still,
+// every remaining count from burst-1 down to 0 is handed out exactly once.
+func TestRateLimitHeadersConcurrent(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		burst    int
+		requests int
+	}{
+		{"exact", 30, 30},
+		{"over", 30, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			h := newRateLimitedServer(t, 1, tt.burst, clock)
+
+			var mu sync.Mutex
+			remaining := make(map[int]int)
+			var wg sync.WaitGroup
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := serve(h, newRequest(http.MethodGet, "/user/1", ""))
+					n, err := strconv.Atoi(rec.Header().Get("X-RateLimit-Remaining"))
+					if err != nil || n < 0 {
+						t.Errorf("X-RateLimit-Remaining = %q", rec.Header().Get("X-RateLimit-Remaining"))
+						return
+					}
+					reset, _ := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+					if want := unixCeil(clock.now().Add(time.Duration(tt.burst-n) * time.Second)); rec.Code == http.StatusOK && reset != want {
+						t.Errorf("remaining %d with reset %d, want %d", n, reset, want)
+					}
+					if rec.Code == http.StatusOK {
+						mu.Lock()
+						remaining[n]++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			for n := range tt.burst {
+				if remaining[n] != 1 {
+					t.Errorf("remaining %d given to %d admitted requests, want 1", n, remaining[n])
+				}
+			}
+		})
+	}
+}
+
+// TestPerKeyRateLimit runs two keys with limits of their own side by side
+// and checks that each is throttled at its own rate, and that changing one
+// key's limit leaves the other's bucket alone.
+func TestPerKeyRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin", "fast,read,100,50", "slow,read,1,5"}
+	cfg.authMaxFailures = 0
+	clock := newFakeClock()
+	s := newTestServerAt(t, cfg, nil, clock.now)
+	h := s.Handler()
+
+	get := func(key string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodGet, "/users", "")
+		r.Header.Set("X-API-Key", key)
+		return serve(h, r)
+	}
+	var mu sync.Mutex
+	allowed := make(map[string]int)
+	var wg sync.WaitGroup
+	for _, key := range []string{"fast", "slow"} {
+		for range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := get(key)
+				if want := map[string]string{"fast": "50", "slow": "5"}[key]; rec.Header().Get("X-RateLimit-Limit") != want {
+					t.Errorf("%s: X-RateLimit-Limit = %q, want %s", key, rec.Header().Get("X-RateLimit-Limit"), want)
+				}
+				if rec.Code == http.StatusOK {
+					mu.Lock()
+					allowed[key]++
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if allowed["fast"] != 50 || allowed["slow"] != 5 {
+		t.Errorf("allowed %v, want fast 50 and slow 5", allowed)
+	}
+	// A managed key's limit is changed through the admin API.
+	var created CreateKeyResponse
+	if err := json.Unmarshal(mustServe(t, h, http.StatusCreated, http.MethodPost, "/admin/keys", `{"scopes":["read"],"rate":1,"burst":2}`), &created); err != nil {
+		t.Fatal(err)
+	}
+	if n := countAllowed(get, created.Key, 5); n != 2 {
+		t.Errorf("managed key: %d allowed, want 2", n)
+	}
+	mustServe(t, h, http.StatusOK, http.MethodPatch, "/admin/keys/"+created.ID, `{"rate":1,"burst":4}`)
+	if rec := get(created.Key); rec.Header().Get("X-RateLimit-Limit") != "4" {
+		t.Errorf("after the update: X-RateLimit-Limit = %q, want 4", rec.Header().Get("X-RateLimit-Limit"))
+	}
+	if n := countAllowed(get, created.Key, 5); n != 3 {
+		t.Errorf("managed key after the update: %d more allowed, want 3", n)
+	}
+	// The other keys' buckets are still empty, and refill at their own
+	// rates.
+	if n := countAllowed(get, "fast", 10); n != 0 {
+		t.Errorf("fast key: %d allowed after the update, want its bucket still empty", n)
+	}
+	clock.advance(time.Second)
+	if n := countAllowed(get, "slow", 10); n != 1 {
+		t.Errorf("slow key: %d allowed a second later, want 1", n)
+	}
+	if n := countAllowed(get, "fast", 100); n != 50 {
+		t.Errorf("fast key: %d allowed a second later, want 50", n)
+	}
+}
+
+// countAllowed sends n requests with key through get, one after the
+// other, and returns how many were let through.
+func countAllowed(get func(string) *httptest.ResponseRecorder, key string, n int) int {
+	allowed := 0
+	for range n {
+		if get(key).Code == http.StatusOK {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"-rate=0"}, false},
+		{[]string{"-rate=2.5", "-burst=1"}, false},
+		{[]string{"-rate=-1"}, true},
+		{[]string{"-burst=0"}, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%q: Validate = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
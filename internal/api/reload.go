@@ -0,0 +1,100 @@
+package api
+
+import (
+	"log/slog"
+	"slices"
+)
+
+// hotSettings are the settings a reload applies to the running server. A
+// change to any other one is reported as needing a restart.
+var hotSettings = []string{"keys-file", "rate", "burst", "cors-origins", "log-level", "maintenance"}
+
+// liveConfig is the part of the configuration that can change while
+// serving. It is replaced whole rather than modified, so every request
+// sees one consistent version of it.
+type liveConfig struct {
+	rateLimit   float64
+	rateBurst   int
+	corsOrigins []string
+	maintenance bool
+}
+
+func newLiveConfig(cfg Config) *liveConfig {
+	return &liveConfig{
+		rateLimit:   cfg.rateLimit,
+		rateBurst:   cfg.rateBurst,
+		corsOrigins: cfg.corsOrigins,
+		maintenance: cfg.maintenance,
+	}
+}
+
+// reloader applies a fresh read of the configuration to a running server,
+// on SIGHUP.
+type reloader struct {
+	s     *Server
+	level *slog.LevelVar
+	args  []string
+	// settings are the values in effect, as formatted by their flags, and
+	// keys the configured API keys.
+	settings map[string]string
+	keys     []string
+	// pending are the values of settings that need a restart already
+	// warned about, so that a later reload warns only of new changes.
+	pending map[string]string
+}
+
+func newReloader(s *Server, level *slog.LevelVar, args []string, settings map[string]string) *reloader {
+	return &reloader{s: s, level: level, args: args, settings: settings, keys: s.cfg.apiKeys, pending: map[string]string{}}
+}
+
+// reload reads the configuration again and, if it is valid, switches the
+// server to its hotSettings and API keys, logging each change. Nothing is
+// applied from a configuration that does not validate.
+func (rl *reloader) reload() {
+	logger := rl.s.logger
+	next, fs, err := readConfig(rl.args)
+	if err != nil {
+		logger.Error("reloading configuration failed, keeping the current one", "err", err)
+		return
+	}
+
+	values := settingValues(fs)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	changed, restart := 0, []string{}
+	for _, name := range names {
+		old, v := rl.settings[name], values[name]
+		switch {
+		case v == old:
+			delete(rl.pending, name)
+		case slices.Contains(hotSettings, name):
+			logger.Info("setting changed", "setting", name, "old", old, "new", v)
+			rl.settings[name] = v
+			changed++
+		default:
+			if p, ok := rl.pending[name]; !ok || p != v {
+				restart = append(restart, name)
+				rl.pending[name] = v
+			}
+		}
+	}
+
+	if lvl, err := parseLogLevel(next.logLevel); err == nil && rl.level != nil {
+		rl.level.Set(lvl)
+	}
+	rl.s.live.Store(newLiveConfig(next))
+	if !slices.Equal(next.apiKeys, rl.keys) {
+		rl.s.keys.replace(next.apiKeys)
+		logger.Info("setting changed", "setting", "API keys", "old_count", len(rl.keys), "new_count", len(next.apiKeys))
+		rl.keys = next.apiKeys
+		changed++
+	}
+
+	logger.Info("reloaded configuration", "changed", changed)
+	if len(restart) > 0 {
+		logger.Warn("changed settings need a restart to take effect", "settings", restart)
+	}
+}
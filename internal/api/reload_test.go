@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestReloader starts a test server from a config file holding
+// settings, as main would with -config. It returns the server, its
+// reloader and the file, for the test to change.
+func newTestReloader(t *testing.T, settings string, logger *slog.Logger) (*Server, *reloader, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(settings), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-config", file}
+	cfg, fs, err := readConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, cfg, logger)
+	return s, newReloader(s, new(slog.LevelVar), args, settingValues(fs)), file
+}
+
+func TestReload(t *testing.T) {
+	t.Setenv("API_KEYS", testKey)
+	for _, tt := range []struct {
+		name string
+		// reloads are the config files read on successive SIGHUPs.
+		reloads []string
+		// wantWarnings are the restart warnings expected in all, and
+		// wantRate the rate limit in effect at the end.
+		wantWarnings int
+		wantRate     float64
+	}{
+		{
+			name:     "unchanged",
+			reloads:  []string{`{"addr": ":8080"}`},
+			wantRate: 10,
+		},
+		{
+			name:     "hot setting",
+			reloads:  []string{`{"addr": ":8080", "rate": "3"}`},
+			wantRate: 3,
+		},
+		{
+			name:         "restart setting",
+			reloads:      []string{`{"addr": ":9090"}`},
+			wantWarnings: 1,
+			wantRate:     10,
+		},
+		{
+			name:         "restart setting warned once",
+			reloads:      []string{`{"addr": ":9090"}`, `{"addr": ":9090"}`, `{"addr": ":9090", "rate": "5"}`},
+			wantWarnings: 1,
+			wantRate:     5,
+		},
+		{
+			name:         "restart setting changed again",
+			reloads:      []string{`{"addr": ":9090"}`, `{"addr": ":9091"}`},
+			wantWarnings: 2,
+			wantRate:     10,
+		},
+		{
+			name:         "restart setting reverted and changed",
+			reloads:      []string{`{"addr": ":9090"}`, `{"addr": ":8080"}`, `{"addr": ":9090"}`},
+			wantWarnings: 2,
+			wantRate:     10,
+		},
+		{
+			name:     "invalid config kept out",
+			reloads:  []string{`{"addr": ":8080", "rate": "3"}`, `{"addr": ":8080", "rate": "-1"}`},
+			wantRate: 3,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s, rl, file := newTestReloader(t, `{"addr": ":8080"}`, slog.New(slog.NewTextHandler(&logs, nil)))
+			for _, settings := range tt.reloads {
+				if err := os.WriteFile(file, []byte(settings), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				rl.reload()
+			}
+			if got := strings.Count(logs.String(), "need a restart"); got != tt.wantWarnings {
+				t.Errorf("%d restart warnings, want %d; logs:\n%s", got, tt.wantWarnings, logs.String())
+			}
+			if got := s.live.Load().rateLimit; got != tt.wantRate {
+				t.Errorf("rate = %v, want %v", got, tt.wantRate)
+			}
+		})
+	}
+}
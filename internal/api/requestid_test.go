@@ -0,0 +1,44 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		sent   string
+		reused bool
+	}{
+		{"none", "", false},
+		{"well-formed", "abc-123_X.y", true},
+		{"too long", strings.Repeat("a", maxRequestIDLen+1), false},
+		{"longest", strings.Repeat("a", maxRequestIDLen), true},
+		{"bad characters", "abc 123\n", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := newTestServer(t, DefaultConfig(), slog.New(slog.NewJSONHandler(&logs, nil))).Handler()
+			r := newRequest(http.MethodGet, "/user/1", "")
+			if tt.sent != "" {
+				r.Header.Set(requestIDHeader, tt.sent)
+			}
+			rec := serve(h, r)
+			id := rec.Header().Get(requestIDHeader)
+			switch {
+			case tt.reused && id != tt.sent:
+				t.Errorf("%s = %q, want %q", requestIDHeader, id, tt.sent)
+			case !tt.reused && (id == tt.sent || len(id) != 32):
+				t.Errorf("%s = %q, want a fresh id", requestIDHeader, id)
+			}
+			recs := logRecords(t, logs.String(), "request")
+			if len(recs) != 1 || recs[0]["request_id"] != id {
+				t.Errorf("access log does not carry the id %q:\n%s", id, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const jsonContentType = "application/json; charset=utf-8"
+
+// maxPooledBuffer keeps one oversized response from pinning its buffer in
+// the pool forever.
+const maxPooledBuffer = 64 << 10
+
+var bufPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// ErrorResponse carries an error message, the APIError code for clients to
+// tell errors apart by and, for validation failures, what is wrong with
+// each offending field.
+type ErrorResponse struct {
+	Error  string            `json:"error"`
+	Code   string            `json:"code,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type EnvelopeResponse struct {
+	Data   any               `json:"data"`
+	Error  *string           `json:"error"`
+	Code   string            `json:"code,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// respond is the single exit point for JSON responses. Exactly one of data
+// and errMsg is expected to be set.
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, status int, data any, errMsg string) {
+	s.send(w, r, status, s.body(data, errMsg))
+}
+
+// send encodes body before anything is written so that an encoding failure
+// still yields a clean 500.
+func (s *Server) send(w http.ResponseWriter, r *http.Request, status int, body any) {
+	s.sendInCase(w, r, status, body, s.cfg.jsonCase)
+}
+
+// sendInCase is send with the field names in jsonCase instead of the
+// configured case.
+func (s *Server) sendInCase(w http.ResponseWriter, r *http.Request, status int, body any, jsonCase string) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			bufPool.Put(buf)
+		}
+	}()
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(s.cfg.escapeHTML)
+	if s.pretty(r) {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(body); err != nil {
+		s.log(r.Context()).Error("json encode error", "err", err)
+		buf.Reset()
+		status = http.StatusInternalServerError
+		_ = enc.Encode(s.body(nil, "internal error"))
+	}
+
+	out := buf.Bytes()
+	if jsonCase == jsonCaseCamel {
+		out = camelKeys(out)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+func (s *Server) body(data any, errMsg string) any {
+	switch {
+	case s.cfg.envelope && errMsg != "":
+		return EnvelopeResponse{Error: &errMsg}
+	case s.cfg.envelope:
+		return EnvelopeResponse{Data: data}
+	case errMsg != "":
+		return ErrorResponse{Error: errMsg}
+	default:
+		return data
+	}
+}
+
+// pretty reports whether the response to r should be indented: ?pretty=
+// overrides the server-wide default.
+func (s *Server) pretty(r *http.Request) bool {
+	v := r.URL.Query().Get("pretty")
+	if v == "" {
+		return s.cfg.prettyJSON
+	}
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	s.respond(w, r, status, v, "")
+}
+
+func (s *Server) errorJSON(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	s.respond(w, r, status, nil, msg)
+}
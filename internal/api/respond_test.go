@@ -0,0 +1,206 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+func TestEnvelope(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		envelope bool
+		target   string
+		key      string
+		want     string
+	}{
+		{"data", true, "/user/1", testKey,
+			`{"data":{"user_id":1,"name":"Ann","version":1,"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"},"error":null}`},
+		{"handler error", true, "/user/2", testKey,
+			`{"data":null,"error":"not found","code":"not_found"}`},
+		{"middleware error", true, "/user/1", "",
+			`{"data":null,"error":"unauthorized","code":"unauthorized"}`},
+		{"bare data", false, "/user/1", testKey,
+			`{"user_id":1,"name":"Ann","version":1,"created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}`},
+		{"bare error", false, "/user/2", testKey,
+			`{"error":"not found","code":"not_found"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.envelope = tt.envelope
+			s := newTestServer(t, cfg, nil)
+			useStore(s, store.NewMemory(0, func() time.Time { return time.Time{} }))
+			if _, err := s.users.Create(context.Background(), "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Header.Set("X-API-Key", tt.key)
+			rec := serve(s.Handler(), r)
+			if got := strings.TrimSuffix(rec.Body.String(), "\n"); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONBuffered(t *testing.T) {
+	big := strings.Repeat("x", 2*maxPooledBuffer)
+	for _, tt := range []struct {
+		name   string
+		target string
+		body   any
+		want   string
+	}{
+		{"small", "/", map[string]int{"n": 1}, `{"n":1}` + "\n"},
+		{"pretty", "/?pretty=true", map[string]int{"n": 1}, "{\n  \"n\": 1\n}\n"},
+		{"larger than pooled", "/", []string{big}, `["` + big + `"]` + "\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			newTestServer(t, DefaultConfig(), nil).writeJSON(rec, r, http.StatusTeapot, tt.body)
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+			}
+			if rec.Body.String() != tt.want {
+				t.Errorf("body = %.80q, want %.80q", rec.Body, tt.want)
+			}
+			if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(len(tt.want)); got != want {
+				t.Errorf("Content-Length = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestEscapeHTML(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		escapeHTML bool
+		wantName   string
+	}{
+		{"escaped", true, `"name":"\u003cb\u003eA\u0026B\u003c/b\u003e"`},
+		{"unescaped", false, `"name":"<b>A&B</b>"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.escapeHTML = tt.escapeHTML
+			h := newTestServer(t, cfg, nil).Handler()
+			rec := serve(h, newRequest(http.MethodPost, "/user", `{"name":"<b>A&B</b>"}`))
+			if !strings.Contains(rec.Body.String(), tt.wantName) {
+				t.Errorf("body = %s, want %s in it", rec.Body, tt.wantName)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+		})
+	}
+}
+
+func TestEscapeHTMLConfig(t *testing.T) {
+	for _, tt := range []struct {
+		env     string
+		args    []string
+		want    bool
+		wantErr bool
+	}{
+		{env: "", want: true},
+		{env: "0", want: false},
+		{env: "false", want: false},
+		{env: "1", want: true},
+		{env: "", args: []string{"-escape-html=false"}, want: false},
+		// The flag wins over the environment.
+		{env: "0", args: []string{"-escape-html"}, want: true},
+		{env: "sometimes", wantErr: true},
+	} {
+		t.Run(strings.Join(append([]string{"JSON_ESCAPE_HTML=" + tt.env}, tt.args...), " "), func(t *testing.T) {
+			t.Setenv("API_KEYS", testKey)
+			t.Setenv("JSON_ESCAPE_HTML", tt.env)
+			cfg, _, err := readConfig(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.escapeHTML != tt.want {
+				t.Fatalf("escapeHTML = %v, want %v", cfg.escapeHTML, tt.want)
+			}
+			// Every JSON response follows it, streamed ones included.
+			h := newTestServer(t, cfg, nil).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"<b>A&B</b>"}`))
+			for _, target := range []string{"/user/1", "/users", "/users?format=ndjson"} {
+				body := serve(h, newRequest(http.MethodGet, target, "")).Body.String()
+				if got := strings.Contains(body, "<b>A&B</b>"); got == tt.want {
+					t.Errorf("%s: body %s unescaped %v, want %v", target, body, got, !tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPretty(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		prettyJSON bool
+		query      string
+		want       bool
+	}{
+		{"default", false, "", false},
+		{"asked for", false, "?pretty=true", true},
+		{"asked for as 1", false, "?pretty=1", true},
+		{"pretty by default", true, "", true},
+		{"turned off", true, "?pretty=false", false},
+		{"malformed", true, "?pretty=very", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.prettyJSON = tt.prettyJSON
+			h := newTestServer(t, cfg, nil).Handler()
+			// Errors are indented like the rest.
+			for _, target := range []string{"/healthz", "/user/1"} {
+				rec := serve(h, newRequest(http.MethodGet, target+tt.query, ""))
+				if got := strings.Contains(rec.Body.String(), "\n  \""); got != tt.want {
+					t.Errorf("%s: body %q indented: %v, want %v", target, rec.Body, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendEncodingFailure(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		envelope bool
+		want     string
+	}{
+		{"plain", false, `{"error":"internal error"}` + "\n"},
+		{"envelope", true, `{"data":null,"error":"internal error"}` + "\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.envelope = tt.envelope
+			s := newTestServer(t, cfg, nil)
+			rec := httptest.NewRecorder()
+			s.send(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK,
+				map[string]any{"ok": true, "ch": make(chan int)})
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want 500", rec.Code)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(len(tt.want)); got != want {
+				t.Errorf("Content-Length = %s, want %s", got, want)
+			}
+			if got := rec.Header().Get("Content-Type"); got != jsonContentType {
+				t.Errorf("Content-Type = %q, want %q", got, jsonContentType)
+			}
+		})
+	}
+}
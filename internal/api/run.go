@@ -0,0 +1,416 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// process is what ListenAndServe sets up around a Server: the listeners'
+// servers and the files and exporters to close on the way out.
+type process struct {
+	srv             *http.Server
+	conns           *connTracker
+	reloader        *reloader
+	accessFile      *logFile
+	shutdownTracing func(context.Context) error
+	// certs reloads the TLS certificate on SIGHUP, if there is one.
+	certs *certReloader
+	// aux are the plaintext servers run alongside the main one.
+	aux     []auxServer
+	closers []io.Closer
+}
+
+func (p *process) close() {
+	for _, c := range p.closers {
+		_ = c.Close()
+	}
+}
+
+// setup opens the log files s.cfg names and builds the servers that
+// ListenAndServe runs.
+func (s *Server) setup() (_ *process, err error) {
+	cfg, logger := s.cfg, s.logger
+	p := &process{shutdownTracing: func(context.Context) error { return nil }}
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+	if cfg.accessLogPath != "" {
+		p.accessFile, err = openLogFile(cfg.accessLogPath, cfg.accessLogMaxSize, cfg.accessLogKeep, logger)
+		if err == nil {
+			p.closers = append(p.closers, p.accessFile)
+		}
+	}
+	if err == nil && cfg.auditLog == auditFile && s.auditor == nil {
+		var f *os.File
+		f, err = os.OpenFile(cfg.auditPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if f != nil {
+			p.closers = append(p.closers, f)
+			s.auditor = newAuditSink(logger, f, cfg.auditQueue)
+		}
+	}
+	if err == nil && cfg.callLogPath != "" && s.calls == nil {
+		var f *os.File
+		f, err = os.OpenFile(cfg.callLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if f != nil {
+			p.closers = append(p.closers, f)
+			s.calls = newCallLog(f, cfg.auditQueue)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.accessFile != nil {
+		// Only the access log goes to the file; everything else stays on
+		// stderr.
+		var level slog.Leveler = slog.LevelInfo
+		if cfg.level != nil {
+			level = cfg.level
+		}
+		s.accessLogger, _ = newLogger(p.accessFile, cfg.logFormat, level)
+	}
+	if cfg.insecureNoAuth {
+		logger.Warn("authentication is disabled")
+	}
+	if cfg.authMode == authModeKey && !cfg.insecureNoAuth {
+		headers := []string{"Authorization", apiKeyHeader}
+		if cfg.apiKeyHeader != "" && cfg.apiKeyHeader != apiKeyHeader {
+			headers = append(headers, cfg.apiKeyHeader)
+		}
+		logger.Info("accepting API keys", "headers", headers)
+	}
+	if cfg.writeTimeout > 0 && cfg.requestTimeout >= cfg.writeTimeout {
+		logger.Warn("request timeout is not below the write timeout; timed-out requests may get no response",
+			"request_timeout", cfg.requestTimeout.String(), "write_timeout", cfg.writeTimeout.String())
+	}
+	if len(cfg.authExempt) > 0 {
+		logger.Info("paths exempt from authentication", "paths", cfg.authExempt)
+	}
+
+	tp, shutdownTracing, err := newTracerProvider(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if tracingEnabled(tp) {
+		logger.Info("exporting traces over OTLP")
+	}
+	s.traceWith(tp)
+	p.shutdownTracing = shutdownTracing
+
+	p.srv = s.httpServer(cfg.addr, s.Handler())
+	p.conns = &connTracker{conns: make(map[net.Conn]http.ConnState)}
+	p.srv.ConnState = p.conns.track
+	switch {
+	case cfg.tlsCert != "":
+		p.certs, err = newCertReloader(cfg.tlsCert, cfg.tlsKey)
+		if err == nil {
+			p.srv.TLSConfig = p.certs.tlsConfig()
+		}
+	case len(cfg.acmeDomains) > 0:
+		var m *autocert.Manager
+		m, err = newACMEManager(cfg.acmeDomains, cfg.acmeCache, cfg.acmeEmail)
+		if err == nil {
+			p.srv.TLSConfig = hardenTLS(m.TLSConfig())
+			// With no fallback handler, the challenge server redirects
+			// every other request to https.
+			p.aux = append(p.aux, auxServer{"ACME challenges", s.httpServer(cfg.acmeHTTPAddr, m.HTTPHandler(nil))})
+		}
+	}
+	if err == nil && p.srv.TLSConfig != nil {
+		// Failed handshakes, such as those without a client certificate,
+		// are reported here.
+		p.srv.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+		if cfg.authMode == authModeMTLS {
+			err = requireClientCerts(p.srv.TLSConfig, cfg.clientCA)
+		}
+	}
+	if err != nil {
+		_ = shutdownTracing(context.Background())
+		return nil, err
+	}
+	if cfg.h2c {
+		p.srv.Handler = h2c.NewHandler(p.srv.Handler, &http2.Server{IdleTimeout: cfg.idleTimeout})
+	}
+	if cfg.healthAddr != "" {
+		p.aux = append(p.aux, auxServer{"health checks", s.httpServer(cfg.healthAddr, s.healthHandler())})
+	}
+	if cfg.settings != nil {
+		// Only a Config filled in by Load can be read again.
+		p.reloader = newReloader(s, cfg.level, cfg.args, cfg.settings)
+	}
+	return p, nil
+}
+
+// ListenAndServe opens the log files s.cfg names and serves s on its
+// addresses until SIGINT or SIGTERM, and then shuts it down gracefully. It
+// logs whatever makes it fail before returning the error. The store is
+// left for the caller to close.
+func (s *Server) ListenAndServe() error {
+	cfg, logger := s.cfg, s.logger
+	p, err := s.setup()
+	if err != nil {
+		logger.Error("starting failed", "err", err)
+		return err
+	}
+	defer p.close()
+	// However serving ends, what is still buffered is written out before
+	// the files it goes to are closed; after a graceful shutdown, within
+	// what is left of the grace period.
+	flushCtx, cancelFlush := context.Background(), context.CancelFunc(func() {})
+	defer func() {
+		s.flush(flushCtx, p)
+		cancelFlush()
+	}()
+	if p.accessFile != nil {
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				if err := p.accessFile.reopen(); err != nil {
+					logger.Error("reopening access log failed", "path", cfg.accessLogPath, "err", err)
+				} else {
+					logger.Info("reopened access log", "path", cfg.accessLogPath)
+				}
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if p.reloader != nil {
+				p.reloader.reload()
+			}
+			if p.certs == nil {
+				continue
+			}
+			if err := p.certs.reload(); err != nil {
+				logger.Error("reloading TLS certificate failed, keeping the current one", "err", err)
+			} else {
+				logger.Info("reloaded TLS certificate")
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.userTTL > 0 {
+		logger.Info("users expire", "ttl", cfg.userTTL.String())
+		go s.expireUsers(ctx)
+	}
+
+	// Listening before serving means a bad or busy address is reported
+	// right away, and the log shows the port actually bound for :0.
+	srv := p.srv
+	ln, err := listen(cfg.addr, cfg.socketMode)
+	if err != nil {
+		logger.Error("listen failed", "addr", cfg.addr, "err", err)
+		return err
+	}
+	auxLns := make([]net.Listener, len(p.aux))
+	for i, a := range p.aux {
+		if auxLns[i], err = listen(a.srv.Addr, cfg.socketMode); err != nil {
+			logger.Error("listen failed", "addr", a.srv.Addr, "err", err)
+			_ = ln.Close()
+			for _, l := range auxLns[:i] {
+				_ = l.Close()
+			}
+			return err
+		}
+	}
+
+	errc := make(chan error, 1+len(p.aux))
+	go func() {
+		if srv.TLSConfig != nil {
+			attrs := []any{"addr", ln.Addr().String(), "scheme", "https"}
+			if srv.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+				attrs = append(attrs, "client_certs", "required")
+			}
+			logger.Info("listening", attrs...)
+			errc <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		logger.Info("listening", "addr", ln.Addr().String(), "scheme", "http", "h2c", cfg.h2c)
+		errc <- srv.Serve(ln)
+	}()
+	for i, a := range p.aux {
+		go func() {
+			logger.Info("listening for "+a.name, "addr", auxLns[i].Addr().String())
+			errc <- a.srv.Serve(auxLns[i])
+		}()
+	}
+	s.ready.Store(true)
+
+	select {
+	case err := <-errc:
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("server failed", "err", err)
+			_ = srv.Close()
+			for _, a := range p.aux {
+				_ = a.srv.Close()
+			}
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Hand the signals back so that a second one ends the process instead
+	// of waiting for the grace period.
+	force := make(chan os.Signal, 1)
+	signal.Notify(force, os.Interrupt, syscall.SIGTERM)
+	stop()
+	// Once ListenAndServe has returned, a signal is no longer its to
+	// handle.
+	returned := make(chan struct{})
+	defer func() {
+		signal.Stop(force)
+		close(returned)
+	}()
+	go func() {
+		select {
+		case <-force:
+			logger.Warn("second signal received, exiting without waiting for requests")
+			os.Exit(1)
+		case <-returned:
+		}
+	}()
+
+	logger.Info("shutting down", "grace", cfg.shutdownGrace.String(), "drain_delay", cfg.drainDelay.String())
+	s.beginShutdown()
+	time.Sleep(cfg.drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownGrace)
+	flushCtx, cancelFlush = shutdownCtx, cancel
+	if err := srv.Shutdown(shutdownCtx); errors.Is(err, context.DeadlineExceeded) {
+		// A handler that never returns must not hold up the deploy.
+		abandoned := p.conns.busy()
+		_ = srv.Close()
+		logger.Warn("shutdown grace period over, closed the remaining connections",
+			"grace", cfg.shutdownGrace.String(), "abandoned", abandoned)
+	} else if err != nil {
+		logger.Error("shutdown failed", "err", err)
+		return err
+	}
+	for _, a := range p.aux {
+		if a.srv.Shutdown(shutdownCtx) != nil {
+			_ = a.srv.Close()
+		}
+	}
+	return nil
+}
+
+// flush writes out the access log records, traces and audit events still
+// buffered when ListenAndServe returns, giving up on the traces when ctx
+// is done.
+func (s *Server) flush(ctx context.Context, p *process) {
+	s.flushAccessLog()
+	if err := p.shutdownTracing(ctx); err != nil {
+		s.logger.Warn("flushing traces failed", "err", err)
+	}
+	s.closeAudit()
+}
+
+// unixPrefix marks a listen address as the path of a Unix socket.
+const unixPrefix = "unix:"
+
+// listen opens a TCP listener on addr, or a Unix socket with mode
+// permissions, explaining the usual reasons for failing to in terms of
+// what to do about them.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return listenUnix(path, mode)
+	}
+	ln, err := net.Listen("tcp", addr)
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return nil, fmt.Errorf("address %s already in use; is another instance running? (%w)", addr, err)
+	case errors.Is(err, syscall.EACCES):
+		return nil, fmt.Errorf("not allowed to bind %s; ports below 1024 need extra privileges (%w)", addr, err)
+	}
+	return ln, err
+}
+
+// listenUnix listens on the socket at path, first removing a stale socket
+// file left behind by a process that did not shut down cleanly. The
+// listener removes the file again when it is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s already in use; is another instance running?", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// connTracker follows the connections of an http.Server through its
+// ConnState hook, to tell how many were still in use when the grace period
+// of a shutdown ran out.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, c)
+	default:
+		t.conns[c] = state
+	}
+}
+
+// busy returns the number of connections that are not idle.
+func (t *connTracker) busy() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, state := range t.conns {
+		if state != http.StateIdle {
+			n++
+		}
+	}
+	return n
+}
+
+// auxServer is a plaintext server run next to the API, such as the health
+// check listener.
+type auxServer struct {
+	name string
+	srv  *http.Server
+}
@@ -0,0 +1,582 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestListenAndServeAuxListenFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	cfg := DefaultConfig()
+	cfg.addr = unixPrefix + sock
+	cfg.socketMode = 0o600
+	cfg.healthAddr = busy.Addr().String()
+	cfg.accessLogBuffer = 16
+	s := newTestServer(t, cfg, nil)
+	if err := s.ListenAndServe(); err == nil {
+		t.Fatal("ListenAndServe succeeded with the health address in use")
+	}
+	// Closing the main listener removes its socket.
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+	// The access log was flushed, which closes its buffer.
+	if !s.accessLogClosed {
+		t.Error("access log not flushed")
+	}
+}
+
+// startServer runs s.ListenAndServe, whose logger writes JSON to logs, and
+// returns the base URL it listens on once it does and the channel its
+// result arrives on.
+func startServer(t *testing.T, s *Server, logs *syncBuffer) (string, <-chan error) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe() }()
+	var addr string
+	waitFor(t, func() bool {
+		for _, rec := range jsonLines(t, logs.String()) {
+			if rec["msg"] == "listening" {
+				addr, _ = rec["addr"].(string)
+				return true
+			}
+		}
+		return false
+	})
+	return "http://" + addr, errc
+}
+
+// noKeepAlive is a client whose every request has a connection of its own,
+// so that none sits around unused to hold up a shutdown.
+var noKeepAlive = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// get sends a GET for target with the test key and returns the status.
+func get(t *testing.T, target string) int {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(apiKeyHeader, testKey)
+	resp, err := noKeepAlive.Do(r)
+	if err != nil {
+		t.Errorf("GET %s: %v", target, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		sig  syscall.Signal
+	}{
+		{"SIGTERM", syscall.SIGTERM},
+		{"SIGINT", syscall.SIGINT},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.addr = "127.0.0.1:0"
+			cfg.drainDelay = 300 * time.Millisecond
+			cfg.accessLogBuffer = 16
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			st := newBlockingStore()
+			useStore(s, st)
+			base, errc := startServer(t, s, &logs)
+
+			slow := make(chan int, 1)
+			go func() { slow <- get(t, base+"/users") }()
+			<-st.entered
+			if err := syscall.Kill(os.Getpid(), tt.sig); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return len(logRecords(t, logs.String(), "shutting down")) > 0 })
+
+			// While draining, load balancers are told to stop sending
+			// requests, and those still sent are turned away.
+			if code := get(t, base+"/ready"); code != http.StatusServiceUnavailable {
+				t.Errorf("/ready while draining: status = %d, want 503", code)
+			}
+			if code := get(t, base+"/users"); code != http.StatusServiceUnavailable {
+				t.Errorf("new request while draining: status = %d, want 503", code)
+			}
+
+			close(st.release)
+			if code := <-slow; code != http.StatusOK {
+				t.Errorf("request in flight: status = %d, want 200", code)
+			}
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Errorf("ListenAndServe = %v, want nil after a graceful shutdown", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ListenAndServe did not return")
+			}
+			if !s.accessLogClosed {
+				t.Error("access log not flushed")
+			}
+			if _, err := net.Dial("tcp", strings.TrimPrefix(base, "http://")); err == nil {
+				t.Error("still accepting connections after shutdown")
+			}
+		})
+	}
+}
+
+func TestShutdownGraceOver(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		busy int
+	}{
+		{"one stuck request", 1},
+		{"two stuck requests", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const grace = 200 * time.Millisecond
+			cfg := DefaultConfig()
+			cfg.addr = "127.0.0.1:0"
+			cfg.drainDelay = 0
+			cfg.shutdownGrace = grace
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			st := newBlockingStore()
+			t.Cleanup(func() { close(st.release) })
+			useStore(s, st)
+			base, errc := startServer(t, s, &logs)
+
+			// An idle keep-alive connection is not abandoned: shutting
+			// down closes it right away.
+			idle, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idle.Close()
+			fmt.Fprint(idle, "GET /healthz HTTP/1.1\r\nHost: api\r\n\r\n")
+			if resp, err := http.ReadResponse(bufio.NewReader(idle), nil); err != nil {
+				t.Fatal(err)
+			} else {
+				resp.Body.Close()
+			}
+
+			// The store never answers these.
+			stuck := make(chan error, tt.busy)
+			for range tt.busy {
+				go func() {
+					r, _ := http.NewRequest(http.MethodGet, base+"/users", nil)
+					r.Header.Set(apiKeyHeader, testKey)
+					resp, err := noKeepAlive.Do(r)
+					if err == nil {
+						resp.Body.Close()
+					}
+					stuck <- err
+				}()
+				<-st.entered
+			}
+
+			start := time.Now()
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Errorf("ListenAndServe = %v, want nil once the connections are closed", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ListenAndServe did not return")
+			}
+			if took := time.Since(start); took < grace {
+				t.Errorf("returned after %v, before the grace period of %v was over", took, grace)
+			}
+			for range tt.busy {
+				if err := <-stuck; err == nil {
+					t.Error("a stuck request got a response, want its connection closed")
+				}
+			}
+			recs := logRecords(t, logs.String(), "shutdown grace period over, closed the remaining connections")
+			if len(recs) != 1 || recs[0]["abandoned"] != float64(tt.busy) || recs[0]["grace"] != grace.String() || recs[0]["level"] != "WARN" {
+				t.Errorf("logged %v, want one warning with %d abandoned", recs, tt.busy)
+			}
+		})
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	var conns [4]net.Conn
+	for i := range conns {
+		c, other := net.Pipe()
+		defer c.Close()
+		defer other.Close()
+		conns[i] = c
+	}
+	ct := &connTracker{conns: make(map[net.Conn]http.ConnState)}
+	for _, tt := range []struct {
+		conn  int
+		state http.ConnState
+		want  int
+	}{
+		{0, http.StateNew, 1},
+		{1, http.StateActive, 2},
+		{0, http.StateIdle, 1},
+		{2, http.StateActive, 2},
+		{2, http.StateHijacked, 1},
+		{3, http.StateActive, 2},
+		{3, http.StateClosed, 1},
+		{0, http.StateActive, 2},
+	} {
+		ct.track(conns[tt.conn], tt.state)
+		if got := ct.busy(); got != tt.want {
+			t.Errorf("conn %d %v: busy = %d, want %d", tt.conn, tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestShutdownGraceConfig(t *testing.T) {
+	for _, tt := range []struct {
+		env     string
+		args    []string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", nil, 30 * time.Second, false},
+		{"45s", nil, 45 * time.Second, false},
+		{"45s", []string{"-shutdown-grace=5s"}, 5 * time.Second, false},
+		{"soon", nil, 0, true},
+		{"-5s", nil, 0, true},
+		{"", []string{"-drain-delay=-1s"}, 0, true},
+	} {
+		t.Setenv("API_KEYS", testKey)
+		t.Setenv("SHUTDOWN_TIMEOUT", tt.env)
+		cfg, _, err := readConfig(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SHUTDOWN_TIMEOUT=%q %q: err = %v, want error %v", tt.env, tt.args, err, tt.wantErr)
+		}
+		if err == nil && cfg.shutdownGrace != tt.want {
+			t.Errorf("SHUTDOWN_TIMEOUT=%q %q: shutdownGrace = %v, want %v", tt.env, tt.args, cfg.shutdownGrace, tt.want)
+		}
+	}
+}
+
+// stopServer ends a server started with startServer as SIGTERM would and
+// returns what ListenAndServe did.
+func stopServer(t *testing.T, errc <-chan error) error {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+		return nil
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr     string
+		wantHost string
+	}{
+		{"127.0.0.1:0", "127.0.0.1"},
+		{":0", "::"},
+	} {
+		t.Run(tt.addr, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.addr = tt.addr
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			base, errc := startServer(t, s, &logs)
+
+			// The log shows the port chosen, not the one asked for.
+			host, port, err := net.SplitHostPort(strings.TrimPrefix(base, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.wantHost || port == "0" {
+				t.Errorf("listening on %s, want a free port on %s", base, tt.wantHost)
+			}
+			if code := get(t, "http://127.0.0.1:"+port+"/healthz"); code != http.StatusOK {
+				t.Errorf("/healthz: status = %d, want 200", code)
+			}
+			if err := stopServer(t, errc); err != nil {
+				t.Errorf("ListenAndServe = %v", err)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	priorKnowledge := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	for _, tt := range []struct {
+		name   string
+		h2c    bool
+		client *http.Client
+		// upgrade sends an HTTP/1.1 request asking to switch to h2c
+		// instead of using client.
+		upgrade   bool
+		wantErr   bool
+		wantProto string
+	}{
+		{name: "prior knowledge", h2c: true, client: priorKnowledge, wantProto: "HTTP/2.0"},
+		{name: "HTTP/1.1", h2c: true, client: noKeepAlive, wantProto: "HTTP/1.1"},
+		{name: "upgrade", h2c: true, upgrade: true, wantProto: "HTTP/2.0"},
+		{name: "off", client: priorKnowledge, wantErr: true},
+		{name: "off, upgrade", upgrade: true, wantProto: "HTTP/1.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.addr = "127.0.0.1:0"
+			cfg.h2c = tt.h2c
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			for i := range 3 {
+				if _, err := s.users.Create(context.Background(), "user"+strconv.Itoa(i), ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			base, errc := startServer(t, s, &logs)
+			defer func() {
+				if err := stopServer(t, errc); err != nil {
+					t.Errorf("ListenAndServe = %v", err)
+				}
+			}()
+
+			if tt.upgrade {
+				conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				fmt.Fprintf(conn, "GET /healthz HTTP/1.1\r\nHost: api\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if switched := resp.StatusCode == http.StatusSwitchingProtocols; switched != tt.h2c {
+					t.Errorf("status = %d, want switching protocols %v", resp.StatusCode, tt.h2c)
+				}
+			} else {
+				r, err := http.NewRequest(http.MethodGet, base+"/users?format=ndjson", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set(apiKeyHeader, testKey)
+				resp, err := tt.client.Do(r)
+				if tt.wantErr {
+					if err == nil {
+						resp.Body.Close()
+						t.Fatalf("%s response without h2c", resp.Proto)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The stream, flushes and all, makes it through.
+				if resp.Proto != tt.wantProto || strings.Count(string(body), "\n") != 3 {
+					t.Errorf("%s response %q, want %s with 3 records", resp.Proto, body, tt.wantProto)
+				}
+			}
+
+			var recs []map[string]any
+			waitFor(t, func() bool {
+				recs = logRecords(t, logs.String(), "request")
+				return len(recs) > 0
+			})
+			if recs[0]["proto"] != tt.wantProto {
+				t.Errorf("logged proto %v, want %s", recs[0]["proto"], tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestListenAddrInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	addr := busy.Addr().String()
+	for _, tt := range []struct {
+		name string
+		// main and health are the listen addresses of the server.
+		main, health string
+	}{
+		{"main address", addr, ""},
+		{"health address", "127.0.0.1:0", addr},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.addr, cfg.healthAddr = tt.main, tt.health
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			err := s.ListenAndServe()
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				t.Fatalf("ListenAndServe = %v, want EADDRINUSE", err)
+			}
+			want := "address " + addr + " already in use; is another instance running?"
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q does not say %q", err, want)
+			}
+			recs := logRecords(t, logs.String(), "listen failed")
+			if len(recs) != 1 || recs[0]["addr"] != addr || !strings.Contains(recs[0]["err"].(string), want) {
+				t.Errorf("logged %v, want the address in use explained", recs)
+			}
+			if recs := logRecords(t, logs.String(), "listening"); len(recs) != 0 {
+				t.Errorf("logged %v, want nothing served", recs)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		// wantStatus are the statuses of GET /users sent one after the
+		// other.
+		wantStatus []int
+	}{
+		{"defaults", nil, []int{http.StatusOK, http.StatusOK}},
+		// The peer has no IP address for the rate limiter and the
+		// allowlist to go by, which must not trip them up.
+		{"rate limited", []string{"-rate=0.001", "-burst=1"}, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{"allowlist", []string{"-allow-cidr=10.0.0.0/8"}, []int{http.StatusForbidden}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sock := filepath.Join(t.TempDir(), "api.sock")
+			cfg := configFromFlags(t, append([]string{"-addr=unix:" + sock, "-socket-mode=0660"}, tt.args...)...)
+			var logs syncBuffer
+			s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+			_, errc := startServer(t, s, &logs)
+
+			if fi, err := os.Stat(sock); err != nil || fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o660 {
+				t.Errorf("socket file %v (%v), want a socket with mode 0660", fi.Mode(), err)
+			}
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sock)
+				},
+			}}
+			defer client.CloseIdleConnections()
+			for i, want := range tt.wantStatus {
+				r, err := http.NewRequest(http.MethodGet, "http://api/users", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Header.Set(apiKeyHeader, testKey)
+				resp, err := client.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("request %d: status = %d, want %d", i, resp.StatusCode, want)
+				}
+			}
+
+			client.CloseIdleConnections()
+			if err := stopServer(t, errc); err != nil {
+				t.Errorf("ListenAndServe = %v", err)
+			}
+			if _, err := os.Stat(sock); !os.IsNotExist(err) {
+				t.Errorf("socket left behind after shutdown: %v", err)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// prepare leaves something at path before listening on it.
+		prepare func(t *testing.T, path string)
+		wantErr string
+	}{
+		{name: "new", prepare: func(*testing.T, string) {}},
+		{name: "stale socket", prepare: func(t *testing.T, path string) {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// As a process that crashed would, leave the file behind.
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+			ln.Close()
+		}},
+		{name: "socket in use", wantErr: "already in use; is another instance running?", prepare: func(t *testing.T, path string) {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+		}},
+		{name: "not a socket", wantErr: "exists and is not a socket", prepare: func(t *testing.T, path string) {
+			if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "api.sock")
+			tt.prepare(t, path)
+			ln, err := listen(unixPrefix+path, 0o600)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("listen = %v, want an error saying %q", err, tt.wantErr)
+				}
+				if err == nil {
+					ln.Close()
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+				t.Errorf("socket file %v (%v), want mode 0600", fi.Mode(), err)
+			}
+			ln.Close()
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("socket left behind after closing: %v", err)
+			}
+		})
+	}
+}
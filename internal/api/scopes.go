@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+// defaultScopes are granted to credentials that do not name any.
+var defaultScopes = []string{scopeRead, scopeWrite}
+
+// parseScopes splits a space-separated scope list, rejecting unknown
+// scopes. An empty list means defaultScopes.
+func parseScopes(v string) ([]string, error) {
+	scopes := strings.Fields(v)
+	if len(scopes) == 0 {
+		return defaultScopes, nil
+	}
+	for _, sc := range scopes {
+		if sc != scopeRead && sc != scopeWrite && sc != scopeAdmin {
+			return nil, fmt.Errorf("unknown scope %q", sc)
+		}
+	}
+	return scopes, nil
+}
+
+// requireScope lets through only callers whose credentials carry scope,
+// answering 403 otherwise. The caller has already been authenticated by
+// requireAuth; paths exempt from that are exempt from this too.
+func (s *Server) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.cfg.insecureNoAuth {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pathExempt(r.URL.Path, s.cfg.authExempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !slices.Contains(principalFromContext(r.Context()).scopes, scope) {
+				s.errorJSON(w, r, http.StatusForbidden, "insufficient scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestScopes(t *testing.T) {
+	const (
+		allowed   = iota // the scope check lets the request through
+		forbidden        // 403 insufficient scope
+	)
+	for _, tt := range []struct {
+		method, target, body string
+		// want is the outcome by key: read, write and admin.
+		read, write, admin int
+	}{
+		{http.MethodGet, "/user?id=1", "", allowed, forbidden, allowed},
+		{http.MethodGet, "/user/1", "", allowed, forbidden, allowed},
+		{http.MethodGet, "/users", "", allowed, forbidden, allowed},
+		{http.MethodGet, "/users?format=ndjson", "", allowed, forbidden, allowed},
+		{http.MethodGet, "/stats", "", allowed, forbidden, allowed},
+		{http.MethodGet, "/export", "", allowed, forbidden, allowed},
+		{http.MethodPost, "/user", `{"name":"Bob"}`, forbidden, allowed, allowed},
+		{http.MethodPatch, "/user?id=1", `{"name":"Bob"}`, forbidden, allowed, allowed},
+		{http.MethodPost, "/import", `[]`, forbidden, forbidden, allowed},
+		{http.MethodGet, "/admin/keys", "", forbidden, forbidden, allowed},
+		{http.MethodPost, "/admin/keys", `{"label":"ci"}`, forbidden, forbidden, allowed},
+		{http.MethodDelete, "/admin/keys/0123456789ab", "", forbidden, forbidden, allowed},
+	} {
+		for key, want := range map[string]int{"reader": tt.read, "writer": tt.write, "admin": tt.admin} {
+			t.Run(tt.method+" "+tt.target+" as "+key, func(t *testing.T) {
+				cfg := DefaultConfig()
+				cfg.apiKeys = []string{"reader,read", "writer,write", "admin,read write admin", testKey}
+				cfg.rateLimit = 0
+				h := newTestServer(t, cfg, nil).Handler()
+				serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+
+				r := newRequest(tt.method, tt.target, tt.body)
+				r.Header.Set("X-API-Key", key)
+				rec := serve(h, r)
+				var body ErrorResponse
+				_ = json.Unmarshal(rec.Body.Bytes(), &body)
+				denied := rec.Code == http.StatusForbidden && body.Error == "insufficient scope"
+				if denied != (want == forbidden) {
+					t.Errorf("status = %d: %s; want it forbidden: %v", rec.Code, rec.Body, want == forbidden)
+				}
+			})
+		}
+	}
+}
+
+func TestScopesUnknownKey(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{"reader,read"}
+	h := newTestServer(t, cfg, nil).Handler()
+	for key, want := range map[string]int{"reader": http.StatusForbidden, "stranger": http.StatusUnauthorized} {
+		r := newRequest(http.MethodPost, "/user", `{"name":"Ann"}`)
+		r.Header.Set("X-API-Key", key)
+		if rec := serve(h, r); rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", key, rec.Code, want)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", defaultScopes, false},
+		{"  ", defaultScopes, false},
+		{"read", []string{"read"}, false},
+		{"read  admin", []string{"read", "admin"}, false},
+		{"read root", nil, true},
+	} {
+		got, err := parseScopes(tt.in)
+		if (err != nil) != tt.wantErr || !tt.wantErr && !slices.Equal(got, tt.want) {
+			t.Errorf("parseScopes(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		target string
+		key    string
+		tls    bool
+		want   map[string]string
+	}{
+		{"api", "/user/1", testKey, false, map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer",
+			"Strict-Transport-Security": "", "Cache-Control": "no-store",
+		}},
+		{"over tls", "/user/1", testKey, true, map[string]string{
+			"X-Content-Type-Options": "nosniff", "Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+		}},
+		{"unauthenticated", "/user/1", "", false, map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Cache-Control": "",
+		}},
+		{"health", "/healthz", "", false, map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Cache-Control": "",
+		}},
+		{"not found", "/nope", "", false, map[string]string{"X-Content-Type-Options": "nosniff"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestServer(t, DefaultConfig(), nil).Handler()
+			r := newRequest(http.MethodGet, tt.target, "")
+			r.Header.Set("X-API-Key", tt.key)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			rec := serve(h, r)
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeaderOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		set  func(*securityHeaderSet)
+		want map[string]string
+	}{
+		{"override", func(sh *securityHeaderSet) { sh.frameOptions, sh.hsts = "SAMEORIGIN", "max-age=60" }, map[string]string{
+			"X-Frame-Options": "SAMEORIGIN", "Strict-Transport-Security": "max-age=60", "X-Content-Type-Options": "nosniff",
+		}},
+		{"drop", func(sh *securityHeaderSet) { sh.referrerPolicy, sh.hsts, sh.cacheControl = "", "", "" }, map[string]string{
+			"Referrer-Policy": "", "Strict-Transport-Security": "", "Cache-Control": "", "X-Frame-Options": "DENY",
+		}},
+		{"cache control", func(sh *securityHeaderSet) { sh.cacheControl = "private, max-age=0" }, map[string]string{
+			"Cache-Control": "private, max-age=0",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.set(&cfg.securityHeaders)
+			h := newTestServer(t, cfg, nil).Handler()
+			r := newRequest(http.MethodGet, "/users", "")
+			r.TLS = &tls.ConnectionState{}
+			rec := serve(h, r)
+			for name, want := range tt.want {
+				if _, ok := rec.Header()[name]; want == "" && ok {
+					t.Errorf("%s = %q, want it dropped", name, rec.Header().Get(name))
+				} else if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNoStoreHandlerWins(t *testing.T) {
+	s := newTestServer(t, DefaultConfig(), nil)
+	for _, tt := range []struct {
+		name, set, want string
+	}{
+		{"default", "", "no-store"},
+		{"handler", "max-age=60", "max-age=60"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := s.noStore()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.set != "" {
+					w.Header().Set("Cache-Control", tt.set)
+				}
+			}))
+			if got := serve(h, newRequest(http.MethodGet, "/", "")).Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
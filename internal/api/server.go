@@ -0,0 +1,541 @@
+// Package api is the users API server: its handlers, routes and
+// middleware, its configuration and the process serving it.
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+const userPath = "/user/"
+
+// Config is every setting of the server and of the process around it; see
+// Config.Load for where the values come from.
+type Config struct {
+	// Version is the build version, which the command sets from the one
+	// it was built with.
+	Version string
+
+	// compatCreated keeps the legacy "created" field in POST /user
+	// responses for consumers that have not moved to the full resource yet.
+	compatCreated bool
+	// envelope wraps every response as {"data": ..., "error": ...}.
+	envelope bool
+	// escapeHTML escapes <, > and & in JSON strings, as browsers expect.
+	escapeHTML bool
+	// prettyJSON indents responses by default; ?pretty= overrides it.
+	prettyJSON bool
+	// jsonCase names the fields of JSON responses: jsonCaseSnake, as in
+	// the struct tags, or jsonCaseCamel.
+	jsonCase string
+	// trustProxy takes the client address from X-Forwarded-For/X-Real-IP
+	// instead of the connection's peer address.
+	trustProxy bool
+	// trustedProxies restricts X-Forwarded-For, X-Real-IP and
+	// X-Forwarded-Proto handling to requests whose peer address is one of
+	// these proxies.
+	trustedProxies []netip.Prefix
+	// enablePprof serves the net/http/pprof profiles under /debug/pprof/
+	// to admins.
+	enablePprof bool
+	// metricsBuckets are the upper bounds, in seconds, of the latency
+	// histogram on /metrics, and metricsToken the bearer token scrapers
+	// must send, if set.
+	metricsBuckets []float64
+	metricsToken   []byte
+	// allowCIDRs, when non-empty, is the only set of networks the API
+	// accepts requests from.
+	allowCIDRs []netip.Prefix
+	// allowedHosts, when non-empty, lists the Host header values requests
+	// may carry; a leading "*." matches any subdomain.
+	allowedHosts []string
+	// authMode is authModeKey or authModeJWT; the JWT mode checks HS256
+	// tokens signed with jwtSecret, requiring jwtIssuer and jwtAudience if
+	// set and allowing jwtLeeway of clock skew.
+	authMode    string
+	jwtSecret   []byte
+	jwtIssuer   string
+	jwtAudience string
+	jwtLeeway   time.Duration
+	// certSubjects are the client certificate subjects accepted in
+	// authModeMTLS, where the connection's verified certificate is the
+	// only credential.
+	certSubjects []certSubject
+	// apiKeys are the keys accepted as Bearer tokens or in X-API-Key,
+	// plain or hashed (see hashedKeyPrefix). Starting with none is refused
+	// unless insecureNoAuth is set, which disables the check.
+	apiKeys        []string
+	insecureNoAuth bool
+	// apiKeyHeader, if set, is a further header, besides X-API-Key, that
+	// an API key is accepted in.
+	apiKeyHeader string
+	// basicAuth additionally accepts HTTP Basic credentials: one of
+	// basicUsers and the API key mapped to it as the password.
+	basicAuth  bool
+	basicUsers []basicUser
+	// auditLog selects where authentication events go: auditOff, auditLog
+	// (the main logger, marked audit=true) or auditFile (JSON lines to
+	// auditOut). At most auditQueue events wait to be written.
+	auditLog   string
+	auditOut   io.Writer
+	auditQueue int
+	// callLogOut, if set, receives a JSON line for every call that
+	// changes something, and with callLogReads for reads as well, with
+	// the request and response bodies. The callLogRedact fields are
+	// blanked out of the bodies. Records wait in a queue of auditQueue.
+	callLogOut    io.Writer
+	callLogReads  bool
+	callLogRedact []string
+	// authExempt lists path prefixes, matched by segment, that the API key
+	// check lets through.
+	authExempt []string
+	// maintenance turns API requests away with a 503, leaving the health
+	// checks and the spec up.
+	maintenance bool
+	// rateLimit is the steady number of requests per second allowed per
+	// API key, with bursts of up to rateBurst, unless the key sets its own;
+	// zero disables limiting.
+	rateLimit float64
+	rateBurst int
+	// authMaxFailures failed authentications from one client within
+	// authFailureWindow block it for authCooldown; zero disables this.
+	authMaxFailures   int
+	authFailureWindow time.Duration
+	authCooldown      time.Duration
+	// securityHeaders are the hardening headers added to responses.
+	securityHeaders securityHeaderSet
+	// corsOrigins lists the browser origins allowed to call the API; an
+	// empty list disables CORS handling entirely.
+	corsOrigins []string
+	corsMethods []string
+	corsHeaders []string
+	corsMaxAge  time.Duration
+	// maxBody is the largest request body accepted, in bytes; zero means
+	// no limit.
+	maxBody int64
+	// requestTimeout bounds how long a non-streaming handler may run;
+	// zero disables the limit. timeoutMode selects the implementation,
+	// timeoutModeContext or timeoutModeHandler.
+	requestTimeout time.Duration
+	timeoutMode    string
+	// The connection timeouts of the http.Server: readHeaderTimeout and
+	// maxHeaderBytes bound the request head, readTimeout the whole request
+	// with its body, writeTimeout the time from the end of the request head
+	// to the end of the response, and idleTimeout keep-alive connections
+	// between requests. requestTimeout applies within these, so it should
+	// stay below writeTimeout for its 503 to make it to the client.
+	// Streaming responses extend their write deadline as they go.
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+	// maxConcurrent caps the number of API requests handled at once;
+	// zero means unlimited. Requests over the cap wait up to
+	// concurrencyWait for a slot; zero rejects them immediately.
+	maxConcurrent   int
+	concurrencyWait time.Duration
+	// debugHTTP logs request and response bodies, up to debugBodyLimit
+	// bytes each, with the debugRedact fields blanked out.
+	debugHTTP      bool
+	debugBodyLimit int
+	debugRedact    []string
+	// accessLogSample logs one in this many successful requests; every
+	// other response is always logged. If accessLogBuffer is positive,
+	// records are queued and written by a background goroutine.
+	accessLogSample int
+	accessLogBuffer int
+	// accessLogPath, if set, is a file the access log is written to
+	// instead of the main log, rotated when it would grow past
+	// accessLogMaxSize bytes, with accessLogKeep old files kept.
+	accessLogPath    string
+	accessLogMaxSize int64
+	accessLogKeep    int
+	// slowThreshold is the duration above which a request is logged as
+	// slow; zero disables this. A request still running at slowStackFactor
+	// times the threshold gets its stacks logged; zero disables that.
+	slowThreshold   time.Duration
+	slowStackFactor float64
+	// trailingSlash is what happens to paths ending in a slash:
+	// trailingSlashRedirect or trailingSlashStrip.
+	trailingSlash string
+	// pageLimit is the page size of GET /users when the client does not
+	// ask for one; larger requests are clamped to maxPageLimit.
+	pageLimit    int
+	maxPageLimit int
+	// maxBatch is the most users POST /users creates at once.
+	maxBatch int
+	// userTTL, if set, expires users that have not been updated for that
+	// long; expireUsers removes them in the background.
+	userTTL time.Duration
+	// idempotencyTTL is how long responses to requests carrying an
+	// Idempotency-Key are kept for replay, up to idempotencyMaxKeys.
+	idempotencyTTL     time.Duration
+	idempotencyMaxKeys int
+
+	// The settings below are used by ListenAndServe and OpenStore to set
+	// up the process around the server. addr and healthAddr are the
+	// listen addresses; healthAddr is optional. Either may be a Unix
+	// socket, created with socketMode permissions. storeBackend is
+	// storeMemory or storeSQLite, the database at dbPath. keysFile adds to
+	// the keys in API_KEYS.
+	addr         string
+	healthAddr   string
+	socketMode   os.FileMode
+	storeBackend string
+	dbPath       string
+	keysFile     string
+	// tlsCert and tlsKey serve HTTPS from files; acmeDomains instead
+	// obtains certificates for those domains, kept in acmeCache, with
+	// challenges answered on acmeHTTPAddr. clientCA verifies client
+	// certificates in authModeMTLS. h2c serves HTTP/2 on a plaintext
+	// listener.
+	tlsCert      string
+	tlsKey       string
+	acmeDomains  []string
+	acmeCache    string
+	acmeEmail    string
+	acmeHTTPAddr string
+	clientCA     string
+	h2c          bool
+	// auditPath is the file the auditFile mode appends events to.
+	auditPath string
+	// callLogPath is the file the call log is appended to; empty disables
+	// it.
+	callLogPath string
+	logFormat   string
+	logLevel    string
+	// shutdownGrace is how long in-flight requests get to finish once
+	// shutdown begins, after /ready has reported 503 for drainDelay; the
+	// connections of those still running then are closed.
+	shutdownGrace time.Duration
+	drainDelay    time.Duration
+
+	// args and settings are where Load read the configuration from, and
+	// the values it found, for ListenAndServe to read it again on SIGHUP.
+	// level is the level of the logger NewLogger made, which a reload may
+	// change.
+	args     []string
+	settings map[string]string
+	level    *slog.LevelVar
+}
+
+// DefaultConfig returns the settings used when nothing is overridden.
+func DefaultConfig() Config {
+	return Config{
+		compatCreated: true,
+		escapeHTML:    true,
+		jsonCase:      jsonCaseSnake,
+		authMode:      authModeKey,
+		auditLog:      auditOff,
+		auditQueue:    1024,
+		callLogRedact: []string{"password"},
+		jwtLeeway:     30 * time.Second,
+		rateLimit:     10,
+		rateBurst:     20,
+
+		authMaxFailures:   10,
+		authFailureWindow: time.Minute,
+		authCooldown:      5 * time.Minute,
+
+		securityHeaders: defaultSecurityHeaders(),
+		metricsBuckets:  defaultMetricsBuckets,
+
+		corsMethods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete},
+		corsHeaders: []string{"Authorization", "Content-Type", apiKeyHeader, requestIDHeader, idempotencyKeyHeader, "If-Match", methodOverrideHeader, "Content-Encoding"},
+		corsMaxAge:  10 * time.Minute,
+
+		maxBody:        1 << 20,
+		requestTimeout: 10 * time.Second,
+		timeoutMode:    timeoutModeContext,
+		trailingSlash:  trailingSlashRedirect,
+		slowThreshold:  time.Second,
+
+		readHeaderTimeout: 5 * time.Second,
+		readTimeout:       15 * time.Second,
+		writeTimeout:      30 * time.Second,
+		idleTimeout:       60 * time.Second,
+		maxHeaderBytes:    64 << 10,
+
+		concurrencyWait: 100 * time.Millisecond,
+
+		debugBodyLimit: 4 << 10,
+		debugRedact:    []string{"email", "password"},
+
+		accessLogMaxSize: 100 << 20,
+		accessLogKeep:    5,
+
+		pageLimit:    50,
+		maxPageLimit: 100,
+		maxBatch:     100,
+
+		idempotencyTTL:     24 * time.Hour,
+		idempotencyMaxKeys: 10000,
+
+		addr:          ":8080",
+		socketMode:    0o660,
+		storeBackend:  storeMemory,
+		acmeCache:     "acme-cache",
+		acmeHTTPAddr:  ":80",
+		auditPath:     "audit.jsonl",
+		logFormat:     "json",
+		logLevel:      "info",
+		shutdownGrace: 30 * time.Second,
+	}
+}
+
+// Server is the users API: its handlers, middleware and the state they
+// share, served through Handler or by ListenAndServe.
+type Server struct {
+	cfg Config
+	// accessLogger receives the access log, if it does not go to logger.
+	accessLogger *slog.Logger
+	// live holds the settings that can change while serving; they are
+	// read from here rather than from cfg.
+	live   atomic.Pointer[liveConfig]
+	logger *slog.Logger
+	now    func() time.Time
+	// store is the Store given to NewServer, and users the same wrapped
+	// for metrics and, once tracing is on, spans.
+	store store.Store
+	users store.Store
+	// tracerProvider receives the request and store spans; by default it
+	// discards them.
+	tracerProvider trace.TracerProvider
+	keys           *keySet
+
+	// lookups collapses concurrent GETs for the same id into one store call.
+	lookups      lookupGroup
+	limiter      *rateLimiter
+	authFailures *authFailureLimiter
+	slots        chan struct{}
+	redactRE     *regexp.Regexp
+	idempotency  *idempotencyCache
+	auditor      *auditSink
+	calls        *callSink
+	callRedactRE *regexp.Regexp
+	metrics      *metrics
+
+	accessSeq     atomic.Uint64
+	accessLog     chan accessRecord
+	accessLogDone sync.WaitGroup
+	// accessLogMu guards against sending to accessLog once it is closed,
+	// by requests that outlive a shutdown.
+	accessLogMu     sync.RWMutex
+	accessLogClosed bool
+
+	// ready is reported by /ready; it is set once the server is able to
+	// take traffic and cleared again when shutdown begins.
+	ready    atomic.Bool
+	draining atomic.Bool
+
+	// started is when the server was created, for the uptime in /stats.
+	started time.Time
+	// requests counts the responses written by status class, 1xx at index 0
+	// to 5xx at index 4.
+	requests [5]atomic.Int64
+	// bytesServed is the total size of all response bodies written.
+	bytesServed atomic.Int64
+	// authFailureCount is the number of failed authentications.
+	authFailureCount atomic.Int64
+	// storeCounters count the calls made to users.
+	storeCounters storeCounters
+	// lastSlowStack is when stacks of a slow request were last logged, in
+	// Unix nanoseconds.
+	lastSlowStack atomic.Int64
+}
+
+// NewServer returns a Server for cfg keeping users in st, logging to
+// logger and telling the time by clock, for timestamps, rate limits and
+// expiry; nil means time.Now. cfg should have been validated.
+func NewServer(cfg Config, st store.Store, logger *slog.Logger, clock func() time.Time) *Server {
+	if clock == nil {
+		clock = time.Now
+	}
+	s := &Server{
+		cfg:            cfg,
+		logger:         logger,
+		now:            clock,
+		started:        clock(),
+		store:          st,
+		tracerProvider: noop.NewTracerProvider(),
+		keys:           newKeySet(cfg.apiKeys),
+		redactRE:       compileRedactRE(cfg.debugRedact),
+		callRedactRE:   compileRedactRE(cfg.callLogRedact),
+		limiter:        newRateLimiter(clock),
+		metrics:        newMetrics(cfg.metricsBuckets),
+
+		idempotency: newIdempotencyCache(cfg.idempotencyTTL, cfg.idempotencyMaxKeys, clock),
+	}
+	s.users = countingStore{st, &s.storeCounters}
+	s.live.Store(newLiveConfig(cfg))
+	if cfg.maxConcurrent > 0 {
+		s.slots = make(chan struct{}, cfg.maxConcurrent)
+	}
+	switch {
+	case cfg.auditLog == auditLog:
+		s.auditor = newAuditSink(logger, nil, cfg.auditQueue)
+	case cfg.auditLog == auditFile && cfg.auditOut != nil:
+		s.auditor = newAuditSink(logger, cfg.auditOut, cfg.auditQueue)
+	}
+	if cfg.callLogOut != nil {
+		s.calls = newCallLog(cfg.callLogOut, cfg.auditQueue)
+	}
+	if cfg.accessLogBuffer > 0 {
+		s.accessLog = make(chan accessRecord, cfg.accessLogBuffer)
+		s.accessLogDone.Add(1)
+		go s.accessLogWriter(&s.accessLogDone)
+	}
+	if cfg.authMaxFailures > 0 {
+		s.authFailures = newAuthFailureLimiter(cfg.authMaxFailures, cfg.authFailureWindow, cfg.authCooldown, clock)
+	}
+	return s
+}
+
+// traceWith sends the request and store spans to tp from then on. Handlers
+// made by Handler before keep to the previous provider.
+func (s *Server) traceWith(tp trace.TracerProvider) {
+	s.tracerProvider = tp
+	if tracingEnabled(tp) {
+		s.users = countingStore{newTracingStore(s.store, tp), &s.storeCounters}
+	}
+}
+
+// httpServer returns an http.Server for h with the connection limits
+// from the config.
+func (s *Server) httpServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: s.cfg.readHeaderTimeout,
+		ReadTimeout:       s.cfg.readTimeout,
+		WriteTimeout:      s.cfg.writeTimeout,
+		IdleTimeout:       s.cfg.idleTimeout,
+		MaxHeaderBytes:    s.cfg.maxHeaderBytes,
+	}
+}
+
+func userLocation(id int64) string {
+	return userPath + strconv.FormatInt(id, 10)
+}
+
+// Handler returns the handler serving the API, with the middleware cfg
+// asks for.
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	// handle registers a regular, buffered JSON route behind the request
+	// timeout. Streaming and debug routes are registered on api directly
+	// instead.
+	handle := func(pattern string, h http.Handler) {
+		api.Handle(pattern, s.negotiate()(s.timeout()(h)))
+	}
+	// scoped lets h through only for callers holding scope.
+	scoped := func(scope string, h http.Handler) http.HandlerFunc {
+		return s.requireScope(scope)(h).ServeHTTP
+	}
+	handle("/user", s.methodHandler(map[string]http.HandlerFunc{
+		http.MethodGet:    scoped(scopeRead, s.handler(s.handleGetUser)),
+		http.MethodPost:   scoped(scopeWrite, s.idempotent()(s.handler(s.handleCreateUser))),
+		http.MethodPatch:  scoped(scopeWrite, s.handler(s.handlePatchUser)),
+		http.MethodDelete: scoped(scopeWrite, s.handler(s.handleDeleteUser)),
+	}))
+	handle("GET "+userPath+"{id}", scoped(scopeRead, s.handler(s.handleGetUserByID)))
+	handle("GET /stats", scoped(scopeRead, s.handler(s.handleStats)))
+	// A whole export may well take longer than the request timeout.
+	api.Handle("GET /export", s.negotiate()(scoped(scopeRead, s.handler(s.handleExport))))
+	handle("POST /import", scoped(scopeAdmin, s.handler(s.handleImport)))
+	handle("POST /admin/keys", scoped(scopeAdmin, s.handler(s.handleCreateKey)))
+	handle("GET /admin/keys", scoped(scopeAdmin, s.handler(s.handleListKeys)))
+	handle("PATCH /admin/keys/{id}", scoped(scopeAdmin, s.handler(s.handleUpdateKey)))
+	handle("DELETE /admin/keys/{id}", scoped(scopeAdmin, s.handler(s.handleRevokeKey)))
+	// The debug routes serve their own formats, to browsers as well, so
+	// Accept is not negotiated on them.
+	api.Handle("GET /debug/vars", s.timeout()(scoped(scopeAdmin, s.handler(s.handleVars))))
+	if s.cfg.enablePprof {
+		// Mounted here explicitly, and without the request timeout since
+		// profile and trace run for ?seconds=N on purpose. What
+		// net/http/pprof registers on http.DefaultServeMux is never served.
+		api.Handle("GET /debug/pprof/", scoped(scopeAdmin, http.HandlerFunc(pprof.Index)))
+		api.Handle("GET /debug/pprof/cmdline", scoped(scopeAdmin, http.HandlerFunc(pprof.Cmdline)))
+		api.Handle("GET /debug/pprof/profile", scoped(scopeAdmin, http.HandlerFunc(pprof.Profile)))
+		api.Handle("GET /debug/pprof/symbol", scoped(scopeAdmin, http.HandlerFunc(pprof.Symbol)))
+		api.Handle("POST /debug/pprof/symbol", scoped(scopeAdmin, http.HandlerFunc(pprof.Symbol)))
+		api.Handle("GET /debug/pprof/trace", scoped(scopeAdmin, http.HandlerFunc(pprof.Trace)))
+	}
+	// Pages of users are bounded by the request timeout like any other
+	// response; the NDJSON stream of all of them is not, and must not be
+	// buffered.
+	listUsers := scoped(scopeRead, s.handler(s.handleListUsers))
+	timedListUsers := s.timeout()(listUsers)
+	api.Handle("GET /users", s.negotiate()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "ndjson" {
+			listUsers(w, r)
+			return
+		}
+		timedListUsers.ServeHTTP(w, r)
+	})))
+	handle("POST /users", scoped(scopeWrite, s.idempotent()(s.handler(s.handleCreateUsers))))
+
+	mux := http.NewServeMux()
+	mux.Handle("/openapi.json", s.negotiate()(s.methodHandler(map[string]http.HandlerFunc{
+		http.MethodGet: s.handler(s.handleOpenAPI),
+	})))
+	// Scrapers ask for the text exposition format, which the JSON
+	// negotiation would refuse.
+	mux.Handle("GET /metrics", s.handler(s.handleMetrics))
+	s.healthRoutes(mux)
+	mux.Handle("/", chain(api,
+		s.rejectWhileDraining(),
+		s.rejectInMaintenance(),
+		s.allowCIDRs(),
+		s.limitConcurrency(),
+		s.authFailureLimit(),
+		s.rateLimit(),
+		s.requireAuth(s.cfg.authExempt),
+		s.noStore(),
+		s.limitBody(),
+		s.decompressBody(),
+		s.logCalls(matchPattern(api, nil)),
+		s.recoverer(),
+	))
+	route := routePattern(mux, api)
+	return chain(mux,
+		requestID(),
+		s.clientAddress(),
+		s.stripForwarded(),
+		s.tracing(route),
+		s.requestLogger(route),
+		s.securityHeaders(),
+		s.checkHost(),
+		s.cors(),
+		s.methodOverride(),
+		s.trailingSlash(matchPattern(mux, api)),
+	)
+}
+
+func (s *Server) healthRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /healthz", s.handler(s.handleHealthz))
+	mux.Handle("GET /ready", s.handler(s.handleReady))
+}
+
+// healthHandler serves only the health endpoints, for a listener kept
+// apart from the API.
+func (s *Server) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.healthRoutes(mux)
+	return chain(mux, requestID(), s.clientAddress(), s.requestLogger(routePattern(mux, nil)))
+}
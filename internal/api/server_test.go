@@ -0,0 +1,372 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// testKey is the API key the server accepts.
+const testKey = "secret123"
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// newTestServer returns a Server for cfg keeping users in memory and
+// logging to logger, or nowhere if it is nil. Unless cfg sets keys of its
+// own or turns authentication off, testKey is the one key accepted.
+func newTestServer(t testing.TB, cfg Config, logger *slog.Logger) *Server {
+	t.Helper()
+	return newTestServerAt(t, cfg, logger, time.Now)
+}
+
+// newTestServerAt is newTestServer telling the time by clock.
+func newTestServerAt(t testing.TB, cfg Config, logger *slog.Logger, clock func() time.Time) *Server {
+	t.Helper()
+	if len(cfg.apiKeys) == 0 && !cfg.insecureNoAuth {
+		cfg.apiKeys = []string{testKey}
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return NewServer(cfg, store.NewMemory(0, clock), logger, clock)
+}
+
+// configFromFlags returns the default config with args parsed as the
+// command line would be.
+func configFromFlags(t testing.TB, args ...string) Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newRequest returns a request for target, with body if it is not empty,
+// carrying testKey.
+func newRequest(method, target, body string) *http.Request {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	r.Header.Set("X-API-Key", testKey)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+// serve sends r through h and returns the response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// fakeClock is a clock for the server's limiters that only moves when told
+// to.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// TestHandlerGolden runs a session of requests over the main routes and
+// compares each response, its headers sorted, with its golden file in
+// testdata/golden. The requests build on each other and run in order.
+func TestHandlerGolden(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.apiKeys = []string{testKey + ",read write admin", "reader,read"}
+	cfg.rateLimit = 0
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServerAt(t, cfg, nil, newFakeClock().now).Handler()
+
+	for i, tt := range []struct {
+		name, method, target, body string
+		// header is set on the request, replacing testKey for X-API-Key.
+		header map[string]string
+	}{
+		{name: "healthz", method: "GET", target: "/healthz"},
+		{name: "ready", method: "GET", target: "/ready"},
+		{name: "create", method: "POST", target: "/user", body: `{"name":"Ann","email":"ann@example.com"}`},
+		{name: "create form", method: "POST", target: "/user", body: "name=Bob",
+			header: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}},
+		{name: "create empty", method: "POST", target: "/user", body: " "},
+		{name: "create malformed", method: "POST", target: "/user", body: `{"name":`},
+		{name: "create bad email", method: "POST", target: "/user", body: `{"name":"Eve","email":"eve"}`},
+		{name: "create batch", method: "POST", target: "/users", body: `[{"name":"Cy"},{"name":""}]`},
+		{name: "get", method: "GET", target: "/user?id=1"},
+		{name: "get by id", method: "GET", target: "/user/2"},
+		{name: "get missing", method: "GET", target: "/user/99"},
+		{name: "get invalid id", method: "GET", target: "/user/x"},
+		{name: "get duplicate id", method: "GET", target: "/user?id=1&id=2"},
+		{name: "list", method: "GET", target: "/users"},
+		{name: "list page", method: "GET", target: "/users?limit=1&offset=1"},
+		{name: "patch", method: "PATCH", target: "/user?id=1", body: `{"name":"Anne"}`,
+			header: map[string]string{"If-Match": `"1"`}},
+		{name: "patch stale", method: "PATCH", target: "/user?id=1", body: `{"name":"Annie"}`,
+			header: map[string]string{"If-Match": `"1"`}},
+		{name: "delete", method: "DELETE", target: "/user?id=2"},
+		{name: "delete again", method: "DELETE", target: "/user?id=2"},
+		{name: "method not allowed", method: "PUT", target: "/user?id=1"},
+		{name: "export", method: "GET", target: "/export"},
+		{name: "import", method: "POST", target: "/import", body: `[{"user_id":7,"name":"Gus"}]`},
+		{name: "import as reader", method: "POST", target: "/import", body: `[]`,
+			header: map[string]string{apiKeyHeader: "reader"}},
+		{name: "unauthorized", method: "GET", target: "/users", header: map[string]string{apiKeyHeader: ""}},
+		{name: "wrong key", method: "GET", target: "/users", header: map[string]string{apiKeyHeader: "nope"}},
+		{name: "not acceptable", method: "GET", target: "/users", header: map[string]string{"Accept": "text/html"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(tt.method, tt.target, tt.body)
+			// A request id of its own keeps the one echoed back the same.
+			r.Header.Set(requestIDHeader, fmt.Sprintf("golden-%02d", i))
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			rec := serve(h, r)
+			var got strings.Builder
+			fmt.Fprintf(&got, "%d\n", rec.Code)
+			for _, name := range slices.Sorted(maps.Keys(rec.Header())) {
+				for _, v := range rec.Header()[name] {
+					fmt.Fprintf(&got, "%s: %s\n", name, v)
+				}
+			}
+			fmt.Fprintf(&got, "\n%s", rec.Body)
+			file := filepath.Join("testdata", "golden", fmt.Sprintf("%02d-%s.txt", i, strings.ReplaceAll(tt.name, " ", "-")))
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(file, []byte(got.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("%v; run go test -update to create it", err)
+			}
+			if got.String() != string(want) {
+				t.Errorf("%s %s: got\n%s\nwant\n%s", tt.method, tt.target, got.String(), want)
+			}
+		})
+	}
+}
+
+// blockingStore is a Store whose List calls wait until release is closed,
+// telling entered about each call first.
+type blockingStore struct {
+	store.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{
+		Store:   store.NewMemory(0, time.Now),
+		entered: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingStore) List(ctx context.Context) ([]store.User, error) {
+	b.entered <- struct{}{}
+	select {
+	case <-b.release:
+		return b.Store.List(ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// useStore makes s keep its users in st.
+func useStore(s *Server, st store.Store) {
+	s.store = st
+	s.users = countingStore{st, &s.storeCounters}
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	const request = "GET /healthz HTTP/1.1\r\nHost: api\r\n\r\n"
+	for _, tt := range []struct {
+		name string
+		set  func(*Config)
+		// send is written to a fresh connection, which is then expected to
+		// get a response of wantStatus, if any, and to be closed or not.
+		send       string
+		wantStatus int
+		wantClosed bool
+	}{
+		{name: "prompt request", send: request, wantStatus: http.StatusOK},
+		{name: "slow header", set: func(c *Config) { c.readHeaderTimeout = 100 * time.Millisecond },
+			send: "GET /healthz HTTP/1.1\r\nHost: api\r\n", wantClosed: true},
+		{name: "idle keep-alive", set: func(c *Config) { c.idleTimeout = 100 * time.Millisecond },
+			send: request, wantStatus: http.StatusOK, wantClosed: true},
+		{name: "header too large", set: func(c *Config) { c.maxHeaderBytes = 1024 },
+			send:       "GET /healthz HTTP/1.1\r\nHost: api\r\nX-Big: " + strings.Repeat("x", 16<<10) + "\r\n\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge, wantClosed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			if tt.set != nil {
+				tt.set(&cfg)
+			}
+			s := newTestServer(t, cfg, nil)
+			ts := httptest.NewUnstartedServer(nil)
+			ts.Config = s.httpServer("", s.Handler())
+			ts.Start()
+			t.Cleanup(ts.Close)
+
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, tt.send); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(conn)
+			if tt.wantStatus != 0 {
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+			}
+
+			wait := 2 * time.Second
+			if !tt.wantClosed {
+				wait = 300 * time.Millisecond
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(wait))
+			_, err = br.ReadByte()
+			var ne net.Error
+			switch timedOut := errors.As(err, &ne) && ne.Timeout(); {
+			case tt.wantClosed && !errors.Is(err, io.EOF):
+				t.Errorf("read = %v, want the server to close the connection", err)
+			case !tt.wantClosed && !timedOut:
+				t.Errorf("read = %v, want the connection kept open", err)
+			}
+		})
+	}
+}
+
+func TestConnectionTimeoutDefaults(t *testing.T) {
+	s := newTestServer(t, DefaultConfig(), nil)
+	srv := s.httpServer(":8080", http.NotFoundHandler())
+	got := []time.Duration{srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout}
+	want := []time.Duration{5 * time.Second, 15 * time.Second, 30 * time.Second, time.Minute}
+	if !slices.Equal(got, want) || srv.MaxHeaderBytes != 64<<10 {
+		t.Errorf("timeouts %v, max header bytes %d; want %v and %d", got, srv.MaxHeaderBytes, want, 64<<10)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	clock := newFakeClock()
+	for _, tt := range []struct {
+		name  string
+		clock func() time.Time
+		// fixed is whether the clock stands still at clock.now().
+		fixed bool
+	}{
+		{"injected clock", clock.now, true},
+		{"nil clock", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Users already in the store are served.
+			st := store.NewMemory(0, clock.now)
+			if _, err := st.Create(t.Context(), "Ann", "ann@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			var logs syncBuffer
+			cfg := DefaultConfig()
+			cfg.apiKeys = []string{testKey}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(NewServer(cfg, st, slog.New(slog.NewJSONHandler(&logs, nil)), tt.clock).Handler())
+			defer srv.Close()
+			do := func(method, path, body string) *http.Response {
+				t.Helper()
+				r := newRequest(method, srv.URL+path, body)
+				r.RequestURI = ""
+				resp, err := srv.Client().Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { resp.Body.Close() })
+				return resp
+			}
+
+			var got UserResponse
+			if err := json.NewDecoder(do(http.MethodGet, "/user/1", "").Body).Decode(&got); err != nil || got.Name != "Ann" {
+				t.Fatalf("GET /user/1 = %+v, %v; want the user already stored", got, err)
+			}
+			resp := do(http.MethodPost, "/user", `{"name":"Bo"}`)
+			var created UserResponse
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || resp.StatusCode != http.StatusCreated {
+				t.Fatalf("POST /user: %d, %v", resp.StatusCode, err)
+			}
+			// The store keeps what the server writes.
+			if u, err := st.Get(t.Context(), created.UserID); err != nil || u.Name != "Bo" {
+				t.Errorf("store holds %+v, %v; want the created user", u, err)
+			}
+			// The server tells the time by its clock, or the real one.
+			var stats StatsResponse
+			if err := json.NewDecoder(do(http.MethodGet, "/stats", "").Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fixed != (stats.UptimeSeconds == 0) {
+				t.Errorf("uptime %v, want it zero only with a clock that stands still", stats.UptimeSeconds)
+			}
+			if recs := logRecords(t, logs.String(), "request"); len(recs) != 3 {
+				t.Errorf("logged %d requests to the logger given, want 3:\n%s", len(recs), logs.String())
+			}
+		})
+	}
+}
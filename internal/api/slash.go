@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	trailingSlashRedirect = "redirect"
+	trailingSlashStrip    = "strip"
+)
+
+// trailingSlash applies cfg.trailingSlash to paths ending in a slash that
+// match no route, as told by match: trailingSlashRedirect answers with a
+// 308 to the path without it, which keeps the method and body, and
+// trailingSlashStrip serves the request as if it had been sent without.
+func (s *Server) trailingSlash(match func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trimmed, ok := trimSlash(r.URL.Path)
+			// A path starting with // would redirect to another host; it
+			// is left to the mux, which cleans it up.
+			if !ok || strings.HasPrefix(trimmed, "//") || match(r) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if s.cfg.trailingSlash == trailingSlashRedirect {
+				loc, _ := trimSlash(r.URL.EscapedPath())
+				if r.URL.RawQuery != "" {
+					loc += "?" + r.URL.RawQuery
+				}
+				w.Header().Set("Location", loc)
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			next.ServeHTTP(w, withPath(r, trimmed))
+		})
+	}
+}
+
+// trimSlash removes the trailing slashes of path, reporting whether there
+// were any. The root path is left alone.
+func trimSlash(path string) (string, bool) {
+	trimmed := strings.TrimRight(path, "/")
+	if trimmed == path || path == "/" {
+		return path, false
+	}
+	if trimmed == "" {
+		trimmed = "/"
+	}
+	return trimmed, true
+}
+
+// withPath returns a shallow copy of r for path instead.
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r2.URL = &u
+	return r2
+}
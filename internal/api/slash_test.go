@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrimSlash(t *testing.T) {
+	for _, tt := range []struct {
+		path, want string
+		wantOK     bool
+	}{
+		{"/users", "/users", false},
+		{"/users/", "/users", true},
+		{"/users//", "/users", true},
+		{"/", "/", false},
+		{"//", "/", true},
+	} {
+		if got, ok := trimSlash(tt.path); got != tt.want || ok != tt.wantOK {
+			t.Errorf("trimSlash(%q) = %q, %v; want %q, %v", tt.path, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	for _, tt := range []struct {
+		policy, method, target string
+		wantStatus             int
+		wantLocation           string
+	}{
+		{trailingSlashRedirect, http.MethodGet, "/users/", http.StatusPermanentRedirect, "/users"},
+		{trailingSlashRedirect, http.MethodGet, "/users/?limit=1", http.StatusPermanentRedirect, "/users?limit=1"},
+		{trailingSlashRedirect, http.MethodGet, "/user/1//", http.StatusPermanentRedirect, "/user/1"},
+		{trailingSlashRedirect, http.MethodGet, "/user/a%2Fb/", http.StatusPermanentRedirect, "/user/a%2Fb"},
+		// A 308 keeps the method and body.
+		{trailingSlashRedirect, http.MethodPost, "/user/", http.StatusPermanentRedirect, "/user"},
+		{trailingSlashRedirect, http.MethodGet, "/users", http.StatusOK, ""},
+		{trailingSlashRedirect, http.MethodGet, "/healthz/", http.StatusPermanentRedirect, "/healthz"},
+		{trailingSlashStrip, http.MethodGet, "/users/", http.StatusOK, ""},
+		{trailingSlashStrip, http.MethodGet, "/user/1/", http.StatusOK, ""},
+		{trailingSlashStrip, http.MethodPost, "/user/", http.StatusCreated, "/user/2"},
+		{trailingSlashStrip, http.MethodGet, "/nope/", http.StatusNotFound, ""},
+	} {
+		t.Run(tt.policy+" "+tt.method+" "+tt.target, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.trailingSlash = tt.policy
+			h := newTestServer(t, cfg, nil).Handler()
+			serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+			rec := serve(h, newRequest(tt.method, tt.target, `{"name":"Bo"}`))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestTrailingSlashOtherHost(t *testing.T) {
+	// Redirecting //evil.example/ to //evil.example would send the client
+	// to another host.
+	for _, policy := range []string{trailingSlashRedirect, trailingSlashStrip} {
+		cfg := DefaultConfig()
+		cfg.trailingSlash = policy
+		rec := serve(newTestServer(t, cfg, nil).Handler(), newRequest(http.MethodGet, "//evil.example/", ""))
+		if loc := rec.Header().Get("Location"); strings.HasPrefix(loc, "//") {
+			t.Errorf("%s: redirected to %q", policy, loc)
+		}
+	}
+}
+
+func TestTrailingSlashMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.trailingSlash = trailingSlashStrip
+	h := newTestServer(t, cfg, nil).Handler()
+	serve(h, newRequest(http.MethodGet, "/users/", ""))
+	want := `http_requests_total{method="GET",route="GET /users",client="key:` + keyFingerprint(testKey) + `",code="200"}`
+	if got := scrape(t, h, "")[want]; got != "1" {
+		t.Errorf("%s = %q, want the stripped request counted under its route", want, got)
+	}
+}
+
+func TestTrailingSlashConfig(t *testing.T) {
+	for _, tt := range []struct {
+		arg     string
+		wantErr bool
+	}{
+		{"-trailing-slash=redirect", false},
+		{"-trailing-slash=strip", false},
+		{"-trailing-slash=ignore", true},
+	} {
+		cfg := configFromFlags(t, tt.arg)
+		cfg.apiKeys = []string{testKey}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.arg, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// slowStackEvery is the least time between two stack dumps of slow
+// requests, so that a general slowdown does not flood the log.
+const slowStackEvery = time.Minute
+
+// storeTimings collects how long each store call of a request took, for
+// the slow request log. requestLogger places one in the context and
+// countingStore adds to it.
+type storeTimings struct {
+	mu  sync.Mutex
+	ops []storeTiming
+}
+
+type storeTiming struct {
+	op string
+	d  time.Duration
+}
+
+func withStoreTimings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storeTimingsKey, &storeTimings{})
+}
+
+// recordStoreTiming notes a store call taking d in the request's
+// storeTimings, if it has any.
+func recordStoreTiming(ctx context.Context, op string, d time.Duration) {
+	if st, ok := ctx.Value(storeTimingsKey).(*storeTimings); ok {
+		st.mu.Lock()
+		st.ops = append(st.ops, storeTiming{op, d})
+		st.mu.Unlock()
+	}
+}
+
+// storeTimingsAttr summarises the store calls recorded in ctx.
+func storeTimingsAttr(ctx context.Context) (slog.Attr, bool) {
+	st, ok := ctx.Value(storeTimingsKey).(*storeTimings)
+	if !ok {
+		return slog.Attr{}, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.ops) == 0 {
+		return slog.Attr{}, false
+	}
+	var total time.Duration
+	ops := make([]string, len(st.ops))
+	for i, t := range st.ops {
+		total += t.d
+		ops[i] = fmt.Sprintf("%s %.3fms", t.op, float64(t.d.Microseconds())/1000)
+	}
+	return slog.Group("store",
+		slog.Int("calls", len(st.ops)),
+		slog.Float64("duration_ms", float64(total.Microseconds())/1000),
+		slog.Any("ops", ops),
+	), true
+}
+
+// logSlowRequest reports a request that took longer than
+// cfg.slowThreshold, and counts it for its route.
+func (s *Server) logSlowRequest(r *http.Request, route string, status int, elapsed time.Duration) {
+	s.metrics.observeSlow(route)
+	attrs := []any{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", status,
+		"duration_ms", float64(elapsed.Microseconds()) / 1000,
+		"threshold_ms", s.cfg.slowThreshold.Milliseconds(),
+	}
+	if a, ok := storeTimingsAttr(r.Context()); ok {
+		attrs = append(attrs, a)
+	}
+	s.log(r.Context()).Warn("slow request", attrs...)
+}
+
+// watchSlowRequest arranges for the stacks of the calling goroutine and
+// those it started to be logged once the request has taken
+// cfg.slowStackFactor times cfg.slowThreshold, at most once every
+// slowStackEvery across requests. The returned func stops the watch.
+func (s *Server) watchSlowRequest(r *http.Request) (stop func() bool) {
+	after := time.Duration(float64(s.cfg.slowThreshold) * s.cfg.slowStackFactor)
+	if s.cfg.slowThreshold <= 0 || after <= 0 {
+		return func() bool { return false }
+	}
+	gid := goroutineID()
+	start := time.Now()
+	t := time.AfterFunc(after, func() {
+		now := time.Now().UnixNano()
+		last := s.lastSlowStack.Load()
+		if now-last < int64(slowStackEvery) || !s.lastSlowStack.CompareAndSwap(last, now) {
+			return
+		}
+		s.log(r.Context()).Warn("slow request still running",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"stacks", string(goroutineStacks(gid)))
+	})
+	return t.Stop
+}
+
+// goroutineID returns the id of the calling goroutine, from the header of
+// its stack trace.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// goroutineStacks returns the stack traces of goroutine gid and of the
+// goroutines it created, such as the one the request timeout runs the
+// handler on.
+func goroutineStacks(gid uint64) []byte {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	self := fmt.Appendf(nil, "goroutine %d ", gid)
+	child := fmt.Appendf(nil, " in goroutine %d", gid)
+	createdBy := func(g []byte) bool {
+		for line := range bytes.Lines(g) {
+			if bytes.HasPrefix(line, []byte("created by ")) && bytes.HasSuffix(bytes.TrimRight(line, "\n"), child) {
+				return true
+			}
+		}
+		return false
+	}
+	var out []byte
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(g, self) || createdBy(g) {
+			out = append(out, g...)
+			out = append(out, "\n\n"...)
+		}
+	}
+	return bytes.TrimSpace(out)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// sleepyStore is a Store whose Get calls take at least delay.
+type sleepyStore struct {
+	store.Store
+	delay time.Duration
+}
+
+func (s sleepyStore) Get(ctx context.Context, id int64) (store.User, error) {
+	time.Sleep(s.delay)
+	return s.Store.Get(ctx, id)
+}
+
+// newSlowServer returns the handler of a server with cfg whose GET
+// /user/{id} takes delay, and the buffer it logs to as JSON.
+func newSlowServer(t *testing.T, cfg Config, delay time.Duration) (http.Handler, *syncBuffer) {
+	t.Helper()
+	var logs syncBuffer
+	s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+	useStore(s, sleepyStore{store.NewMemory(0, time.Now), delay})
+	h := s.Handler()
+	serve(h, newRequest(http.MethodPost, "/user", `{"name":"Ann"}`))
+	return h, &logs
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		threshold time.Duration
+		sample    int
+		target    string
+		wantSlow  bool
+	}{
+		{name: "slow", threshold: 10 * time.Millisecond, target: "/user/1", wantSlow: true},
+		{name: "slow and not sampled", threshold: 10 * time.Millisecond, sample: 1000, target: "/user/1", wantSlow: true},
+		{name: "slow error", threshold: 10 * time.Millisecond, target: "/user/9", wantSlow: true},
+		{name: "fast", threshold: 10 * time.Millisecond, target: "/users"},
+		{name: "under the threshold", threshold: time.Second, target: "/user/1"},
+		{name: "disabled", threshold: 0, target: "/user/1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.slowThreshold = tt.threshold
+			cfg.accessLogSample = tt.sample
+			h, logs := newSlowServer(t, cfg, 30*time.Millisecond)
+			rec := serve(h, newRequest(http.MethodGet, tt.target, ""))
+			recs := logRecords(t, logs.String(), "slow request")
+			if !tt.wantSlow {
+				if len(recs) != 0 {
+					t.Errorf("logged as slow: %v", recs)
+				}
+				return
+			}
+			if len(recs) != 1 {
+				t.Fatalf("logged %d slow requests, want 1:\n%s", len(recs), logs)
+			}
+			rec0 := recs[0]
+			if rec0["level"] != "WARN" || rec0["method"] != "GET" || rec0["path"] != tt.target ||
+				rec0["status"] != float64(rec.Code) || rec0["threshold_ms"] != float64(tt.threshold.Milliseconds()) {
+				t.Errorf("slow request logged as %v", rec0)
+			}
+			if d, _ := rec0["duration_ms"].(float64); d < 30 {
+				t.Errorf("duration_ms = %v, want at least 30", rec0["duration_ms"])
+			}
+			if rec0["request_id"] == nil {
+				t.Errorf("no request id in %v", rec0)
+			}
+		})
+	}
+}
+
+func TestSlowRequestDetail(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.slowThreshold = 10 * time.Millisecond
+	h, logs := newSlowServer(t, cfg, 30*time.Millisecond)
+	for _, target := range []string{"/user/1", "/user/1", "/user/9", "/users"} {
+		serve(h, newRequest(http.MethodGet, target, ""))
+	}
+
+	recs := logRecords(t, logs.String(), "slow request")
+	if len(recs) != 3 {
+		t.Fatalf("logged %d slow requests, want 3:\n%s", len(recs), logs)
+	}
+	for _, rec := range recs {
+		st, _ := rec["store"].(map[string]any)
+		ops, _ := st["ops"].([]any)
+		if rec["route"] != "GET /user/{id}" || st["calls"] != float64(1) || len(ops) != 1 || !strings.HasPrefix(ops[0].(string), "Get ") {
+			t.Errorf("slow request logged as %v, want its route and one store Get", rec)
+		}
+		if d, _ := st["duration_ms"].(float64); d < 30 {
+			t.Errorf("store duration_ms = %v, want at least 30", st["duration_ms"])
+		}
+	}
+	if statuses := []any{recs[0]["status"], recs[2]["status"]}; statuses[0] != float64(200) || statuses[1] != float64(404) {
+		t.Errorf("statuses %v, want 200 and 404", statuses)
+	}
+
+	// They are counted by route on /metrics and /stats alike.
+	if got := scrape(t, h, "")[`http_slow_requests_total{route="GET /user/{id}"}`]; got != "3" {
+		t.Errorf("http_slow_requests_total = %q, want 3", got)
+	}
+	var st StatsResponse
+	if err := json.Unmarshal(serve(h, newRequest(http.MethodGet, "/stats", "")).Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(st.SlowRequests, map[string]int64{"GET /user/{id}": 3}) {
+		t.Errorf("slow_requests = %v", st.SlowRequests)
+	}
+}
+
+func TestSlowRequestStacks(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		factor     float64
+		wantStacks int
+	}{
+		{"dumped once a minute", 2, 1},
+		{"disabled", 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.slowThreshold = 10 * time.Millisecond
+			cfg.slowStackFactor = tt.factor
+			// At 20ms the stacks are taken while the handler waits on the store.
+			h, logs := newSlowServer(t, cfg, 100*time.Millisecond)
+			for range 2 {
+				serve(h, newRequest(http.MethodGet, "/user/1", ""))
+			}
+			recs := logRecords(t, logs.String(), "slow request still running")
+			if len(recs) != tt.wantStacks {
+				t.Fatalf("dumped stacks %d times, want %d:\n%s", len(recs), tt.wantStacks, logs)
+			}
+			if tt.wantStacks == 0 {
+				return
+			}
+			stacks, _ := recs[0]["stacks"].(string)
+			if recs[0]["path"] != "/user/1" || !strings.Contains(stacks, "handleGetUserByID") {
+				t.Errorf("dump %v, want the stack of the request's handler", recs[0])
+			}
+		})
+	}
+}
+
+func TestSlowThresholdConfig(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		want    time.Duration
+		wantErr bool
+	}{
+		{nil, time.Second, false},
+		{[]string{"-slow-threshold=250ms"}, 250 * time.Millisecond, false},
+		{[]string{"-slow-threshold=0"}, 0, false},
+		{[]string{"-slow-threshold=-1s"}, 0, true},
+		{[]string{"-slow-stack-factor=-1"}, 0, true},
+	} {
+		cfg := configFromFlags(t, tt.args...)
+		cfg.apiKeys = []string{testKey}
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+		if err == nil && cfg.slowThreshold != tt.want {
+			t.Errorf("%q: slowThreshold = %v, want %v", tt.args, cfg.slowThreshold, tt.want)
+		}
+	}
+}
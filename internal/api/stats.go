@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type StatsResponse struct {
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	// Requests is the number of responses written since start, and
+	// Responses the same split by status class ("2xx" and so on).
+	Requests    int64            `json:"requests"`
+	Responses   map[string]int64 `json:"responses"`
+	Users       int              `json:"users"`
+	BytesServed int64            `json:"bytes_served"`
+	InFlight    int64            `json:"in_flight"`
+	// AuditDropped counts audit events lost to a full queue.
+	AuditDropped int64 `json:"audit_dropped"`
+	// CallLogDropped counts call log records lost the same way.
+	CallLogDropped int64 `json:"call_log_dropped"`
+	AuthFailures   int64 `json:"auth_failures"`
+	// StoreOperations counts calls to the store, and StoreErrors those of
+	// them that failed.
+	StoreOperations int64 `json:"store_operations"`
+	StoreErrors     int64 `json:"store_errors"`
+	// SlowRequests counts the requests over the slow threshold by route
+	// pattern.
+	SlowRequests map[string]int64 `json:"slow_requests"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) error {
+	users, err := s.users.Count(r.Context())
+	if err != nil {
+		return err
+	}
+	resp := StatsResponse{
+		UptimeSeconds: s.now().Sub(s.started).Seconds(),
+		Responses:     make(map[string]int64, len(s.requests)),
+		Users:         users,
+		BytesServed:   s.bytesServed.Load(),
+		InFlight:      s.metrics.inFlight.Load(),
+
+		AuthFailures:    s.authFailureCount.Load(),
+		StoreOperations: s.storeCounters.ops.Load(),
+		StoreErrors:     s.storeCounters.errors.Load(),
+		SlowRequests:    s.metrics.slowCounts(),
+	}
+	for i := range s.requests {
+		n := s.requests[i].Load()
+		resp.Requests += n
+		resp.Responses[strconv.Itoa(i+1)+"xx"] = n
+	}
+	if s.auditor != nil {
+		resp.AuditDropped = s.auditor.dropped.Load()
+	}
+	if s.calls != nil {
+		resp.CallLogDropped = s.calls.dropped.Load()
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+	return nil
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	type request struct {
+		method, target, body string
+	}
+	var (
+		list     = request{http.MethodGet, "/users", ""}
+		create   = request{http.MethodPost, "/user", `{"name":"Ann"}`}
+		notFound = request{http.MethodGet, "/user/99", ""}
+		invalid  = request{http.MethodPost, "/user", `{`}
+		health   = request{http.MethodGet, "/healthz", ""}
+	)
+	for _, tt := range []struct {
+		name          string
+		traffic       []request
+		uptime        time.Duration
+		wantResponses map[string]int64
+		wantUsers     int
+	}{
+		{name: "no traffic",
+			wantResponses: map[string]int64{"1xx": 0, "2xx": 0, "3xx": 0, "4xx": 0, "5xx": 0}},
+		{name: "mixed", traffic: []request{create, create, list, notFound, invalid, health}, uptime: 90 * time.Second,
+			wantResponses: map[string]int64{"1xx": 0, "2xx": 4, "3xx": 0, "4xx": 2, "5xx": 0}, wantUsers: 2},
+		{name: "only failures", traffic: []request{notFound, notFound, notFound}, uptime: time.Hour,
+			wantResponses: map[string]int64{"1xx": 0, "2xx": 0, "3xx": 0, "4xx": 3, "5xx": 0}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.rateLimit = 0
+			// In-flight requests are only tracked while slots are handed out.
+			cfg.maxConcurrent = 10
+			s := newTestServer(t, cfg, nil)
+			h := s.Handler()
+			for _, req := range tt.traffic {
+				serve(h, newRequest(req.method, req.target, req.body))
+			}
+			s.started = s.started.Add(-tt.uptime)
+
+			rec := serve(h, newRequest(http.MethodGet, "/stats", ""))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var stats StatsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+				t.Fatal(err)
+			}
+			// The stats request itself is counted once it has finished.
+			if stats.Requests != int64(len(tt.traffic)) {
+				t.Errorf("requests = %d, want %d", stats.Requests, len(tt.traffic))
+			}
+			if !maps.Equal(stats.Responses, tt.wantResponses) {
+				t.Errorf("responses = %v, want %v", stats.Responses, tt.wantResponses)
+			}
+			if stats.Users != tt.wantUsers {
+				t.Errorf("users = %d, want %d", stats.Users, tt.wantUsers)
+			}
+			if want := tt.uptime.Seconds(); stats.UptimeSeconds < want || stats.UptimeSeconds > want+60 {
+				t.Errorf("uptime = %vs, want about %vs", stats.UptimeSeconds, want)
+			}
+			if stats.InFlight != 1 {
+				t.Errorf("in flight = %d, want only the stats request", stats.InFlight)
+			}
+		})
+	}
+}
+
+func TestStatsRequiresAuth(t *testing.T) {
+	h := newTestServer(t, DefaultConfig(), nil).Handler()
+	for _, tt := range []struct {
+		key        string
+		wantStatus int
+	}{
+		{testKey, http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+	} {
+		r := newRequest(http.MethodGet, "/stats", "")
+		r.Header.Set(apiKeyHeader, tt.key)
+		if rec := serve(h, r); rec.Code != tt.wantStatus {
+			t.Errorf("key %q: status = %d, want %d", tt.key, rec.Code, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	timeoutModeContext = "context"
+	timeoutModeHandler = "handler"
+)
+
+const timeoutMessage = "request timed out"
+
+// timeout runs the handler with a context that expires after the configured
+// request timeout. A handler that overruns gets its response replaced by a
+// JSON 503. The handler's output is buffered until it returns, so timeout
+// must not be used on streaming routes. With cfg.timeoutMode set to
+// timeoutModeHandler the standard http.TimeoutHandler does the work instead.
+func (s *Server) timeout() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s.cfg.requestTimeout <= 0 {
+			return next
+		}
+		if s.cfg.timeoutMode == timeoutModeHandler {
+			return s.timeoutHandler(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), s.cfg.requestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{header: make(http.Header), status: http.StatusOK}
+			done := make(chan struct{})
+			panicked := make(chan *handlerPanic, 1)
+			go func() {
+				defer func() {
+					if v := recover(); v != nil {
+						panicked <- &handlerPanic{value: v, stack: debug.Stack()}
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case v := <-panicked:
+				panic(v)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				dst := w.Header()
+				for k, vv := range tw.header {
+					dst[k] = vv
+				}
+				w.WriteHeader(tw.status)
+				_, _ = w.Write(tw.buf.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					s.errorJSON(w, r, http.StatusServiceUnavailable, timeoutMessage)
+				}
+			}
+		})
+	}
+}
+
+// handlerPanic carries a panic out of the goroutine timeout runs the
+// handler in, with the stack it was raised on, for recoverer to report
+// instead of the stack it is raised again on.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+// timeoutHandler wraps next in http.TimeoutHandler with the same JSON body
+// errorJSON would send. TimeoutHandler does not set a Content-Type for its
+// message, so jsonTimeoutWriter supplies it.
+func (s *Server) timeoutHandler(next http.Handler) http.Handler {
+	msg, err := json.Marshal(s.body(nil, timeoutMessage))
+	if err != nil {
+		panic(err)
+	}
+	th := http.TimeoutHandler(next, s.cfg.requestTimeout, string(msg))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		th.ServeHTTP(&jsonTimeoutWriter{ResponseWriter: w}, r)
+	})
+}
+
+// jsonTimeoutWriter labels a 503 without a Content-Type, which can only be
+// http.TimeoutHandler's message, as JSON.
+type jsonTimeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (w *jsonTimeoutWriter) WriteHeader(code int) {
+	h := w.Header()
+	if code == http.StatusServiceUnavailable && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", jsonContentType)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *jsonTimeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// timeoutWriter buffers a response until the handler returns. Once the
+// request has timed out it refuses further writes, which guarantees that
+// the client only ever sees one of the two responses.
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.status = code
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	return tw.buf.Write(b)
+}
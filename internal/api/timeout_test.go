@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// slowHandler writes a 200 after d, or gives up when the request is
+// canceled if it heeds the context.
+func slowHandler(d time.Duration, heedContext bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "ran")
+		var gone <-chan struct{}
+		if heedContext {
+			gone = r.Context().Done()
+		}
+		select {
+		case <-time.After(d):
+		case <-gone:
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("done"))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		mode        string
+		timeout     time.Duration
+		h           http.HandlerFunc
+		wantStatus  int
+		wantBody    string
+		wantHandler string
+	}{
+		{"fast", timeoutModeContext, 20 * time.Millisecond, slowHandler(0, true), http.StatusOK, "done", "ran"},
+		{"slow", timeoutModeContext, 20 * time.Millisecond, slowHandler(time.Second, true), http.StatusServiceUnavailable, `{"error":"request timed out"}` + "\n", ""},
+		{"slow and deaf", timeoutModeContext, 20 * time.Millisecond, slowHandler(200*time.Millisecond, false), http.StatusServiceUnavailable, `{"error":"request timed out"}` + "\n", ""},
+		{"disabled", timeoutModeContext, 0, slowHandler(50*time.Millisecond, true), http.StatusOK, "done", "ran"},
+		{"fast, TimeoutHandler", timeoutModeHandler, 20 * time.Millisecond, slowHandler(0, true), http.StatusOK, "done", "ran"},
+		{"slow, TimeoutHandler", timeoutModeHandler, 20 * time.Millisecond, slowHandler(time.Second, true), http.StatusServiceUnavailable, `{"error":"request timed out"}`, ""},
+		{"slow and deaf, TimeoutHandler", timeoutModeHandler, 20 * time.Millisecond, slowHandler(200*time.Millisecond, false), http.StatusServiceUnavailable, `{"error":"request timed out"}`, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.requestTimeout = tt.timeout
+			cfg.timeoutMode = tt.mode
+			s := newTestServer(t, cfg, nil)
+			rec := httptest.NewRecorder()
+			s.timeout()(tt.h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+			if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Content-Type") != jsonContentType {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+			// Headers the handler set are only sent with its own response.
+			if got := rec.Header().Get("X-Handler"); got != tt.wantHandler {
+				t.Errorf("X-Handler = %q, want %q", got, tt.wantHandler)
+			}
+		})
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	s := newTestServer(t, DefaultConfig(), nil)
+	defer func() {
+		hp, ok := recover().(*handlerPanic)
+		if !ok || hp.value != "kaboom" {
+			t.Fatalf("recovered %v, want the handler's panic", hp)
+		}
+		// The stack is the handler's, not the one timeout panics again on.
+		if !strings.Contains(string(hp.stack), "TestTimeoutPanic.func2") {
+			t.Errorf("stack does not show the handler:\n%s", hp.stack)
+		}
+	}()
+	s.timeout()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("kaboom")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// blockingGets is a blockingStore whose Get calls wait as List calls do.
+type blockingGets struct {
+	*blockingStore
+}
+
+func (b blockingGets) Get(ctx context.Context, id int64) (store.User, error) {
+	b.entered <- struct{}{}
+	select {
+	case <-b.release:
+		return b.Store.Get(ctx, id)
+	case <-ctx.Done():
+		return store.User{}, ctx.Err()
+	}
+}
+
+// TestTimeoutRoutes stalls the store past the request timeout to check
+// which routes are bounded by it.
+func TestTimeoutRoutes(t *testing.T) {
+	for _, tt := range []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/user?id=1", http.StatusServiceUnavailable},
+		{"/users", http.StatusServiceUnavailable},
+		{"/users?format=ndjson", http.StatusOK},
+		{"/export", http.StatusOK},
+	} {
+		t.Run(tt.target, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.requestTimeout = 20 * time.Millisecond
+			st := newBlockingStore()
+			s := newTestServer(t, cfg, nil)
+			useStore(s, blockingGets{st})
+			go func() {
+				<-st.entered
+				// Well past the timeout.
+				time.Sleep(100 * time.Millisecond)
+				close(st.release)
+			}()
+			if rec := serve(s.Handler(), newRequest(http.MethodGet, tt.target, "")); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+// TestTimeoutHandlerEnvelope checks that the message http.TimeoutHandler
+// writes has the shape of every other error.
+func TestTimeoutHandlerEnvelope(t *testing.T) {
+	for _, envelope := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.requestTimeout = 20 * time.Millisecond
+		cfg.timeoutMode = timeoutModeHandler
+		cfg.envelope = envelope
+		s := newTestServer(t, cfg, nil)
+		rec := httptest.NewRecorder()
+		s.timeout()(slowHandler(time.Second, true)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		want := httptest.NewRecorder()
+		s.errorJSON(want, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusServiceUnavailable, timeoutMessage)
+		if got, want := rec.Body.String()+"\n", want.Body.String(); got != want {
+			t.Errorf("envelope %v: body %q, want %q", envelope, got, want)
+		}
+	}
+}
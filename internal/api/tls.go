@@ -0,0 +1,56 @@
+package api
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// certReloader serves the certificate in certFile and keyFile, re-reading
+// them on reload so that certificates can be rotated without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the key pair once, so that unreadable or
+// mismatched files are reported at startup.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload re-reads the key pair. On failure the current certificate stays
+// in use.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// tlsConfig is the server's TLS configuration with the certificate from cr.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return hardenTLS(&tls.Config{GetCertificate: cr.getCertificate})
+}
+
+// hardenTLS restricts cfg to TLS 1.2 or later with modern curves.
+func hardenTLS(cfg *tls.Config) *tls.Config {
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	return cfg
+}
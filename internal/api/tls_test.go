@@ -0,0 +1,160 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writeKeyPair writes cert and its key as PEM files in dir and returns
+// their paths.
+func writeKeyPair(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	first, second := ca.issue(t, "first", "localhost"), ca.issue(t, "second", "localhost")
+	for _, tt := range []struct {
+		name string
+		// rewrite changes the files after they were loaded.
+		rewrite       func(t *testing.T, certFile, keyFile string)
+		wantReloadErr bool
+		want          tls.Certificate
+	}{
+		{name: "unchanged", want: first},
+		{name: "rotated", want: second, rewrite: func(t *testing.T, certFile, _ string) {
+			writeKeyPair(t, filepath.Dir(certFile), second)
+		}},
+		{name: "unreadable", wantReloadErr: true, want: first, rewrite: func(t *testing.T, certFile, _ string) {
+			if err := os.Remove(certFile); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "mismatched", wantReloadErr: true, want: first, rewrite: func(t *testing.T, certFile, _ string) {
+			// The certificate is the second one, the key still the first's.
+			if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.Certificate[0]}), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := writeKeyPair(t, t.TempDir(), first)
+			cr, err := newCertReloader(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rewrite != nil {
+				tt.rewrite(t, certFile, keyFile)
+			}
+			if err := cr.reload(); (err != nil) != tt.wantReloadErr {
+				t.Errorf("reload = %v, want error %v", err, tt.wantReloadErr)
+			}
+			got, _ := cr.getCertificate(nil)
+			if string(got.Certificate[0]) != string(tt.want.Certificate[0]) {
+				t.Error("serving the wrong certificate")
+			}
+		})
+	}
+}
+
+func TestNewCertReloaderFails(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	certFile, keyFile := writeKeyPair(t, t.TempDir(), ca.issue(t, "first"))
+	otherCert, otherKey := writeKeyPair(t, t.TempDir(), ca.issue(t, "second"))
+	for _, tt := range []struct {
+		name              string
+		certFile, keyFile string
+	}{
+		{"missing cert", filepath.Join(t.TempDir(), "nope.pem"), keyFile},
+		{"missing key", certFile, filepath.Join(t.TempDir(), "nope.pem")},
+		{"mismatched", certFile, otherKey},
+		{"swapped", keyFile, otherCert},
+	} {
+		if _, err := newCertReloader(tt.certFile, tt.keyFile); err == nil {
+			t.Errorf("%s: loaded", tt.name)
+		}
+	}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	first, second := ca.issue(t, "first", "localhost"), ca.issue(t, "second", "localhost")
+	cfg := DefaultConfig()
+	cfg.addr = "127.0.0.1:0"
+	cfg.tlsCert, cfg.tlsKey = writeKeyPair(t, t.TempDir(), first)
+	var logs syncBuffer
+	s := newTestServer(t, cfg, slog.New(slog.NewJSONHandler(&logs, nil)))
+	base, errc := startServer(t, s, &logs)
+	base = strings.Replace(base, "http://", "https://", 1)
+	if recs := logRecords(t, logs.String(), "listening"); recs[0]["scheme"] != "https" {
+		t.Errorf("startup logged %v, want scheme https", recs[0])
+	}
+
+	for _, tt := range []struct {
+		name       string
+		maxVersion uint16
+		wantErr    bool
+		// wantCN is the common name of the certificate the server presents.
+		wantCN string
+	}{
+		{name: "TLS 1.3", wantCN: "first"},
+		{name: "TLS 1.2", maxVersion: tls.VersionTLS12, wantCN: "first"},
+		{name: "TLS 1.1", maxVersion: tls.VersionTLS11, wantErr: true},
+		{name: "after SIGHUP", wantCN: "second"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantCN == "second" {
+				writeKeyPair(t, filepath.Dir(cfg.tlsCert), second)
+				if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+					t.Fatal(err)
+				}
+				waitFor(t, func() bool { return len(logRecords(t, logs.String(), "reloaded TLS certificate")) > 0 })
+			}
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MaxVersion: tt.maxVersion},
+				DisableKeepAlives: true,
+			}}
+			resp, err := client.Get(base + "/healthz")
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("handshake succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != tt.wantCN {
+				t.Errorf("server presented %q, want %q", cn, tt.wantCN)
+			}
+			if resp.Header.Get("Strict-Transport-Security") == "" {
+				t.Error("no HSTS over TLS")
+			}
+		})
+	}
+	if err := stopServer(t, errc); err != nil {
+		t.Errorf("ListenAndServe = %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+const tracerName = "github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/api"
+
+var tracePropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// newTracerProvider exports spans over OTLP/HTTP when
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set,
+// configured by the standard OTEL_* variables. Otherwise tracing is off:
+// the provider is a no-op one and shutdown does nothing.
+func newTracerProvider(ctx context.Context) (tp trace.TracerProvider, shutdown func(context.Context) error, err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sdk := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	return sdk, sdk.Shutdown, nil
+}
+
+// tracingEnabled reports whether spans go anywhere, so that the store is
+// only wrapped in tracingStore when they do. A nil tp, as in a zero Config,
+// sends them nowhere.
+func tracingEnabled(tp trace.TracerProvider) bool {
+	_, off := tp.(noop.TracerProvider)
+	return tp != nil && !off
+}
+
+// tracing starts a server span for every request, continuing the trace
+// carried by the incoming traceparent header if there is one. The span is
+// named after the route pattern route finds, which keeps names bounded.
+func (s *Server) tracing(route func(*http.Request) string) func(http.Handler) http.Handler {
+	tracer := s.tracerProvider.Tracer(tracerName)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			name, attrs := r.Method, []attribute.KeyValue{
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestIDFromContext(r.Context())),
+			}
+			if p := route(r); p != "" {
+				// http.route is the path template alone, without the
+				// method some patterns start with.
+				if i := strings.IndexByte(p, '/'); i > 0 {
+					p = p[i:]
+				}
+				name = r.Method + " " + p
+				attrs = append(attrs, attribute.String("http.route", p))
+			}
+			ctx, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attrs...),
+			)
+			defer span.End()
+
+			rr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rr, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", rr.status))
+			if rr.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rr.status))
+			}
+		})
+	}
+}
+
+// tracingStore is a Store that records a child span of the caller's span
+// around every call to the one it wraps.
+type tracingStore struct {
+	store.Store
+	tracer trace.Tracer
+}
+
+func newTracingStore(st store.Store, tp trace.TracerProvider) tracingStore {
+	return tracingStore{st, tp.Tracer(tracerName)}
+}
+
+func (ts tracingStore) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return ts.tracer.Start(ctx, "store."+op,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endStoreSpan finishes span, marking it failed for errors that are not the
+// client's doing.
+func endStoreSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if storeFailure(err) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func (ts tracingStore) Create(ctx context.Context, name, email string) (store.User, error) {
+	ctx, span := ts.start(ctx, "Create")
+	u, err := ts.Store.Create(ctx, name, email)
+	span.SetAttributes(attribute.Int64("user.id", u.ID))
+	endStoreSpan(span, err)
+	return u, err
+}
+
+func (ts tracingStore) Get(ctx context.Context, id int64) (store.User, error) {
+	ctx, span := ts.start(ctx, "Get", attribute.Int64("user.id", id))
+	u, err := ts.Store.Get(ctx, id)
+	endStoreSpan(span, err)
+	return u, err
+}
+
+func (ts tracingStore) Update(ctx context.Context, id int64, fn func(*store.User) error) (store.User, error) {
+	ctx, span := ts.start(ctx, "Update", attribute.Int64("user.id", id))
+	u, err := ts.Store.Update(ctx, id, fn)
+	endStoreSpan(span, err)
+	return u, err
+}
+
+func (ts tracingStore) Delete(ctx context.Context, id int64) error {
+	ctx, span := ts.start(ctx, "Delete", attribute.Int64("user.id", id))
+	err := ts.Store.Delete(ctx, id)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (ts tracingStore) List(ctx context.Context) ([]store.User, error) {
+	ctx, span := ts.start(ctx, "List")
+	users, err := ts.Store.List(ctx)
+	span.SetAttributes(attribute.Int("users", len(users)))
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (ts tracingStore) ListAfter(ctx context.Context, afterID int64, limit int) ([]store.User, error) {
+	ctx, span := ts.start(ctx, "ListAfter", attribute.Int64("user.after_id", afterID))
+	users, err := ts.Store.ListAfter(ctx, afterID, limit)
+	span.SetAttributes(attribute.Int("users", len(users)))
+	endStoreSpan(span, err)
+	return users, err
+}
+
+func (ts tracingStore) Count(ctx context.Context) (int, error) {
+	ctx, span := ts.start(ctx, "Count")
+	n, err := ts.Store.Count(ctx)
+	endStoreSpan(span, err)
+	return n, err
+}
+
+func (ts tracingStore) Load(ctx context.Context, users []store.User, replace bool) error {
+	ctx, span := ts.start(ctx, "Load", attribute.Int("users", len(users)), attribute.Bool("replace", replace))
+	err := ts.Store.Load(ctx, users, replace)
+	endStoreSpan(span, err)
+	return err
+}
+
+func (ts tracingStore) Expire(ctx context.Context) (int, error) {
+	ctx, span := ts.start(ctx, "Expire")
+	n, err := ts.Store.Expire(ctx)
+	span.SetAttributes(attribute.Int("users", n))
+	endStoreSpan(span, err)
+	return n, err
+}
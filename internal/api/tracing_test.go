@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ETOOOOOOCHAAAAAAAAAAI/go-practice1/internal/store"
+)
+
+// newTracedServer returns a test server for cfg whose spans are kept by
+// the returned recorder.
+func newTracedServer(t *testing.T, cfg Config) (*Server, *tracetest.SpanRecorder) {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	t.Cleanup(func() { _ = tp.Shutdown(t.Context()) })
+	s := newTestServer(t, cfg, nil)
+	s.traceWith(tp)
+	return s, sr
+}
+
+// spanAttrs returns the attributes of span by key.
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, tt := range []struct {
+		name, method, target string
+		traceparent          string
+		draining             bool
+		// wantName is the span name, and wantRoute its http.route.
+		wantName   string
+		wantRoute  string
+		wantStatus int
+		wantError  bool
+	}{
+		{name: "get", method: http.MethodGet, target: "/user/1",
+			wantName: "GET /user/{id}", wantRoute: "/user/{id}", wantStatus: http.StatusOK},
+		{name: "not found", method: http.MethodGet, target: "/user/99",
+			wantName: "GET /user/{id}", wantRoute: "/user/{id}", wantStatus: http.StatusNotFound},
+		{name: "list", method: http.MethodGet, target: "/users",
+			wantName: "GET /users", wantRoute: "/users", wantStatus: http.StatusOK},
+		{name: "no route", method: http.MethodGet, target: "/nope",
+			wantName: "GET", wantStatus: http.StatusNotFound},
+		{name: "continued trace", method: http.MethodGet, target: "/user/1",
+			traceparent: "00-" + traceID + "-00f067aa0ba902b7-01",
+			wantName:    "GET /user/{id}", wantRoute: "/user/{id}", wantStatus: http.StatusOK},
+		{name: "draining", method: http.MethodGet, target: "/user/1", draining: true,
+			wantName: "GET /user/{id}", wantRoute: "/user/{id}", wantStatus: http.StatusServiceUnavailable, wantError: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, sr := newTracedServer(t, DefaultConfig())
+			s.users.Create(context.Background(), "Ann", "")
+			if tt.draining {
+				s.beginShutdown()
+			}
+			r := newRequest(tt.method, tt.target, "")
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			if rec := serve(s.Handler(), r); rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			// Store calls have spans of their own.
+			var span sdktrace.ReadOnlySpan
+			for _, sp := range sr.Ended() {
+				if sp.SpanKind() == trace.SpanKindServer {
+					span = sp
+				}
+			}
+			if span == nil {
+				t.Fatalf("no server span among %d", len(sr.Ended()))
+			}
+			if span.Name() != tt.wantName {
+				t.Errorf("span name = %q, want %q", span.Name(), tt.wantName)
+			}
+			attrs := spanAttrs(span)
+			if got := attrs["http.request.method"].AsString(); got != tt.method {
+				t.Errorf("http.request.method = %q, want %q", got, tt.method)
+			}
+			if got := attrs["url.path"].AsString(); got != tt.target {
+				t.Errorf("url.path = %q, want %q", got, tt.target)
+			}
+			if got := attrs["http.route"].AsString(); got != tt.wantRoute {
+				t.Errorf("http.route = %q, want %q", got, tt.wantRoute)
+			}
+			if got := attrs["http.response.status_code"].AsInt64(); got != int64(tt.wantStatus) {
+				t.Errorf("http.response.status_code = %d, want %d", got, tt.wantStatus)
+			}
+			if got := span.Status().Code == codes.Error; got != tt.wantError {
+				t.Errorf("error status = %v, want %v", got, tt.wantError)
+			}
+
+			parent := span.Parent()
+			if tt.traceparent == "" {
+				if parent.IsValid() {
+					t.Errorf("span has parent %v, want none", parent)
+				}
+			} else if got := span.SpanContext().TraceID().String(); got != traceID || !parent.IsRemote() {
+				t.Errorf("trace %s, remote parent %v; want trace %s continued", got, parent.IsRemote(), traceID)
+			}
+		})
+	}
+}
+
+// failingStore is a Store whose List calls fail.
+type failingStore struct{ store.Store }
+
+var errStoreDown = errors.New("store down")
+
+func (failingStore) List(context.Context) ([]store.User, error) { return nil, errStoreDown }
+
+func TestTracingStore(t *testing.T) {
+	type storeSpan struct {
+		name   string
+		userID int64
+		err    bool
+	}
+	for _, tt := range []struct {
+		name, method, target, body string
+		failing                    bool
+		want                       []storeSpan
+	}{
+		{name: "get", method: http.MethodGet, target: "/user/1", want: []storeSpan{{"store.Get", 1, false}}},
+		// A missing user is the client's doing, not a failure.
+		{name: "get missing", method: http.MethodGet, target: "/user/9", want: []storeSpan{{"store.Get", 9, false}}},
+		{name: "create", method: http.MethodPost, target: "/user", body: `{"name":"Bo"}`, want: []storeSpan{{"store.Create", 2, false}}},
+		{name: "update", method: http.MethodPatch, target: "/user?id=1", body: `{"name":"Anne"}`, want: []storeSpan{{"store.Update", 1, false}}},
+		{name: "delete", method: http.MethodDelete, target: "/user?id=1", want: []storeSpan{{"store.Delete", 1, false}}},
+		{name: "list", method: http.MethodGet, target: "/users", want: []storeSpan{{"store.List", 0, false}}},
+		{name: "failing", method: http.MethodGet, target: "/users", failing: true, want: []storeSpan{{"store.List", 0, true}}},
+		{name: "no store calls", method: http.MethodGet, target: "/healthz"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+			t.Cleanup(func() { _ = tp.Shutdown(t.Context()) })
+			s := newTestServer(t, DefaultConfig(), nil)
+			if _, err := s.store.Create(t.Context(), "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failing {
+				useStore(s, failingStore{s.store})
+			}
+			s.traceWith(tp)
+			serve(s.Handler(), newRequest(tt.method, tt.target, tt.body))
+
+			var server sdktrace.ReadOnlySpan
+			var got []storeSpan
+			var children []sdktrace.ReadOnlySpan
+			for _, span := range sr.Ended() {
+				switch span.SpanKind() {
+				case trace.SpanKindServer:
+					server = span
+				case trace.SpanKindInternal:
+					children = append(children, span)
+					got = append(got, storeSpan{span.Name(), spanAttrs(span)["user.id"].AsInt64(), span.Status().Code == codes.Error})
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("store spans %v, want %v", got, tt.want)
+			}
+			for _, span := range children {
+				if server == nil || span.Parent().SpanID() != server.SpanContext().SpanID() {
+					t.Errorf("%s is not a child of the server span", span.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	for _, tt := range []struct {
+		name, env, value string
+		wantEnabled      bool
+	}{
+		{"unset", "OTEL_EXPORTER_OTLP_ENDPOINT", "", false},
+		{"endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:4318", true},
+		{"traces endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://127.0.0.1:4318/v1/traces", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+			t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+			t.Setenv(tt.env, tt.value)
+			tp, shutdown, err := newTracerProvider(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer shutdown(t.Context())
+			if got := tracingEnabled(tp); got != tt.wantEnabled {
+				t.Errorf("tracing enabled %v, want %v", got, tt.wantEnabled)
+			}
+			// The store is only wrapped when spans go somewhere.
+			s := newTestServer(t, DefaultConfig(), nil)
+			s.traceWith(tp)
+			if _, traced := s.users.(countingStore).Store.(tracingStore); traced != tt.wantEnabled {
+				t.Errorf("store traced %v, want %v", traced, tt.wantEnabled)
+			}
+		})
+	}
+}
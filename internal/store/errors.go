@@ -0,0 +1,12 @@
+package store
+
+import "errors"
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrUnavailable = errors.New("service unavailable")
+	ErrConflict    = errors.New("conflict")
+	// ErrPrecondition is returned when a conditional request, such as one
+	// carrying If-Match, finds the resource in a different state.
+	ErrPrecondition = errors.New("precondition failed")
+)
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       TEXT    NOT NULL,
+	email      TEXT    NOT NULL DEFAULT '',
+	version    INTEGER NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+)`
+
+const sqliteUserColumns = "id, name, email, version, created_at, updated_at"
+
+// SQLite is a Store persisted in a SQLite database. Timestamps are
+// kept as Unix nanoseconds. AUTOINCREMENT keeps ids from being reused
+// after deletes, as in the in-memory store.
+type SQLite struct {
+	ttl time.Duration
+	now func() time.Time
+	db  *sql.DB
+}
+
+var _ Store = (*SQLite)(nil)
+
+// OpenSQLite opens the database at path, creating it and its schema
+// on first use. now tells the time for timestamps and the ttl.
+func OpenSQLite(path string, ttl time.Duration, now func() time.Time) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; a single connection turns lock
+	// contention into queueing in database/sql.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", sqliteSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &SQLite{ttl: ttl, now: now, db: db}, nil
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// cutoff is the updated_at, in Unix nanoseconds, at or before which users
+// have expired.
+func (s *SQLite) cutoff() int64 {
+	if s.ttl <= 0 {
+		return math.MinInt64
+	}
+	return s.now().Add(-s.ttl).UnixNano()
+}
+
+// sqliteErr maps SQLite failures onto the store errors.
+func sqliteErr(err error) error {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return err
+	}
+	switch se.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT:
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var created, updated int64
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Version, &created, &updated); err != nil {
+		return User{}, err
+	}
+	u.CreatedAt = time.Unix(0, created).UTC()
+	u.UpdatedAt = time.Unix(0, updated).UTC()
+	return u, nil
+}
+
+func (s *SQLite) Create(ctx context.Context, name, email string) (User, error) {
+	now := s.now().UTC()
+	res, err := s.db.ExecContext(ctx, `INSERT INTO users (name, email, version, created_at, updated_at) VALUES (?, ?, 1, ?, ?)`,
+		name, email, now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return User{}, sqliteErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return User{ID: id, Name: name, Email: email, Version: 1, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+func (s *SQLite) Get(ctx context.Context, id int64) (User, error) {
+	u, err := scanUser(s.db.QueryRowContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE id = ? AND updated_at > ?`, id, s.cutoff()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	return u, sqliteErr(err)
+}
+
+func (s *SQLite) Update(ctx context.Context, id int64, fn func(*User) error) (User, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, sqliteErr(err)
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	u, err := scanUser(tx.QueryRowContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE id = ? AND updated_at > ?`, id, s.cutoff()))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return User{}, fmt.Errorf("user %d: %w", id, ErrNotFound)
+	case err != nil:
+		return User{}, sqliteErr(err)
+	}
+	if err := fn(&u); err != nil {
+		return User{}, err
+	}
+	u.Version++
+	u.UpdatedAt = now.UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET name = ?, email = ?, version = ?, updated_at = ? WHERE id = ?`,
+		u.Name, u.Email, u.Version, u.UpdatedAt.UnixNano(), id); err != nil {
+		return User{}, sqliteErr(err)
+	}
+	return u, sqliteErr(tx.Commit())
+}
+
+func (s *SQLite) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = ? AND updated_at > ?`, id, s.cutoff())
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+func (s *SQLite) List(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE updated_at > ? ORDER BY id`, s.cutoff())
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, sqliteErr(rows.Err())
+}
+
+func (s *SQLite) ListAfter(ctx context.Context, afterID int64, limit int) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteUserColumns+` FROM users WHERE id > ? AND updated_at > ? ORDER BY id LIMIT ?`,
+		afterID, s.cutoff(), limit)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, limit)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, sqliteErr(rows.Err())
+}
+
+func (s *SQLite) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE updated_at > ?`, s.cutoff()).Scan(&n)
+	return n, sqliteErr(err)
+}
+
+func (s *SQLite) Load(ctx context.Context, users []User, replace bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM users`); err != nil {
+			return sqliteErr(err)
+		}
+	}
+	for _, u := range users {
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO users (`+sqliteUserColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+			u.ID, u.Name, u.Email, u.Version, u.CreatedAt.UnixNano(), u.UpdatedAt.UnixNano()); err != nil {
+			return sqliteErr(err)
+		}
+	}
+	return sqliteErr(tx.Commit())
+}
+
+func (s *SQLite) Expire(ctx context.Context) (int, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE updated_at <= ?`, s.cutoff())
+	if err != nil {
+		return 0, sqliteErr(err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openSQLite opens the database at path for the test, closing it when the
+// test ends.
+func openSQLite(t *testing.T, path string, ttl time.Duration, now func() time.Time) *SQLite {
+	t.Helper()
+	s, err := OpenSQLite(path, ttl, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLite(t *testing.T) {
+	testStore(t, func(t *testing.T, ttl time.Duration, now func() time.Time) Store {
+		return openSQLite(t, filepath.Join(t.TempDir(), "users.db"), ttl, now)
+	})
+}
+
+func TestSQLiteReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+	clock := newTestClock()
+	s := openSQLite(t, path, 0, clock.now)
+	for _, name := range []string{"Ann", "Bob", "Cy"} {
+		if _, err := s.Create(ctx, name, name+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(time.Minute)
+	if _, err := s.Update(ctx, 1, func(u *User) error {
+		u.Name = "Anne"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSQLite(t, path, 0, clock.now)
+	after, err := s.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(after, before, func(a, b User) bool {
+		return a.ID == b.ID && a.Name == b.Name && a.Email == b.Email && a.Version == b.Version &&
+			a.CreatedAt.Equal(b.CreatedAt) && a.UpdatedAt.Equal(b.UpdatedAt)
+	}) {
+		t.Errorf("after reopening: %+v, want %+v", after, before)
+	}
+	// The deleted id stays used.
+	if u, err := s.Create(ctx, "Di", ""); err != nil || u.ID != 4 {
+		t.Errorf("Create after reopening = %+v, %v; want id 4", u, err)
+	}
+}
+
+func TestSQLiteErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		run  func(s *SQLite) error
+		want error
+	}{
+		{"missing user", func(s *SQLite) error {
+			_, err := s.Get(ctx, 9)
+			return err
+		}, ErrNotFound},
+		{"duplicate id", func(s *SQLite) error {
+			_, err := s.db.ExecContext(ctx, `INSERT INTO users (`+sqliteUserColumns+`) VALUES (1, 'Bob', '', 1, 0, 0)`)
+			return sqliteErr(err)
+		}, ErrConflict},
+		{"missing name", func(s *SQLite) error {
+			_, err := s.db.ExecContext(ctx, `INSERT INTO users (version, created_at, updated_at) VALUES (1, 0, 0)`)
+			return sqliteErr(err)
+		}, ErrConflict},
+		{"canceled", func(s *SQLite) error {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := s.List(ctx)
+			return err
+		}, context.Canceled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openSQLite(t, filepath.Join(t.TempDir(), "users.db"), 0, time.Now)
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.run(s); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenSQLiteFails(t *testing.T) {
+	if s, err := OpenSQLite(filepath.Join(t.TempDir(), "missing", "users.db"), 0, time.Now); err == nil {
+		s.Close()
+		t.Error("opened a database in a directory that does not exist")
+	}
+}
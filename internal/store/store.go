@@ -0,0 +1,220 @@
+// Package store keeps the users of the API: the Store interface, an
+// in-memory implementation and one backed by SQLite.
+package store
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// User is a stored user.
+type User struct {
+	ID    int64
+	Name  string
+	Email string
+	// Version starts at 1 and is incremented by every update.
+	Version   int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Store holds the users. Every method is safe for concurrent use; errors
+// wrap ErrNotFound, ErrPrecondition or, for backends that can be down,
+// ErrUnavailable. The context carries the caller's deadline and trace.
+type Store interface {
+	Create(ctx context.Context, name, email string) (User, error)
+	Get(ctx context.Context, id int64) (User, error)
+	// Update applies fn to the user with the given id and stores the
+	// result, unless fn fails.
+	Update(ctx context.Context, id int64, fn func(*User) error) (User, error)
+	Delete(ctx context.Context, id int64) error
+	// List returns all users ordered by id.
+	List(ctx context.Context) ([]User, error)
+	// ListAfter returns up to limit users with ids above afterID, ordered
+	// by id, for going through the users a page at a time.
+	ListAfter(ctx context.Context, afterID int64, limit int) ([]User, error)
+	Count(ctx context.Context) (int, error)
+	// Load stores users with their ids, in addition to or, with replace,
+	// instead of the existing ones.
+	Load(ctx context.Context, users []User, replace bool) error
+	// Expire removes users past their TTL and returns how many there were.
+	Expire(ctx context.Context) (int, error)
+}
+
+// Memory is the in-memory Store. With a ttl, users not updated for that
+// long are expired: they are no longer returned, and Expire removes them.
+type Memory struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu     sync.RWMutex
+	nextID int64
+	users  map[int64]User
+}
+
+// NewMemory returns an empty Memory telling the time by now; with a ttl,
+// users expire after it.
+func NewMemory(ttl time.Duration, now func() time.Time) *Memory {
+	return &Memory{ttl: ttl, now: now, users: make(map[int64]User)}
+}
+
+func (s *Memory) expired(u User, now time.Time) bool {
+	return s.ttl > 0 && !now.Before(u.UpdatedAt.Add(s.ttl))
+}
+
+var _ Store = (*Memory)(nil)
+
+func (s *Memory) Create(_ context.Context, name, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	now := s.now().UTC()
+	u := User{ID: s.nextID, Name: name, Email: email, Version: 1, CreatedAt: now, UpdatedAt: now}
+	s.users[u.ID] = u
+	return u, nil
+}
+
+func (s *Memory) Get(_ context.Context, id int64) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok || s.expired(u, s.now()) {
+		return User{}, fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	return u, nil
+}
+
+// Update applies fn to the stored user with the given id and bumps its
+// Version and UpdatedAt. If fn fails, for instance because the user is not
+// at the version the caller expected, nothing is stored and its error is
+// returned.
+func (s *Memory) Update(_ context.Context, id int64, fn func(*User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	u, ok := s.users[id]
+	if !ok || s.expired(u, now) {
+		return User{}, fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	if err := fn(&u); err != nil {
+		return User{}, err
+	}
+	u.Version++
+	u.UpdatedAt = now.UTC()
+	s.users[id] = u
+	return u, nil
+}
+
+func (s *Memory) Delete(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok || s.expired(u, s.now()) {
+		return fmt.Errorf("user %d: %w", id, ErrNotFound)
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *Memory) Count(context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ttl == 0 {
+		return len(s.users), nil
+	}
+	n, now := 0, s.now()
+	for _, u := range s.users {
+		if !s.expired(u, now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// List returns a snapshot of all users ordered by id.
+func (s *Memory) List(context.Context) ([]User, error) {
+	s.mu.RLock()
+	users := make([]User, 0, len(s.users))
+	now := s.now()
+	for _, u := range s.users {
+		if !s.expired(u, now) {
+			users = append(users, u)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(users, func(a, b User) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return users, nil
+}
+
+// ListAfter returns up to limit users with ids above afterID, ordered by id,
+// for going through the users a page at a time. Like List, it leaves out
+// expired users.
+func (s *Memory) ListAfter(_ context.Context, afterID int64, limit int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]User, 0, min(limit, len(s.users)))
+	now := s.now()
+	// Ids are handed out in order, so unless they are sparse walking them
+	// is quicker than scanning every user.
+	if span := s.nextID - afterID; span <= 2*int64(len(s.users)) {
+		for id := afterID + 1; id <= s.nextID && len(users) < limit; id++ {
+			if u, ok := s.users[id]; ok && !s.expired(u, now) {
+				users = append(users, u)
+			}
+		}
+		return users, nil
+	}
+	for _, u := range s.users {
+		if u.ID > afterID && !s.expired(u, now) {
+			users = append(users, u)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return users[:min(limit, len(users))], nil
+}
+
+// Load stores users, keeping their ids, either in addition to the existing
+// ones (overwriting any with the same id) or, with replace, instead of them.
+// New ids are allocated past the largest id loaded.
+func (s *Memory) Load(_ context.Context, users []User, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if replace {
+		s.users = make(map[int64]User, len(users))
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+		s.nextID = max(s.nextID, u.ID)
+	}
+	return nil
+}
+
+// Expire removes the expired users and returns how many there were.
+func (s *Memory) Expire(context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, now := 0, s.now()
+	for id, u := range s.users {
+		if s.expired(u, now) {
+			delete(s.users, id)
+			n++
+		}
+	}
+	return n, nil
+}
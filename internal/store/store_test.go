@@ -0,0 +1,296 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when told to.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newStoreFunc opens an empty Store whose users expire after ttl, by now.
+type newStoreFunc func(t *testing.T, ttl time.Duration, now func() time.Time) Store
+
+// ids returns the ids of users in order.
+func ids(users []User) []int64 {
+	out := make([]int64, len(users))
+	for i, u := range users {
+		out[i] = u.ID
+	}
+	return out
+}
+
+// testStore runs the behaviour every Store must have against the ones
+// newStore opens.
+func testStore(t *testing.T, newStore newStoreFunc) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		ttl  time.Duration
+		run  func(t *testing.T, s Store, clock *testClock)
+	}{
+		{name: "create and get", run: func(t *testing.T, s Store, clock *testClock) {
+			created, err := s.Create(ctx, "Ann", "ann@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := User{ID: 1, Name: "Ann", Email: "ann@example.com", Version: 1, CreatedAt: clock.now(), UpdatedAt: clock.now()}
+			if created != want {
+				t.Errorf("Create = %+v, want %+v", created, want)
+			}
+			got, err := s.Get(ctx, 1)
+			if err != nil || !got.CreatedAt.Equal(want.CreatedAt) || got.Name != want.Name || got.Version != 1 {
+				t.Errorf("Get = %+v, %v; want %+v", got, err, want)
+			}
+			if _, err := s.Get(ctx, 2); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a missing user = %v, want ErrNotFound", err)
+			}
+		}},
+		{name: "ids are not reused", run: func(t *testing.T, s Store, _ *testClock) {
+			for _, name := range []string{"Ann", "Bob"} {
+				if _, err := s.Create(ctx, name, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(ctx, 2); err != nil {
+				t.Fatal(err)
+			}
+			if u, err := s.Create(ctx, "Cy", ""); err != nil || u.ID != 3 {
+				t.Errorf("Create after a delete = %+v, %v; want id 3", u, err)
+			}
+		}},
+		{name: "update", run: func(t *testing.T, s Store, clock *testClock) {
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(time.Minute)
+			u, err := s.Update(ctx, 1, func(u *User) error {
+				u.Name = "Anne"
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Name != "Anne" || u.Version != 2 || !u.UpdatedAt.Equal(clock.now()) || u.CreatedAt.Equal(u.UpdatedAt) {
+				t.Errorf("Update = %+v, want the new name at version 2, updated now", u)
+			}
+			if got, _ := s.Get(ctx, 1); got.Name != "Anne" || got.Version != 2 {
+				t.Errorf("Get after Update = %+v", got)
+			}
+		}},
+		{name: "failed update", run: func(t *testing.T, s Store, _ *testClock) {
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.Update(ctx, 1, func(u *User) error {
+				u.Name = "Anne"
+				return ErrPrecondition
+			})
+			if !errors.Is(err, ErrPrecondition) {
+				t.Errorf("Update = %v, want the error of fn", err)
+			}
+			if got, _ := s.Get(ctx, 1); got.Name != "Ann" || got.Version != 1 {
+				t.Errorf("Get after a failed Update = %+v, want it unchanged", got)
+			}
+			if _, err := s.Update(ctx, 2, func(*User) error { return nil }); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Update of a missing user = %v, want ErrNotFound", err)
+			}
+		}},
+		{name: "delete", run: func(t *testing.T, s Store, _ *testClock) {
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(ctx, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+			}
+			if err := s.Delete(ctx, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second Delete = %v, want ErrNotFound", err)
+			}
+		}},
+		{name: "list and count", run: func(t *testing.T, s Store, _ *testClock) {
+			if users, err := s.List(ctx); err != nil || len(users) != 0 {
+				t.Errorf("List of an empty store = %v, %v", users, err)
+			}
+			for _, name := range []string{"Ann", "Bob", "Cy", "Di"} {
+				if _, err := s.Create(ctx, name, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(ctx, 2); err != nil {
+				t.Fatal(err)
+			}
+			users, err := s.List(ctx)
+			if err != nil || !slices.Equal(ids(users), []int64{1, 3, 4}) {
+				t.Errorf("List = %v, %v; want ids 1, 3, 4", ids(users), err)
+			}
+			if n, err := s.Count(ctx); err != nil || n != 3 {
+				t.Errorf("Count = %d, %v; want 3", n, err)
+			}
+		}},
+		{name: "list after", run: func(t *testing.T, s Store, clock *testClock) {
+			for _, name := range []string{"Ann", "Bob", "Cy", "Di", "Ed"} {
+				if _, err := s.Create(ctx, name, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Delete(ctx, 2); err != nil {
+				t.Fatal(err)
+			}
+			// An imported id far above the rest leaves them sparse.
+			now := clock.now()
+			if err := s.Load(ctx, []User{{ID: 1 << 40, Name: "Far", Version: 1, CreatedAt: now, UpdatedAt: now}}, false); err != nil {
+				t.Fatal(err)
+			}
+			for _, tt := range []struct {
+				after int64
+				limit int
+				want  []int64
+			}{
+				{0, 2, []int64{1, 3}},
+				{3, 2, []int64{4, 5}},
+				{5, 2, []int64{1 << 40}},
+				{1 << 40, 2, []int64{}},
+				{0, 10, []int64{1, 3, 4, 5, 1 << 40}},
+			} {
+				users, err := s.ListAfter(ctx, tt.after, tt.limit)
+				if err != nil || !slices.Equal(ids(users), tt.want) {
+					t.Errorf("ListAfter(%d, %d) = %v, %v; want ids %v", tt.after, tt.limit, ids(users), err, tt.want)
+				}
+			}
+		}},
+		{name: "load", run: func(t *testing.T, s Store, clock *testClock) {
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			now := clock.now()
+			loaded := []User{
+				{ID: 5, Name: "Eve", Version: 3, CreatedAt: now, UpdatedAt: now},
+				{ID: 7, Name: "Gus", Version: 1, CreatedAt: now, UpdatedAt: now},
+			}
+			if err := s.Load(ctx, loaded, false); err != nil {
+				t.Fatal(err)
+			}
+			if users, _ := s.List(ctx); !slices.Equal(ids(users), []int64{1, 5, 7}) {
+				t.Errorf("after adding: ids %v, want 1, 5, 7", ids(users))
+			}
+			if u, _ := s.Get(ctx, 5); u.Name != "Eve" || u.Version != 3 {
+				t.Errorf("loaded user = %+v", u)
+			}
+			if u, err := s.Create(ctx, "Hal", ""); err != nil || u.ID != 8 {
+				t.Errorf("Create after Load = %+v, %v; want id 8", u, err)
+			}
+			if err := s.Load(ctx, loaded[:1], true); err != nil {
+				t.Fatal(err)
+			}
+			if users, _ := s.List(ctx); !slices.Equal(ids(users), []int64{5}) {
+				t.Errorf("after replacing: ids %v, want 5", ids(users))
+			}
+		}},
+		{name: "expiry", ttl: time.Minute, run: func(t *testing.T, s Store, clock *testClock) {
+			for _, name := range []string{"Ann", "Bob"} {
+				if _, err := s.Create(ctx, name, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock.advance(40 * time.Second)
+			if _, err := s.Update(ctx, 2, func(*User) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(20 * time.Second)
+			if _, err := s.Get(ctx, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of an expired user = %v, want ErrNotFound", err)
+			}
+			if users, _ := s.List(ctx); !slices.Equal(ids(users), []int64{2}) {
+				t.Errorf("List = %v, want only the updated user", ids(users))
+			}
+			if n, _ := s.Count(ctx); n != 1 {
+				t.Errorf("Count = %d, want 1", n)
+			}
+			if n, err := s.Expire(ctx); err != nil || n != 1 {
+				t.Errorf("Expire = %d, %v; want 1", n, err)
+			}
+			if n, err := s.Expire(ctx); err != nil || n != 0 {
+				t.Errorf("second Expire = %d, %v; want 0", n, err)
+			}
+		}},
+		{name: "no expiry without a ttl", run: func(t *testing.T, s Store, clock *testClock) {
+			if _, err := s.Create(ctx, "Ann", ""); err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(365 * 24 * time.Hour)
+			if n, err := s.Expire(ctx); err != nil || n != 0 {
+				t.Errorf("Expire = %d, %v; want 0", n, err)
+			}
+			if _, err := s.Get(ctx, 1); err != nil {
+				t.Errorf("Get = %v", err)
+			}
+		}},
+		{name: "concurrent writers", run: func(t *testing.T, s Store, _ *testClock) {
+			const writers = 20
+			if _, err := s.Create(ctx, "counter", ""); err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			for range writers {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					if _, err := s.Create(ctx, "user", ""); err != nil {
+						t.Error(err)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					if _, err := s.Update(ctx, 1, func(*User) error { return nil }); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			users, _ := s.List(ctx)
+			if len(users) != writers+1 || users[len(users)-1].ID != writers+1 {
+				t.Errorf("ids %v, want 1 to %d", ids(users), writers+1)
+			}
+			if u, _ := s.Get(ctx, 1); u.Version != writers+1 {
+				t.Errorf("version = %d after %d updates, want %d", u.Version, writers, writers+1)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newTestClock()
+			tt.run(t, newStore(t, tt.ttl, clock.now), clock)
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, func(_ *testing.T, ttl time.Duration, now func() time.Time) Store {
+		return NewMemory(ttl, now)
+	})
+}